@@ -0,0 +1,48 @@
+package main
+
+import "net/http"
+
+// adminCollection is the authCache key of the admin token role.
+const adminCollection = "_admin"
+
+func isAdminTokenValid(token string) bool {
+	return isAuthTokenValid(token, adminCollection, ActionAll)
+}
+
+// requireAdmin only lets requests with an admin token through.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions && !isAdminTokenValid(getAuthTokenFromRequest(r)) {
+			sendError(w, "Unauthorized access", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("OPTIONS /", mockOptionsHandler)
+	mux.HandleFunc("GET /webhooks", getWebhooksHandler)
+	mux.HandleFunc("POST /webhooks", createWebhookHandler)
+	mux.HandleFunc("GET /webhooks/{name}", getWebhookHandler)
+	mux.HandleFunc("DELETE /webhooks/{name}", deleteWebhookHandler)
+	mux.HandleFunc("GET /webhooks/{name}/deliveries", getWebhookDeliveriesHandler)
+	mux.HandleFunc("GET /deliveries/{id}", getWebhookDeliveryHandler)
+	mux.HandleFunc("POST /deliveries/{id}/_retry", retryWebhookDeliveryHandler)
+	mux.HandleFunc("GET /collections", getCollectionsHandler)
+	mux.HandleFunc("GET /collections/{name}", getCollectionHandler)
+	mux.HandleFunc("PUT /collections/{name}", putCollectionHandler)
+	mux.HandleFunc("DELETE /collections/{name}", deleteCollectionHandler)
+	mux.HandleFunc("POST /collections/{name}/_plan", planCollectionHandler)
+	mux.HandleFunc("GET /collections/{name}/_nonconformant", getNonconformantDocumentsHandler)
+	mux.HandleFunc("GET /collections/{name}/_quarantine", getQuarantineHandler)
+	mux.HandleFunc("GET /tokens", getTokensHandler)
+	mux.HandleFunc("PUT /tokens/{name}", putTokenHandler)
+	mux.HandleFunc("DELETE /tokens/{name}", deleteTokenHandler)
+	mux.HandleFunc("GET /stored_tokens", getStoredTokensHandler)
+	mux.HandleFunc("POST /stored_tokens", createStoredTokenHandler)
+	mux.HandleFunc("GET /stored_tokens/{id}", getStoredTokenHandler)
+	mux.HandleFunc("DELETE /stored_tokens/{id}", revokeStoredTokenHandler)
+	mux.HandleFunc("POST /stored_tokens/{id}/_rotate", rotateStoredTokenHandler)
+	mux.HandleFunc("GET /audit", getAuditHandler)
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	AttachmentStorageSQLite     = "sqlite"
+	AttachmentStorageFilesystem = "filesystem"
+)
+
+const defaultAttachmentMaxSize = 10 << 20
+
+var errAttachmentNotFound = errors.New("attachment not found")
+
+var attachmentStore AttachmentStore
+
+// AttachmentStorage selects where attachment content is kept. Attachment
+// metadata always lives in the _attachments table.
+type AttachmentStorage struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+// CollectionAttachments enables attachments on the documents of a collection.
+type CollectionAttachments struct {
+	AllowedTypes []string `json:"allowed_types"`
+	MaxSize      int64    `json:"max_size"`
+}
+
+type Attachment struct {
+	Name        string `db:"name" json:"name"`
+	ContentType string `db:"content_type" json:"content_type"`
+	Size        int64  `db:"size" json:"size"`
+	CreatedAt   string `db:"created_at" json:"created_at"`
+}
+
+// AttachmentStore keeps attachment content. Writes receive the transaction
+// that updates the attachment metadata. Changes that cannot be rolled back
+// must wait until the transaction commits.
+type AttachmentStore interface {
+	Save(tx *writeTx, collectionName string, documentID int, name string, content []byte) error
+	Open(q sqlx.Queryer, collectionName string, documentID int, name string) (io.ReadSeekCloser, error)
+	Remove(tx *writeTx, collectionName string, documentID int, name string) error
+	RemoveAll(tx *writeTx, collectionName string, documentID int) error
+}
+
+func newAttachmentStore(storage AttachmentStorage) (AttachmentStore, error) {
+	switch storage.Type {
+	case "", AttachmentStorageSQLite:
+		return sqliteAttachmentStore{}, nil
+	case AttachmentStorageFilesystem:
+		if storage.Path == "" {
+			return nil, errors.New("filesystem attachment storage needs a path")
+		}
+		err := os.MkdirAll(storage.Path, 0o755)
+		if err != nil {
+			return nil, err
+		}
+		return filesystemAttachmentStore{root: storage.Path}, nil
+	}
+	return nil, fmt.Errorf("unknown attachment storage %q", storage.Type)
+}
+
+// sqliteAttachmentStore keeps content as blobs in the _attachment_blobs table.
+type sqliteAttachmentStore struct{}
+
+func (sqliteAttachmentStore) Save(tx *writeTx, collectionName string, documentID int, name string, content []byte) error {
+	query := `INSERT OR REPLACE INTO _attachment_blobs (collection, document_id, name, content) VALUES ($1, $2, $3, $4)`
+	_, err := tx.Exec(query, collectionName, documentID, name, content)
+	return err
+}
+
+func (sqliteAttachmentStore) Open(q sqlx.Queryer, collectionName string, documentID int, name string) (io.ReadSeekCloser, error) {
+	var content []byte
+	query := `SELECT content FROM _attachment_blobs WHERE collection = $1 AND document_id = $2 AND name = $3`
+	err := sqlx.Get(q, &content, query, collectionName, documentID, name)
+	if isDocumentNotFound(err) {
+		return nil, errAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(content)}, nil
+}
+
+func (sqliteAttachmentStore) Remove(tx *writeTx, collectionName string, documentID int, name string) error {
+	query := `DELETE FROM _attachment_blobs WHERE collection = $1 AND document_id = $2 AND name = $3`
+	_, err := tx.Exec(query, collectionName, documentID, name)
+	return err
+}
+
+func (sqliteAttachmentStore) RemoveAll(tx *writeTx, collectionName string, documentID int) error {
+	query := `DELETE FROM _attachment_blobs WHERE collection = $1 AND document_id = $2`
+	_, err := tx.Exec(query, collectionName, documentID)
+	return err
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// filesystemAttachmentStore keeps content in files below
+// root/{collection}/{documentID}/{name}. File changes cannot be rolled back
+// together with the metadata transaction, so files are put in place and
+// removed only after it commits.
+type filesystemAttachmentStore struct {
+	root string
+}
+
+func (store filesystemAttachmentStore) documentDir(collectionName string, documentID int) string {
+	return filepath.Join(store.root, collectionName, strconv.Itoa(documentID))
+}
+
+func (store filesystemAttachmentStore) Save(tx *writeTx, collectionName string, documentID int, name string, content []byte) error {
+	dir := store.documentDir(collectionName, documentID)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see partial content.
+	temp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	file := filepath.Join(dir, name)
+	tx.afterCommit = append(tx.afterCommit, func() {
+		err := os.Rename(temp.Name(), file)
+		if err != nil {
+			log.Printf("Error saving attachment %s: %v", file, err)
+			os.Remove(temp.Name())
+		}
+	})
+	tx.afterRollback = append(tx.afterRollback, func() {
+		os.Remove(temp.Name())
+	})
+	return nil
+}
+
+func (store filesystemAttachmentStore) Open(_ sqlx.Queryer, collectionName string, documentID int, name string) (io.ReadSeekCloser, error) {
+	file, err := os.Open(filepath.Join(store.documentDir(collectionName, documentID), name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errAttachmentNotFound
+	}
+	return file, err
+}
+
+func (store filesystemAttachmentStore) Remove(tx *writeTx, collectionName string, documentID int, name string) error {
+	file := filepath.Join(store.documentDir(collectionName, documentID), name)
+	tx.afterCommit = append(tx.afterCommit, func() {
+		err := os.Remove(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error removing attachment %s: %v", file, err)
+		}
+	})
+	return nil
+}
+
+func (store filesystemAttachmentStore) RemoveAll(tx *writeTx, collectionName string, documentID int) error {
+	dir := store.documentDir(collectionName, documentID)
+	tx.afterCommit = append(tx.afterCommit, func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			log.Printf("Error removing attachments %s: %v", dir, err)
+		}
+	})
+	return nil
+}
+
+func createSQLDDLForAttachments() string {
+	return `
+	CREATE TABLE IF NOT EXISTS _attachments (
+		collection TEXT NOT NULL,
+		document_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (collection, document_id, name)
+	);
+	CREATE TABLE IF NOT EXISTS _attachment_blobs (
+		collection TEXT NOT NULL,
+		document_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		content BLOB NOT NULL,
+		PRIMARY KEY (collection, document_id, name)
+	);`
+}
+
+func saveAttachment(db *sqlx.DB, store AttachmentStore, collectionName string, documentID int, name string, contentType string, content []byte) error {
+	tx, err := beginWrite(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = saveAttachmentTx(tx, store, collectionName, documentID, name, contentType, content)
+	if err != nil {
+		return err
+	}
+	return commitWrite(tx)
+}
+
+// saveAttachmentTx stores an attachment in an open transaction, such as the
+// one that inserts the document it belongs to.
+func saveAttachmentTx(tx *writeTx, store AttachmentStore, collectionName string, documentID int, name string, contentType string, content []byte) error {
+	// The document must still exist once the write lock is held.
+	_, err := getDocument(tx, collectionName, documentID)
+	if err != nil {
+		return err
+	}
+	query := `INSERT OR REPLACE INTO _attachments (collection, document_id, name, content_type, size) VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(query, collectionName, documentID, name, contentType, len(content))
+	if err != nil {
+		return err
+	}
+	return store.Save(tx, collectionName, documentID, name, content)
+}
+
+func getAttachment(q sqlx.Queryer, collectionName string, documentID int, name string) (Attachment, error) {
+	attachment := Attachment{}
+	query := `SELECT name, content_type, size, created_at FROM _attachments WHERE collection = $1 AND document_id = $2 AND name = $3`
+	err := sqlx.Get(q, &attachment, query, collectionName, documentID, name)
+	if isDocumentNotFound(err) {
+		return attachment, errAttachmentNotFound
+	}
+	return attachment, err
+}
+
+func getAttachments(q sqlx.Queryer, collectionName string, documentID int) ([]Attachment, error) {
+	attachments := []Attachment{}
+	query := `SELECT name, content_type, size, created_at FROM _attachments WHERE collection = $1 AND document_id = $2 ORDER BY name`
+	err := sqlx.Select(q, &attachments, query, collectionName, documentID)
+	return attachments, err
+}
+
+func deleteAttachment(db *sqlx.DB, store AttachmentStore, collectionName string, documentID int, name string) error {
+	tx, err := beginWrite(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM _attachments WHERE collection = $1 AND document_id = $2 AND name = $3`
+	result, err := tx.Exec(query, collectionName, documentID, name)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errAttachmentNotFound
+	}
+	err = store.Remove(tx, collectionName, documentID, name)
+	if err != nil {
+		return err
+	}
+	return commitWrite(tx)
+}
+
+// deleteAttachmentsTx removes all attachments of a document as part of
+// deleting the document.
+func deleteAttachmentsTx(tx *writeTx, collectionName string, documentID int) error {
+	query := `DELETE FROM _attachments WHERE collection = $1 AND document_id = $2`
+	_, err := tx.Exec(query, collectionName, documentID)
+	if err != nil || attachmentStore == nil {
+		return err
+	}
+	return attachmentStore.RemoveAll(tx, collectionName, documentID)
+}
+
+var attachmentNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,254}$`)
+
+func isAttachmentNameValid(name string) bool {
+	return attachmentNamePattern.MatchString(name)
+}
+
+// attachmentContentType sniffs the content type of an upload. The type the
+// client declared is only used when sniffing finds nothing specific.
+func attachmentContentType(content []byte, declared string, name string) string {
+	contentType := http.DetectContentType(content)
+	if contentType == "application/octet-stream" || strings.HasPrefix(contentType, "text/plain") {
+		if declared == "" {
+			declared = mime.TypeByExtension(filepath.Ext(name))
+		}
+		if mediaType, _, err := mime.ParseMediaType(declared); err == nil && mediaType != "" {
+			return mediaType
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType
+}
+
+// inlineAttachmentTypes are the content types that browsers display without
+// running scripts.
+var inlineAttachmentTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif", "text/plain", "audio/*", "video/*"}
+
+func isAttachmentInline(contentType string) bool {
+	return matchesMediaTypes(inlineAttachmentTypes, contentType)
+}
+
+func isAttachmentTypeAllowed(settings *CollectionAttachments, contentType string) bool {
+	return len(settings.AllowedTypes) == 0 || matchesMediaTypes(settings.AllowedTypes, contentType)
+}
+
+// matchesMediaTypes reports whether contentType is one of types, which may
+// contain wildcards such as image/*.
+func matchesMediaTypes(types []string, contentType string) bool {
+	return slices.ContainsFunc(types, func(allowed string) bool {
+		if prefix, isWildcard := strings.CutSuffix(allowed, "/*"); isWildcard {
+			return strings.HasPrefix(contentType, prefix+"/")
+		}
+		return allowed == contentType
+	})
+}
+
+func (settings *CollectionAttachments) maxSize() int64 {
+	if settings.MaxSize > 0 {
+		return settings.MaxSize
+	}
+	return defaultAttachmentMaxSize
+}
+
+// readAttachmentUpload reads an upload sent as multipart/form-data (the first
+// file part is used) or as the raw request body. It returns the content and
+// the declared content type.
+func readAttachmentUpload(r *http.Request, maxSize int64) ([]byte, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		content, err := readLimited(r.Body, maxSize)
+		return content, r.Header.Get("Content-Type"), err
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, "", errors.New("no file part in upload")
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		content, err := readLimited(part, maxSize)
+		return content, part.Header.Get("Content-Type"), err
+	}
+}
+
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+func readLimited(reader io.Reader, maxSize int64) ([]byte, error) {
+	content, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxSize {
+		return nil, errAttachmentTooLarge
+	}
+	return content, nil
+}
+
+// attachmentRequest resolves the collection and document of an attachment
+// route and checks that the document exists. It sends the error response and returns ok == false when the
+// request cannot proceed.
+func attachmentRequest(w http.ResponseWriter, r *http.Request, action string) (collection *Collection, id int, ok bool) {
+	collectionName, _, ok := requestCollection(w, r, action)
+	if !ok {
+		return nil, 0, false
+	}
+	collection = getCollectionByName(collectionName)
+	if collection.Attachments == nil {
+		sendError(w, "Attachments are not enabled for this collection", http.StatusNotFound)
+		return nil, 0, false
+	}
+
+	id, err := StoiStrict(r.PathValue("id"))
+	if err != nil {
+		sendError(w, "Invalid ID", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	if name := r.PathValue("name"); name != "" && !isAttachmentNameValid(name) {
+		sendError(w, "Invalid attachment name", http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	_, err = getDocument(db, collection.Name, id)
+	if err != nil {
+		if isDocumentNotFound(err) {
+			sendError(w, "Document not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error retrieving document: %v", err)
+			sendError(w, "Failed to retrieve document", http.StatusInternalServerError)
+		}
+		return nil, 0, false
+	}
+	return collection, id, true
+}
+
+func uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	collection, id, ok := attachmentRequest(w, r, ActionPatch)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+
+	content, declaredType, err := readAttachmentUpload(r, collection.Attachments.maxSize())
+	if errors.Is(err, errAttachmentTooLarge) {
+		sendError(w, "Attachment too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		sendError(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	contentType := attachmentContentType(content, declaredType, name)
+	if !isAttachmentTypeAllowed(collection.Attachments, contentType) {
+		sendError(w, fmt.Sprintf("Content type %s is not allowed", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	err = saveAttachment(db, attachmentStore, collection.Name, id, name, contentType, content)
+	if err != nil {
+		if isDocumentNotFound(err) {
+			sendError(w, "Document not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error saving attachment: %v", err)
+		sendError(w, "Failed to save attachment", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccess(w, "Attachment saved")
+}
+
+func getAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	collection, id, ok := attachmentRequest(w, r, ActionRead)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+
+	attachment, err := getAttachment(db, collection.Name, id, name)
+	var content io.ReadSeekCloser
+	if err == nil {
+		content, err = attachmentStore.Open(db, collection.Name, id, name)
+	}
+	if err != nil {
+		if errors.Is(err, errAttachmentNotFound) {
+			sendError(w, "Attachment not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error retrieving attachment: %v", err)
+		sendError(w, "Failed to retrieve attachment", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	modified, _ := parseTimestamp(attachment.CreatedAt)
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Uploads such as HTML or SVG would run scripts on the API origin when
+	// opened, so only types that cannot are shown inline.
+	disposition := "attachment"
+	if isAttachmentInline(attachment.ContentType) {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	// ServeContent answers range and conditional requests.
+	http.ServeContent(w, r, name, modified, content)
+}
+
+func getAllAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	collection, id, ok := attachmentRequest(w, r, ActionRead)
+	if !ok {
+		return
+	}
+
+	attachments, err := getAttachments(db, collection.Name, id)
+	if err != nil {
+		log.Printf("Error retrieving attachments: %v", err)
+		sendError(w, "Failed to retrieve attachments", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
+
+func deleteAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	collection, id, ok := attachmentRequest(w, r, ActionPatch)
+	if !ok {
+		return
+	}
+
+	err := deleteAttachment(db, attachmentStore, collection.Name, id, r.PathValue("name"))
+	if err != nil {
+		if errors.Is(err, errAttachmentNotFound) {
+			sendError(w, "Attachment not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting attachment: %v", err)
+		sendError(w, "Failed to delete attachment", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccess(w, "Attachment deleted")
+}
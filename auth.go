@@ -2,38 +2,104 @@ package main
 
 import "slices"
 
-var authCache map[string][]string // {"collection-action" : "access token"}
-
 func buildAuthCache(config Config) map[string][]string {
-	var tokenCache = make(map[string]string)
-	for _, accessToken := range config.AccessTokens {
-		tokenCache[accessToken.Name] = accessToken.Token
-	}
 	var authCache = make(map[string][]string)
+	authCache[adminCollection+"-"+ActionAll] = slices.Clone(config.AdminTokens)
 	for _, collection := range config.Collections {
-		baseTokenNames := collection.Auth.All
-		authCache[collection.Name+"-"+ActionCreate] = tokensFromTokenNames(baseTokenNames, collection.Auth.Create, tokenCache)
-		authCache[collection.Name+"-"+ActionRead] = tokensFromTokenNames(baseTokenNames, collection.Auth.Read, tokenCache)
-		authCache[collection.Name+"-"+ActionList] = tokensFromTokenNames(baseTokenNames, collection.Auth.List, tokenCache)
-		authCache[collection.Name+"-"+ActionReplace] = tokensFromTokenNames(baseTokenNames, collection.Auth.Replace, tokenCache)
-		authCache[collection.Name+"-"+ActionPatch] = tokensFromTokenNames(baseTokenNames, collection.Auth.Patch, tokenCache)
-		authCache[collection.Name+"-"+ActionDelete] = tokensFromTokenNames(baseTokenNames, collection.Auth.Delete, tokenCache)
+		auth := collection.Auth
+		if collection.ParentAuth == ParentAuthInherit {
+			auth = inheritParentAuth(auth, config.Collections, collection.Parent)
+		}
+		baseTokenNames := auth.All
+		authCache[collection.Name+"-"+ActionAll] = slices.Clone(baseTokenNames)
+		authCache[collection.Name+"-"+ActionCreate] = slices.Concat(baseTokenNames, auth.Create)
+		authCache[collection.Name+"-"+ActionRead] = slices.Concat(baseTokenNames, auth.Read)
+		authCache[collection.Name+"-"+ActionList] = slices.Concat(baseTokenNames, auth.List)
+		authCache[collection.Name+"-"+ActionReplace] = slices.Concat(baseTokenNames, auth.Replace)
+		authCache[collection.Name+"-"+ActionPatch] = slices.Concat(baseTokenNames, auth.Patch)
+		authCache[collection.Name+"-"+ActionDelete] = slices.Concat(baseTokenNames, auth.Delete)
 	}
 	return authCache
 }
 
-func tokensFromTokenNames(baseTokenNames []string, tokenNames []string, tokenCache map[string]string) []string {
-	mergedTokens := []string{}
-	for _, tokenName := range baseTokenNames {
-		mergedTokens = append(mergedTokens, tokenCache[tokenName])
+// buildPublicCache marks the actions of collections that anyone may run.
+// With parent_auth inherit, the public actions of the parent are public in
+// the child as well.
+func buildPublicCache(config Config) map[string]bool {
+	var publicCache = make(map[string]bool)
+	for _, collection := range config.Collections {
+		public := collection.Public
+		if collection.ParentAuth == ParentAuthInherit {
+			if parent := getCollectionFrom(config.Collections, collection.Parent); parent != nil {
+				public = slices.Concat(public, parent.Public)
+			}
+		}
+		for _, action := range public {
+			if action == ActionAll {
+				for _, action := range collectionActions {
+					publicCache[collection.Name+"-"+action] = true
+				}
+			}
+			publicCache[collection.Name+"-"+action] = true
+		}
 	}
-	for _, tokenName := range tokenNames {
-		mergedTokens = append(mergedTokens, tokenCache[tokenName])
+	return publicCache
+}
+
+// inheritParentAuth adds the access lists of the parent collection to the
+// access lists of a child collection.
+func inheritParentAuth(auth CollectionAuth, collections []Collection, parentName string) CollectionAuth {
+	for _, parent := range collections {
+		if parent.Name != parentName {
+			continue
+		}
+		return CollectionAuth{
+			All:     append(slices.Clone(auth.All), parent.Auth.All...),
+			Create:  append(slices.Clone(auth.Create), parent.Auth.Create...),
+			Read:    append(slices.Clone(auth.Read), parent.Auth.Read...),
+			List:    append(slices.Clone(auth.List), parent.Auth.List...),
+			Replace: append(slices.Clone(auth.Replace), parent.Auth.Replace...),
+			Patch:   append(slices.Clone(auth.Patch), parent.Auth.Patch...),
+			Delete:  append(slices.Clone(auth.Delete), parent.Auth.Delete...),
+		}
 	}
-	return mergedTokens
+	return auth
 }
 
+// isAuthTokenValid reports whether the bearer of token may run action on the
+// collection: the action is public, or the token is an access token, a
+// stored token within its scopes or a JWT with a role listed for it.
 func isAuthTokenValid(token string, collectionName string, action string) bool {
-	validTokens := authCache[collectionName+"-"+action]
-	return slices.Contains(validTokens, token)
+	loaded := active()
+	if loaded.publicCache[collectionName+"-"+action] {
+		return true
+	}
+	validNames := loaded.authCache[collectionName+"-"+action]
+	if name, ok := loaded.tokenIndex.name(token); ok {
+		return slices.Contains(validNames, name)
+	}
+	if grant, ok := lookupStoredToken(token); ok {
+		return grant.allows(collectionName, action) && slices.Contains(validNames, grant.role)
+	}
+	identity, ok := loaded.jwtAuth.identity(token)
+	if !ok {
+		return false
+	}
+	return slices.ContainsFunc(identity.roles, func(role string) bool { return slices.Contains(validNames, role) })
+}
+
+// tokenName returns the configured name of an access token, the prefix of a
+// stored token, or the name claim of a JWT.
+func tokenName(token string) string {
+	loaded := active()
+	if name, ok := loaded.tokenIndex.name(token); ok {
+		return name
+	}
+	if grant, ok := lookupStoredToken(token); ok {
+		return grant.prefix
+	}
+	if identity, ok := loaded.jwtAuth.identity(token); ok {
+		return identity.name
+	}
+	return ""
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+)
+
+const eventBusBuffer = 256
+
+var eventBus = newWriteEventBus()
+
+// writeEvent is a committed document write.
+type writeEvent struct {
+	Event      string
+	Collection string
+	ID         int
+	Document   map[string]any
+}
+
+// writeEventBus fans committed writes out to in-process subscribers.
+// Subscribers that fall behind by more than eventBusBuffer events are
+// dropped and their channel is closed.
+type writeEventBus struct {
+	mu          sync.Mutex
+	nextID      int
+	subscribers map[int]chan writeEvent
+}
+
+func newWriteEventBus() *writeEventBus {
+	return &writeEventBus{subscribers: make(map[int]chan writeEvent)}
+}
+
+func (bus *writeEventBus) Subscribe() (int, <-chan writeEvent) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.nextID++
+	events := make(chan writeEvent, eventBusBuffer)
+	bus.subscribers[bus.nextID] = events
+	return bus.nextID, events
+}
+
+func (bus *writeEventBus) Unsubscribe(id int) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if events, ok := bus.subscribers[id]; ok {
+		delete(bus.subscribers, id)
+		close(events)
+	}
+}
+
+// Publish hands events to every subscriber without blocking the writer.
+// Documents are shared between subscribers and must not be modified.
+func (bus *writeEventBus) Publish(events []writeEvent) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for id, subscriber := range bus.subscribers {
+		for _, event := range events {
+			select {
+			case subscriber <- event:
+				continue
+			default:
+			}
+			delete(bus.subscribers, id)
+			close(subscriber)
+			break
+		}
+	}
+}
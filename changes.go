@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultChangesRetention = 7 * 24 * 60 * 60
+const changesHeartbeatInterval = 15 * time.Second
+const changesBatchSize = 100
+const changesTicketLifetime = 60 * time.Second
+
+// ChangesReset is sent instead of the events of a stream that resumes after
+// entries that were already pruned from the change log.
+const ChangesReset = "reset"
+
+var changesSignal = newBroadcastSignal()
+
+// changesTickets holds the tickets that open change feeds in browsers. A
+// ticket stands for the token it was issued to, expires after
+// changesTicketLifetime and opens a single stream, so a ticket that ends up
+// in an access log cannot be used again.
+var changesTickets = struct {
+	sync.Mutex
+	tickets map[string]changesTicket
+}{tickets: make(map[string]changesTicket)}
+
+type changesTicket struct {
+	token      string
+	collection string
+	expires    time.Time
+}
+
+func issueChangesTicket(token string, collectionName string, now time.Time) string {
+	ticket := newAccessToken()
+	changesTickets.Lock()
+	defer changesTickets.Unlock()
+	for key, issued := range changesTickets.tickets {
+		if now.After(issued.expires) {
+			delete(changesTickets.tickets, key)
+		}
+	}
+	changesTickets.tickets[ticket] = changesTicket{token: token, collection: collectionName, expires: now.Add(changesTicketLifetime)}
+	return ticket
+}
+
+// redeemChangesTicket returns the token a ticket was issued to and removes
+// the ticket.
+func redeemChangesTicket(ticket string, collectionName string, now time.Time) (string, bool) {
+	changesTickets.Lock()
+	defer changesTickets.Unlock()
+	issued, ok := changesTickets.tickets[ticket]
+	delete(changesTickets.tickets, ticket)
+	if !ok || issued.collection != collectionName || now.After(issued.expires) {
+		return "", false
+	}
+	return issued.token, true
+}
+
+// broadcastSignal wakes every goroutine waiting on it at once.
+type broadcastSignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newBroadcastSignal() *broadcastSignal {
+	return &broadcastSignal{ch: make(chan struct{})}
+}
+
+// Wait returns a channel that is closed by the next Broadcast.
+func (signal *broadcastSignal) Wait() <-chan struct{} {
+	signal.mu.Lock()
+	defer signal.mu.Unlock()
+	return signal.ch
+}
+
+func (signal *broadcastSignal) Broadcast() {
+	signal.mu.Lock()
+	defer signal.mu.Unlock()
+	close(signal.ch)
+	signal.ch = make(chan struct{})
+}
+
+// Change is an entry of the change log. Seq increases with every write.
+type Change struct {
+	Seq        int            `json:"seq"`
+	Event      string         `json:"event"`
+	Collection string         `json:"collection"`
+	ID         int            `json:"id"`
+	Document   map[string]any `json:"document,omitempty"`
+	Timestamp  string         `json:"timestamp"`
+}
+
+type changeRecord struct {
+	Seq        int    `db:"seq"`
+	Collection string `db:"collection"`
+	DocumentID int    `db:"document_id"`
+	Event      string `db:"event"`
+	Data       string `db:"data"`
+	CreatedAt  string `db:"created_at"`
+}
+
+func createSQLDDLForChanges() string {
+	return `
+	CREATE TABLE IF NOT EXISTS _changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		collection TEXT NOT NULL,
+		document_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		data BLOB NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS _changes_collection ON _changes (collection, seq);
+	CREATE INDEX IF NOT EXISTS _changes_created_at ON _changes (created_at);`
+}
+
+// recordChange appends a write to the change log and returns its sequence
+// number. Writers are serialized by SQLite, so sequence numbers are handed
+// out in commit order.
+func recordChange(tx sqlx.Queryer, event string, collectionName string, id int, document map[string]any) (int, error) {
+	jsonData, err := json.Marshal(document)
+	if err != nil {
+		return 0, err
+	}
+	var seq int
+	query := `INSERT INTO _changes (collection, document_id, event, data) VALUES ($1, $2, $3, jsonb($4)) RETURNING seq`
+	err = sqlx.Get(tx, &seq, query, collectionName, id, event, jsonData)
+	return seq, err
+}
+
+func getChanges(db *sqlx.DB, collectionName string, since int, limit int) ([]Change, error) {
+	records := []changeRecord{}
+	query := `SELECT seq, collection, document_id, event, json(data) AS data, created_at FROM _changes WHERE collection = $1 AND seq > $2 ORDER BY seq LIMIT $3`
+	err := db.Select(&records, query, collectionName, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	changes := []Change{}
+	for _, record := range records {
+		change := Change{
+			Seq:        record.Seq,
+			Event:      record.Event,
+			Collection: record.Collection,
+			ID:         record.DocumentID,
+			Timestamp:  record.CreatedAt,
+		}
+		err = json.Unmarshal([]byte(record.Data), &change.Document)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// lastChangeSeq returns the sequence number of the latest write, including
+// writes whose entries were pruned since.
+func lastChangeSeq(db *sqlx.DB) (int, error) {
+	var seq int
+	err := db.Get(&seq, `SELECT coalesce((SELECT seq FROM sqlite_sequence WHERE name = '_changes'), 0)`)
+	return seq, err
+}
+
+// firstChangeSeq returns the sequence number of the oldest entry the change
+// log still holds. When every entry was pruned, it is the number of the next
+// write.
+func firstChangeSeq(db *sqlx.DB) (int, error) {
+	var seq int
+	query := `SELECT coalesce(min(seq), (SELECT seq FROM sqlite_sequence WHERE name = '_changes') + 1, 1) FROM _changes`
+	err := db.Get(&seq, query)
+	return seq, err
+}
+
+// pruneChanges deletes change log entries older than retention seconds.
+func pruneChanges(db *sqlx.DB, retention int) (int64, error) {
+	result, err := db.Exec(`DELETE FROM _changes WHERE created_at <= datetime('now', $1)`, fmt.Sprintf("-%d seconds", retention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// changesHandler streams the change log of a collection as Server-Sent
+// Events. Streams start after Last-Event-ID or the since parameter, or with
+// the next write when neither is given.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	// EventSource cannot send headers, so browsers pass a ticket in the URL.
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" && r.Header.Get("Authorization") == "" {
+		token, ok := redeemChangesTicket(ticket, r.PathValue("collection"), time.Now())
+		if !ok {
+			sendError(w, "Invalid or expired ticket", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	collectionName, _, ok := requestCollection(w, r, ActionList)
+	if !ok {
+		return
+	}
+	token := getAuthTokenFromRequest(r)
+
+	filter, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	seq, err := StoiStrict(since)
+	if since == "" {
+		seq, err = lastChangeSeq(db)
+	}
+	if err != nil || seq < 0 {
+		sendError(w, "Invalid event ID", http.StatusBadRequest)
+		return
+	}
+	first, err := firstChangeSeq(db)
+	if err != nil {
+		log.Printf("Error retrieving changes: %v", err)
+		sendError(w, "Failed to retrieve changes", http.StatusInternalServerError)
+		return
+	}
+	// Entries after seq were pruned, so the client missed writes.
+	pruned := seq+1 < first
+	if pruned {
+		seq, err = lastChangeSeq(db)
+		if err != nil {
+			log.Printf("Error retrieving changes: %v", err)
+			sendError(w, "Failed to retrieve changes", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	if pruned {
+		data, _ := json.Marshal(map[string]any{"seq": seq, "message": "Events after the given ID were pruned, reload the collection"})
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", seq, ChangesReset, data)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(changesHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		// Permissions may change while the stream is open.
+		canList := isAuthTokenValid(token, collectionName, ActionList)
+		canRead := isAuthTokenValid(token, collectionName, ActionRead)
+		if !canList {
+			return
+		}
+
+		wait := changesSignal.Wait()
+		changes, err := getChanges(db, collectionName, seq, changesBatchSize)
+		if err != nil {
+			log.Printf("Error retrieving changes: %v", err)
+			return
+		}
+		for _, change := range changes {
+			seq = change.Seq
+			if !filter.Matches(change.Document) {
+				continue
+			}
+			if !canRead {
+				change.Document = nil
+			}
+			data, _ := json.Marshal(change)
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", strconv.Itoa(change.Seq), change.Event, data)
+		}
+		flusher.Flush()
+		if len(changes) == changesBatchSize {
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wait:
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// changesTicketHandler issues a ticket that opens a change feed for the
+// token of the request.
+func changesTicketHandler(w http.ResponseWriter, r *http.Request) {
+	collectionName, _, ok := requestCollection(w, r, ActionList)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"ticket": issueChangesTicket(getAuthTokenFromRequest(r), collectionName, time.Now())})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// sqliteKeywords cannot be used as collection names, because table names
+// are not quoted in queries.
+var sqliteKeywords = []string{
+	"ABORT", "ACTION", "ADD", "AFTER", "ALL", "ALTER", "ALWAYS", "ANALYZE", "AND", "AS", "ASC",
+	"ATTACH", "AUTOINCREMENT", "BEFORE", "BEGIN", "BETWEEN", "BY", "CASCADE", "CASE", "CAST",
+	"CHECK", "COLLATE", "COLUMN", "COMMIT", "CONFLICT", "CONSTRAINT", "CREATE", "CROSS",
+	"CURRENT", "CURRENT_DATE", "CURRENT_TIME", "CURRENT_TIMESTAMP", "DATABASE", "DEFAULT",
+	"DEFERRABLE", "DEFERRED", "DELETE", "DESC", "DETACH", "DISTINCT", "DO", "DROP", "EACH",
+	"ELSE", "END", "ESCAPE", "EXCEPT", "EXCLUDE", "EXCLUSIVE", "EXISTS", "EXPLAIN", "FAIL",
+	"FILTER", "FIRST", "FOLLOWING", "FOR", "FOREIGN", "FROM", "FULL", "GENERATED", "GLOB",
+	"GROUP", "GROUPS", "HAVING", "IF", "IGNORE", "IMMEDIATE", "IN", "INDEX", "INDEXED",
+	"INITIALLY", "INNER", "INSERT", "INSTEAD", "INTERSECT", "INTO", "IS", "ISNULL", "JOIN",
+	"KEY", "LAST", "LEFT", "LIKE", "LIMIT", "MATCH", "MATERIALIZED", "NATURAL", "NO", "NOT",
+	"NOTHING", "NOTNULL", "NULL", "NULLS", "OF", "OFFSET", "ON", "OR", "ORDER", "OTHERS",
+	"OUTER", "OVER", "PARTITION", "PLAN", "PRAGMA", "PRECEDING", "PRIMARY", "QUERY", "RAISE",
+	"RANGE", "RECURSIVE", "REFERENCES", "REGEXP", "REINDEX", "RELEASE", "RENAME", "REPLACE",
+	"RESTRICT", "RETURNING", "RIGHT", "ROLLBACK", "ROW", "ROWS", "SAVEPOINT", "SELECT", "SET",
+	"TABLE", "TEMP", "TEMPORARY", "THEN", "TIES", "TO", "TRANSACTION", "TRIGGER", "UNBOUNDED",
+	"UNION", "UNIQUE", "UPDATE", "USING", "VACUUM", "VALUES", "VIEW", "VIRTUAL", "WHEN",
+	"WHERE", "WINDOW", "WITH", "WITHOUT",
+}
+
+// checkConfig runs the structural and cross-reference checks the config
+// schema cannot express and returns every problem found.
+func checkConfig(config Config) []string {
+	problems := []string{}
+
+	tokenNames := make(map[string]bool)
+	for _, accessToken := range config.AccessTokens {
+		if tokenNames[accessToken.Name] {
+			problems = append(problems, fmt.Sprintf("access token %s is defined more than once", accessToken.Name))
+		}
+		tokenNames[accessToken.Name] = true
+		if err := checkAccessToken(accessToken); err != nil {
+			problems = append(problems, fmt.Sprintf("access token %s: %v", accessToken.Name, err))
+		}
+	}
+	// JWT roles are granted access like tokens.
+	for _, name := range config.JWT.roleNames() {
+		if tokenNames[name] {
+			problems = append(problems, fmt.Sprintf("jwt: role %s is already defined as an access token or role", name))
+		}
+		tokenNames[name] = true
+	}
+	// Token roles name what tokens of the token store act as.
+	for _, name := range config.TokenRoles {
+		if tokenNames[name] {
+			problems = append(problems, fmt.Sprintf("token_roles: %s is already defined as an access token or role", name))
+		}
+		tokenNames[name] = true
+	}
+	for _, name := range config.AdminTokens {
+		if !tokenNames[name] {
+			problems = append(problems, fmt.Sprintf("admin_tokens: unknown access token %s", name))
+		}
+	}
+
+	// Definitions and collection schemas share the OpenAPI components.
+	titles := make(map[string]string)
+	for _, name := range builtinComponents {
+		titles[name] = "the API"
+	}
+	for _, name := range sortedKeys(config.Definitions) {
+		if !definitionNamePattern.MatchString(name) || titles[name] != "" {
+			problems = append(problems, fmt.Sprintf("definitions: invalid or reserved name %s", name))
+		}
+		titles[name] = "definitions"
+	}
+
+	collectionNames := make(map[string]bool)
+	for _, collection := range config.Collections {
+		if collectionNames[collection.Name] {
+			problems = append(problems, fmt.Sprintf("collection %s is defined more than once", collection.Name))
+		}
+		collectionNames[collection.Name] = true
+		if !collectionNamePattern.MatchString(collection.Name) || slices.Contains(sqliteKeywords, strings.ToUpper(collection.Name)) {
+			problems = append(problems, fmt.Sprintf("collection %s: name must start with a letter, contain only letters, digits and underscores and not be an SQL keyword", collection.Name))
+		}
+
+		auth := collection.Auth
+		for action, names := range map[string][]string{
+			ActionAll:     auth.All,
+			ActionCreate:  auth.Create,
+			ActionRead:    auth.Read,
+			ActionList:    auth.List,
+			ActionReplace: auth.Replace,
+			ActionPatch:   auth.Patch,
+			ActionDelete:  auth.Delete,
+		} {
+			for _, name := range names {
+				if !tokenNames[name] {
+					problems = append(problems, fmt.Sprintf("collection %s: auth.%s: unknown access token %s", collection.Name, action, name))
+				}
+			}
+		}
+
+		for _, action := range collection.Public {
+			if !slices.Contains(collectionActions, action) {
+				problems = append(problems, fmt.Sprintf("collection %s: public: unknown action %s", collection.Name, action))
+			}
+		}
+
+		if collection.Schema == nil {
+			problems = append(problems, fmt.Sprintf("collection %s: schema is missing", collection.Name))
+			continue
+		}
+		title, _ := collection.Schema["title"].(string)
+		if title == "" {
+			// The title names the schema in the OpenAPI spec.
+			problems = append(problems, fmt.Sprintf("collection %s: schema needs a title", collection.Name))
+		} else if other, exists := titles[title]; exists {
+			problems = append(problems, fmt.Sprintf("collection %s: schema title %q is already used by %s", collection.Name, title, other))
+		} else {
+			titles[title] = "collection " + collection.Name
+		}
+		keywordProblems := checkCollectionSchema(collection)
+		if len(keywordProblems) > 0 {
+			problems = append(problems, keywordProblems...)
+			continue
+		}
+		_, err := compileSchema(collection.Schema, collection.schemaDraft())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("collection %s: invalid schema: %v", collection.Name, err))
+		}
+	}
+	slices.Sort(problems)
+	return problems
+}
+
+// runCheck implements the check command. It validates the config file
+// merged with the runtime configuration of the database and optionally
+// checks the database itself. It returns the exit code.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configFile := flags.String("config", defaultConfigFile, "Path to config file")
+	databaseFile := flags.String("db", databaseFileFromEnvironment(), "Path to database file")
+	integrity := flags.Bool("integrity", false, "Run the SQLite integrity check")
+	documents := flags.Bool("documents", false, "Report stored documents that fail their collection schema")
+	flags.Parse(args)
+
+	problems := []string{}
+	report := func(problem string) {
+		problems = append(problems, problem)
+		fmt.Println(problem)
+	}
+
+	content, err := readConfigDocument(*configFile)
+	if err != nil {
+		report(fmt.Sprintf("config: %v", err))
+		return 1
+	}
+	schemaProblems, err := validateConfigJSON(content)
+	if err != nil {
+		report(fmt.Sprintf("config: %v", err))
+		return 1
+	}
+	for _, problem := range schemaProblems {
+		report("config: " + problem)
+	}
+	var checked Config
+	err = json.Unmarshal(content, &checked)
+	if err != nil {
+		report(fmt.Sprintf("config: %v", err))
+		return 1
+	}
+
+	_, err = os.Stat(*databaseFile)
+	databaseExists := err == nil
+	if databaseExists {
+		db, err = connectToDatabase(*databaseFile)
+		if err != nil {
+			report(fmt.Sprintf("database: %v", err))
+			return 1
+		}
+		defer db.Close()
+		var tables int
+		db.Get(&tables, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = '_runtime_collections'`)
+		if tables > 0 {
+			overrides, err := loadRuntimeOverrides(db)
+			if err != nil {
+				report(fmt.Sprintf("database: could not read runtime configuration: %v", err))
+			}
+			checked = mergeRuntimeOverrides(checked, overrides)
+		}
+	}
+
+	var loaded *loadedConfig
+	configPath = *configFile
+	checked, err = resolveCollectionSchemas(checked)
+	if err != nil {
+		report(fmt.Sprintf("config: invalid schema reference: %v", err))
+		return 1
+	}
+	configProblems := checkConfig(checked)
+	for _, problem := range configProblems {
+		report("config: " + problem)
+	}
+	if len(schemaProblems) == 0 && len(configProblems) == 0 {
+		loaded, err = buildLoadedConfig(checked)
+		if err != nil {
+			report(fmt.Sprintf("config: %v", err))
+		}
+	}
+
+	if *integrity && databaseExists {
+		results := []string{}
+		err = db.Select(&results, `PRAGMA integrity_check`)
+		if err != nil {
+			report(fmt.Sprintf("database: %v", err))
+		}
+		for _, result := range results {
+			if result != "ok" {
+				report("database: " + result)
+			}
+		}
+	}
+
+	if *documents && databaseExists && loaded != nil {
+		loaded.activate()
+		for _, collection := range active().config.Collections {
+			var columns int
+			db.Get(&columns, `SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = 'schema_version'`, collection.Name)
+			if columns == 0 {
+				// The table is created or migrated on the next start.
+				continue
+			}
+			failing, err := nonconformantDocuments(db, collection.Name, 0, -1)
+			if err != nil {
+				report(fmt.Sprintf("documents: %s: %v", collection.Name, err))
+				continue
+			}
+			for _, document := range failing {
+				report(fmt.Sprintf("documents: %s/%d: %s", collection.Name, document.ID, strings.Join(document.Errors, "; ")))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Println("OK")
+	return 0
+}
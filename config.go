@@ -3,14 +3,10 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
-	"os"
-
-	"github.com/xeipuuv/gojsonschema"
 )
 
-var config Config
-
 const (
 	ActionAll     = "all"
 	ActionCreate  = "create"
@@ -21,23 +17,59 @@ const (
 	ActionDelete  = "delete"
 )
 
+var collectionActions = []string{ActionAll, ActionCreate, ActionRead, ActionList, ActionReplace, ActionPatch, ActionDelete}
+
+const (
+	ParentAuthInherit = "inherit"
+	ParentAuthCombine = "combine"
+)
+
 type Config struct {
-	Host         string        `json:"host"`
-	OpenapiHost  string        `json:"openapi_host"`
-	Port         int           `json:"port"`
-	AccessTokens []AccessToken `json:"access_tokens"`
-	Collections  []Collection  `json:"collections"`
+	Host                  string            `json:"host"`
+	OpenapiHost           string            `json:"openapi_host"`
+	Port                  int               `json:"port"`
+	ReaperInterval        int               `json:"reaper_interval"`
+	ChangesRetention      int               `json:"changes_retention"`
+	LiveSubscriptionLimit int               `json:"live_subscription_limit"`
+	AttachmentStorage     AttachmentStorage `json:"attachment_storage"`
+	SpamSecret            string            `json:"spam_secret"`
+	SMTP                  *SMTPConfig       `json:"smtp"`
+	AccessTokens          []AccessToken     `json:"access_tokens"`
+	AdminTokens           []string          `json:"admin_tokens"`
+	TokenRoles            []string          `json:"token_roles"`
+	JWT                   *JWTConfig        `json:"jwt"`
+	Definitions           map[string]any    `json:"definitions"`
+	Collections           []Collection      `json:"collections"`
 }
 
 type AccessToken struct {
 	Name  string `json:"name"`
 	Token string `json:"token"`
+	Hash  string `json:"hash"`
 }
 
 type Collection struct {
-	Name   string         `json:"name"`
-	Auth   CollectionAuth `json:"auth"`
-	Schema map[string]any `json:"schema"`
+	Name           string                   `json:"name"`
+	Parent         string                   `json:"parent"`
+	ParentAuth     string                   `json:"parent_auth"`
+	Auth           CollectionAuth           `json:"auth"`
+	Schema         map[string]any           `json:"schema"`
+	Generated      []GeneratedField         `json:"generated"`
+	ReadOnlyPolicy string                   `json:"read_only_policy"`
+	TTL            *CollectionTTL           `json:"ttl"`
+	Attachments    *CollectionAttachments   `json:"attachments"`
+	Form           *CollectionForm          `json:"form"`
+	Spam           *CollectionSpam          `json:"spam"`
+	Notifications  []CollectionNotification `json:"notifications"`
+	Webhooks       []Webhook                `json:"webhooks"`
+	Sync           *CollectionSync          `json:"sync"`
+	Versioning     *CollectionVersioning    `json:"versioning"`
+	Draft          string                   `json:"draft"`
+	Public         []string                 `json:"public"`
+
+	// declaredSchema is the schema as written, before its refs were
+	// resolved into Schema.
+	declaredSchema map[string]any
 }
 
 type CollectionAuth struct {
@@ -52,7 +84,7 @@ type CollectionAuth struct {
 
 func readConfig(fileName string) (Config, error) {
 	var config Config
-	content, err := os.ReadFile(fileName)
+	content, err := readConfigDocument(fileName)
 	if err != nil {
 		return config, err
 	}
@@ -61,29 +93,78 @@ func readConfig(fileName string) (Config, error) {
 		return config, err
 	}
 
-	documentLoader := gojsonschema.NewStringLoader(string(content))
-	schemaLoader := gojsonschema.NewStringLoader(configSchema)
-
-	result, err := gojsonschema.Validate(schemaLoader, documentLoader)
+	problems, err := validateConfigJSON(content)
 	if err != nil {
 		return config, err
 	}
-	if result.Valid() {
+	if len(problems) == 0 {
 		return config, nil
 	}
 	log.Printf("Found error in config. see errors :\n")
-	for _, err := range result.Errors() {
-		// Err implements the ResultError interface
-		log.Printf("- %s\n", err)
+	for _, problem := range problems {
+		log.Printf("- %s\n", problem)
 	}
 	return config, errors.New("Config is invalid")
 }
 
+// validateConfigJSON checks a config document against the config schema and
+// returns the problems found.
+func validateConfigJSON(content []byte) ([]string, error) {
+	var schema, document map[string]any
+	err := json.Unmarshal([]byte(configSchema), &schema)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &document)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := compileSchema(schema, DefaultDraft)
+	if err != nil {
+		return nil, err
+	}
+	return schemaErrors(document, compiled), nil
+}
+
 func getCollectionByName(collectionName string) *Collection {
-	for _, collection := range config.Collections {
+	for _, collection := range active().config.Collections {
 		if collection.Name == collectionName {
 			return &collection
 		}
 	}
 	return nil
 }
+
+func getChildCollections(collectionName string) []Collection {
+	children := []Collection{}
+	for _, collection := range active().config.Collections {
+		if collection.Parent == collectionName {
+			children = append(children, collection)
+		}
+	}
+	return children
+}
+
+// checkCollectionParents verifies that every parent names an existing top
+// level collection. Nesting is limited to one level.
+func checkCollectionParents(collections []Collection) error {
+	for _, collection := range collections {
+		if collection.Parent == "" {
+			continue
+		}
+		var parent *Collection
+		for _, candidate := range collections {
+			if candidate.Name == collection.Parent {
+				parent = &candidate
+				break
+			}
+		}
+		if parent == nil {
+			return fmt.Errorf("collection %s has unknown parent %s", collection.Name, collection.Parent)
+		}
+		if parent.Parent != "" {
+			return fmt.Errorf("collection %s: parent %s is itself a child collection", collection.Name, parent.Name)
+		}
+	}
+	return nil
+}
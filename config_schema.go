@@ -12,129 +12,504 @@ var configSchema string = `
       "description": "TCP port the server listens on.",
       "type": "integer"
     },
+    "reaper_interval": {
+      "description": "Seconds between purges of expired documents. Defaults to 60.",
+      "type": "integer",
+      "minimum": 1
+    },
+    "spam_secret": {
+      "description": "Secret that signs form tokens of collections with min_submit_seconds.",
+      "type": "string"
+    },
+    "smtp": {
+      "description": "Mail server notifications are sent through.",
+      "type": "object",
+      "properties": {
+        "host": { "type": "string" },
+        "port": { "description": "Defaults to 587.", "type": "integer" },
+        "username": { "type": "string" },
+        "password": { "type": "string" },
+        "from": { "description": "Sender address.", "type": "string" },
+        "starttls": { "description": "Require STARTTLS.", "type": "boolean" }
+      },
+      "required": ["host", "from"]
+    },
+    "attachment_storage": {
+      "description": "Where attachment content is stored.",
+      "type": "object",
+      "properties": {
+        "type": {
+          "description": "sqlite (default) stores content as blobs in the database, filesystem stores files below path.",
+          "type": "string",
+          "enum": ["sqlite", "filesystem"]
+        },
+        "path": {
+          "description": "Directory of the filesystem storage.",
+          "type": "string"
+        }
+      }
+    },
     "access_tokens": {
       "description": "List of access tokens that can authenticate requests.",
       "type": "array",
-      "items": [
-        {
-          "type": "object",
-          "properties": {
-            "name": {
-              "description": "Human-friendly label for the access token.",
-              "type": "string"
-            },
-            "token": {
-              "description": "Secret bearer token used for authentication.",
-              "type": "string"
-            }
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {
+            "description": "Human-friendly label for the access token.",
+            "type": "string"
+          },
+          "token": {
+            "description": "Secret bearer token used for authentication.",
+            "type": "string"
           },
-          "required": [
-            "name",
-            "token"
-          ]
+          "hash": {
+            "description": "Hash of the token instead of the token itself: sha256:{hex} or an argon2id hash.",
+            "type": "string"
+          }
+        },
+        "required": [
+          "name"
+        ]
+      }
+    },
+    "changes_retention": {
+      "description": "Seconds change log entries are kept (default 7 days).",
+      "type": "integer"
+    },
+    "live_subscription_limit": {
+      "description": "Maximum number of live query subscriptions per WebSocket connection (default 20).",
+      "type": "integer"
+    },
+    "admin_tokens": {
+      "description": "Names of the access tokens and JWT roles allowed to use the admin API under /api/_admin.",
+      "type": "array",
+      "items": { "type": "string" }
+    },
+    "token_roles": {
+      "description": "Names that tokens of the token store can act as, used in auth rules and admin_tokens like access token names.",
+      "type": "array",
+      "items": { "type": "string" }
+    },
+    "jwt": {
+      "description": "Accepts JWTs of an identity provider next to the static access tokens.",
+      "type": "object",
+      "properties": {
+        "secret": {
+          "description": "Shared secret of HS256 tokens.",
+          "type": "string"
+        },
+        "jwks_file": {
+          "description": "JWKS file with the RS256 and ES256 public keys, relative to the config file.",
+          "type": "string"
+        },
+        "jwks_url": {
+          "description": "URL of the JWKS with the RS256 and ES256 public keys.",
+          "type": "string"
+        },
+        "issuer": {
+          "description": "Required iss claim.",
+          "type": "string"
+        },
+        "audience": {
+          "description": "Required aud claim.",
+          "type": "string"
+        },
+        "leeway": {
+          "description": "Seconds of clock skew allowed when checking exp and nbf.",
+          "type": "integer",
+          "minimum": 0
+        },
+        "name_claim": {
+          "description": "Claim naming the caller in audit logs and generated token_name fields (default sub).",
+          "type": "string"
+        },
+        "roles": {
+          "description": "Roles granted by claims. Role names are used in collection auth and admin_tokens like access token names.",
+          "type": "array",
+          "items": {
+            "type": "object",
+            "required": ["name"],
+            "properties": {
+              "name": {
+                "type": "string"
+              },
+              "claim": {
+                "description": "Claim to check, with dot notation for nested claims. Without a claim every valid JWT has the role.",
+                "type": "string"
+              },
+              "value": {
+                "description": "Value the claim must hold or contain. Without a value the claim only has to be present."
+              }
+            }
+          }
         }
-      ]
+      }
+    },
+    "definitions": {
+      "description": "Shared JSON Schemas that collection schemas refer to with $ref: #/definitions/{name}.",
+      "type": "object",
+      "additionalProperties": { "type": "object" }
     },
     "collections": {
       "description": "Collection definitions that configure data storage and access control.",
       "type": "array",
-      "items": [
-        {
-          "type": "object",
-          "properties": {
-            "name": {
-              "description": "Unique collection name used in API routes.",
-              "type": "string"
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {
+            "description": "Unique collection name used in API routes.",
+            "type": "string"
+          },
+          "parent": {
+            "description": "Name of the parent collection. Child collections are served under /{parent}/{parentId}/{name}.",
+            "type": "string"
+          },
+          "parent_auth": {
+            "description": "How the parent's access control applies to a child collection.",
+            "type": "string",
+            "enum": ["", "inherit", "combine"]
+          },
+          "public": {
+            "description": "Actions allowed without a token.",
+            "type": "array",
+            "items": {
+              "type": "string",
+              "enum": ["all", "create", "read", "list", "replace", "patch", "delete"]
+            }
+          },
+          "auth": {
+            "description": "Per-action access control lists for the collection.",
+            "type": "object",
+            "properties": {
+              "all": {
+                "description": "Tokens allowed to perform any action on the collection.",
+                "type": "array",
+                "items": {
+                  "type": "string"
+                }
+              },
+              "create": {
+                "description": "Tokens allowed to create records in the collection.",
+                "type": "array",
+                "items": {
+                  "type": "string"
+                }
+              },
+              "read": {
+                "description": "Tokens allowed to read a single record in the collection.",
+                "type": "array",
+                "items": {
+                  "type": "string"
+                }
+              },
+              "list": {
+                "description": "Tokens allowed to list records in the collection.",
+                "type": "array",
+                "items": {
+                  "type": "string"
+                }
+              },
+              "replace": {
+                "description": "Tokens allowed to replace an entire record in the collection.",
+                "type": "array",
+                "items": {
+                  "type": "string"
+                }
+              },
+              "patch": {
+                "description": "Tokens allowed to partially update a record in the collection.",
+                "type": "array",
+                "items": {
+                  "type": "string"
+                }
+              },
+              "delete": {
+                "description": "Tokens allowed to delete a record in the collection.",
+                "type": "array",
+                "items": {
+                  "type": "string"
+                }
+              }
             },
-            "auth": {
-              "description": "Per-action access control lists for the collection.",
+            "required": [
+              "all",
+              "create",
+              "read",
+              "list",
+              "replace",
+              "patch",
+              "delete"
+            ]
+          },
+          "schema": {
+            "type": "object"
+          },
+          "draft": {
+            "description": "JSON Schema draft the schema is written in (default draft-07, or the draft named by $schema).",
+            "type": "string",
+            "enum": ["draft-04", "draft-06", "draft-07", "2019-09", "2020-12"]
+          },
+          "generated": {
+            "description": "Top level fields the server fills in on write.",
+            "type": "array",
+            "items": {
               "type": "object",
               "properties": {
-                "all": {
-                  "description": "Tokens allowed to perform any action on the collection.",
-                  "type": "array",
-                  "items": [
-                    {
-                      "type": "string"
-                    }
-                  ]
+                "field": {
+                  "description": "Name of the generated field.",
+                  "type": "string"
                 },
-                "create": {
-                  "description": "Tokens allowed to create records in the collection.",
-                  "type": "array",
-                  "items": [
-                    {
-                      "type": "string"
-                    }
-                  ]
+                "type": {
+                  "description": "What the field is generated from.",
+                  "type": "string",
+                  "enum": ["timestamp", "token_name", "client_ip", "slug", "sequence"]
                 },
-                "read": {
-                  "description": "Tokens allowed to read a single record in the collection.",
-                  "type": "array",
-                  "items": [
-                    {
-                      "type": "string"
-                    }
-                  ]
+                "from": {
+                  "description": "Source field of a slug.",
+                  "type": "string"
                 },
-                "list": {
-                  "description": "Tokens allowed to list records in the collection.",
-                  "type": "array",
-                  "items": [
-                    {
-                      "type": "string"
-                    }
-                  ]
+                "on": {
+                  "description": "Generate only on create (default) or on every write.",
+                  "type": "string",
+                  "enum": ["create", "write"]
+                }
+              },
+              "required": [
+                "field",
+                "type"
+              ]
+            }
+          },
+          "ttl": {
+            "description": "Expire documents a fixed number of seconds after creation or at the time stored in a document field.",
+            "type": "object",
+            "properties": {
+              "seconds": {
+                "description": "Lifetime of a document in seconds, counted from created_at.",
+                "type": "integer",
+                "minimum": 1
+              },
+              "field": {
+                "description": "Top level field holding the expiry time as an RFC 3339 timestamp or unix seconds.",
+                "type": "string"
+              }
+            }
+          },
+          "attachments": {
+            "description": "Enables binary attachments on the documents of the collection.",
+            "type": "object",
+            "properties": {
+              "allowed_types": {
+                "description": "Allowed MIME types, such as image/png or image/*. All types are allowed when empty.",
+                "type": "array",
+                "items": {
+                  "type": "string"
+                }
+              },
+              "max_size": {
+                "description": "Maximum size of an attachment in bytes. Defaults to 10 MiB.",
+                "type": "integer",
+                "minimum": 1
+              }
+            }
+          },
+          "form": {
+            "description": "Redirects for HTML form posts (urlencoded or multipart).",
+            "type": "object",
+            "properties": {
+              "success_redirect": {
+                "description": "URL a successful form post is redirected to with 303 See Other.",
+                "type": "string"
+              },
+              "error_redirect": {
+                "description": "URL a failed form post is redirected to with 303 See Other. The message is passed in the error query parameter.",
+                "type": "string"
+              }
+            }
+          },
+          "spam": {
+            "description": "Anti-abuse checks for inserts. Rejected submissions are quarantined.",
+            "type": "object",
+            "properties": {
+              "honeypot_fields": {
+                "description": "Fields that must stay empty.",
+                "type": "array",
+                "items": { "type": "string" }
+              },
+              "min_submit_seconds": {
+                "description": "Minimum seconds between fetching a form token and submitting.",
+                "type": "integer",
+                "minimum": 0
+              },
+              "token_field": {
+                "description": "Field holding the form token (default _form_token).",
+                "type": "string"
+              },
+              "rate_limit": {
+                "description": "Submissions allowed per client IP and window.",
+                "type": "object",
+                "properties": {
+                  "requests": { "type": "integer", "minimum": 1 },
+                  "window": { "description": "Window in seconds.", "type": "integer", "minimum": 1 }
+                },
+                "required": ["requests", "window"]
+              },
+              "duplicate_window": {
+                "description": "Seconds in which submissions with identical content are rejected.",
+                "type": "integer",
+                "minimum": 0
+              },
+              "captcha": {
+                "description": "hCaptcha or Turnstile style CAPTCHA verification.",
+                "type": "object",
+                "properties": {
+                  "verify_url": { "type": "string" },
+                  "secret": { "type": "string" },
+                  "response_field": {
+                    "description": "Field holding the CAPTCHA response (default captcha_response).",
+                    "type": "string"
+                  }
                 },
-                "replace": {
-                  "description": "Tokens allowed to replace an entire record in the collection.",
+                "required": ["verify_url", "secret"]
+              }
+            }
+          },
+          "notifications": {
+            "description": "Emails sent when documents are written.",
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "events": {
                   "type": "array",
-                  "items": [
-                    {
-                      "type": "string"
-                    }
-                  ]
+                  "items": { "type": "string", "enum": ["create", "update", "delete"] },
+                  "minItems": 1
+                },
+                "filter": {
+                  "description": "Go template; the email is only sent when it renders true.",
+                  "type": "string"
                 },
-                "patch": {
-                  "description": "Tokens allowed to partially update a record in the collection.",
+                "to": {
                   "type": "array",
-                  "items": [
-                    {
-                      "type": "string"
-                    }
-                  ]
+                  "items": { "type": "string" },
+                  "minItems": 1
                 },
-                "delete": {
-                  "description": "Tokens allowed to delete a record in the collection.",
+                "subject": { "description": "Go template of the subject.", "type": "string" },
+                "body": { "description": "Go template of the body.", "type": "string" },
+                "html": { "description": "Render the body with html/template and send it as HTML.", "type": "boolean" }
+              },
+              "required": ["events", "to", "subject", "body"]
+            }
+          },
+          "webhooks": {
+            "description": "URLs that receive signed write events of the collection.",
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "name": {
+                  "description": "Unique webhook name.",
+                  "type": "string",
+                  "pattern": "^[A-Za-z0-9._-]+$"
+                },
+                "events": {
                   "type": "array",
-                  "items": [
-                    {
-                      "type": "string"
-                    }
-                  ]
+                  "items": { "type": "string", "enum": ["create", "update", "delete"] },
+                  "minItems": 1
+                },
+                "url": { "type": "string" },
+                "secret": {
+                  "description": "Key of the HMAC-SHA256 signature in the X-QuickStore-Signature header.",
+                  "type": "string"
                 }
               },
-              "required": [
-                "all",
-                "create",
-                "read",
-                "list",
-                "replace",
-                "patch",
-                "delete"
-              ]
-            },
-            "schema": {
-              "type": "object"
+              "required": ["name", "events", "url", "secret"]
             }
           },
-          "required": [
-            "name",
-            "auth",
-            "schema"
-          ]
-        }
-      ]
+          "sync": {
+            "description": "Enables the offline sync endpoints of a top level collection.",
+            "type": "object",
+            "properties": {
+              "conflicts": {
+                "description": "How pushed changes made against an outdated revision are resolved (default server-wins).",
+                "type": "string",
+                "enum": ["server-wins", "client-wins", "last-write-wins", "manual"]
+              }
+            }
+          },
+          "versioning": {
+            "description": "Numbers the revisions of the collection schema and upgrades documents written with older versions.",
+            "type": "object",
+            "required": ["version"],
+            "properties": {
+              "version": {
+                "description": "Current schema version, stored with every written document.",
+                "type": "integer",
+                "minimum": 1
+              },
+              "mode": {
+                "description": "Whether old documents are upgraded when read (default) or in batches by the reaper.",
+                "type": "string",
+                "enum": ["lazy", "eager"]
+              },
+              "migrations": {
+                "description": "Transforms that upgrade documents from the previous version to version.",
+                "type": "array",
+                "items": {
+                  "type": "object",
+                  "required": ["version", "steps"],
+                  "properties": {
+                    "version": {
+                      "type": "integer",
+                      "minimum": 2
+                    },
+                    "steps": {
+                      "type": "array",
+                      "items": {
+                        "type": "object",
+                        "required": ["op", "field"],
+                        "properties": {
+                          "op": {
+                            "type": "string",
+                            "enum": ["rename", "set_default", "delete", "coerce"]
+                          },
+                          "field": {
+                            "description": "Dot separated path of the field.",
+                            "type": "string"
+                          },
+                          "to": {
+                            "description": "New path of a renamed field.",
+                            "type": "string"
+                          },
+                          "value": {
+                            "description": "Value set by set_default when the field is missing."
+                          },
+                          "type": {
+                            "description": "Type a coerced value is converted to.",
+                            "type": "string",
+                            "enum": ["string", "number", "integer", "boolean"]
+                          }
+                        }
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "read_only_policy": {
+            "description": "Whether readOnly schema properties sent by clients are rejected (default) or stripped.",
+            "type": "string",
+            "enum": ["reject", "strip"]
+          }
+        },
+        "required": [
+          "name",
+          "auth",
+          "schema"
+        ]
+      }
     }
   },
   "required": [
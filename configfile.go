@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EnvHost     = "QUICKSTORE_HOST"
+	EnvPort     = "QUICKSTORE_PORT"
+	EnvDatabase = "QUICKSTORE_DB"
+)
+
+// interpolationPattern matches ${NAME} and ${file:/path}. $${ is a literal ${.
+var interpolationPattern = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// readConfigDocument reads a config file in JSON, YAML or TOML, merges the
+// files it includes, fills in ${...} references and applies the environment
+// overrides. The result is returned as JSON, ready to be checked against the
+// config schema.
+func readConfigDocument(fileName string) ([]byte, error) {
+	document, err := readConfigFragment(fileName, []string{})
+	if err != nil {
+		return nil, err
+	}
+	interpolated, err := interpolateConfig(document)
+	if err != nil {
+		return nil, err
+	}
+	document = interpolated.(map[string]any)
+	err = applyEnvironmentOverrides(document)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// decodeConfigFile parses a file by its extension: .yaml and .yml as YAML,
+// .toml as TOML and everything else as JSON.
+func decodeConfigFile(fileName string) (any, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var document any
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &document)
+	case ".toml":
+		var table map[string]any
+		_, err = toml.Decode(string(content), &table)
+		document = table
+	default:
+		err = json.Unmarshal(content, &document)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	// Round trip through JSON so that every format yields the same types.
+	content, err = json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	document = nil
+	err = json.Unmarshal(content, &document)
+	return document, err
+}
+
+// readConfigFragment reads a config file and merges the files matched by its
+// include patterns into it. Patterns are relative to the including file. An
+// included file whose top level has a name is a single collection, any
+// other file is a config fragment whose lists are appended and whose
+// objects are merged.
+func readConfigFragment(fileName string, including []string) (map[string]any, error) {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(including, path) {
+		return nil, fmt.Errorf("%s includes itself", fileName)
+	}
+	decoded, err := decodeConfigFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	document, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: the top level must be an object", fileName)
+	}
+
+	patterns, err := includePatterns(document)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	delete(document, "include")
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(filepath.Dir(fileName), pattern))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include %q: %w", fileName, pattern, err)
+		}
+		for _, match := range matches {
+			fragment, err := readConfigFragment(match, append(including, path))
+			if err != nil {
+				return nil, err
+			}
+			if _, isCollection := fragment["name"]; isCollection {
+				fragment = map[string]any{"collections": []any{fragment}}
+			}
+			mergeConfigFragment(document, fragment)
+		}
+	}
+	return document, nil
+}
+
+func includePatterns(document map[string]any) ([]string, error) {
+	switch include := document["include"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{include}, nil
+	case []any:
+		patterns := []string{}
+		for _, pattern := range include {
+			pattern, ok := pattern.(string)
+			if !ok {
+				return nil, fmt.Errorf("include must list file patterns")
+			}
+			patterns = append(patterns, pattern)
+		}
+		return patterns, nil
+	}
+	return nil, fmt.Errorf("include must list file patterns")
+}
+
+func mergeConfigFragment(document map[string]any, fragment map[string]any) {
+	for key, value := range fragment {
+		switch value := value.(type) {
+		case []any:
+			existing, _ := document[key].([]any)
+			document[key] = append(existing, value...)
+		case map[string]any:
+			existing, ok := document[key].(map[string]any)
+			if !ok {
+				document[key] = value
+				continue
+			}
+			for name, child := range value {
+				existing[name] = child
+			}
+		default:
+			document[key] = value
+		}
+	}
+}
+
+// interpolateConfig replaces ${NAME} in string values with the environment
+// variable NAME and ${file:/path} with the trimmed content of the file, so
+// that secrets do not have to be written into the config.
+func interpolateConfig(value any) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, child := range value {
+			interpolated, err := interpolateConfig(child)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = interpolated
+		}
+	case []any:
+		for i, child := range value {
+			interpolated, err := interpolateConfig(child)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = interpolated
+		}
+	case string:
+		var err error
+		interpolated := interpolationPattern.ReplaceAllStringFunc(value, func(match string) string {
+			if strings.HasPrefix(match, "$$") {
+				return match[1:]
+			}
+			reference := match[2 : len(match)-1]
+			if path, ok := strings.CutPrefix(reference, "file:"); ok {
+				content, readErr := os.ReadFile(path)
+				if readErr != nil && err == nil {
+					err = fmt.Errorf("could not read secret: %w", readErr)
+				}
+				return strings.TrimSpace(string(content))
+			}
+			variable, ok := os.LookupEnv(reference)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s is not set", reference)
+			}
+			return variable
+		})
+		return interpolated, err
+	}
+	return value, nil
+}
+
+// applyEnvironmentOverrides lets the environment replace the address the
+// server listens on.
+func applyEnvironmentOverrides(document map[string]any) error {
+	if host, ok := os.LookupEnv(EnvHost); ok {
+		document["host"] = host
+	}
+	if port, ok := os.LookupEnv(EnvPort); ok {
+		value, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", EnvPort, err)
+		}
+		document["port"] = value
+	}
+	return nil
+}
+
+// databaseFileFromEnvironment returns the database path of the environment,
+// which the -db flag overrides.
+func databaseFileFromEnvironment() string {
+	if databaseFile, ok := os.LookupEnv(EnvDatabase); ok {
+		return databaseFile
+	}
+	return defaultDatabaseFile
+}
+
+// configFileState describes a config file and the files it includes, so
+// that changes to any of them can be noticed. Unreadable files are skipped.
+func configFileState(fileName string, including []string) string {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return ""
+	}
+	state := fmt.Sprintf("%s:%d:%d;", fileName, info.ModTime().UnixNano(), info.Size())
+	path, _ := filepath.Abs(fileName)
+	if slices.Contains(including, path) {
+		return state
+	}
+	decoded, err := decodeConfigFile(fileName)
+	if err != nil {
+		return state
+	}
+	document, _ := decoded.(map[string]any)
+	patterns, _ := includePatterns(document)
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(filepath.Dir(fileName), pattern))
+		for _, match := range matches {
+			state += configFileState(match, append(including, path))
+		}
+	}
+	return state
+}
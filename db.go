@@ -3,6 +3,14 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "modernc.org/sqlite"
@@ -10,16 +18,47 @@ import (
 
 var db *sqlx.DB
 
+var errValidationFailed = errors.New("validation failed")
+
+// documentValidator checks a document before it is committed and may fill in
+// server maintained fields. current is the stored document with the given
+// id. It runs inside the write transaction, so lookups must go through q.
+type documentValidator func(q sqlx.Queryer, id int, current map[string]any, document map[string]any) error
+
 type DataTable struct {
 	ID        int    `db:"id"`
 	CreatedAt string `db:"created_at"`
 	Data      string `db:"data"`
+	// SchemaVersion is the version of the collection schema the document
+	// was written with.
+	SchemaVersion int `db:"schema_version"`
+}
+
+// databaseDSN adds the connection parameters the server relies on to a
+// database path, which may already carry a query string like
+// file:x.db?mode=rwc. Parameters set in the path are kept.
+func databaseDSN(filePath string) string {
+	path, query, _ := strings.Cut(filePath, "?")
+	values, _ := url.ParseQuery(query)
+	params := []string{}
+	if query != "" {
+		params = append(params, query)
+	}
+	// Transactions take the write lock up front so read-modify-write updates
+	// cannot interleave with other writers.
+	if !values.Has("_txlock") {
+		params = append(params, "_txlock=immediate")
+	}
+	if !slices.ContainsFunc(values["_pragma"], func(pragma string) bool { return strings.HasPrefix(pragma, "busy_timeout") }) {
+		params = append(params, "_pragma=busy_timeout(5000)")
+	}
+	return path + "?" + strings.Join(params, "&")
 }
 
 func connectToDatabase(filePath string) (*sqlx.DB, error) {
 	var db *sqlx.DB
 	var err error
-	db, err = sqlx.Open("sqlite", filePath)
+	db, err = sqlx.Open("sqlite", databaseDSN(filePath))
 	if err != nil {
 		return db, err
 	}
@@ -35,21 +74,122 @@ func createSQLDDLForCollection(collectionName string) string {
 	CREATE TABLE IF NOT EXISTS ` + collectionName + ` (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		data BLOB NOT NULL
+		data BLOB NOT NULL,
+		schema_version INTEGER NOT NULL DEFAULT 1
+	);`
+}
+
+func createSQLDDLForParentIndex(collectionName string) string {
+	return `CREATE INDEX IF NOT EXISTS ` + collectionName + `_parent_id ON ` + collectionName + ` (parent_id);`
+}
+
+func createSQLDDLForCreatedAtIndex(collectionName string) string {
+	return `CREATE INDEX IF NOT EXISTS ` + collectionName + `_created_at ON ` + collectionName + ` (created_at);`
+}
+
+func createSQLDDLForSchemaVersionIndex(collectionName string) string {
+	return `CREATE INDEX IF NOT EXISTS ` + collectionName + `_schema_version ON ` + collectionName + ` (schema_version);`
+}
+
+func createSQLDDLForSequences() string {
+	return `
+	CREATE TABLE IF NOT EXISTS _sequences (
+		name TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
 	);`
 }
 
 func migrateDatabase(db *sqlx.DB, collections []Collection) error {
+	_, err := db.Exec(createSQLDDLForSequences())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(createSQLDDLForAttachments())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(createSQLDDLForSpam())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(createSQLDDLForEmailQueue())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(createSQLDDLForWebhooks())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(createSQLDDLForChanges())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(createSQLDDLForSync())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(createSQLDDLForRuntimeConfig())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(createSQLDDLForStoredTokens())
+	if err != nil {
+		return err
+	}
 	for _, collection := range collections {
 		schema := createSQLDDLForCollection(collection.Name)
 		_, err := db.Exec(schema)
 		if err != nil {
 			return err
 		}
+		err = addColumnIfMissing(db, collection.Name, "schema_version", "INTEGER NOT NULL DEFAULT 1")
+		if err != nil {
+			return err
+		}
+		if collection.Versioning.mode() == MigrationEager {
+			_, err = db.Exec(createSQLDDLForSchemaVersionIndex(collection.Name))
+			if err != nil {
+				return err
+			}
+		}
+		if collection.TTL != nil && collection.TTL.Seconds > 0 {
+			_, err = db.Exec(createSQLDDLForCreatedAtIndex(collection.Name))
+			if err != nil {
+				return err
+			}
+		}
+		if collection.Parent != "" {
+			err = addColumnIfMissing(db, collection.Name, "parent_id", "INTEGER")
+			if err != nil {
+				return err
+			}
+			_, err = db.Exec(createSQLDDLForParentIndex(collection.Name))
+			if err != nil {
+				return err
+			}
+		}
+		if collection.Sync != nil {
+			err = backfillRevisions(db, collection.Name)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// addColumnIfMissing lets existing tables pick up columns that were added
+// to a collection's configuration after the table was created.
+func addColumnIfMissing(db *sqlx.DB, tableName string, columnName string, columnType string) error {
+	var count int
+	err := db.Get(&count, `SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2`, tableName, columnName)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + tableName + ` ADD COLUMN ` + columnName + ` ` + columnType)
+	return err
+}
+
 func isDocumentNotFound(err error) bool {
 	if err == sql.ErrNoRows {
 		return true
@@ -57,80 +197,473 @@ func isDocumentNotFound(err error) bool {
 	return false
 }
 
-// Store data as JSONB
-func insertDocument(db *sqlx.DB, collectionName string, document map[string]any) error {
-	jsonData, err := json.Marshal(document)
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// writeTx is the transaction of a document write. It collects the writes
+// that are published on the event bus once the transaction commits, file
+// changes that must not happen unless it commits, and the cleanup of files
+// that were only needed if it did.
+type writeTx struct {
+	*sqlx.Tx
+	events        []writeEvent
+	afterCommit   []func()
+	afterRollback []func()
+}
+
+// Rollback rolls back the transaction unless it already committed or rolled
+// back, and then runs the afterRollback hooks.
+func (tx *writeTx) Rollback() error {
+	err := tx.Tx.Rollback()
+	if !errors.Is(err, sql.ErrTxDone) {
+		tx.rolledBack()
+	}
+	return err
+}
+
+func (tx *writeTx) rolledBack() {
+	for _, run := range tx.afterRollback {
+		run()
+	}
+	tx.afterRollback = nil
+}
+
+func beginWrite(db *sqlx.DB) (*writeTx, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &writeTx{Tx: tx}, nil
+}
+
+// recordWrite runs in the transaction of every document write. It appends
+// the write to the change log, bumps the sync revision of the document and
+// queues its notifications and webhook deliveries.
+func recordWrite(tx *writeTx, event string, collectionName string, id int, document map[string]any) error {
+	tx.events = append(tx.events, writeEvent{Event: event, Collection: collectionName, ID: id, Document: maps.Clone(document)})
+	seq, err := recordChange(tx, event, collectionName, id, document)
 	if err != nil {
 		return err
 	}
+	err = recordRevision(tx, collectionName, id, seq, event == EventDelete)
+	if err != nil {
+		return err
+	}
+	err = enqueueNotifications(tx, event, collectionName, id, document)
+	if err != nil {
+		return err
+	}
+	return enqueueWebhooks(tx, event, collectionName, id, document)
+}
 
-	query := `INSERT INTO ` + collectionName + ` (data) VALUES (jsonb($1))`
-	_, err = db.Exec(query, jsonData)
-	return err
+// commitLock is held from the commit of a write until its writes are
+// published, so that subscribers see writes in the order they committed.
+var commitLock sync.Mutex
+
+// commitWrite commits a write transaction, publishes its writes and wakes
+// the background workers that deliver what the write queued.
+func commitWrite(tx *writeTx) error {
+	commitLock.Lock()
+	err := tx.Commit()
+	if err != nil {
+		commitLock.Unlock()
+		tx.rolledBack()
+		return err
+	}
+	eventBus.Publish(tx.events)
+	commitLock.Unlock()
+	for _, run := range tx.afterCommit {
+		run()
+	}
+	wakeMailer()
+	wakeWebhookDispatcher()
+	changesSignal.Broadcast()
+	return nil
+}
+
+// runQueueWorker calls work whenever wake fires and at least every interval.
+func runQueueWorker(wake <-chan struct{}, interval time.Duration, work func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		work()
+		select {
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// Store data as JSONB and return the id of the new document
+func insertDocument(db *sqlx.DB, collectionName string, document map[string]any) (int, error) {
+	return insertRow(db, collectionName, 0, document)
+}
+
+// insertChildDocument stores a document of a child collection under the
+// given parent document.
+func insertChildDocument(db *sqlx.DB, collectionName string, parentID int, document map[string]any) (int, error) {
+	return insertRow(db, collectionName, parentID, document)
+}
+
+func insertRow(db *sqlx.DB, collectionName string, parentID int, document map[string]any) (int, error) {
+	tx, err := beginWrite(db)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertDocumentTx(tx, collectionName, parentID, document)
+	if err != nil {
+		return 0, err
+	}
+	return id, commitWrite(tx)
+}
+
+// insertDocumentTx stores a document in an open write transaction, under the
+// given parent document unless parentID is 0. Callers that validate the
+// document run the validation in the same transaction, so that checks like
+// x-unique see every committed write.
+func insertDocumentTx(tx *writeTx, collectionName string, parentID int, document map[string]any) (int, error) {
+	jsonData, err := json.Marshal(document)
+	if err != nil {
+		return 0, err
+	}
+	query := `INSERT INTO ` + collectionName + ` (data, schema_version) VALUES (jsonb($1), $2) RETURNING id`
+	args := []any{jsonData, schemaVersion(collectionName)}
+	if parentID != 0 {
+		query = `INSERT INTO ` + collectionName + ` (data, parent_id, schema_version) VALUES (jsonb($1), $2, $3) RETURNING id`
+		args = []any{jsonData, parentID, schemaVersion(collectionName)}
+	}
+
+	var id int
+	err = tx.Get(&id, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return id, recordWrite(tx, EventCreate, collectionName, id, document)
 }
 
 // Retrieve JSONB data
-func getDocument(db *sqlx.DB, collectionName string, id int) (map[string]any, error) {
+func getDocument(db sqlx.Queryer, collectionName string, id int) (map[string]any, error) {
 	record := DataTable{}
-	query := `SELECT id, created_at, json(data) AS data FROM ` + collectionName + ` WHERE id = $1`
-	err := db.Get(&record, query, id)
+	query := `SELECT id, created_at, json(data) AS data, schema_version FROM ` + collectionName + ` WHERE id = $1 AND ` + liveCondition(collectionName)
+	err := sqlx.Get(db, &record, query, id)
 	if err != nil {
 		return nil, err
 	}
+	return documentFromRecord(collectionName, record)
+}
+
+// documentFromRecord decodes a stored document and migrates it to the
+// current schema version of its collection.
+func documentFromRecord(collectionName string, record DataTable) (map[string]any, error) {
 	var document map[string]any
-	err = json.Unmarshal([]byte(record.Data), &document)
-	if err == nil {
-		document["_id"] = record.ID
-		document["_created_at"] = record.CreatedAt
-		return document, err
+	err := json.Unmarshal([]byte(record.Data), &document)
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	upgradeDocument(collectionName, document, record.SchemaVersion)
+	document["_id"] = record.ID
+	document["_created_at"] = record.CreatedAt
+	return document, nil
 }
 
 func getAllDocuments(db *sqlx.DB, collectionName string, skip int, limit int) ([]map[string]any, error) {
+	query := `SELECT id, created_at, json(data) AS data, schema_version FROM ` + collectionName + ` WHERE ` + liveCondition(collectionName) + ` LIMIT $1 OFFSET $2`
+	return selectDocuments(db, collectionName, query, limit, skip)
+}
+
+func getAllChildDocuments(db *sqlx.DB, collectionName string, parentID int, skip int, limit int) ([]map[string]any, error) {
+	query := `SELECT id, created_at, json(data) AS data, schema_version FROM ` + collectionName + ` WHERE parent_id = $1 AND ` + liveCondition(collectionName) + ` LIMIT $2 OFFSET $3`
+	return selectDocuments(db, collectionName, query, parentID, limit, skip)
+}
+
+func selectDocuments(db *sqlx.DB, collectionName string, query string, args ...any) ([]map[string]any, error) {
 	records := []DataTable{}
-	query := `SELECT id, created_at, json(data) AS data FROM ` + collectionName + ` LIMIT $1 OFFSET $2`
-	err := db.Select(&records, query, limit, skip)
+	err := db.Select(&records, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	documents := []map[string]any{}
 	for _, record := range records {
-		var document map[string]any
-		err = json.Unmarshal([]byte(record.Data), &document)
+		document, err := documentFromRecord(collectionName, record)
 		if err == nil {
-			document["_id"] = record.ID
-			document["_created_at"] = record.CreatedAt
 			documents = append(documents, document)
 		}
 	}
 	return documents, nil
 }
 
+func isChildDocument(db *sqlx.DB, collectionName string, parentID int, id int) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM ` + collectionName + ` WHERE id = $1 AND parent_id = $2`
+	err := db.Get(&count, query, id, parentID)
+	return count > 0, err
+}
+
+func getDocumentsByIDs(q sqlx.Queryer, collectionName string, ids []int) (map[int]map[string]any, error) {
+	documents := make(map[int]map[string]any)
+	if len(ids) == 0 {
+		return documents, nil
+	}
+	query, args, err := sqlx.In(`SELECT id, created_at, json(data) AS data, schema_version FROM `+collectionName+` WHERE id IN (?) AND `+liveCondition(collectionName), ids)
+	if err != nil {
+		return nil, err
+	}
+	records := []DataTable{}
+	err = sqlx.Select(q, &records, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		document, err := documentFromRecord(collectionName, record)
+		if err == nil {
+			documents[record.ID] = document
+		}
+	}
+	return documents, nil
+}
+
+// deleteDocument deletes a document together with its child documents and
+// attachments and applies the on_delete behaviour of every reference pointing at it in a
+// single transaction.
 func deleteDocument(db *sqlx.DB, collectionName string, id int) error {
-	query := `DELETE FROM ` + collectionName + ` WHERE id = $1`
-	_, err := db.Exec(query, id)
-	return err
+	tx, err := beginWrite(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteDocumentTx(tx, collectionName, id)
+	if err != nil {
+		return err
+	}
+	return commitWrite(tx)
 }
 
-func updateDocument(db *sqlx.DB, collectionName string, id int, document map[string]any) error {
+func deleteDocumentTx(tx *writeTx, collectionName string, id int) error {
+	references := incomingReferences(collectionName)
+	for _, reference := range references {
+		if reference.OnDelete != OnDeleteRestrict {
+			continue
+		}
+		var count int
+		query := `SELECT COUNT(*) FROM ` + reference.Collection + ` WHERE json_extract(data, $1) = $2 AND ` + liveCondition(reference.Collection)
+		err := tx.Get(&count, query, reference.JSONPath(), id)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%w by %d document(s) in %s", errReferenceRestricted, count, reference.Collection)
+		}
+	}
+
+	// The row goes first so that reference cycles stop at documents that are
+	// already deleted.
+	deleted := []string{}
+	query := `DELETE FROM ` + collectionName + ` WHERE id = $1 RETURNING json(data)`
+	err := tx.Select(&deleted, query, id)
+	if err != nil {
+		return err
+	}
+	if len(deleted) > 0 {
+		var document map[string]any
+		err = json.Unmarshal([]byte(deleted[0]), &document)
+		if err != nil {
+			return err
+		}
+		err = recordWrite(tx, EventDelete, collectionName, id, document)
+		if err != nil {
+			return err
+		}
+	}
+	err = deleteAttachmentsTx(tx, collectionName, id)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range getChildCollections(collectionName) {
+		ids := []int{}
+		query := `SELECT id FROM ` + child.Name + ` WHERE parent_id = $1`
+		err := tx.Select(&ids, query, id)
+		if err != nil {
+			return err
+		}
+		for _, childID := range ids {
+			err = deleteDocumentTx(tx, child.Name, childID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, reference := range references {
+		switch reference.OnDelete {
+		case OnDeleteCascade:
+			ids := []int{}
+			query := `SELECT id FROM ` + reference.Collection + ` WHERE json_extract(data, $1) = $2`
+			err := tx.Select(&ids, query, reference.JSONPath(), id)
+			if err != nil {
+				return err
+			}
+			for _, referencingID := range ids {
+				err = deleteDocumentTx(tx, reference.Collection, referencingID)
+				if err != nil {
+					return err
+				}
+			}
+		case OnDeleteSetNull:
+			records := []DataTable{}
+			query := `UPDATE ` + reference.Collection + ` SET data = jsonb_set(data, $1, NULL) WHERE json_extract(data, $1) = $2 RETURNING id, created_at, json(data) AS data`
+			err := tx.Select(&records, query, reference.JSONPath(), id)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				var document map[string]any
+				err = json.Unmarshal([]byte(record.Data), &document)
+				if err != nil {
+					return err
+				}
+				err = recordWrite(tx, EventUpdate, reference.Collection, record.ID, document)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func updateDocument(db sqlx.Execer, collectionName string, id int, document map[string]any) error {
 	jsonData, err := json.Marshal(document)
 	if err != nil {
 		return err
 	}
-	query := `UPDATE ` + collectionName + ` SET data = jsonb($1) WHERE id = $2`
-	_, err = db.Exec(query, jsonData, id)
+	query := `UPDATE ` + collectionName + ` SET data = jsonb($1), schema_version = $3 WHERE id = $2`
+	_, err = db.Exec(query, jsonData, id, schemaVersion(collectionName))
 	return err
 }
 
-func patchDocument(db *sqlx.DB, collectionName string, id int, updates map[string]any) error {
-	// Retrieve existing document
-	document, err := getDocument(db, collectionName, id)
+// replaceDocument replaces a stored document in a single transaction.
+func replaceDocument(db *sqlx.DB, collectionName string, id int, document map[string]any, validate documentValidator) error {
+	tx, err := beginWrite(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := getDocument(tx, collectionName, id)
 	if err != nil {
 		return err
 	}
-	for key, value := range updates {
-		document[key] = value
+	delete(current, "_id")
+	delete(current, "_created_at")
+
+	if validate != nil {
+		err = validate(tx, id, current, document)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = updateDocument(tx, collectionName, id, document)
+	if err != nil {
+		return err
+	}
+	err = recordWrite(tx, EventUpdate, collectionName, id, document)
+	if err != nil {
+		return err
+	}
+	return commitWrite(tx)
+}
+
+// peekSequenceValue returns the value nextSequenceValue will return next. In
+// a write transaction no other writer can take it in between.
+func peekSequenceValue(q sqlx.Queryer, name string) (int, error) {
+	var value int
+	query := `SELECT coalesce((SELECT value FROM _sequences WHERE name = $1), 0) + 1`
+	err := sqlx.Get(q, &value, query, name)
+	return value, err
+}
+
+// nextSequenceValue increments and returns a named counter.
+func nextSequenceValue(q sqlx.Queryer, name string) (int, error) {
+	var value int
+	query := `INSERT INTO _sequences (name, value) VALUES ($1, 1) ON CONFLICT (name) DO UPDATE SET value = value + 1 RETURNING value`
+	err := sqlx.Get(q, &value, query, name)
+	return value, err
+}
+
+// patchDocument replaces the given top level keys of a document in a single
+// transaction and returns the patched document.
+func patchDocument(db *sqlx.DB, collectionName string, id int, updates map[string]any, validate documentValidator) (map[string]any, error) {
+	return applyUpdateOperations(db, collectionName, id, setOperations(updates), validate)
+}
+
+// applyUpdateOperations runs update operators as one UPDATE statement built
+// from jsonb_set, jsonb_insert and jsonb_remove. The document is read and
+// written in the same transaction, and the transaction is rolled back when
+// the updated document does not pass validate. Fields filled in by validate
+// are written back in the same transaction.
+func applyUpdateOperations(db *sqlx.DB, collectionName string, id int, operations []updateOperation, validate documentValidator) (map[string]any, error) {
+	tx, err := beginWrite(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := getDocument(tx, collectionName, id)
+	if err != nil {
+		return nil, err
+	}
+	delete(current, "_id")
+	delete(current, "_created_at")
+	err = upgradeStoredDocument(tx, collectionName, id, current)
+	if err != nil {
+		return nil, err
 	}
-	return updateDocument(db, collectionName, id, document)
+
+	expr, args, err := buildUpdateExpression(current, operations)
+	if err != nil {
+		return nil, err
+	}
+
+	record := DataTable{}
+	query := `UPDATE ` + collectionName + ` SET data = ` + expr + ` WHERE id = ? RETURNING id, created_at, json(data) AS data`
+	err = tx.Get(&record, query, append(args, id)...)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]any
+	err = json.Unmarshal([]byte(record.Data), &document)
+	if err != nil {
+		return nil, err
+	}
+	if validate != nil {
+		updated, _ := json.Marshal(document)
+		err = validate(tx, id, current, document)
+		if err != nil {
+			return nil, err
+		}
+		// Write back fields the validator filled in.
+		validated, _ := json.Marshal(document)
+		if string(validated) != string(updated) {
+			err = updateDocument(tx, collectionName, id, document)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = recordWrite(tx, EventUpdate, collectionName, id, document)
+	if err != nil {
+		return nil, err
+	}
+	document["_id"] = record.ID
+	document["_created_at"] = record.CreatedAt
+
+	return document, commitWrite(tx)
 }
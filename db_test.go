@@ -1,14 +1,36 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/jmoiron/sqlx"
 	_ "modernc.org/sqlite"
 )
 
-func setupTestDB(t *testing.T) *sqlx.DB {
+func setupTestDB(t testing.TB) *sqlx.DB {
 	db, err := sqlx.Open("sqlite", ":memory:")
 	if err != nil {
 		t.Fatalf("Failed to open test database: %v", err)
@@ -16,6 +38,23 @@ func setupTestDB(t *testing.T) *sqlx.DB {
 	return db
 }
 
+// activateCollections makes a configuration with the given collections
+// active for the rest of the test.
+func activateCollections(t testing.TB, collections []Collection) {
+	references, err := buildReferenceCache(collections)
+	if err != nil {
+		t.Fatalf("Failed to build reference cache: %v", err)
+	}
+	loaded := &loadedConfig{
+		config:         Config{Collections: collections},
+		schemaCache:    buildSchemaCache(collections),
+		keywordCache:   buildKeywordCache(collections),
+		referenceCache: references,
+	}
+	loaded.activate()
+	t.Cleanup(func() { activeConfig.Store(nil) })
+}
+
 func TestCreateSQLDDLForCollection(t *testing.T) {
 	collectionName := "test_collection"
 	ddl := createSQLDDLForCollection(collectionName)
@@ -77,7 +116,7 @@ func TestInsertDocument(t *testing.T) {
 		"age":  30,
 	}
 
-	err = insertDocument(db, collectionName, document)
+	_, err = insertDocument(db, collectionName, document)
 	if err != nil {
 		t.Fatalf("Failed to insert document: %v", err)
 	}
@@ -109,7 +148,7 @@ func TestGetDocument(t *testing.T) {
 		"age":  25,
 	}
 
-	err = insertDocument(db, collectionName, document)
+	_, err = insertDocument(db, collectionName, document)
 	if err != nil {
 		t.Fatalf("Failed to insert document: %v", err)
 	}
@@ -150,3 +189,2805 @@ func TestGetDocumentNotFound(t *testing.T) {
 		t.Error("Expected error for non-existent document")
 	}
 }
+
+func TestApplyUpdateOperations(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collectionName := "test_collection"
+	collections := []Collection{{Name: collectionName}}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	document := map[string]any{
+		"votes": 1,
+		"tags":  []any{"a", "b", "c"},
+		"price": 10,
+		"old":   true,
+	}
+	_, err = insertDocument(db, collectionName, document)
+	if err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	operations, err := parseUpdateOperators(map[string]any{
+		"$inc":      map[string]any{"votes": 2, "stats.views": 1},
+		"$min":      map[string]any{"price": 5},
+		"$unset":    map[string]any{"old": ""},
+		"$push":     map[string]any{"tags": map[string]any{"$each": []any{"d", "e"}, "$slice": -4}},
+		"$addToSet": map[string]any{"labels": "x"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse update operators: %v", err)
+	}
+
+	updated, err := applyUpdateOperations(db, collectionName, 1, operations, nil)
+	if err != nil {
+		t.Fatalf("Failed to apply update operations: %v", err)
+	}
+
+	if updated["votes"] != float64(3) {
+		t.Errorf("Expected votes 3, got %v", updated["votes"])
+	}
+	if stats, ok := updated["stats"].(map[string]any); !ok || stats["views"] != float64(1) {
+		t.Errorf("Expected stats.views 1, got %v", updated["stats"])
+	}
+	if updated["price"] != float64(5) {
+		t.Errorf("Expected price 5, got %v", updated["price"])
+	}
+	if _, exists := updated["old"]; exists {
+		t.Error("Expected old to be removed")
+	}
+	tags, _ := json.Marshal(updated["tags"])
+	if string(tags) != `["b","c","d","e"]` {
+		t.Errorf("Expected tags [b c d e], got %s", tags)
+	}
+	labels, _ := json.Marshal(updated["labels"])
+	if string(labels) != `["x"]` {
+		t.Errorf("Expected labels [x], got %s", labels)
+	}
+
+	operations, err = parseUpdateOperators(map[string]any{
+		"$pull": map[string]any{"tags": map[string]any{"$in": []any{"b", "d"}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse update operators: %v", err)
+	}
+	updated, err = applyUpdateOperations(db, collectionName, 1, operations, nil)
+	if err != nil {
+		t.Fatalf("Failed to apply $pull: %v", err)
+	}
+	tags, _ = json.Marshal(updated["tags"])
+	if string(tags) != `["c","e"]` {
+		t.Errorf("Expected tags [c e], got %s", tags)
+	}
+}
+
+func TestApplyUpdateOperationsValidationRollback(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collectionName := "test_collection"
+	collections := []Collection{{Name: collectionName}}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	_, err = insertDocument(db, collectionName, map[string]any{"votes": 1})
+	if err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	operations, err := parseUpdateOperators(map[string]any{"$inc": map[string]any{"votes": 1}})
+	if err != nil {
+		t.Fatalf("Failed to parse update operators: %v", err)
+	}
+	reject := func(sqlx.Queryer, int, map[string]any, map[string]any) error { return errValidationFailed }
+	_, err = applyUpdateOperations(db, collectionName, 1, operations, reject)
+	if err != errValidationFailed {
+		t.Fatalf("Expected validation error, got %v", err)
+	}
+
+	document, err := getDocument(db, collectionName, 1)
+	if err != nil {
+		t.Fatalf("Failed to get document: %v", err)
+	}
+	if document["votes"] != float64(1) {
+		t.Errorf("Expected votes to stay 1, got %v", document["votes"])
+	}
+}
+
+func TestParseUpdateOperatorsConflict(t *testing.T) {
+	_, err := parseUpdateOperators(map[string]any{
+		"$set": map[string]any{"stats": map[string]any{}},
+		"$inc": map[string]any{"stats.views": 1},
+	})
+	if err == nil {
+		t.Error("Expected error for conflicting paths")
+	}
+}
+
+func TestDeleteDocumentReferences(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collections := []Collection{
+		{Name: "users"},
+		{Name: "posts", Schema: map[string]any{"properties": map[string]any{
+			"authorId": map[string]any{"type": "integer", "x-ref": map[string]any{"collection": "users", "on_delete": "cascade"}},
+		}}},
+		{Name: "comments", Schema: map[string]any{"properties": map[string]any{
+			"postId":   map[string]any{"type": "integer", "x-ref": map[string]any{"collection": "posts", "on_delete": "cascade"}},
+			"editorId": map[string]any{"type": "integer", "x-ref": map[string]any{"collection": "users", "on_delete": "set-null"}},
+		}}},
+		{Name: "tags", Schema: map[string]any{"properties": map[string]any{
+			"postId": map[string]any{"type": "integer", "x-ref": "posts"},
+		}}},
+	}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	activateCollections(t, collections)
+
+	insertDocument(db, "users", map[string]any{"name": "author"})
+	insertDocument(db, "users", map[string]any{"name": "editor"})
+	insertDocument(db, "posts", map[string]any{"authorId": 1})
+	insertDocument(db, "posts", map[string]any{"authorId": 2})
+	insertDocument(db, "comments", map[string]any{"postId": 1, "editorId": 2})
+	insertDocument(db, "tags", map[string]any{"postId": 2})
+
+	err = checkReferences(db, "posts", map[string]any{"authorId": 3})
+	if !errors.Is(err, errReferenceNotFound) {
+		t.Errorf("Expected missing reference error, got %v", err)
+	}
+
+	err = deleteDocument(db, "users", 2)
+	if !errors.Is(err, errReferenceRestricted) {
+		t.Fatalf("Expected restricted delete, got %v", err)
+	}
+
+	err = deleteDocument(db, "users", 1)
+	if err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	_, err = getDocument(db, "posts", 1)
+	if !isDocumentNotFound(err) {
+		t.Errorf("Expected post to be deleted by cascade, got %v", err)
+	}
+	_, err = getDocument(db, "comments", 1)
+	if !isDocumentNotFound(err) {
+		t.Errorf("Expected comment to be deleted by cascade, got %v", err)
+	}
+
+	deleteDocument(db, "tags", 1)
+	deleteDocument(db, "posts", 2)
+	insertDocument(db, "comments", map[string]any{"editorId": 2})
+	err = deleteDocument(db, "users", 2)
+	if err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	comment, err := getDocument(db, "comments", 2)
+	if err != nil {
+		t.Fatalf("Failed to get comment: %v", err)
+	}
+	if editorID, exists := comment["editorId"]; !exists || editorID != nil {
+		t.Errorf("Expected editorId to be set to null, got %v", comment["editorId"])
+	}
+}
+
+func TestExpandReferences(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collections := []Collection{
+		{Name: "users"},
+		{Name: "posts", Schema: map[string]any{"properties": map[string]any{
+			"meta": map[string]any{"type": "object", "properties": map[string]any{
+				"authorId": map[string]any{"type": "integer", "x-ref": "users"},
+			}},
+		}}},
+	}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	activateCollections(t, collections)
+
+	insertDocument(db, "users", map[string]any{"name": "author"})
+	insertDocument(db, "posts", map[string]any{"meta": map[string]any{"authorId": 1}})
+
+	documents, err := getAllDocuments(db, "posts", 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to get documents: %v", err)
+	}
+	err = expandReferences(db, "posts", documents, []string{"meta.authorId"})
+	if err != nil {
+		t.Fatalf("Failed to expand references: %v", err)
+	}
+	author, ok := documents[0]["meta"].(map[string]any)["authorId"].(map[string]any)
+	if !ok || author["name"] != "author" {
+		t.Errorf("Expected expanded author, got %v", documents[0]["meta"])
+	}
+}
+
+func TestChildDocuments(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collections := []Collection{
+		{Name: "posts"},
+		{Name: "comments", Parent: "posts"},
+	}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	activateCollections(t, collections)
+
+	insertDocument(db, "posts", map[string]any{"title": "first"})
+	insertDocument(db, "posts", map[string]any{"title": "second"})
+	for _, parentID := range []int{1, 1, 2} {
+		_, err = insertChildDocument(db, "comments", parentID, map[string]any{"text": "hello"})
+		if err != nil {
+			t.Fatalf("Failed to insert child document: %v", err)
+		}
+	}
+
+	documents, err := getAllChildDocuments(db, "comments", 1, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to get child documents: %v", err)
+	}
+	if len(documents) != 2 {
+		t.Errorf("Expected 2 comments for post 1, got %d", len(documents))
+	}
+	inParent, err := isChildDocument(db, "comments", 2, 1)
+	if err != nil || inParent {
+		t.Errorf("Expected comment 1 not to belong to post 2, got %v, %v", inParent, err)
+	}
+
+	err = deleteDocument(db, "posts", 1)
+	if err != nil {
+		t.Fatalf("Failed to delete parent document: %v", err)
+	}
+	var count int
+	err = db.Get(&count, "SELECT COUNT(*) FROM comments")
+	if err != nil {
+		t.Fatalf("Failed to count documents: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 remaining comment, got %d", count)
+	}
+}
+
+func TestNextSequenceValue(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	err := migrateDatabase(db, []Collection{})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	for expected := 1; expected <= 3; expected++ {
+		value, err := nextSequenceValue(db, "orders.number")
+		if err != nil {
+			t.Fatalf("Failed to get sequence value: %v", err)
+		}
+		if value != expected {
+			t.Errorf("Expected sequence value %d, got %d", expected, value)
+		}
+	}
+
+	value, err := nextSequenceValue(db, "invoices.number")
+	if err != nil || value != 1 {
+		t.Errorf("Expected independent sequence to start at 1, got %d, %v", value, err)
+	}
+}
+
+func TestSequenceSkipsInvalidDocuments(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collections := []Collection{{
+		Name:      "orders",
+		Generated: []GeneratedField{{Field: "number", Type: GeneratedSequence}},
+		Schema: map[string]any{"title": "Order", "type": "object", "required": []any{"total"},
+			"properties": map[string]any{"number": map[string]any{"type": "integer", "minimum": 1}}},
+	}}
+	loaded, err := buildLoadedConfig(Config{Collections: collections})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	err = migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	loaded.activate()
+	defer activeConfig.Store(nil)
+
+	insert := func(document map[string]any) error {
+		tx, err := beginWrite(db)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		err = prepareInsert(tx, "orders", writeContext{}, document)
+		if err != nil {
+			return err
+		}
+		_, err = insertDocumentTx(tx, "orders", 0, document)
+		if err != nil {
+			return err
+		}
+		return commitWrite(tx)
+	}
+	if err := insert(map[string]any{}); err != errValidationFailed {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+	for expected := 1; expected <= 2; expected++ {
+		document := map[string]any{"total": 10}
+		if err := insert(document); err != nil {
+			t.Fatalf("Failed to insert order: %v", err)
+		}
+		if document["number"] != expected {
+			t.Errorf("Expected order number %d, got %v", expected, document["number"])
+		}
+	}
+}
+
+func TestExpiredDocuments(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collectionName := "sessions"
+	collections := []Collection{{Name: collectionName, TTL: &CollectionTTL{Field: "expiresAt"}}}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	activateCollections(t, collections)
+
+	insertDocument(db, collectionName, map[string]any{"expiresAt": "2000-01-01T00:00:00Z"})
+	insertDocument(db, collectionName, map[string]any{"expiresAt": "2999-01-01T00:00:00Z"})
+	insertDocument(db, collectionName, map[string]any{"expiresAt": 946684800})
+	insertDocument(db, collectionName, map[string]any{"note": "never expires"})
+
+	_, err = getDocument(db, collectionName, 1)
+	if !isDocumentNotFound(err) {
+		t.Errorf("Expected expired document to be hidden, got %v", err)
+	}
+	documents, err := getAllDocuments(db, collectionName, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to get documents: %v", err)
+	}
+	if len(documents) != 2 {
+		t.Errorf("Expected 2 live documents, got %d", len(documents))
+	}
+
+	purged, err := purgeExpiredDocuments(db, collectionName, 1)
+	if err != nil {
+		t.Fatalf("Failed to purge expired documents: %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("Expected 2 purged documents, got %d", purged)
+	}
+	var count int
+	err = db.Get(&count, "SELECT COUNT(*) FROM "+collectionName)
+	if err != nil {
+		t.Fatalf("Failed to count documents: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 remaining documents, got %d", count)
+	}
+}
+
+func TestExpiredReferences(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collections := []Collection{
+		{Name: "users"},
+		{Name: "sessions", TTL: &CollectionTTL{Field: "expiresAt"}, Schema: map[string]any{"properties": map[string]any{
+			"userId": map[string]any{"type": "integer", "x-ref": "users"},
+		}}},
+		{Name: "visits", Schema: map[string]any{"properties": map[string]any{
+			"sessionId": map[string]any{"type": "integer", "x-ref": "sessions"},
+		}}},
+	}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	activateCollections(t, collections)
+
+	userID, err := insertDocument(db, "users", map[string]any{"name": "ada"})
+	if err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	sessionID, err := insertDocument(db, "sessions", map[string]any{"userId": userID, "expiresAt": "2000-01-01T00:00:00Z"})
+	if err != nil {
+		t.Fatalf("Failed to insert session: %v", err)
+	}
+
+	err = checkReferences(db, "visits", map[string]any{"sessionId": sessionID})
+	if !errors.Is(err, errReferenceNotFound) {
+		t.Errorf("Expected a reference to an expired document to be rejected, got %v", err)
+	}
+	err = deleteDocument(db, "users", userID)
+	if err != nil {
+		t.Errorf("Expected an expired document not to restrict a delete, got %v", err)
+	}
+}
+
+func TestAttachmentsDeletedWithDocument(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collectionName := "feedback"
+	err := migrateDatabase(db, []Collection{{Name: collectionName}})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	attachmentStore = sqliteAttachmentStore{}
+	defer func() { attachmentStore = nil }()
+
+	insertDocument(db, collectionName, map[string]any{"message": "broken"})
+	err = saveAttachment(db, attachmentStore, collectionName, 1, "shot.png", "image/png", []byte("content"))
+	if err != nil {
+		t.Fatalf("Failed to save attachment: %v", err)
+	}
+
+	attachments, err := getAttachments(db, collectionName, 1)
+	if err != nil || len(attachments) != 1 || attachments[0].Size != 7 {
+		t.Fatalf("Expected one attachment of 7 bytes, got %v, %v", attachments, err)
+	}
+	content, err := attachmentStore.Open(db, collectionName, 1, "shot.png")
+	if err != nil {
+		t.Fatalf("Failed to open attachment: %v", err)
+	}
+	content.Close()
+
+	err = deleteDocument(db, collectionName, 1)
+	if err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	_, err = attachmentStore.Open(db, collectionName, 1, "shot.png")
+	if err != errAttachmentNotFound {
+		t.Errorf("Expected attachment content to be deleted, got %v", err)
+	}
+	attachments, _ = getAttachments(db, collectionName, 1)
+	if len(attachments) != 0 {
+		t.Errorf("Expected attachment metadata to be deleted, got %v", attachments)
+	}
+}
+
+func TestGetAttachmentHeaders(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer testDB.Close()
+	previousDB := db
+	db = testDB
+	defer func() { db = previousDB }()
+	collections := []Collection{{
+		Name:        "feedback",
+		Public:      []string{ActionRead},
+		Schema:      map[string]any{"title": "Feedback", "type": "object"},
+		Attachments: &CollectionAttachments{},
+	}}
+	loaded, err := buildLoadedConfig(Config{Collections: collections})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	err = migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	loaded.activate()
+	defer activeConfig.Store(nil)
+	attachmentStore = sqliteAttachmentStore{}
+	defer func() { attachmentStore = nil }()
+
+	id, err := insertDocument(db, "feedback", map[string]any{"message": "broken"})
+	if err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	err = saveAttachment(db, attachmentStore, "feedback", id, "shot.png", "image/png", []byte("content"))
+	if err != nil {
+		t.Fatalf("Failed to save attachment: %v", err)
+	}
+
+	request := httptest.NewRequest("GET", "/feedback/1/_files/shot.png", nil)
+	request.SetPathValue("collection", "feedback")
+	request.SetPathValue("id", "1")
+	request.SetPathValue("name", "shot.png")
+	recorder := httptest.NewRecorder()
+	getAttachmentHandler(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "content" {
+		t.Fatalf("Expected the attachment, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	modified, err := http.ParseTime(recorder.Header().Get("Last-Modified"))
+	if err != nil || time.Since(modified) > time.Minute {
+		t.Errorf("Expected a Last-Modified header from the upload time, got %q", recorder.Header().Get("Last-Modified"))
+	}
+	if recorder.Header().Get("Content-Disposition") != `inline; filename=shot.png` || recorder.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("Expected an image to be shown inline in a sandbox, got %v", recorder.Header())
+	}
+
+	err = saveAttachment(db, attachmentStore, "feedback", id, "page.html", "text/html", []byte("<script>alert(1)</script>"))
+	if err != nil {
+		t.Fatalf("Failed to save attachment: %v", err)
+	}
+	request.SetPathValue("name", "page.html")
+	recorder = httptest.NewRecorder()
+	getAttachmentHandler(recorder, request)
+	if recorder.Header().Get("Content-Disposition") != `attachment; filename=page.html` || recorder.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("Expected HTML to be downloaded, got %v", recorder.Header())
+	}
+	modified, err = parseTimestamp("2026-01-02 03:04:05")
+	if err != nil || !modified.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Expected database timestamps to be read as UTC, got %v, %v", modified, err)
+	}
+}
+
+func TestFilesystemAttachmentsSurviveRollback(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collections := []Collection{
+		{Name: "users"},
+		{Name: "posts", Schema: map[string]any{"properties": map[string]any{
+			"authorId": map[string]any{"type": "integer", "x-ref": map[string]any{"collection": "users", "on_delete": "cascade"}},
+		}}},
+		{Name: "tags", Schema: map[string]any{"properties": map[string]any{
+			"postId": map[string]any{"type": "integer", "x-ref": "posts"},
+		}}},
+	}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	activateCollections(t, collections)
+	store, err := newAttachmentStore(AttachmentStorage{Type: AttachmentStorageFilesystem, Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create attachment store: %v", err)
+	}
+	attachmentStore = store
+	defer func() { attachmentStore = nil }()
+
+	userID, err := insertDocument(db, "users", map[string]any{"name": "author"})
+	if err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	postID, err := insertDocument(db, "posts", map[string]any{"authorId": userID})
+	if err != nil {
+		t.Fatalf("Failed to insert post: %v", err)
+	}
+	tagID, err := insertDocument(db, "tags", map[string]any{"postId": postID})
+	if err != nil {
+		t.Fatalf("Failed to insert tag: %v", err)
+	}
+	err = saveAttachment(db, store, "users", userID, "avatar.png", "image/png", []byte("content"))
+	if err != nil {
+		t.Fatalf("Failed to save attachment: %v", err)
+	}
+
+	// The cascade to the post is restricted by the tag.
+	err = deleteDocument(db, "users", userID)
+	if !errors.Is(err, errReferenceRestricted) {
+		t.Fatalf("Expected the delete to be restricted, got %v", err)
+	}
+	content, err := store.Open(db, "users", userID, "avatar.png")
+	if err != nil {
+		t.Fatalf("Expected the attachment to survive the rollback, got %v", err)
+	}
+	content.Close()
+
+	// A replacement that rolls back keeps the old content and no upload file.
+	tx, err := beginWrite(db)
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	err = saveAttachmentTx(tx, store, "users", userID, "avatar.png", "image/png", []byte("replaced"))
+	if err != nil {
+		t.Fatalf("Failed to save attachment: %v", err)
+	}
+	tx.Rollback()
+	content, err = store.Open(db, "users", userID, "avatar.png")
+	if err != nil {
+		t.Fatalf("Failed to open attachment: %v", err)
+	}
+	saved, _ := io.ReadAll(content)
+	content.Close()
+	files, _ := os.ReadDir(store.(filesystemAttachmentStore).documentDir("users", userID))
+	if string(saved) != "content" || len(files) != 1 {
+		t.Errorf("Expected a rolled back upload to leave the attachment as it was, got %q and %d files", saved, len(files))
+	}
+
+	err = deleteDocument(db, "tags", tagID)
+	if err == nil {
+		err = deleteDocument(db, "users", userID)
+	}
+	if err != nil {
+		t.Fatalf("Failed to delete documents: %v", err)
+	}
+	_, err = store.Open(db, "users", userID, "avatar.png")
+	if err != errAttachmentNotFound {
+		t.Errorf("Expected the attachment to be removed after the commit, got %v", err)
+	}
+}
+
+func TestFormSubmissions(t *testing.T) {
+	schema := map[string]any{
+		"title":    "Signup",
+		"type":     "object",
+		"required": []any{"email"},
+		"properties": map[string]any{
+			"email":      map[string]any{"type": "string"},
+			"age":        map[string]any{"type": "integer"},
+			"score":      map[string]any{"type": "number"},
+			"newsletter": map[string]any{"type": "boolean"},
+			"nickname":   map[string]any{"type": []any{"string", "null"}},
+			"tags":       map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			"ratings":    map[string]any{"type": "array", "items": map[string]any{"type": "integer"}},
+			"address": map[string]any{"type": "object", "properties": map[string]any{
+				"zip": map[string]any{"type": "integer"},
+			}},
+		},
+	}
+	document := coerceFormValues(schema, url.Values{
+		"email":        {"ada@example.com"},
+		"age":          {"36"},
+		"score":        {"4.5"},
+		"newsletter":   {"on"},
+		"nickname":     {""},
+		"tags":         {"math", "engines"},
+		"ratings[]":    {"5", "", "3"},
+		"address.zip":  {"0150"},
+		"address.city": {"Oslo"},
+		"comment":      {"first", "second"},
+	})
+	expected := map[string]any{
+		"email":      "ada@example.com",
+		"age":        int64(36),
+		"score":      4.5,
+		"newsletter": true,
+		"nickname":   "",
+		"tags":       []any{"math", "engines"},
+		"ratings":    []any{int64(5), int64(3)},
+		"address":    map[string]any{"zip": int64(150), "city": "Oslo"},
+		"comment":    "first",
+	}
+	if !reflect.DeepEqual(document, expected) {
+		t.Errorf("Expected %v, got %v", expected, document)
+	}
+
+	for _, test := range []struct {
+		schema map[string]any
+		value  string
+		result any
+		ok     bool
+	}{
+		{map[string]any{"type": "integer"}, "12", int64(12), true},
+		{map[string]any{"type": "integer"}, "twelve", "twelve", true},
+		{map[string]any{"type": "integer"}, "", nil, false},
+		{map[string]any{"type": "number"}, "1e3", 1000.0, true},
+		{map[string]any{"type": "boolean"}, "No", false, true},
+		{map[string]any{"type": "boolean"}, "maybe", "maybe", true},
+		{map[string]any{"type": "string"}, "", "", true},
+		{nil, "7", "7", true},
+	} {
+		result, ok := coerceFormScalar(test.schema, test.value)
+		if result != test.result || ok != test.ok {
+			t.Errorf("Expected %q to coerce to %v, %v under %v, got %v, %v", test.value, test.result, test.ok, test.schema, result, ok)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	redirectForm(recorder, httptest.NewRequest("POST", "/api/signups", nil), "https://example.com/failed?form=signup", "Document validation failed")
+	if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != "https://example.com/failed?error=Document+validation+failed&form=signup" {
+		t.Errorf("Expected a 303 redirect with the error, got %d to %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	testDB := setupTestDB(t)
+	defer testDB.Close()
+	previousDB := db
+	db = testDB
+	defer func() { db = previousDB }()
+	collections := []Collection{{
+		Name:   "signups",
+		Public: []string{ActionCreate},
+		Schema: schema,
+		Form:   &CollectionForm{SuccessRedirect: "https://example.com/thanks", ErrorRedirect: "https://example.com/failed"},
+	}}
+	loaded, err := buildLoadedConfig(Config{Collections: collections})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	err = migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	loaded.activate()
+	defer activeConfig.Store(nil)
+
+	for _, test := range []struct {
+		form     url.Values
+		location string
+	}{
+		{url.Values{"email": {"ada@example.com"}, "age": {"36"}}, "https://example.com/thanks"},
+		{url.Values{"age": {"36"}}, "https://example.com/failed?error=Validation+failed"},
+	} {
+		request := httptest.NewRequest("POST", "/signups", strings.NewReader(test.form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetPathValue("collection", "signups")
+		recorder := httptest.NewRecorder()
+		insertDocumentHandler(recorder, request)
+		if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != test.location {
+			t.Errorf("Expected a 303 redirect to %s, got %d to %q", test.location, recorder.Code, recorder.Header().Get("Location"))
+		}
+	}
+	stored, err := getDocument(db, "signups", 1)
+	if err != nil || stored["age"] != float64(36) {
+		t.Errorf("Expected the form submission to be stored with its age as a number, got %v, %v", stored, err)
+	}
+
+	large := strings.Repeat("a", maxFormSize)
+	multipartBody := &strings.Builder{}
+	writer := multipart.NewWriter(multipartBody)
+	writer.WriteField("email", large)
+	writer.Close()
+	for contentType, body := range map[string]string{
+		"application/x-www-form-urlencoded": "email=" + large,
+		writer.FormDataContentType():        multipartBody.String(),
+	} {
+		request := httptest.NewRequest("POST", "/signups", strings.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		request.SetPathValue("collection", "signups")
+		recorder := httptest.NewRecorder()
+		insertDocumentHandler(recorder, request)
+		if location := recorder.Header().Get("Location"); !strings.Contains(location, "error=form+too+large") {
+			t.Errorf("Expected an oversized %s form to be rejected, got %d to %q", contentType, recorder.Code, location)
+		}
+	}
+}
+
+func TestCheckSubmission(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	err := migrateDatabase(db, []Collection{{Name: "contact"}})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	err = initFormTokenSecret("secret")
+	if err != nil {
+		t.Fatalf("Failed to set form token secret: %v", err)
+	}
+
+	// Stub siteverify endpoint that accepts the response "pass"
+	captcha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		success := r.PostForm.Get("secret") == "captcha-secret" && r.PostForm.Get("response") == "pass"
+		json.NewEncoder(w).Encode(map[string]bool{"success": success})
+	}))
+	defer captcha.Close()
+
+	collection := &Collection{
+		Name: "contact",
+		Spam: &CollectionSpam{
+			HoneypotFields:   []string{"website"},
+			MinSubmitSeconds: 3,
+			RateLimit:        &SpamRateLimit{Requests: 5, Window: 60},
+			DuplicateWindow:  600,
+			Captcha:          &SpamCaptcha{VerifyURL: captcha.URL, Secret: "captcha-secret"},
+		},
+	}
+	now := time.Now()
+	token := newFormToken("contact", now.Add(-10*time.Second))
+
+	tests := []struct {
+		name     string
+		document map[string]any
+		reason   string
+	}{
+		{"honeypot", map[string]any{"message": "a", "website": "spam.example", "_form_token": token, "captcha_response": "pass"}, "Honeypot field website was filled"},
+		{"too fast", map[string]any{"message": "b", "_form_token": newFormToken("contact", now), "captcha_response": "pass"}, "Form submitted too quickly"},
+		{"captcha", map[string]any{"message": "c", "_form_token": token, "captcha_response": "fail"}, "CAPTCHA verification failed"},
+		{"accepted", map[string]any{"message": "d", "website": "", "_form_token": token, "captcha_response": "pass"}, ""},
+		{"duplicate", map[string]any{"message": "d", "_form_token": token, "captcha_response": "pass"}, "Duplicate submission"},
+		{"rate limit", map[string]any{"message": "e", "_form_token": token, "captcha_response": "pass"}, "Too many submissions"},
+	}
+	for _, test := range tests {
+		rejection, err := checkSubmission(db, collection, test.document, "192.0.2.1", now)
+		if err == nil && rejection == nil {
+			rejection, err = checkDuplicateSubmission(db, collection, test.document)
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to check submission: %v", test.name, err)
+		}
+		reason := ""
+		if rejection != nil {
+			reason = rejection.Reason
+		}
+		if reason != test.reason {
+			t.Errorf("%s: expected rejection %q, got %q", test.name, test.reason, reason)
+		}
+		if rejection != nil && rejection.Throttled != (test.name == "rate limit") {
+			t.Errorf("%s: expected only rate limited submissions to skip the quarantine", test.name)
+		}
+	}
+
+	accepted := tests[3].document
+	if len(accepted) != 1 || accepted["message"] != "d" {
+		t.Errorf("Expected spam fields to be removed, got %v", accepted)
+	}
+
+	// A submission whose insert is rolled back is not a duplicate later on.
+	tx, err := beginWrite(db)
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	rejection, err := checkDuplicateSubmission(tx, collection, map[string]any{"message": "f"})
+	tx.Rollback()
+	if err != nil || rejection != nil {
+		t.Fatalf("Expected a new submission to be accepted, got %v, %v", rejection, err)
+	}
+	rejection, err = checkDuplicateSubmission(db, collection, map[string]any{"message": "f"})
+	if err != nil || rejection != nil {
+		t.Errorf("Expected the rolled back submission to be forgotten, got %v, %v", rejection, err)
+	}
+
+	err = quarantineSubmission(db, "contact", "Duplicate submission", "192.0.2.1", map[string]any{"message": "d"})
+	if err != nil {
+		t.Fatalf("Failed to quarantine submission: %v", err)
+	}
+	submissions, err := getQuarantinedSubmissions(db, "contact", 0, 10)
+	if err != nil || len(submissions) != 1 || submissions[0].Document["message"] != "d" {
+		t.Errorf("Expected one quarantined submission, got %v, %v", submissions, err)
+	}
+
+	// The reaper drops hashes past the duplicate window and old quarantined
+	// submissions.
+	db.MustExec(`UPDATE _submission_hashes SET created_at = datetime('now', '-1 hour') WHERE hash = (SELECT min(hash) FROM _submission_hashes)`)
+	db.MustExec(`INSERT INTO _submission_hashes (collection, hash) VALUES ('removed', 'hash')`)
+	db.MustExec(`INSERT INTO _quarantine (collection, reason, client_ip, created_at, data) VALUES ('contact', 'old', '192.0.2.1', datetime('now', '-31 days'), jsonb('{}'))`)
+	pruned, err := pruneSpamRecords(db, []Collection{*collection})
+	if err != nil || pruned != 3 {
+		t.Errorf("Expected 3 pruned spam records, got %d, %v", pruned, err)
+	}
+	var hashes int
+	db.Get(&hashes, `SELECT COUNT(*) FROM _submission_hashes`)
+	submissions, _ = getQuarantinedSubmissions(db, "contact", 0, 10)
+	if hashes != 1 || len(submissions) != 1 {
+		t.Errorf("Expected recent records to be kept, got %d hashes and %d submissions", hashes, len(submissions))
+	}
+}
+
+func TestQuarantineHandler(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer testDB.Close()
+	previousDB := db
+	db = testDB
+	defer func() { db = previousDB }()
+	collections := []Collection{{Name: "contact", Public: []string{ActionAll}}}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	activateCollections(t, collections)
+	err = quarantineSubmission(db, "contact", "Duplicate submission", "192.0.2.1", map[string]any{"message": "d"})
+	if err != nil {
+		t.Fatalf("Failed to quarantine submission: %v", err)
+	}
+
+	for name, status := range map[string]int{"contact": http.StatusOK, "missing": http.StatusNotFound} {
+		request := httptest.NewRequest("GET", "/collections/"+name+"/_quarantine", nil)
+		request.SetPathValue("name", name)
+		recorder := httptest.NewRecorder()
+		getQuarantineHandler(recorder, request)
+		if recorder.Code != status {
+			t.Errorf("%s: expected status %d, got %d", name, status, recorder.Code)
+		}
+	}
+}
+
+// startSMTPStub accepts SMTP sessions on a local port and passes the data of
+// every message to the returned channel.
+func startSMTPStub(t *testing.T) (int, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			text := textproto.NewConn(conn)
+			text.PrintfLine("220 stub ESMTP")
+			for {
+				line, err := text.ReadLine()
+				if err != nil {
+					break
+				}
+				command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+				if command == "DATA" {
+					text.PrintfLine("354 go ahead")
+					data, _ := text.ReadDotBytes()
+					messages <- string(data)
+					text.PrintfLine("250 queued")
+				} else if command == "QUIT" {
+					text.PrintfLine("221 bye")
+					break
+				} else {
+					text.PrintfLine("250 ok")
+				}
+			}
+			text.Close()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, messages
+}
+
+type failingTransport struct{}
+
+func (failingTransport) Send(from string, to []string, message []byte) error {
+	return errors.New("connection refused")
+}
+
+func TestEmailNotifications(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	port, messages := startSMTPStub(t)
+	smtpConfig := &SMTPConfig{Host: "127.0.0.1", Port: port, From: "store@example.com"}
+	collections := []Collection{{
+		Name: "feedback",
+		Notifications: []CollectionNotification{{
+			Events:  []string{EventCreate},
+			Filter:  `{{ lt .rating 3.0 }}`,
+			To:      []string{"support@example.com"},
+			Subject: `Bad rating {{ .rating }} for #{{ ._id }}`,
+			Body:    `{{ .message }}`,
+		}},
+	}}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	notifications, err := buildNotificationCache(Config{SMTP: smtpConfig, Collections: collections})
+	if err != nil {
+		t.Fatalf("Failed to build notification cache: %v", err)
+	}
+	(&loadedConfig{notificationCache: notifications}).activate()
+	defer activeConfig.Store(nil)
+
+	_, err = insertDocument(db, "feedback", map[string]any{"rating": 5.0, "message": "great"})
+	if err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	_, err = insertDocument(db, "feedback", map[string]any{"rating": 1.0, "message": "broken"})
+	if err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+
+	var queued int
+	err = db.Get(&queued, `SELECT COUNT(*) FROM _email_queue`)
+	if err != nil {
+		t.Fatalf("Failed to count queued emails: %v", err)
+	}
+	if queued != 1 {
+		t.Fatalf("Expected 1 queued email, got %d", queued)
+	}
+
+	// Without smtp in the active config, emails stay queued
+	sent, err := sendActiveQueuedEmails(db, time.Now())
+	if err != nil || sent != 0 {
+		t.Fatalf("Expected no email to be sent without smtp, got %d, %v", sent, err)
+	}
+
+	// Failed sends stay queued for a later retry
+	sent, err = sendQueuedEmails(db, failingTransport{}, smtpConfig.From, time.Now())
+	if err != nil || sent != 0 {
+		t.Fatalf("Expected no email to be sent, got %d, %v", sent, err)
+	}
+	var attempts int
+	var status string
+	err = db.QueryRow(`SELECT attempts, status FROM _email_queue`).Scan(&attempts, &status)
+	if err != nil {
+		t.Fatalf("Failed to read queued email: %v", err)
+	}
+	if attempts != 1 || status != EmailPending {
+		t.Errorf("Expected a pending email after 1 attempt, got %d, %s", attempts, status)
+	}
+
+	_, err = db.Exec(`UPDATE _email_queue SET next_attempt_at = datetime('now')`)
+	if err != nil {
+		t.Fatalf("Failed to reschedule queued email: %v", err)
+	}
+	// A reload that configures smtp is picked up by the mailer
+	(&loadedConfig{config: Config{SMTP: smtpConfig}, notificationCache: notifications}).activate()
+	sent, err = sendActiveQueuedEmails(db, time.Now())
+	if err != nil || sent != 1 {
+		t.Fatalf("Expected 1 email to be sent, got %d, %v", sent, err)
+	}
+	select {
+	case message := <-messages:
+		if !strings.Contains(message, "Subject: Bad rating 1 for #2") || !strings.Contains(message, "broken") {
+			t.Errorf("Unexpected message: %s", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SMTP stub did not receive the email")
+	}
+	err = db.QueryRow(`SELECT status FROM _email_queue`).Scan(&status)
+	if err != nil {
+		t.Fatalf("Failed to read queued email: %v", err)
+	}
+	if status != EmailSent {
+		t.Errorf("Expected email to be marked sent, got %s", status)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	failures := 1
+	signatures := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("X-QuickStore-Signature") == signWebhookPayload("s3cret", body) {
+			signatures <- r.Header.Get("X-QuickStore-Event")
+		}
+	}))
+	defer receiver.Close()
+
+	collections := []Collection{{
+		Name:     "orders",
+		Webhooks: []Webhook{{Name: "shipping", Events: []string{EventCreate}, URL: receiver.URL, Secret: "s3cret"}},
+	}}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	err = syncConfigWebhooks(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to sync webhooks: %v", err)
+	}
+
+	id, _ := insertDocument(db, "orders", map[string]any{"item": "book"})
+	updateDocument(db, "orders", id, map[string]any{"item": "pen"})
+
+	deliveries, err := getWebhookDeliveries(db, "shipping", "", 0, 10)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("Expected 1 queued delivery, got %v, %v", deliveries, err)
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	delivered, err := deliverWebhooks(db, client)
+	if err != nil || delivered != 0 {
+		t.Fatalf("Expected the first attempt to fail, got %d, %v", delivered, err)
+	}
+	db.Exec(`UPDATE _webhook_deliveries SET next_attempt_at = datetime('now')`)
+	delivered, err = deliverWebhooks(db, client)
+	if err != nil || delivered != 1 {
+		t.Fatalf("Expected 1 delivered webhook, got %d, %v", delivered, err)
+	}
+	select {
+	case event := <-signatures:
+		if event != EventCreate {
+			t.Errorf("Expected a create event, got %s", event)
+		}
+	default:
+		t.Error("Expected a correctly signed request")
+	}
+
+	delivery, err := getWebhookDelivery(db, deliveries[0].ID)
+	if err != nil || delivery.Status != DeliveryDelivered || len(delivery.Log) != 2 || delivery.Log[0].StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected a delivered webhook with 2 logged attempts, got %+v, %v", delivery, err)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	err := migrateDatabase(db, []Collection{{Name: "tickets"}})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	id, _ := insertDocument(db, "tickets", map[string]any{"status": "open", "votes": 1})
+	insertDocument(db, "tickets", map[string]any{"status": "closed", "votes": 5})
+	_, err = patchDocument(db, "tickets", id, map[string]any{"votes": 4}, nil)
+	if err != nil {
+		t.Fatalf("Failed to patch document: %v", err)
+	}
+	deleteDocument(db, "tickets", id)
+
+	changes, err := getChanges(db, "tickets", 0, 100)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %v", err)
+	}
+	events := []string{}
+	for i, change := range changes {
+		if i > 0 && change.Seq <= changes[i-1].Seq {
+			t.Errorf("Expected increasing sequence numbers, got %d after %d", change.Seq, changes[i-1].Seq)
+		}
+		events = append(events, change.Event)
+	}
+	if strings.Join(events, ",") != "create,create,update,delete" {
+		t.Errorf("Unexpected events: %v", events)
+	}
+	if changes[3].Document["votes"] != 4.0 {
+		t.Errorf("Expected the deleted document in the delete event, got %v", changes[3].Document)
+	}
+
+	resumed, _ := getChanges(db, "tickets", changes[1].Seq, 100)
+	if len(resumed) != 2 || resumed[0].Seq != changes[2].Seq {
+		t.Errorf("Expected to resume after seq %d, got %v", changes[1].Seq, resumed)
+	}
+
+	filter, err := parseFilter(`{"status": "open", "votes": {"$gte": 2}}`)
+	if err != nil {
+		t.Fatalf("Failed to parse filter: %v", err)
+	}
+	matched := 0
+	for _, change := range changes {
+		if filter.Matches(change.Document) {
+			matched++
+		}
+	}
+	if matched != 2 {
+		t.Errorf("Expected the filter to match the update and delete, got %d", matched)
+	}
+
+	_, err = parseFilter(`{"votes": {"$near": 1}}`)
+	if !errors.Is(err, errInvalidFilter) {
+		t.Errorf("Expected an invalid filter error, got %v", err)
+	}
+}
+
+func TestChangesReset(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer testDB.Close()
+	previousDB := db
+	db = testDB
+	defer func() { db = previousDB }()
+	collections := []Collection{{Name: "tickets", Public: []string{ActionList, ActionRead}, Schema: map[string]any{"title": "Ticket", "type": "object"}}}
+	loaded, err := buildLoadedConfig(Config{Collections: collections})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	err = migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	loaded.activate()
+	defer activeConfig.Store(nil)
+
+	first, err := firstChangeSeq(db)
+	if err != nil || first != 1 {
+		t.Fatalf("Expected an empty change log to start at 1, got %d, %v", first, err)
+	}
+	insertDocument(db, "tickets", map[string]any{"status": "open"})
+	insertDocument(db, "tickets", map[string]any{"status": "open"})
+	_, err = pruneChanges(db, 0)
+	if err != nil {
+		t.Fatalf("Failed to prune changes: %v", err)
+	}
+	first, err = firstChangeSeq(db)
+	if err != nil || first != 3 {
+		t.Fatalf("Expected a pruned change log to start at 3, got %d, %v", first, err)
+	}
+
+	for _, test := range []struct {
+		lastEventID string
+		reset       bool
+	}{
+		{"0", true},
+		{"2", false},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		request := httptest.NewRequest("GET", "/tickets/_changes", nil).WithContext(ctx)
+		request.Header.Set("Last-Event-ID", test.lastEventID)
+		request.SetPathValue("collection", "tickets")
+		recorder := httptest.NewRecorder()
+		changesHandler(recorder, request)
+		reset := strings.Contains(recorder.Body.String(), "id: 2\nevent: reset\n")
+		if reset != test.reset {
+			t.Errorf("Last-Event-ID %s: expected reset %v, got %q", test.lastEventID, test.reset, recorder.Body.String())
+		}
+	}
+}
+
+func TestChangesTickets(t *testing.T) {
+	now := time.Now()
+	ticket := issueChangesTicket("secret", "tickets", now)
+	if token, ok := redeemChangesTicket(ticket, "tickets", now); !ok || token != "secret" {
+		t.Errorf("Expected the ticket to stand for its token, got %q, %v", token, ok)
+	}
+	if _, ok := redeemChangesTicket(ticket, "tickets", now); ok {
+		t.Error("Expected a ticket to open a single stream")
+	}
+	ticket = issueChangesTicket("secret", "tickets", now)
+	if _, ok := redeemChangesTicket(ticket, "notes", now); ok {
+		t.Error("Expected a ticket to be bound to its collection")
+	}
+	ticket = issueChangesTicket("secret", "tickets", now)
+	if _, ok := redeemChangesTicket(ticket, "tickets", now.Add(changesTicketLifetime+time.Second)); ok {
+		t.Error("Expected an expired ticket to be rejected")
+	}
+
+	request := httptest.NewRequest("GET", "/tickets/_changes?ticket=unknown", nil)
+	request.SetPathValue("collection", "tickets")
+	recorder := httptest.NewRecorder()
+	changesHandler(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown ticket to be rejected, got %d", recorder.Code)
+	}
+}
+
+func TestLiveSubscriptionDeltas(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	err := migrateDatabase(db, []Collection{{Name: "tickets"}})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	busID, events := eventBus.Subscribe()
+	defer eventBus.Unsubscribe(busID)
+
+	filter, _ := parseFilter(`{"status": "open"}`)
+	subscription := &liveSubscription{collection: "tickets", filter: filter, results: map[int]bool{}}
+
+	id, _ := insertDocument(db, "tickets", map[string]any{"status": "open"})
+	insertDocument(db, "tickets", map[string]any{"status": "closed"})
+	patchDocument(db, "tickets", id, map[string]any{"votes": 1}, nil)
+	patchDocument(db, "tickets", id, map[string]any{"status": "closed"}, nil)
+	patchDocument(db, "tickets", id, map[string]any{"status": "open"}, nil)
+	deleteDocument(db, "tickets", id)
+
+	deltas := []string{}
+	for range 6 {
+		select {
+		case event := <-events:
+			if delta, ok := subscription.apply(event); ok {
+				deltas = append(deltas, delta)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for write events, got %v", deltas)
+		}
+	}
+	if strings.Join(deltas, ",") != "added,changed,removed,added,removed" {
+		t.Errorf("Unexpected deltas: %v", deltas)
+	}
+	if len(subscription.results) != 0 {
+		t.Errorf("Expected an empty result set, got %v", subscription.results)
+	}
+}
+
+func TestWriteEventsInCommitOrder(t *testing.T) {
+	db, err := sqlx.Open("sqlite", databaseDSN(t.TempDir()+"/events.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	err = migrateDatabase(db, []Collection{{Name: "tickets"}})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	busID, events := eventBus.Subscribe()
+	defer eventBus.Unsubscribe(busID)
+
+	// Ids are assigned in commit order, so concurrent inserts must be
+	// published with increasing ids.
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for range 10 {
+				_, err := insertDocument(db, "tickets", map[string]any{"status": "open"})
+				if err != nil {
+					t.Errorf("Failed to insert document: %v", err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	previous := 0
+	for range 40 {
+		event := <-events
+		if event.ID <= previous {
+			t.Fatalf("Expected events in commit order, got %d after %d", event.ID, previous)
+		}
+		previous = event.ID
+	}
+}
+
+func TestLiveInitialDocuments(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	err := migrateDatabase(db, []Collection{{Name: "tickets"}})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	for i := range liveInitialPageSize + 10 {
+		status := "closed"
+		if i%100 == 0 {
+			status = "open"
+		}
+		_, err := insertDocument(db, "tickets", map[string]any{"status": status})
+		if err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+	}
+
+	filter, _ := parseFilter(`{"status": "open"}`)
+	documents, err := liveInitialDocuments(db, "tickets", filter)
+	if err != nil {
+		t.Fatalf("Failed to read initial documents: %v", err)
+	}
+	if len(documents) != 6 || documents[5]["_id"] != liveInitialPageSize+1 {
+		t.Errorf("Expected the open tickets of every page, got %v", documents)
+	}
+	if _, ok := documents[0]["_created_at"]; ok {
+		t.Errorf("Expected initial documents without _created_at like deltas, got %v", documents[0])
+	}
+
+	for range maxLiveInitialDocuments - liveInitialPageSize {
+		insertDocument(db, "tickets", map[string]any{"status": "closed"})
+	}
+	_, err = liveInitialDocuments(db, "tickets", nil)
+	if !errors.Is(err, errTooManyLiveDocuments) {
+		t.Errorf("Expected too many documents, got %v", err)
+	}
+}
+
+func TestSyncPullPush(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collections := []Collection{
+		{Name: "visits", Schema: map[string]any{"type": "object"}, Sync: &CollectionSync{Conflicts: SyncManual}},
+	}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	activateCollections(t, collections)
+	collection := getCollectionByName("visits")
+
+	first, _ := insertDocument(db, "visits", map[string]any{"site": "north"})
+	second, _ := insertDocument(db, "visits", map[string]any{"site": "south"})
+
+	pull, err := pullChanges(db, "visits", initialSyncCheckpoint, 1)
+	if err != nil {
+		t.Fatalf("Failed to pull changes: %v", err)
+	}
+	if len(pull.Documents) != 1 || !pull.HasMore || pull.Documents[0]["site"] != "north" {
+		t.Fatalf("Unexpected first page: %+v", pull)
+	}
+	checkpoint, err := parseSyncCheckpoint(pull.Checkpoint)
+	if err != nil {
+		t.Fatalf("Failed to parse checkpoint %q: %v", pull.Checkpoint, err)
+	}
+	pull, _ = pullChanges(db, "visits", checkpoint, 10)
+	if len(pull.Documents) != 1 || pull.HasMore || pull.Documents[0]["_id"] != second {
+		t.Fatalf("Unexpected second page: %+v", pull)
+	}
+	rev := pull.Documents[0]["_rev"].(int)
+	checkpoint, _ = parseSyncCheckpoint(pull.Checkpoint)
+
+	// A change against the current revision is applied, and the fields
+	// that pulls add are not stored with it
+	context := writeContext{Time: time.Now()}
+	pulled := pull.Documents[0]
+	pulled["done"] = true
+	result, err := pushChange(db, collection, context, SyncChange{ID: second, Rev: rev, Document: pulled})
+	if err != nil || result.Status != SyncApplied || result.Rev <= rev {
+		t.Fatalf("Expected the change to be applied, got %+v, %v", result, err)
+	}
+	var stored string
+	db.Get(&stored, `SELECT json(data) FROM visits WHERE id = $1`, second)
+	if stored != `{"done":true,"site":"south"}` {
+		t.Errorf("Expected the pulled document to be stored without its reserved fields, got %s", stored)
+	}
+
+	// A second change against the same revision conflicts
+	result, _ = pushChange(db, collection, context, SyncChange{ID: second, Rev: rev, Document: map[string]any{"site": "east"}})
+	if result.Status != SyncConflict || result.Document["done"] != true {
+		t.Errorf("Expected a conflict with the server document, got %+v", result)
+	}
+
+	collection.Sync.Conflicts = SyncServerWins
+	result, _ = pushChange(db, collection, context, SyncChange{ID: second, Rev: rev, Document: map[string]any{"site": "east"}})
+	if result.Status != SyncRejected {
+		t.Errorf("Expected the server to win, got %+v", result)
+	}
+
+	collection.Sync.Conflicts = SyncLastWriteWins
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	result, _ = pushChange(db, collection, context, SyncChange{ID: second, Rev: rev, Document: map[string]any{"site": "east"}, ModifiedAt: past})
+	if result.Status != SyncRejected {
+		t.Errorf("Expected the newer server write to win, got %+v", result)
+	}
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	result, _ = pushChange(db, collection, context, SyncChange{ID: second, Rev: rev, Document: map[string]any{"site": "east"}, ModifiedAt: future})
+	if result.Status != SyncApplied {
+		t.Errorf("Expected the newer client write to win, got %+v", result)
+	}
+
+	// Deletes are pulled as tombstones
+	collection.Sync.Conflicts = SyncClientWins
+	result, _ = pushChange(db, collection, context, SyncChange{ID: first, Rev: 0, Deleted: true})
+	if result.Status != SyncApplied {
+		t.Errorf("Expected the client to win, got %+v", result)
+	}
+	created, _ := pushChange(db, collection, context, SyncChange{Document: map[string]any{"site": "west", "_id": 7, "_rev": 3}})
+	if created.Status != SyncApplied || created.ID == 0 {
+		t.Errorf("Expected a new document, got %+v", created)
+	}
+	db.Get(&stored, `SELECT json(data) FROM visits WHERE id = $1`, created.ID)
+	if stored != `{"site":"west"}` {
+		t.Errorf("Expected a new document to be stored without reserved fields, got %s", stored)
+	}
+
+	pull, _ = pullChanges(db, "visits", checkpoint, 10)
+	if len(pull.Documents) != 3 {
+		t.Fatalf("Expected 3 changed documents, got %+v", pull.Documents)
+	}
+	if pull.Documents[0]["site"] != "east" || pull.Documents[1]["_deleted"] != true || pull.Documents[2]["_id"] != created.ID {
+		t.Errorf("Unexpected changes: %+v", pull.Documents)
+	}
+
+	// Editing a deleted document brings it back when the client wins
+	result, _ = pushChange(db, collection, context, SyncChange{ID: first, Rev: 0, Document: map[string]any{"site": "north"}})
+	document, err := getDocument(db, "visits", first)
+	if result.Status != SyncApplied || err != nil || document["site"] != "north" {
+		t.Errorf("Expected the document to be restored, got %+v, %v", result, err)
+	}
+
+	// A server timestamp that cannot be parsed is a conflict
+	collection.Sync.Conflicts = SyncLastWriteWins
+	_, err = db.Exec(`UPDATE _sync_revisions SET modified_at = 'yesterday' WHERE collection = 'visits' AND document_id = $1`, first)
+	if err != nil {
+		t.Fatalf("Failed to update revision: %v", err)
+	}
+	result, err = pushChange(db, collection, context, SyncChange{ID: first, Rev: 0, Document: map[string]any{"site": "east"}, ModifiedAt: future})
+	if err != nil || result.Status != SyncRejected {
+		t.Errorf("Expected the server to keep the document, got %+v, %v", result, err)
+	}
+
+	// A stored document that cannot be decoded fails the push instead of
+	// being replaced without its immutable fields being checked
+	_, err = db.Exec(`UPDATE visits SET data = jsonb('[1]') WHERE id = $1`, created.ID)
+	if err != nil {
+		t.Fatalf("Failed to corrupt document: %v", err)
+	}
+	_, err = pushChange(db, collection, context, SyncChange{ID: created.ID, Rev: created.Rev, Document: map[string]any{"site": "south"}})
+	if err == nil {
+		t.Error("Expected an undecodable stored document to fail the push")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer testDB.Close()
+	testDB.SetMaxOpenConns(1)
+	previousDB := db
+	db = testDB
+	defer func() { db = previousDB; activeConfig.Store(nil) }()
+
+	configFile := t.TempDir() + "/config.json"
+	writeConfig := func(content string) {
+		err := os.WriteFile(configFile, []byte(content), 0o644)
+		if err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	writeConfig(`{"host": "127.0.0.1", "port": 8080, "access_tokens": [{"name": "app", "token": "old"}],
+		"collections": [{"name": "notes", "auth": {"all": ["app"], "create": [], "read": [], "list": [], "replace": [], "patch": [], "delete": []}, "schema": {"title": "Note", "type": "object"}}]}`)
+	err := migrateDatabase(db, nil)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	loaded, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	loaded.activate()
+	err = migrateDatabase(db, loaded.config.Collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	// Rotate the token and add a collection
+	writeConfig(`{"host": "127.0.0.1", "port": 8080, "access_tokens": [{"name": "app", "token": "new"}],
+		"collections": [{"name": "notes", "auth": {"all": ["app"], "create": [], "read": [], "list": [], "replace": [], "patch": [], "delete": []}, "schema": {"title": "Note", "type": "object"}},
+			{"name": "tasks", "auth": {"all": ["app"], "create": [], "read": [], "list": [], "replace": [], "patch": [], "delete": []}, "schema": {"title": "Task", "type": "object"}}]}`)
+	err = reloadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if isAuthTokenValid("old", "notes", ActionRead) || !isAuthTokenValid("new", "tasks", ActionRead) {
+		t.Errorf("Expected the rotated token to be active")
+	}
+	if !strings.Contains(string(active().openapiSpec), "/tasks") {
+		t.Errorf("Expected the OpenAPI spec to include the new collection")
+	}
+	_, err = insertDocument(db, "tasks", map[string]any{"title": "migrated"})
+	if err != nil {
+		t.Errorf("Expected the new collection to be migrated, got %v", err)
+	}
+
+	// A bad config keeps the active one
+	writeConfig(`{"host": "127.0.0.1", "port": 8080, "access_tokens": [],
+		"collections": [{"name": "orphans", "parent": "missing", "auth": {"all": ["app"], "create": [], "read": [], "list": [], "replace": [], "patch": [], "delete": []}, "schema": {"title": "Note", "type": "object"}}]}`)
+	err = reloadConfig(configFile)
+	if err == nil {
+		t.Fatalf("Expected the invalid config to be rejected")
+	}
+	if getCollectionByName("tasks") == nil || !isAuthTokenValid("new", "tasks", ActionRead) {
+		t.Errorf("Expected the previous config to stay active")
+	}
+
+	// Bad webhooks, and webhooks clashing with ones created through the
+	// admin API, keep the active config and the stored webhooks
+	err = createWebhook(db, "ops", Webhook{Name: "api-hook", Collection: "tasks", Events: []string{EventCreate}, URL: "https://example.com/api", Source: WebhookSourceAPI})
+	if err != nil {
+		t.Fatalf("Failed to create webhook: %v", err)
+	}
+	previous := active()
+	for _, webhook := range []string{
+		`{"name": "bad", "events": ["create"], "url": "ftp://example.com"}`,
+		`{"name": "api-hook", "events": ["create"], "url": "https://example.com/config"}`,
+	} {
+		writeConfig(`{"host": "127.0.0.1", "port": 8080, "access_tokens": [{"name": "app", "token": "newer"}],
+			"collections": [{"name": "tasks", "auth": {"all": ["app"], "create": [], "read": [], "list": [], "replace": [], "patch": [], "delete": []}, "schema": {"title": "Task", "type": "object"},
+				"webhooks": [{"name": "good", "events": ["create"], "url": "https://example.com/good"}, ` + webhook + `]}]}`)
+		err = reloadConfig(configFile)
+		if err == nil {
+			t.Errorf("Expected webhook %s to be rejected", webhook)
+		}
+		if active() != previous {
+			t.Errorf("Expected the previous config to stay active after webhook %s", webhook)
+		}
+		webhooks, err := getWebhooks(db)
+		if err != nil || len(webhooks) != 1 || webhooks[0].URL != "https://example.com/api" {
+			t.Errorf("Expected the stored webhooks to be kept, got %+v, %v", webhooks, err)
+		}
+	}
+}
+
+func TestRuntimeConfigChanges(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer testDB.Close()
+	testDB.SetMaxOpenConns(1)
+	previousDB := db
+	db = testDB
+	defer func() { db = previousDB; activeConfig.Store(nil); configPath = "" }()
+
+	configPath = t.TempDir() + "/config.json"
+	err := os.WriteFile(configPath, []byte(`{"host": "127.0.0.1", "port": 8080,
+		"access_tokens": [{"name": "app", "token": "app-token"}, {"name": "ops", "token": "ops-token"}],
+		"admin_tokens": ["ops"],
+		"collections": [{"name": "notes", "auth": {"all": ["app"], "create": [], "read": [], "list": [], "replace": [], "patch": [], "delete": []}, "schema": {"title": "Note", "type": "object"}}]}`), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	err = migrateDatabase(db, nil)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	loaded, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	loaded.activate()
+
+	tasks := Collection{Name: "tasks", Auth: CollectionAuth{All: []string{"mobile"}}, Schema: map[string]any{"title": "Task", "type": "object"}}
+	orphans := Collection{Name: "orphans", Parent: "missing", Schema: map[string]any{"title": "Orphan", "type": "object"}}
+	invalid, _ := putRuntimeCollectionChange("ops", orphans)
+	err = applyRuntimeChange(invalid)
+	if !errors.Is(err, errInvalidRuntimeChange) || getCollectionByName("orphans") != nil {
+		t.Errorf("Expected a collection with an unknown parent to be rejected, got %v", err)
+	}
+	change, _ := putRuntimeCollectionChange("ops", tasks)
+	err = applyRuntimeChange(change)
+	if !errors.Is(err, errInvalidRuntimeChange) {
+		t.Errorf("Expected a collection with an unknown token to be rejected, got %v", err)
+	}
+
+	err = applyRuntimeChange(putRuntimeTokenChange("ops", "mobile", runtimeToken{Token: "mobile-token"}))
+	if err != nil {
+		t.Fatalf("Failed to add token: %v", err)
+	}
+	err = applyRuntimeChange(change)
+	if err != nil {
+		t.Fatalf("Failed to add collection: %v", err)
+	}
+	if !isAuthTokenValid("mobile-token", "tasks", ActionCreate) || !strings.Contains(string(active().openapiSpec), "/tasks") {
+		t.Errorf("Expected the new collection to be active")
+	}
+	_, err = insertDocument(db, "tasks", map[string]any{"title": "migrated"})
+	if err != nil {
+		t.Errorf("Expected the new collection to be migrated, got %v", err)
+	}
+
+	// Overrides survive a reload of the config file
+	err = reloadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if getCollectionByName("tasks") == nil || !isAuthTokenValid("mobile-token", "tasks", ActionRead) {
+		t.Errorf("Expected the runtime changes to be merged into the reloaded config")
+	}
+
+	// A token that is still used by auth rules cannot be removed
+	err = applyRuntimeChange(deleteRuntimeTokenChange("ops", "mobile"))
+	if !errors.Is(err, errInvalidRuntimeChange) || !isAuthTokenValid("mobile-token", "tasks", ActionRead) {
+		t.Errorf("Expected removing a token in use to be rejected, got %v", err)
+	}
+
+	err = applyRuntimeChange(deleteRuntimeCollectionChange("ops", "notes"))
+	if err != nil || getCollectionByName("notes") != nil {
+		t.Errorf("Expected the config file collection to be removed, got %v", err)
+	}
+
+	entries, err := getAuditEntries(db, 10)
+	if err != nil {
+		t.Fatalf("Failed to get audit log: %v", err)
+	}
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action+" "+entry.Target)
+		if entry.Actor != "ops" {
+			t.Errorf("Expected ops as actor, got %q", entry.Actor)
+		}
+	}
+	if strings.Join(actions, ",") != "collection.delete notes,collection.put tasks,token.put mobile" {
+		t.Errorf("Unexpected audit log: %v", actions)
+	}
+
+	// A collection whose webhook clashes with one created through the admin
+	// API is rejected before anything is stored
+	err = createWebhook(db, "ops", Webhook{Name: "clash", Collection: "tasks", Events: []string{EventCreate}, URL: "https://example.com/api", Source: WebhookSourceAPI})
+	if err != nil {
+		t.Fatalf("Failed to create webhook: %v", err)
+	}
+	hooked := Collection{Name: "hooked", Schema: map[string]any{"title": "Hooked", "type": "object"},
+		Webhooks: []Webhook{{Name: "clash", Events: []string{EventCreate}, URL: "https://example.com/config"}}}
+	change, _ = putRuntimeCollectionChange("ops", hooked)
+	err = applyRuntimeChange(change)
+	if !errors.Is(err, errInvalidRuntimeChange) {
+		t.Errorf("Expected the clashing webhook to be rejected, got %v", err)
+	}
+	overrides, _ := loadRuntimeOverrides(db)
+	if getCollectionByName("hooked") != nil || overrides.Collections["hooked"] != nil {
+		t.Errorf("Expected the rejected collection not to be stored or active")
+	}
+	entries, _ = getAuditEntries(db, 1)
+	if len(entries) != 1 || entries[0].Action != "webhook.create" {
+		t.Errorf("Expected no audit entry for the rejected change, got %+v", entries)
+	}
+}
+
+func TestWebhookAudit(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	err := migrateDatabase(db, nil)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	webhook := Webhook{Name: "shipping", Collection: "orders", Events: []string{EventCreate}, URL: "https://example.com/hook", Source: WebhookSourceAPI}
+	err = createWebhook(db, "ops", webhook)
+	if err != nil {
+		t.Fatalf("Failed to create webhook: %v", err)
+	}
+	err = createWebhook(db, "ops", webhook)
+	if !errors.Is(err, errWebhookExists) {
+		t.Errorf("Expected a duplicate webhook to be rejected, got %v", err)
+	}
+	err = deleteWebhook(db, "ops", "shipping")
+	if err != nil {
+		t.Fatalf("Failed to delete webhook: %v", err)
+	}
+
+	entries, err := getAuditEntries(db, 10)
+	if err != nil {
+		t.Fatalf("Failed to get audit log: %v", err)
+	}
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Actor+" "+entry.Action+" "+entry.Target)
+	}
+	if strings.Join(actions, ",") != "ops webhook.delete shipping,ops webhook.create shipping" {
+		t.Errorf("Expected an audit entry for every stored change, got %v", actions)
+	}
+}
+
+func TestSchemaVersionMigrations(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	collections := []Collection{{Name: "people", Schema: map[string]any{"type": "object"}}}
+	err := migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	activateCollections(t, collections)
+
+	first, _ := insertDocument(db, "people", map[string]any{"fullname": "Ada", "age": "36", "legacy": true})
+	second, _ := insertDocument(db, "people", map[string]any{"fullname": "Bob", "age": "unknown"})
+
+	schema := map[string]any{
+		"type":       "object",
+		"required":   []any{"name", "active"},
+		"properties": map[string]any{"age": map[string]any{"type": "integer"}},
+	}
+	next := Collection{Name: "people", Schema: schema, Versioning: &CollectionVersioning{Version: 2, Migrations: []SchemaMigration{{
+		Version: 2,
+		Steps: []MigrationStep{
+			{Op: MigrationRename, Field: "fullname", To: "name"},
+			{Op: MigrationSetDefault, Field: "active", Value: true},
+			{Op: MigrationDelete, Field: "legacy"},
+			{Op: MigrationCoerce, Field: "age", Type: "integer"},
+		},
+	}}}}
+	err = checkCollectionVersioning([]Collection{next})
+	if err != nil {
+		t.Fatalf("Expected valid versioning, got %v", err)
+	}
+	plan, err := planSchemaChange(db, next)
+	if err != nil {
+		t.Fatalf("Failed to plan schema change: %v", err)
+	}
+	if plan.Documents != 2 || plan.Outdated != 2 || plan.Failing != 1 || plan.Failures[0].ID != second {
+		t.Fatalf("Unexpected plan: %+v", plan)
+	}
+
+	collections = []Collection{next}
+	activateCollections(t, collections)
+
+	// Old documents are migrated when they are read
+	document, _ := getDocument(db, "people", first)
+	if document["name"] != "Ada" || document["fullname"] != nil || document["active"] != true || document["legacy"] != nil || document["age"] != float64(36) {
+		t.Errorf("Expected a migrated document, got %v", document)
+	}
+
+	problems, err := nonconformantDocuments(db, "people", 0, 10)
+	if err != nil || len(problems) != 1 || problems[0].ID != second || problems[0].SchemaVersion != 1 {
+		t.Fatalf("Expected the second document to be nonconformant, got %+v, %v", problems, err)
+	}
+
+	// Updates store the migrated document with the current version
+	_, err = patchDocument(db, "people", first, map[string]any{"age": 37}, nil)
+	if err != nil {
+		t.Fatalf("Failed to patch document: %v", err)
+	}
+	var version int
+	db.Get(&version, `SELECT schema_version FROM people WHERE id = $1`, first)
+	document, _ = getDocument(db, "people", first)
+	if version != 2 || document["name"] != "Ada" || document["age"] != float64(37) {
+		t.Errorf("Expected the patched document at version 2, got version %d: %v", version, document)
+	}
+
+	// Eager collections are upgraded in batches
+	collections[0].Versioning.Mode = MigrationEager
+	upgraded, err := upgradeOutdatedDocuments(db, "people", 1)
+	if err != nil || upgraded != 1 {
+		t.Fatalf("Expected one upgraded document, got %d, %v", upgraded, err)
+	}
+	db.Get(&version, `SELECT schema_version FROM people WHERE id = $1`, second)
+	if version != 2 {
+		t.Errorf("Expected the second document at version 2, got %d", version)
+	}
+
+	next.Versioning.Migrations[0].Steps[0].Op = "split"
+	if checkCollectionVersioning([]Collection{next}) == nil {
+		t.Error("Expected an unknown migration op to be rejected")
+	}
+
+	// SQL queries read stored documents, which lazy migrations leave as
+	// they are.
+	for _, step := range []MigrationStep{
+		{Op: MigrationRename, Field: "mail", To: "contact.email"},
+		{Op: MigrationDelete, Field: "contact"},
+		{Op: MigrationCoerce, Field: "teamId", Type: "integer"},
+		{Op: MigrationSetDefault, Field: "expiresAt", Value: "2999-01-01T00:00:00Z"},
+	} {
+		queried := Collection{
+			Name: "people",
+			TTL:  &CollectionTTL{Field: "expiresAt"},
+			Schema: map[string]any{"type": "object", "properties": map[string]any{
+				"teamId":  map[string]any{"type": "integer", "x-ref": "teams"},
+				"contact": map[string]any{"type": "object", "properties": map[string]any{"email": map[string]any{"type": "string", "x-unique": true}}},
+			}},
+			Versioning: &CollectionVersioning{Version: 2, Migrations: []SchemaMigration{{Version: 2, Steps: []MigrationStep{step}}}},
+		}
+		err := checkCollectionVersioning([]Collection{queried})
+		if err == nil || !strings.Contains(err.Error(), "eager") {
+			t.Errorf("Expected lazy %s of %s to be rejected, got %v", step.Op, step.Field, err)
+		}
+		queried.Versioning.Mode = MigrationEager
+		if err := checkCollectionVersioning([]Collection{queried}); err != nil {
+			t.Errorf("Expected eager %s of %s to be accepted, got %v", step.Op, step.Field, err)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	auth := CollectionAuth{All: []string{"app"}, Read: []string{"missing"}}
+	checked := Config{
+		AccessTokens: []AccessToken{{Name: "app", Token: "app-token"}, {Name: "app", Token: "other"}},
+		AdminTokens:  []string{"root"},
+		Definitions:  map[string]any{"ErrorResponse": map[string]any{"type": "object"}},
+		Collections: []Collection{
+			{Name: "notes", Auth: auth, Schema: map[string]any{"title": "Note", "type": "object"}},
+			{Name: "notes", Schema: map[string]any{"title": "Note", "type": "object"}},
+			{Name: "order", Schema: map[string]any{"type": "object"}},
+			{Name: "items", Schema: map[string]any{"title": "Item", "type": "no-such-type"}},
+		},
+	}
+	problems := strings.Join(checkConfig(checked), "\n")
+	for _, expected := range []string{
+		"access token app is defined more than once",
+		"admin_tokens: unknown access token root",
+		"collection notes: auth.read: unknown access token missing",
+		"collection notes is defined more than once",
+		`schema title "Note" is already used by collection notes`,
+		"definitions: invalid or reserved name ErrorResponse",
+		"collection order: name must start with a letter",
+		"collection order: schema needs a title",
+		"collection items: invalid schema",
+	} {
+		if !strings.Contains(problems, expected) {
+			t.Errorf("Expected problem %q, got:\n%s", expected, problems)
+		}
+	}
+
+	checked = Config{
+		AccessTokens: []AccessToken{{Name: "app", Token: "app-token"}},
+		Collections:  []Collection{{Name: "notes", Auth: CollectionAuth{All: []string{"app"}}, Schema: map[string]any{"title": "Note", "type": "object"}}},
+	}
+	if problems := checkConfig(checked); len(problems) > 0 {
+		t.Errorf("Expected a valid config, got %v", problems)
+	}
+}
+
+func TestSchemaDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	previousPath := configPath
+	configPath = dir + "/config.json"
+	defer func() { configPath = previousPath }()
+	err := os.WriteFile(dir+"/money.json", []byte(`{"definitions": {"currency": {"type": "string", "enum": ["EUR", "USD"]}},
+		"type": "object", "required": ["amount", "currency"],
+		"properties": {"amount": {"type": "number"}, "currency": {"$ref": "#/definitions/currency"}}}`), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write schema file: %v", err)
+	}
+
+	auth := CollectionAuth{All: []string{"app"}}
+	checked := Config{
+		AccessTokens: []AccessToken{{Name: "app", Token: "app-token"}},
+		Definitions: map[string]any{
+			"address": map[string]any{"type": "object", "required": []any{"city"}, "properties": map[string]any{"city": map[string]any{"type": "string"}}},
+			"parcel":  map[string]any{"type": "string"},
+		},
+		Collections: []Collection{
+			{Name: "customers", Auth: auth, Schema: map[string]any{"title": "Customer", "type": "object", "properties": map[string]any{
+				"address": map[string]any{"$ref": "#/definitions/address"},
+			}}},
+			{Name: "orders", Auth: auth, Schema: map[string]any{"title": "Order", "type": "object", "properties": map[string]any{
+				"total":    map[string]any{"$ref": "money.json"},
+				"customer": map[string]any{"$ref": "#/collections/customers", "description": "Copy of the customer"},
+			}}},
+			{Name: "shipments", Auth: auth, Schema: map[string]any{"title": "Shipment", "type": "object",
+				"definitions": map[string]any{"parcel": map[string]any{"type": "object", "properties": map[string]any{"weight": map[string]any{"type": "number"}}}},
+				"properties": map[string]any{
+					"parcel":      map[string]any{"$ref": "#/definitions/parcel"},
+					"default":     map[string]any{"$ref": "#/definitions/address"},
+					"destination": map[string]any{"$ref": "#/definitions/address", "required": []any{"zip"}, "properties": map[string]any{"zip": map[string]any{"type": "string", "default": "0000"}}},
+				}}},
+		},
+	}
+	loaded, err := buildLoadedConfig(checked)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	order := map[string]any{"total": map[string]any{"amount": 10, "currency": "EUR"}, "customer": map[string]any{"address": map[string]any{"city": "Oslo"}}}
+	if !validateJSON(order, loaded.schemaCache["orders"]) {
+		t.Errorf("Expected a valid order")
+	}
+	order["total"] = map[string]any{"amount": 10, "currency": "GBP"}
+	if validateJSON(order, loaded.schemaCache["orders"]) {
+		t.Errorf("Expected the currency of the schema file to be checked")
+	}
+	order["total"] = map[string]any{"amount": 10, "currency": "EUR"}
+	order["customer"] = map[string]any{"address": map[string]any{}}
+	if validateJSON(order, loaded.schemaCache["orders"]) {
+		t.Errorf("Expected the shared address definition to be checked")
+	}
+
+	var spec map[string]any
+	json.Unmarshal(loaded.openapiSpec, &spec)
+	schemas := spec["components"].(map[string]any)["schemas"].(map[string]any)
+	customer := schemas["Customer"].(map[string]any)["properties"].(map[string]any)["address"].(map[string]any)
+	if customer["$ref"] != "#/components/schemas/address" || schemas["address"] == nil {
+		t.Errorf("Expected the address to be a shared component, got %v", customer)
+	}
+	orderCustomer := schemas["Order"].(map[string]any)["properties"].(map[string]any)["customer"].(map[string]any)
+	if orderCustomer["description"] != "Copy of the customer" || orderCustomer["allOf"] == nil {
+		t.Errorf("Expected a ref to the Customer component, got %v", orderCustomer)
+	}
+	parcel := schemas["Shipment"].(map[string]any)["properties"].(map[string]any)["parcel"].(map[string]any)
+	if parcel["$ref"] != nil || parcel["type"] != "object" {
+		t.Errorf("Expected the parcel definition of the collection schema to win, got %v", parcel)
+	}
+	if loaded.config.Collections[0].declared().Schema["properties"].(map[string]any)["address"].(map[string]any)["$ref"] == nil {
+		t.Errorf("Expected the declared schema to be kept")
+	}
+
+	shipment := map[string]any{"parcel": map[string]any{"weight": 2}, "destination": map[string]any{"city": "Oslo", "zip": "0150"}}
+	if !validateJSON(shipment, loaded.schemaCache["shipments"]) {
+		t.Errorf("Expected a valid shipment, with the own parcel definition winning over the shared one")
+	}
+	shipment["parcel"] = map[string]any{"weight": "heavy"}
+	if validateJSON(shipment, loaded.schemaCache["shipments"]) {
+		t.Errorf("Expected the definition of the collection schema to be checked")
+	}
+	shipment["parcel"] = map[string]any{"weight": 2}
+	for _, destination := range []map[string]any{{"city": "Oslo"}, {"zip": "0150"}} {
+		shipment["destination"] = destination
+		if validateJSON(shipment, loaded.schemaCache["shipments"]) {
+			t.Errorf("Expected both the address and the keys next to its ref to be checked for %v", destination)
+		}
+	}
+	// Properties named like value keywords are schemas too
+	shipment["destination"] = map[string]any{"city": "Oslo", "zip": "0150"}
+	shipment["default"] = map[string]any{"zip": "0150"}
+	if validateJSON(shipment, loaded.schemaCache["shipments"]) {
+		t.Errorf("Expected the ref of a property called default to be resolved")
+	}
+	delete(shipment, "default")
+	defaulted := map[string]any{"destination": map[string]any{"city": "Oslo"}}
+	applySchemaDefaults(loaded.config.Collections[2].Schema, defaulted)
+	if defaulted["destination"].(map[string]any)["zip"] != "0000" {
+		t.Errorf("Expected the defaults next to a ref to be applied, got %v", defaulted)
+	}
+
+	checked.Definitions["loop"] = map[string]any{"type": "array", "items": map[string]any{"$ref": "#/definitions/loop"}}
+	checked.Collections[0].Schema["properties"].(map[string]any)["loop"] = map[string]any{"$ref": "#/definitions/loop"}
+	_, err = buildLoadedConfig(checked)
+	if err == nil || !strings.Contains(err.Error(), "recursive") {
+		t.Errorf("Expected a recursive ref to be rejected, got %v", err)
+	}
+}
+
+func TestReadConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.yaml": `host: 127.0.0.1
+port: 8080
+include:
+  - tokens.json
+  - collections/*.toml
+access_tokens:
+  - name: app
+    token: ${APP_TOKEN}
+`,
+		"tokens.json":            `{"access_tokens": [{"name": "ops", "token": "${file:` + dir + `/ops-secret}"}], "admin_tokens": ["ops"]}`,
+		"ops-secret":             "ops-token\n",
+		"collections/notes.toml": "name = \"notes\"\n[auth]\nall = [\"app\"]\ncreate = []\nread = []\nlist = []\nreplace = []\npatch = []\ndelete = []\n[schema]\ntitle = \"Note\"\ntype = \"object\"\ndescription = \"Costs $${price}\"\n",
+	}
+	os.Mkdir(dir+"/collections", 0o755)
+	for name, content := range files {
+		err := os.WriteFile(dir+"/"+name, []byte(content), 0o644)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	t.Setenv("APP_TOKEN", "app-token")
+	t.Setenv(EnvPort, "9090")
+	read, err := readConfig(dir + "/config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if read.Port != 9090 || read.Host != "127.0.0.1" {
+		t.Errorf("Expected the port from the environment, got %s:%d", read.Host, read.Port)
+	}
+	if len(read.AccessTokens) != 2 || read.AccessTokens[0].Token != "app-token" || read.AccessTokens[1].Token != "ops-token" {
+		t.Errorf("Expected interpolated tokens from both files, got %+v", read.AccessTokens)
+	}
+	if len(read.Collections) != 1 || read.Collections[0].Name != "notes" || read.Collections[0].Schema["description"] != "Costs ${price}" {
+		t.Errorf("Expected the included collection, got %+v", read.Collections)
+	}
+
+	os.Unsetenv("APP_TOKEN")
+	_, err = readConfig(dir + "/config.yaml")
+	if err == nil || !strings.Contains(err.Error(), "APP_TOKEN") {
+		t.Errorf("Expected a missing variable to be reported, got %v", err)
+	}
+}
+
+func TestSchemaDraftsAndKeywords(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	schema := map[string]any{
+		"title":                 "Contact",
+		"type":                  "object",
+		"$defs":                 map[string]any{"code": map[string]any{"type": "string", "format": "ulid"}},
+		"required":              []any{"email"},
+		"dependentRequired":     map[string]any{"phone": []any{"country"}},
+		"unevaluatedProperties": false,
+		"properties": map[string]any{
+			"email":    map[string]any{"type": "string", "x-unique": true},
+			"code":     map[string]any{"$ref": "#/$defs/code", "x-immutable": true},
+			"phone":    map[string]any{"type": "string", "format": "phone"},
+			"country":  map[string]any{"type": "string", "format": "country"},
+			"currency": map[string]any{"type": "string", "format": "currency"},
+		},
+	}
+	collections := []Collection{{Name: "contacts", Draft: Draft2020, Schema: schema}}
+	loaded, err := buildLoadedConfig(Config{Collections: collections})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	err = migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	loaded.activate()
+	defer activeConfig.Store(nil)
+
+	for _, invalid := range []map[string]any{
+		{"email": "ada@example.com", "phone": "+4930123456"},
+		{"email": "ada@example.com", "nickname": "ada"},
+		{"email": "ada@example.com", "phone": "030 123456", "country": "DE"},
+		{"email": "ada@example.com", "country": "XX"},
+		{"email": "ada@example.com", "currency": "EURO"},
+		{"email": "ada@example.com", "code": "not-a-ulid"},
+	} {
+		if err := validateDocument(db, "contacts", 0, nil, invalid); err != errValidationFailed {
+			t.Errorf("Expected %v to fail validation, got %v", invalid, err)
+		}
+	}
+
+	ada := map[string]any{"email": "ada@example.com", "phone": "+4930123456", "country": "DE", "currency": "EUR", "code": "01ARZ3NDEKTSV4RRFFQ69G5FAV"}
+	id, err := insertDocument(db, "contacts", ada)
+	if err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	err = validateDocument(db, "contacts", 0, nil, map[string]any{"email": "ada@example.com"})
+	if !errors.Is(err, errUniqueField) {
+		t.Fatalf("Expected a unique violation, got %v", err)
+	}
+	err = replaceDocument(db, "contacts", id, map[string]any{"email": "ada@example.com", "code": "01ARZ3NDEKTSV4RRFFQ69G5FAV"}, replaceValidator("contacts", writeContext{}))
+	if err != nil {
+		t.Fatalf("Expected a replace keeping the email and code, got %v", err)
+	}
+	err = replaceDocument(db, "contacts", id, map[string]any{"email": "ada@example.com", "code": "01BX5ZZKBKACTAV9WEVGEMMVRZ"}, replaceValidator("contacts", writeContext{}))
+	if !errors.Is(err, errImmutableField) {
+		t.Fatalf("Expected an immutable violation, got %v", err)
+	}
+	if _, code := validationErrorMessage(err); code != http.StatusConflict {
+		t.Fatalf("Expected status 409, got %d", code)
+	}
+
+	checked := Config{Collections: []Collection{
+		{Name: "legacy", Schema: map[string]any{"title": "Legacy", "type": "object", "unevaluatedProperties": false}},
+		{Name: "tags", Schema: map[string]any{"title": "Tag", "type": "object", "x-unique": true, "properties": map[string]any{
+			"name":  map[string]any{"type": "string", "x-searchable": true},
+			"items": map[string]any{"type": "array", "items": map[string]any{"type": "string", "x-immutable": true}},
+		}}},
+		{Name: "notes", Draft: "2030-01", Schema: map[string]any{"title": "Note", "type": "object"}},
+	}}
+	problems := strings.Join(checkConfig(checked), "\n")
+	for _, expected := range []string{
+		"collection legacy: schema /unevaluatedProperties: unsupported keyword unevaluatedProperties",
+		"collection tags: schema /x-unique: x-unique is only supported on object properties",
+		"collection tags: schema /properties/name/x-searchable: unsupported keyword x-searchable",
+		"collection tags: schema /properties/items/items/x-immutable: x-immutable is only supported on object properties",
+		"collection notes: unknown draft 2030-01",
+	} {
+		if !strings.Contains(problems, expected) {
+			t.Errorf("Expected problem %q, got:\n%s", expected, problems)
+		}
+	}
+}
+
+func TestImmutableAndWriteOnceFields(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	schema := map[string]any{
+		"title": "Order",
+		"type":  "object",
+		"properties": map[string]any{
+			"productId":   map[string]any{"type": "integer", "x-immutable": true},
+			"submittedBy": map[string]any{"type": []any{"string", "null"}, "x-write-once": true},
+			"note":        map[string]any{"type": "string"},
+		},
+	}
+	collections := []Collection{{Name: "orders", Schema: schema}}
+	loaded, err := buildLoadedConfig(Config{Collections: collections})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	err = migrateDatabase(db, collections)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	loaded.activate()
+	defer activeConfig.Store(nil)
+
+	id, err := insertDocument(db, "orders", map[string]any{"productId": 7, "submittedBy": nil, "note": "first"})
+	if err != nil {
+		t.Fatalf("Failed to insert document: %v", err)
+	}
+	context := writeContext{}
+
+	// Write-once fields may be set while they are null.
+	_, err = patchDocument(db, "orders", id, map[string]any{"submittedBy": "ada", "note": "second"}, updateValidator("orders", context))
+	if err != nil {
+		t.Fatalf("Expected the write-once field to be set, got %v", err)
+	}
+	err = replaceDocument(db, "orders", id, map[string]any{"productId": 7, "submittedBy": "ada", "note": "third"}, replaceValidator("orders", context))
+	if err != nil {
+		t.Fatalf("Expected a replace keeping the fields, got %v", err)
+	}
+
+	operations, _ := parseUpdateOperators(map[string]any{"$inc": map[string]any{"productId": 1}})
+	for name, write := range map[string]func() error{
+		"replace changing productId": func() error {
+			return replaceDocument(db, "orders", id, map[string]any{"productId": 8, "submittedBy": "ada"}, replaceValidator("orders", context))
+		},
+		"replace dropping submittedBy": func() error {
+			return replaceDocument(db, "orders", id, map[string]any{"productId": 7}, replaceValidator("orders", context))
+		},
+		"patch changing submittedBy": func() error {
+			_, err := patchDocument(db, "orders", id, map[string]any{"submittedBy": "bob"}, updateValidator("orders", context))
+			return err
+		},
+		"update incrementing productId": func() error {
+			_, err := applyUpdateOperations(db, "orders", id, operations, updateValidator("orders", context))
+			return err
+		},
+	} {
+		err := write()
+		message, code := validationErrorMessage(err)
+		if code != http.StatusConflict {
+			t.Errorf("%s: expected status 409, got %d (%v)", name, code, err)
+		}
+		if !strings.Contains(message, "productId") && !strings.Contains(message, "submittedBy") {
+			t.Errorf("%s: expected the field in %q", name, message)
+		}
+	}
+
+	document, _ := getDocument(db, "orders", id)
+	if document["productId"] != float64(7) || document["submittedBy"] != "ada" || document["note"] != "third" {
+		t.Fatalf("Expected the rejected writes to be rolled back, got %v", document)
+	}
+}
+
+func TestReadOnlyFieldsInUpdates(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	schema := map[string]any{
+		"title": "Order",
+		"type":  "object",
+		"properties": map[string]any{
+			"address": map[string]any{"type": "object", "properties": map[string]any{
+				"city":       map[string]any{"type": "string"},
+				"verifiedAt": map[string]any{"type": "string", "readOnly": true},
+			}},
+		},
+	}
+	for _, policy := range []string{ReadOnlyPolicyReject, ReadOnlyPolicyStrip} {
+		collections := []Collection{{Name: "orders", Schema: schema, ReadOnlyPolicy: policy}}
+		loaded, err := buildLoadedConfig(Config{Collections: collections})
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		err = migrateDatabase(db, collections)
+		if err != nil {
+			t.Fatalf("Failed to migrate database: %v", err)
+		}
+		loaded.activate()
+
+		id, err := insertDocument(db, "orders", map[string]any{"address": map[string]any{"city": "Oslo", "verifiedAt": "2026-01-01"}})
+		if err != nil {
+			t.Fatalf("Failed to insert document: %v", err)
+		}
+		address := map[string]any{"city": "Bergen"}
+		if policy == ReadOnlyPolicyStrip {
+			address["verifiedAt"] = "2026-02-02"
+		}
+		operations, _ := parseUpdateOperators(map[string]any{"$set": map[string]any{"address": address}})
+		operations, err = removeReadOnlyOperations("orders", operations)
+		if err != nil {
+			t.Fatalf("%s: failed to remove read-only operations: %v", policy, err)
+		}
+		document, err := applyUpdateOperations(db, "orders", id, operations, updateValidator("orders", writeContext{}))
+		if err != nil {
+			t.Fatalf("%s: failed to update document: %v", policy, err)
+		}
+		expected := map[string]any{"city": "Bergen", "verifiedAt": "2026-01-01"}
+		if !reflect.DeepEqual(document["address"], expected) {
+			t.Errorf("%s: expected the stored read-only value to be kept, got %v", policy, document["address"])
+		}
+	}
+	activeConfig.Store(nil)
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]any{"keys": []any{
+		map[string]any{"kty": "RSA", "kid": "rsa-1", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}})
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	verifier, err := newJWTVerifier(&JWTConfig{JWKSURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+	alg := jwt.SigningMethodRS256.Alg()
+	if _, err := verifier.keys.lookup("rsa-1", alg); err == nil || fetches != 0 {
+		t.Fatalf("Expected lookups not to fetch the JWKS, got %d fetches, %v", fetches, err)
+	}
+
+	now := time.Now()
+	verifier.keys.refresh(now)
+	if _, err := verifier.keys.lookup("rsa-1", alg); err != nil || fetches != 1 {
+		t.Fatalf("Expected the refreshed key, got %d fetches, %v", fetches, err)
+	}
+	verifier.keys.refresh(now.Add(time.Second))
+	if fetches != 1 {
+		t.Errorf("Expected fresh keys not to be fetched again, got %d fetches", fetches)
+	}
+
+	// Unknown keys cause a fetch, at most once a minute.
+	if _, err := verifier.keys.lookup("rsa-2", alg); err == nil {
+		t.Error("Expected an unknown key to be rejected")
+	}
+	verifier.keys.refresh(now.Add(time.Second))
+	if fetches != 1 {
+		t.Errorf("Expected no fetch within a minute, got %d fetches", fetches)
+	}
+	verifier.keys.refresh(now.Add(jwksMinRefreshPeriod + time.Second))
+	if fetches != 2 {
+		t.Errorf("Expected an unknown key to cause a fetch, got %d fetches", fetches)
+	}
+	verifier.keys.refresh(now.Add(jwksMinRefreshPeriod + 2*time.Second))
+	if fetches != 2 {
+		t.Errorf("Expected no fetch without unknown keys, got %d fetches", fetches)
+	}
+	verifier.keys.refresh(now.Add(jwksMinRefreshPeriod + jwksRefreshInterval + 2*time.Second))
+	if fetches != 3 {
+		t.Errorf("Expected stale keys to be fetched again, got %d fetches", fetches)
+	}
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	previousPath := configPath
+	configPath = dir + "/config.json"
+	defer func() { configPath = previousPath }()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecPublic, _ := ecKey.PublicKey.Bytes()
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]any{"keys": []any{
+		map[string]any{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		map[string]any{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encode(ecPublic[1:33]), "y": encode(ecPublic[33:])},
+	}})
+	err := os.WriteFile(dir+"/jwks.json", jwks, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+
+	loaded, err := buildLoadedConfig(Config{
+		AccessTokens: []AccessToken{{Name: "app", Token: "app-token"}},
+		AdminTokens:  []string{"admins"},
+		JWT: &JWTConfig{
+			Secret:   "shared-secret",
+			JWKSFile: "jwks.json",
+			Issuer:   "https://login.example.com/",
+			Audience: "quickstore",
+			Roles: []JWTRole{
+				{Name: "staff"},
+				{Name: "editors", Claim: "realm_access.roles", Value: "editor"},
+				{Name: "admins", Claim: "admin", Value: true},
+			},
+		},
+		Collections: []Collection{{
+			Name:   "articles",
+			Auth:   CollectionAuth{All: []string{"app", "editors"}, Read: []string{"staff"}},
+			Schema: map[string]any{"title": "Article", "type": "object"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	loaded.activate()
+	defer activeConfig.Store(nil)
+
+	sign := func(method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+		base := jwt.MapClaims{"sub": "user-1", "iss": "https://login.example.com/", "aud": "quickstore", "exp": time.Now().Add(time.Hour).Unix()}
+		for name, value := range claims {
+			base[name] = value
+		}
+		token := jwt.NewWithClaims(method, base)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return signed
+	}
+	editorClaims := jwt.MapClaims{"realm_access": map[string]any{"roles": []any{"viewer", "editor"}}}
+	editor := sign(jwt.SigningMethodHS256, "", []byte("shared-secret"), editorClaims)
+	reader := sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, nil)
+	ecEditor := sign(jwt.SigningMethodES256, "ec-1", ecKey, editorClaims)
+	admin := sign(jwt.SigningMethodHS256, "", []byte("shared-secret"), jwt.MapClaims{"admin": true})
+
+	for _, check := range []struct {
+		name   string
+		token  string
+		action string
+		valid  bool
+	}{
+		{"static token", "app-token", ActionDelete, true},
+		{"HS256 editor", editor, ActionDelete, true},
+		{"RS256 reader reads", reader, ActionRead, true},
+		{"RS256 reader deletes", reader, ActionDelete, false},
+		{"ES256 editor", ecEditor, ActionCreate, true},
+		{"wrong secret", sign(jwt.SigningMethodHS256, "", []byte("other"), editorClaims), ActionRead, false},
+		{"expired", sign(jwt.SigningMethodHS256, "", []byte("shared-secret"), jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), ActionRead, false},
+		{"not yet valid", sign(jwt.SigningMethodHS256, "", []byte("shared-secret"), jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()}), ActionRead, false},
+		{"wrong audience", sign(jwt.SigningMethodHS256, "", []byte("shared-secret"), jwt.MapClaims{"aud": "other"}), ActionRead, false},
+		{"wrong issuer", sign(jwt.SigningMethodHS256, "", []byte("shared-secret"), jwt.MapClaims{"iss": "https://evil.example.com/"}), ActionRead, false},
+		{"unknown key", sign(jwt.SigningMethodRS256, "rsa-2", rsaKey, nil), ActionRead, false},
+	} {
+		if isAuthTokenValid(check.token, "articles", check.action) != check.valid {
+			t.Errorf("%s: expected %s to be allowed: %v", check.name, check.action, check.valid)
+		}
+	}
+	if !isAdminTokenValid(admin) || isAdminTokenValid(editor) {
+		t.Error("Expected only the admin role to use the admin API")
+	}
+	if tokenName(reader) != "user-1" || tokenName("app-token") != "app" {
+		t.Errorf("Unexpected token names %q and %q", tokenName(reader), tokenName("app-token"))
+	}
+
+	problems := checkConfig(Config{
+		AccessTokens: []AccessToken{{Name: "app", Token: "app-token"}},
+		JWT:          &JWTConfig{Secret: "s", Roles: []JWTRole{{Name: "app"}}},
+	})
+	if len(problems) != 1 || !strings.Contains(problems[0], "role app is already defined") {
+		t.Errorf("Expected a role name conflict, got %v", problems)
+	}
+}
+
+func TestJWTSkipsArgon2Checks(t *testing.T) {
+	argon2Hash, _ := hashToken("ops-token", TokenHashArgon2id)
+	loaded, err := buildLoadedConfig(Config{
+		AccessTokens: []AccessToken{{Name: "ops", Hash: argon2Hash}},
+		JWT:          &JWTConfig{Secret: "shared-secret", Roles: []JWTRole{{Name: "users"}}},
+		Collections: []Collection{{
+			Name:   "posts",
+			Auth:   CollectionAuth{All: []string{"ops", "users"}},
+			Schema: map[string]any{"title": "Post", "type": "object"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	loaded.activate()
+	defer activeConfig.Store(nil)
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "ada", "exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("shared-secret"))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	// With every argon2id slot taken, a check that needed one would block.
+	for range cap(argon2Slots) {
+		argon2Slots <- struct{}{}
+	}
+	defer func() {
+		for range cap(argon2Slots) {
+			<-argon2Slots
+		}
+	}()
+	done := make(chan [2]bool)
+	go func() {
+		done <- [2]bool{isAuthTokenValid(signed, "posts", ActionRead), isAuthTokenValid(storedTokenPrefix+"unknown", "posts", ActionRead)}
+	}()
+	select {
+	case valid := <-done:
+		if !valid[0] || valid[1] {
+			t.Errorf("Expected the JWT to be valid and the unknown stored token not, got %v", valid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected JWTs and stored tokens not to wait for argon2id slots")
+	}
+}
+
+func TestHashedTokensAndPublicActions(t *testing.T) {
+	sha256Hash, _ := hashToken("mobile-token", TokenHashSHA256)
+	argon2Hash, _ := hashToken("ops-token", TokenHashArgon2id)
+	for _, hash := range []string{sha256Hash, argon2Hash} {
+		if _, err := parseTokenHash(hash); err != nil {
+			t.Errorf("Expected %s to parse, got %v", hash, err)
+		}
+	}
+	for _, hash := range []string{"sha256:abc", "md5:abc", "$argon2i$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA"} {
+		if _, err := parseTokenHash(hash); err == nil {
+			t.Errorf("Expected %s to be rejected", hash)
+		}
+	}
+
+	loaded, err := buildLoadedConfig(Config{
+		AccessTokens: []AccessToken{
+			{Name: "app", Token: "app-token"},
+			{Name: "mobile", Hash: sha256Hash},
+			{Name: "ops", Hash: argon2Hash},
+		},
+		Collections: []Collection{
+			{
+				Name:   "posts",
+				Public: []string{ActionRead, ActionList},
+				Auth:   CollectionAuth{All: []string{"app", "ops"}, Create: []string{"mobile"}},
+				Schema: map[string]any{"title": "Post", "type": "object"},
+			},
+			{
+				Name:       "comments",
+				Parent:     "posts",
+				ParentAuth: ParentAuthInherit,
+				Public:     []string{ActionCreate},
+				Schema:     map[string]any{"title": "Comment", "type": "object"},
+			},
+			{
+				Name:   "drafts",
+				Public: []string{ActionAll},
+				Schema: map[string]any{"title": "Draft", "type": "object"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	loaded.activate()
+	defer activeConfig.Store(nil)
+
+	for _, test := range []struct {
+		token      string
+		collection string
+		action     string
+		valid      bool
+	}{
+		{"", "posts", ActionRead, true},
+		{"", "posts", ActionCreate, false},
+		{"mobile-token", "posts", ActionCreate, true},
+		{"mobile-token", "posts", ActionDelete, false},
+		{"ops-token", "posts", ActionDelete, true},
+		{"ops-token", "posts", ActionDelete, true},
+		{"app-token", "posts", ActionPatch, true},
+		{"app-token-2", "posts", ActionPatch, false},
+		{"", "comments", ActionCreate, true},
+		{"", "comments", ActionList, true},
+		{"", "comments", ActionDelete, false},
+		{"", "drafts", ActionDelete, true},
+	} {
+		if valid := isAuthTokenValid(test.token, test.collection, test.action); valid != test.valid {
+			t.Errorf("Expected %q on %s %s to be valid=%v", test.token, test.collection, test.action, test.valid)
+		}
+	}
+	if name := tokenName("ops-token"); name != "ops" {
+		t.Errorf("Expected token name ops, got %q", name)
+	}
+
+	problems := strings.Join(checkConfig(Config{
+		AccessTokens: []AccessToken{
+			{Name: "anonymous", Token: ""},
+			{Name: "both", Token: "token", Hash: sha256Hash},
+			{Name: "broken", Hash: "sha256:xyz"},
+		},
+		Collections: []Collection{{
+			Name:   "posts",
+			Public: []string{"browse"},
+			Schema: map[string]any{"title": "Post", "type": "object"},
+		}},
+	}), "\n")
+	for _, expected := range []string{
+		"access token anonymous: token or hash is required; list actions under public to allow requests without a token",
+		"access token both: use either token or hash",
+		"access token broken: invalid sha256 hash",
+		"collection posts: public: unknown action browse",
+	} {
+		if !strings.Contains(problems, expected) {
+			t.Errorf("Expected problem %q, got:\n%s", expected, problems)
+		}
+	}
+}
+
+func TestStoredTokens(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer testDB.Close()
+	testDB.SetMaxOpenConns(1)
+	previousDB := db
+	db = testDB
+	defer func() { db = previousDB; activeConfig.Store(nil) }()
+
+	err := migrateDatabase(db, nil)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	loaded, err := buildLoadedConfig(Config{
+		AccessTokens: []AccessToken{{Name: "ops", Token: "ops-token"}},
+		AdminTokens:  []string{"ops", "partners"},
+		TokenRoles:   []string{"partners"},
+		Collections: []Collection{
+			{Name: "orders", Auth: CollectionAuth{All: []string{"partners"}}, Schema: map[string]any{"title": "Order", "type": "object"}},
+			{Name: "invoices", Auth: CollectionAuth{Read: []string{"partners"}}, Schema: map[string]any{"title": "Invoice", "type": "object"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	loaded.activate()
+
+	past := "2001-01-01T00:00:00Z"
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	for _, invalid := range []StoredToken{
+		{Role: "strangers"},
+		{Role: "partners", Scopes: []TokenScope{{Collection: "missing", Actions: []string{ActionRead}}}},
+		{Role: "partners", Scopes: []TokenScope{{Collection: "orders", Actions: []string{"browse"}}}},
+		{Role: "partners", ExpiresAt: &past},
+	} {
+		if err := checkStoredToken(&invalid, active().config); !errors.Is(err, errInvalidStoredToken) {
+			t.Errorf("Expected token %+v to be rejected, got %v", invalid, err)
+		}
+	}
+
+	full := StoredToken{Role: "partners", Description: "Acme", ExpiresAt: &future}
+	err = checkStoredToken(&full, active().config)
+	if err != nil {
+		t.Fatalf("Expected a valid token, got %v", err)
+	}
+	fullToken, err := createStoredToken(db, "ops", full)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	scopedToken, err := createStoredToken(db, "ops", StoredToken{Role: "partners", Scopes: []TokenScope{{Collection: "orders", Actions: []string{ActionRead, ActionList}}}})
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	if !strings.HasPrefix(fullToken.Token, storedTokenPrefix) || !strings.HasPrefix(fullToken.Token, fullToken.Prefix) {
+		t.Errorf("Expected a token starting with its prefix, got %q and %q", fullToken.Token, fullToken.Prefix)
+	}
+
+	for _, test := range []struct {
+		token      string
+		collection string
+		action     string
+		valid      bool
+	}{
+		{fullToken.Token, "orders", ActionDelete, true},
+		{fullToken.Token, "invoices", ActionRead, true},
+		{fullToken.Token, "invoices", ActionDelete, false},
+		{fullToken.Token, adminCollection, ActionAll, true},
+		{scopedToken.Token, "orders", ActionList, true},
+		{scopedToken.Token, "orders", ActionDelete, false},
+		{scopedToken.Token, "invoices", ActionRead, false},
+		{scopedToken.Token, adminCollection, ActionAll, false},
+		{storedTokenPrefix + "unknown", "orders", ActionRead, false},
+	} {
+		if valid := isAuthTokenValid(test.token, test.collection, test.action); valid != test.valid {
+			t.Errorf("Expected token %s on %s %s to be valid=%v", test.token[:11], test.collection, test.action, test.valid)
+		}
+	}
+	if name := tokenName(scopedToken.Token); name != scopedToken.Prefix {
+		t.Errorf("Expected the prefix as token name, got %q", name)
+	}
+
+	// Token use is written in batches.
+	err = flushTokenUsage(db)
+	if err != nil {
+		t.Fatalf("Failed to record token usage: %v", err)
+	}
+	used, err := getStoredToken(db, scopedToken.ID)
+	if err != nil || used.LastUsedAt == nil {
+		t.Errorf("Expected the last use of the token to be recorded, got %+v, %v", used, err)
+	}
+
+	// The old token keeps working during the grace period.
+	rotated, err := rotateStoredToken(db, "ops", fullToken.ID, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("Failed to rotate token: %v", err)
+	}
+	if rotated.RotatedFrom == nil || *rotated.RotatedFrom != fullToken.ID || rotated.Description != "Acme" || rotated.ExpiresAt == nil {
+		t.Errorf("Expected a replacement of token %d with its description and lifetime, got %+v", fullToken.ID, rotated)
+	}
+	if !isAuthTokenValid(fullToken.Token, "orders", ActionRead) || !isAuthTokenValid(rotated.Token, "orders", ActionRead) {
+		t.Errorf("Expected old and new token to work during the grace period")
+	}
+	_, err = rotateStoredToken(db, "ops", rotated.ID, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to rotate token: %v", err)
+	}
+	if isAuthTokenValid(rotated.Token, "orders", ActionRead) {
+		t.Errorf("Expected the token to stop working without a grace period")
+	}
+	_, err = rotateStoredToken(db, "ops", rotated.ID, time.Hour, nil)
+	if !errors.Is(err, errInactiveStoredToken) {
+		t.Errorf("Expected an expired token not to be rotated, got %v", err)
+	}
+
+	revoked, err := revokeStoredToken(db, "ops", scopedToken.ID)
+	if err != nil || !revoked {
+		t.Fatalf("Failed to revoke token: %v", err)
+	}
+	if isAuthTokenValid(scopedToken.Token, "orders", ActionRead) {
+		t.Errorf("Expected a revoked token to be rejected")
+	}
+	revoked, _ = revokeStoredToken(db, "ops", scopedToken.ID)
+	if revoked {
+		t.Errorf("Expected a token to be revoked only once")
+	}
+
+	tokens, err := getStoredTokens(db)
+	if err != nil || len(tokens) != 4 {
+		t.Fatalf("Expected 4 stored tokens, got %d, %v", len(tokens), err)
+	}
+	now := time.Now()
+	statuses := []string{tokens[0].status(now), tokens[1].status(now), tokens[2].status(now), tokens[3].status(now)}
+	if !slices.Equal(statuses, []string{"active", "revoked", "expired", "active"}) {
+		t.Errorf("Unexpected statuses %v", statuses)
+	}
+	for _, token := range tokens {
+		if token.Token != "" {
+			t.Errorf("Expected listed tokens without the token itself")
+		}
+	}
+}
+
+func TestDatabaseDSN(t *testing.T) {
+	for path, expected := range map[string]string{
+		"./quickstore.db":    "./quickstore.db?_txlock=immediate&_pragma=busy_timeout(5000)",
+		"file:x.db?mode=rwc": "file:x.db?mode=rwc&_txlock=immediate&_pragma=busy_timeout(5000)",
+		"x.db?_txlock=deferred&_pragma=busy_timeout(100)": "x.db?_txlock=deferred&_pragma=busy_timeout(100)",
+	} {
+		if dsn := databaseDSN(path); dsn != expected {
+			t.Errorf("Expected DSN %s for %s, got %s", expected, path, dsn)
+		}
+	}
+}
+
+var benchmarkSchema = map[string]any{
+	"title":    "Order",
+	"type":     "object",
+	"required": []any{"customer", "items", "status"},
+	"properties": map[string]any{
+		"customer": map[string]any{
+			"type":     "object",
+			"required": []any{"name", "email"},
+			"properties": map[string]any{
+				"name":  map[string]any{"type": "string", "minLength": 1},
+				"email": map[string]any{"type": "string", "pattern": "^[^@]+@[^@]+$"},
+			},
+		},
+		"items": map[string]any{
+			"type":     "array",
+			"minItems": 1,
+			"items": map[string]any{
+				"type":     "object",
+				"required": []any{"sku", "quantity"},
+				"properties": map[string]any{
+					"sku":      map[string]any{"type": "string"},
+					"quantity": map[string]any{"type": "integer", "minimum": 1},
+					"price":    map[string]any{"type": "number"},
+				},
+			},
+		},
+		"status": map[string]any{"type": "string", "enum": []any{"new", "paid", "shipped"}},
+		"note":   map[string]any{"type": "string", "maxLength": 500},
+	},
+}
+
+func benchmarkDocument() map[string]any {
+	return map[string]any{
+		"customer": map[string]any{"name": "Ada", "email": "ada@example.com"},
+		"items":    []any{map[string]any{"sku": "A-1", "quantity": 2, "price": 9.5}, map[string]any{"sku": "B-2", "quantity": 1}},
+		"status":   "new",
+	}
+}
+
+// BenchmarkValidate compares validating against a schema that is compiled
+// for every document with validating against the precompiled schema.
+func BenchmarkValidate(b *testing.B) {
+	document := benchmarkDocument()
+	b.Run("recompiled", func(b *testing.B) {
+		for b.Loop() {
+			schema, err := compileSchema(benchmarkSchema, DefaultDraft)
+			if err != nil || !validateJSON(document, schema) {
+				b.Fatalf("Expected a valid document, got %v", err)
+			}
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		schema, _ := compileSchema(benchmarkSchema, DefaultDraft)
+		for b.Loop() {
+			if !validateJSON(document, schema) {
+				b.Fatal("Expected a valid document")
+			}
+		}
+	})
+}
+
+// BenchmarkInsertDocuments measures validated inserts, the path of bulk
+// ingestion.
+func BenchmarkInsertDocuments(b *testing.B) {
+	collections := []Collection{{Name: "orders", Schema: benchmarkSchema}}
+	for _, mode := range []string{"recompiled", "compiled"} {
+		b.Run(mode, func(b *testing.B) {
+			testDB := setupTestDB(b)
+			defer testDB.Close()
+			testDB.SetMaxOpenConns(1)
+			err := migrateDatabase(testDB, collections)
+			if err != nil {
+				b.Fatalf("Failed to migrate database: %v", err)
+			}
+			activateCollections(b, collections)
+
+			document := benchmarkDocument()
+			for b.Loop() {
+				if mode == "recompiled" {
+					schema, err := compileSchema(benchmarkSchema, DefaultDraft)
+					if err != nil || !validateJSON(document, schema) {
+						b.Fatalf("Expected a valid document, got %v", err)
+					}
+				} else if err := validateDocument(testDB, "orders", 0, nil, document); err != nil {
+					b.Fatalf("Expected a valid document, got %v", err)
+				}
+				_, err := insertDocument(testDB, "orders", document)
+				if err != nil {
+					b.Fatalf("Failed to insert document: %v", err)
+				}
+			}
+		})
+	}
+}
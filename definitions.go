@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var definitionNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// builtinComponents are the OpenAPI component schemas of the API itself.
+var builtinComponents = []string{"ErrorResponse", "SuccessResponse", "Attachment", "UpdateOperators"}
+
+// schemaValueKeywords hold data instead of schemas, so refs are not followed
+// inside them.
+var schemaValueKeywords = []string{"enum", "const", "default", "examples"}
+
+// schemaDocument is what "#" refers to while a schema is resolved. Config
+// documents are collection schemas and config definitions, where
+// #/definitions/{name} and #/collections/{name} point into the config.
+// Schema files resolve refs within themselves.
+type schemaDocument struct {
+	name   string
+	root   any
+	dir    string
+	config bool
+}
+
+// schemaResolver replaces the $ref of collection schemas with the schemas
+// they point to. A $ref with keys next to it becomes an allOf of the
+// referenced schema and those keys, so that both apply.
+type schemaResolver struct {
+	config Config
+	dir    string
+	files  map[string]any
+	stack  []string
+}
+
+func newSchemaResolver(config Config) *schemaResolver {
+	return &schemaResolver{config: config, dir: filepath.Dir(configPath), files: make(map[string]any)}
+}
+
+// resolveCollectionSchemas returns the config with the refs of every
+// collection schema resolved. The schemas as written are kept for the
+// OpenAPI spec and the admin API.
+func resolveCollectionSchemas(config Config) (Config, error) {
+	resolver := newSchemaResolver(config)
+	config.Collections = slices.Clone(config.Collections)
+	for i, collection := range config.Collections {
+		declared := collection.declared().Schema
+		resolved, err := resolver.resolveSchema(declared)
+		if err != nil {
+			return config, fmt.Errorf("collection %s: %w", collection.Name, err)
+		}
+		config.Collections[i].Schema = resolved
+		config.Collections[i].declaredSchema = declared
+	}
+	return config, nil
+}
+
+// declared returns the collection with its schema as written.
+func (collection Collection) declared() Collection {
+	if collection.declaredSchema != nil {
+		collection.Schema = collection.declaredSchema
+	}
+	return collection
+}
+
+func (resolver *schemaResolver) resolveSchema(schema map[string]any) (map[string]any, error) {
+	if schema == nil {
+		return nil, nil
+	}
+	resolved, err := resolver.resolve(schema, schemaDocument{root: schema, dir: resolver.dir, config: true})
+	if err != nil {
+		return nil, err
+	}
+	return resolved.(map[string]any), nil
+}
+
+func (resolver *schemaResolver) resolve(value any, document schemaDocument) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		if ref, ok := value["$ref"].(string); ok {
+			return resolver.resolveRef(ref, value, document)
+		}
+		return resolveSchemaKeywords(value, func(child any) (any, error) {
+			return resolver.resolve(child, document)
+		})
+	case []any:
+		resolved := make([]any, len(value))
+		for i, child := range value {
+			var err error
+			resolved[i], err = resolver.resolve(child, document)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return resolved, nil
+	}
+	return value, nil
+}
+
+// resolveSchemaKeywords applies resolve to the values of the keywords of a
+// schema object. The keys of schemaMapKeywords are names, so a property
+// called "default" is still resolved, while the values of
+// schemaValueKeywords are kept as they are.
+func resolveSchemaKeywords(schema map[string]any, resolve func(any) (any, error)) (map[string]any, error) {
+	resolved := make(map[string]any, len(schema))
+	for key, child := range schema {
+		if slices.Contains(schemaValueKeywords, key) {
+			resolved[key] = child
+			continue
+		}
+		named, isMap := child.(map[string]any)
+		if slices.Contains(schemaMapKeywords, key) && isMap {
+			schemas := make(map[string]any, len(named))
+			for name, schema := range named {
+				var err error
+				schemas[name], err = resolve(schema)
+				if err != nil {
+					return nil, err
+				}
+			}
+			resolved[key] = schemas
+			continue
+		}
+		var err error
+		resolved[key], err = resolve(child)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
+
+func (resolver *schemaResolver) resolveRef(ref string, schema map[string]any, document schemaDocument) (any, error) {
+	target, targetDocument, err := resolver.lookup(ref, document)
+	if err != nil {
+		return nil, err
+	}
+	key := targetDocument.name + "#" + ref
+	if slices.Contains(resolver.stack, key) {
+		return nil, fmt.Errorf("$ref %q is recursive", ref)
+	}
+	resolver.stack = append(resolver.stack, key)
+	resolved, err := resolver.resolve(target, targetDocument)
+	resolver.stack = resolver.stack[:len(resolver.stack)-1]
+	if err != nil {
+		return nil, err
+	}
+
+	if len(schema) == 1 {
+		return resolved, nil
+	}
+	siblings := maps.Clone(schema)
+	delete(siblings, "$ref")
+	resolvedSiblings, err := resolver.resolve(siblings, document)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"allOf": []any{resolved, resolvedSiblings}}, nil
+}
+
+// lookup finds the schema a ref points to and the document that refs inside
+// of it are resolved against.
+func (resolver *schemaResolver) lookup(ref string, document schemaDocument) (any, schemaDocument, error) {
+	file, pointer, _ := strings.Cut(ref, "#")
+	if file != "" {
+		fileDocument, err := resolver.loadFile(file, document.dir)
+		if err != nil {
+			return nil, schemaDocument{}, err
+		}
+		target, err := resolvePointer(fileDocument.root, pointer)
+		if err != nil {
+			return nil, schemaDocument{}, fmt.Errorf("$ref %q: %w", ref, err)
+		}
+		return target, fileDocument, nil
+	}
+
+	if document.config {
+		segments := strings.SplitN(strings.TrimPrefix(pointer, "/"), "/", 3)
+		if len(segments) >= 2 && (segments[0] == "definitions" || segments[0] == "collections") {
+			var root any
+			if segments[0] == "definitions" {
+				name := unescapePointer(segments[1])
+				definition, ok := resolver.config.Definitions[name]
+				if !ok || hasOwnDefinition(document.root, name) {
+					// A schema may have definitions of its own, which win
+					// over config definitions of the same name.
+					target, err := resolvePointer(document.root, pointer)
+					if err != nil {
+						return nil, schemaDocument{}, fmt.Errorf("$ref %q: unknown definition", ref)
+					}
+					return target, document, nil
+				}
+				root = definition
+			} else {
+				collection := getCollectionFrom(resolver.config.Collections, unescapePointer(segments[1]))
+				if collection == nil {
+					return nil, schemaDocument{}, fmt.Errorf("$ref %q: unknown collection", ref)
+				}
+				root = collection.declared().Schema
+			}
+			rest := ""
+			if len(segments) == 3 {
+				rest = "/" + segments[2]
+			}
+			target, err := resolvePointer(root, rest)
+			if err != nil {
+				return nil, schemaDocument{}, fmt.Errorf("$ref %q: %w", ref, err)
+			}
+			return target, schemaDocument{root: root, dir: document.dir, config: true}, nil
+		}
+	}
+	target, err := resolvePointer(document.root, pointer)
+	if err != nil {
+		return nil, schemaDocument{}, fmt.Errorf("$ref %q: %w", ref, err)
+	}
+	return target, document, nil
+}
+
+// hasOwnDefinition reports whether a schema defines name in its own
+// definitions.
+func hasOwnDefinition(root any, name string) bool {
+	schema, _ := root.(map[string]any)
+	definitions, _ := schema["definitions"].(map[string]any)
+	_, ok := definitions[name]
+	return ok
+}
+
+// loadFile reads a schema file. Files are looked up relative to the
+// document that refers to them and have to be below the config directory.
+func (resolver *schemaResolver) loadFile(file string, dir string) (schemaDocument, error) {
+	if strings.Contains(file, "://") || filepath.IsAbs(file) {
+		return schemaDocument{}, fmt.Errorf("$ref %q: only schema files next to the config are supported", file)
+	}
+	path := filepath.Join(dir, file)
+	relative, err := filepath.Rel(resolver.dir, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return schemaDocument{}, fmt.Errorf("$ref %q: only schema files next to the config are supported", file)
+	}
+	root, ok := resolver.files[path]
+	if !ok {
+		root, err = decodeConfigFile(path)
+		if err != nil {
+			return schemaDocument{}, fmt.Errorf("$ref %q: %w", file, err)
+		}
+		resolver.files[path] = root
+	}
+	return schemaDocument{name: path, root: root, dir: filepath.Dir(path)}, nil
+}
+
+// resolvePointer follows a JSON pointer like /properties/address.
+func resolvePointer(root any, pointer string) (any, error) {
+	if pointer == "" || pointer == "/" {
+		return root, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("invalid JSON pointer")
+	}
+	current := root
+	for _, segment := range strings.Split(pointer[1:], "/") {
+		segment = unescapePointer(segment)
+		switch value := current.(type) {
+		case map[string]any:
+			child, ok := value[segment]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", segment)
+			}
+			current = child
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(value) {
+				return nil, fmt.Errorf("%s not found", segment)
+			}
+			current = value[index]
+		default:
+			return nil, fmt.Errorf("%s not found", segment)
+		}
+	}
+	return current, nil
+}
+
+func unescapePointer(segment string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+}
+
+// componentSchema prepares a schema as written for the OpenAPI spec. Refs to
+// config definitions and collections become refs to their component
+// schemas, and all other refs are resolved.
+func (resolver *schemaResolver) componentSchema(value any, document schemaDocument) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		if ref, ok := value["$ref"].(string); ok {
+			component, ok := resolver.componentRef(ref, document)
+			if !ok {
+				return resolver.resolve(value, document)
+			}
+			if len(value) == 1 {
+				return map[string]any{"$ref": component}, nil
+			}
+			// OpenAPI 3.0 ignores keys next to $ref.
+			siblings := maps.Clone(value)
+			delete(siblings, "$ref")
+			schema, err := resolver.componentSchema(siblings, document)
+			if err != nil {
+				return nil, err
+			}
+			schema.(map[string]any)["allOf"] = []any{map[string]any{"$ref": component}}
+			return schema, nil
+		}
+		return resolveSchemaKeywords(value, func(child any) (any, error) {
+			return resolver.componentSchema(child, document)
+		})
+	case []any:
+		schema := make([]any, len(value))
+		for i, child := range value {
+			var err error
+			schema[i], err = resolver.componentSchema(child, document)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return schema, nil
+	}
+	return value, nil
+}
+
+// componentRef returns the component a ref to a whole config definition or
+// collection schema is emitted as. Refs to the own definitions of the
+// document are resolved instead, as lookup does.
+func (resolver *schemaResolver) componentRef(ref string, document schemaDocument) (string, bool) {
+	if name, ok := strings.CutPrefix(ref, "#/definitions/"); ok && !strings.Contains(name, "/") {
+		name = unescapePointer(name)
+		if _, exists := resolver.config.Definitions[name]; exists && !hasOwnDefinition(document.root, name) {
+			return "#/components/schemas/" + name, true
+		}
+	}
+	if name, ok := strings.CutPrefix(ref, "#/collections/"); ok && !strings.Contains(name, "/") {
+		collection := getCollectionFrom(resolver.config.Collections, unescapePointer(name))
+		if collection != nil {
+			if title, ok := collection.Schema["title"].(string); ok {
+				return "#/components/schemas/" + title, true
+			}
+		}
+	}
+	return "", false
+}
+
+// schemaProperties returns the properties of an object schema, including
+// those of its allOf schemas, which is what a $ref with keys next to it
+// resolves to. Each property is flattened with flattenSchema.
+func schemaProperties(schema map[string]any) map[string]any {
+	properties, _ := schema["properties"].(map[string]any)
+	allOf, _ := schema["allOf"].([]any)
+	if len(allOf) == 0 && properties == nil {
+		return nil
+	}
+	merged := make(map[string]any, len(properties))
+	for name, property := range properties {
+		merged[name] = flattenSchema(property)
+	}
+	for _, item := range allOf {
+		subschema, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		for name, property := range schemaProperties(subschema) {
+			merged[name] = mergeSchemas(merged[name], property)
+		}
+	}
+	return merged
+}
+
+// flattenSchema folds the keys of the allOf schemas of a schema into it, so
+// that walks over the properties see keywords like x-unique or readOnly
+// wherever they were declared. Keys of the schema itself win.
+func flattenSchema(value any) any {
+	schema, ok := value.(map[string]any)
+	if !ok {
+		return value
+	}
+	allOf, _ := schema["allOf"].([]any)
+	if len(allOf) == 0 {
+		return schema
+	}
+	var flattened any = schema
+	for _, item := range allOf {
+		flattened = mergeSchemas(flattened, flattenSchema(item))
+	}
+	return flattened
+}
+
+// mergeSchemas combines two declarations of the same value. Keys of the
+// first declaration win, except for properties, which are merged.
+func mergeSchemas(first any, second any) any {
+	firstSchema, firstOK := first.(map[string]any)
+	secondSchema, secondOK := second.(map[string]any)
+	if !firstOK || !secondOK {
+		if first == nil {
+			return second
+		}
+		return first
+	}
+	merged := maps.Clone(firstSchema)
+	for key, value := range secondSchema {
+		if _, exists := merged[key]; !exists {
+			merged[key] = value
+		}
+	}
+	firstProperties, _ := firstSchema["properties"].(map[string]any)
+	secondProperties, _ := secondSchema["properties"].(map[string]any)
+	properties := maps.Clone(firstProperties)
+	for name, property := range secondProperties {
+		if properties == nil {
+			properties = make(map[string]any)
+		}
+		properties[name] = mergeSchemas(properties[name], property)
+	}
+	if properties != nil {
+		merged["properties"] = properties
+	}
+	return merged
+}
+
+func getCollectionFrom(collections []Collection, collectionName string) *Collection {
+	index := slices.IndexFunc(collections, func(c Collection) bool { return c.Name == collectionName })
+	if index < 0 {
+		return nil
+	}
+	return &collections[index]
+}
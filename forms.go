@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxFormMemory = 32 << 20
+
+// maxFormSize bounds the body of a form post. Forms with file uploads may
+// be larger by the attachment size limit of the collection.
+const maxFormSize = 1 << 20
+
+var (
+	errInvalidForm  = errors.New("invalid form")
+	errFormTooLarge = errors.New("form too large")
+)
+
+// CollectionForm configures HTML form submissions. Form posts are answered
+// with 303 See Other redirects when the URLs are set.
+type CollectionForm struct {
+	SuccessRedirect string `json:"success_redirect"`
+	ErrorRedirect   string `json:"error_redirect"`
+}
+
+// formUpload is a file part of a multipart form that is stored as an
+// attachment of the new document.
+type formUpload struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+func isFormRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data"
+}
+
+// decodeFormDocument builds a document from an urlencoded or multipart form.
+// Values are coerced to the types the collection schema declares, dotted
+// keys build nested objects and repeated keys build arrays. File parts are
+// returned as uploads for collections with attachments.
+func decodeFormDocument(w http.ResponseWriter, r *http.Request, collection *Collection) (map[string]any, []formUpload, error) {
+	maxSize := int64(maxFormSize)
+	if collection.Attachments != nil {
+		maxSize += collection.Attachments.maxSize()
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var files map[string][]*multipart.FileHeader
+	var err error
+	if mediaType == "multipart/form-data" {
+		err = r.ParseMultipartForm(maxFormMemory)
+	} else {
+		err = r.ParseForm()
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, nil, fmt.Errorf("%w: the limit is %d bytes", errFormTooLarge, tooLarge.Limit)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidForm, err)
+	}
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File
+	}
+
+	document := coerceFormValues(collection.Schema, r.PostForm)
+
+	uploads := []formUpload{}
+	for field, headers := range files {
+		if collection.Attachments == nil {
+			return nil, nil, fmt.Errorf("%w: file uploads are not enabled", errInvalidForm)
+		}
+		for _, header := range headers {
+			upload, err := readFormUpload(collection.Attachments, field, header)
+			if err != nil {
+				return nil, nil, err
+			}
+			uploads = append(uploads, upload)
+		}
+	}
+	return document, uploads, nil
+}
+
+func coerceFormValues(schema map[string]any, values url.Values) map[string]any {
+	document := map[string]any{}
+	for key, fieldValues := range values {
+		path := strings.Split(strings.TrimSuffix(key, "[]"), ".")
+		propertySchema := schemaAtPath(schema, path)
+		value, ok := coerceFormValue(propertySchema, fieldValues)
+		if !ok {
+			continue
+		}
+		object := document
+		for _, segment := range path[:len(path)-1] {
+			child, isObject := object[segment].(map[string]any)
+			if !isObject {
+				child = map[string]any{}
+				object[segment] = child
+			}
+			object = child
+		}
+		object[path[len(path)-1]] = value
+	}
+	return document
+}
+
+func schemaAtPath(schema map[string]any, path []string) map[string]any {
+	for _, segment := range path {
+		properties := schemaProperties(schema)
+		schema, _ = properties[segment].(map[string]any)
+	}
+	return schema
+}
+
+// schemaType returns the declared type of a schema, ignoring "null" in a
+// list of types.
+func schemaType(schema map[string]any) string {
+	switch declared := schema["type"].(type) {
+	case string:
+		return declared
+	case []any:
+		for _, candidate := range declared {
+			if name, ok := candidate.(string); ok && name != "null" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// coerceFormValue converts the submitted strings of one field. Empty values
+// of non-string fields are dropped so that schema defaults apply. Values
+// that cannot be converted are kept as strings and left to validation.
+func coerceFormValue(schema map[string]any, values []string) (any, bool) {
+	if schemaType(schema) == "array" {
+		itemSchema, _ := schema["items"].(map[string]any)
+		items := []any{}
+		for _, value := range values {
+			if item, ok := coerceFormScalar(itemSchema, value); ok {
+				items = append(items, item)
+			}
+		}
+		return items, true
+	}
+	if len(values) == 0 {
+		return nil, false
+	}
+	return coerceFormScalar(schema, values[0])
+}
+
+func coerceFormScalar(schema map[string]any, value string) (any, bool) {
+	fieldType := schemaType(schema)
+	if value == "" && fieldType != "" && fieldType != "string" {
+		return nil, false
+	}
+	switch fieldType {
+	case "integer":
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n, true
+		}
+	case "number":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f, true
+		}
+	case "boolean":
+		switch strings.ToLower(value) {
+		case "true", "on", "yes", "1":
+			return true, true
+		case "false", "off", "no", "0":
+			return false, true
+		}
+	}
+	return value, true
+}
+
+var unsafeFileNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func readFormUpload(settings *CollectionAttachments, field string, header *multipart.FileHeader) (formUpload, error) {
+	name := strings.TrimLeft(unsafeFileNameCharacters.ReplaceAllString(filepath.Base(header.Filename), "_"), ".")
+	if !isAttachmentNameValid(name) {
+		name = field
+	}
+	if header.Size > settings.maxSize() {
+		return formUpload{}, fmt.Errorf("%w: %s", errAttachmentTooLarge, name)
+	}
+	file, err := header.Open()
+	if err != nil {
+		return formUpload{}, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return formUpload{}, err
+	}
+	contentType := attachmentContentType(content, header.Header.Get("Content-Type"), name)
+	if !isAttachmentTypeAllowed(settings, contentType) {
+		return formUpload{}, fmt.Errorf("%w: content type %s is not allowed", errInvalidForm, contentType)
+	}
+	return formUpload{Name: name, ContentType: contentType, Content: content}, nil
+}
+
+// redirectForm answers a form post with 303 See Other. Errors are passed to
+// the error page in the error query parameter.
+func redirectForm(w http.ResponseWriter, r *http.Request, target string, message string) {
+	if message != "" {
+		if redirectURL, err := url.Parse(target); err == nil {
+			query := redirectURL.Query()
+			query.Set("error", message)
+			redirectURL.RawQuery = query.Encode()
+			target = redirectURL.String()
+		}
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	GeneratedTimestamp = "timestamp"
+	GeneratedTokenName = "token_name"
+	GeneratedClientIP  = "client_ip"
+	GeneratedSlug      = "slug"
+	GeneratedSequence  = "sequence"
+)
+
+const (
+	GenerateOnCreate = "create"
+	GenerateOnWrite  = "write"
+)
+
+const (
+	ReadOnlyPolicyReject = "reject"
+	ReadOnlyPolicyStrip  = "strip"
+)
+
+var errReadOnlyField = errors.New("field is read-only")
+
+// GeneratedField is a top level document field the server fills in on write.
+type GeneratedField struct {
+	Field string `json:"field"`
+	Type  string `json:"type"`
+	From  string `json:"from"`
+	On    string `json:"on"`
+}
+
+// writeContext carries the request details generated fields are built from.
+type writeContext struct {
+	TokenName string
+	ClientIP  string
+	Time      time.Time
+}
+
+func newWriteContext(r *http.Request) writeContext {
+	return writeContext{
+		TokenName: tokenName(getAuthTokenFromRequest(r)),
+		ClientIP:  clientIP(r),
+		Time:      time.Now().UTC(),
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func checkGeneratedFields(collections []Collection) error {
+	types := []string{GeneratedTimestamp, GeneratedTokenName, GeneratedClientIP, GeneratedSlug, GeneratedSequence}
+	for _, collection := range collections {
+		for _, generated := range collection.Generated {
+			if !slices.Contains(types, generated.Type) {
+				return fmt.Errorf("collection %s: field %s has unknown generated type %q", collection.Name, generated.Field, generated.Type)
+			}
+			if generated.Type == GeneratedSlug && generated.From == "" {
+				return fmt.Errorf("collection %s: slug field %s needs a from field", collection.Name, generated.Field)
+			}
+			if generated.On != "" && generated.On != GenerateOnCreate && generated.On != GenerateOnWrite {
+				return fmt.Errorf("collection %s: field %s has unknown on %q", collection.Name, generated.Field, generated.On)
+			}
+		}
+	}
+	return nil
+}
+
+func (generated GeneratedField) onWrite() bool {
+	return generated.On == GenerateOnWrite && generated.Type != GeneratedSequence
+}
+
+// applyGeneratedFields fills in the generated fields of a collection. On
+// create every field is generated; afterwards only fields with on "write".
+func applyGeneratedFields(q sqlx.Queryer, collection *Collection, document map[string]any, context writeContext, creating bool) error {
+	for _, generated := range collection.Generated {
+		if !creating && !generated.onWrite() {
+			continue
+		}
+		switch generated.Type {
+		case GeneratedTimestamp:
+			document[generated.Field] = context.Time.Format(time.RFC3339)
+		case GeneratedTokenName:
+			document[generated.Field] = context.TokenName
+		case GeneratedClientIP:
+			document[generated.Field] = context.ClientIP
+		case GeneratedSlug:
+			if source, ok := document[generated.From].(string); ok {
+				document[generated.Field] = slugify(source)
+			}
+		case GeneratedSequence:
+			// The counter is only taken by allocateSequences once the
+			// document is valid.
+			value, err := peekSequenceValue(q, collection.Name+"."+generated.Field)
+			if err != nil {
+				return err
+			}
+			document[generated.Field] = value
+		}
+	}
+	return nil
+}
+
+// allocateSequences takes the sequence values applyGeneratedFields filled in
+// for a new document.
+func allocateSequences(q sqlx.Queryer, collection *Collection, document map[string]any) error {
+	for _, generated := range collection.Generated {
+		if generated.Type != GeneratedSequence {
+			continue
+		}
+		value, err := nextSequenceValue(q, collection.Name+"."+generated.Field)
+		if err != nil {
+			return err
+		}
+		document[generated.Field] = value
+	}
+	return nil
+}
+
+var nonSlugCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slugify(text string) string {
+	return strings.Trim(nonSlugCharacters.ReplaceAllString(strings.ToLower(text), "-"), "-")
+}
+
+// prepareInsert runs the server side steps of a client insert: read-only
+// properties are rejected or stripped, then schema defaults and generated
+// fields are filled in before the document is validated. It runs in the
+// write transaction of the insert, and sequence counters are only advanced
+// for valid documents.
+func prepareInsert(q sqlx.Queryer, collectionName string, context writeContext, document map[string]any) error {
+	collection := getCollectionByName(collectionName)
+	err := removeReadOnlyFields(collection, document)
+	if err != nil {
+		return err
+	}
+	applySchemaDefaults(collection.Schema, document)
+	err = applyGeneratedFields(q, collection, document, context, true)
+	if err != nil {
+		return err
+	}
+	err = validateDocument(q, collectionName, 0, nil, document)
+	if err != nil {
+		return err
+	}
+	return allocateSequences(q, collection, document)
+}
+
+// replaceValidator prepares a replacement document like prepareInsert, but
+// carries read-only properties and create-time generated fields over from
+// the stored document instead of generating them again.
+func replaceValidator(collectionName string, context writeContext) documentValidator {
+	return func(q sqlx.Queryer, id int, current map[string]any, document map[string]any) error {
+		collection := getCollectionByName(collectionName)
+		err := removeReadOnlyFields(collection, document)
+		if err != nil {
+			return err
+		}
+		preserved := readOnlyPaths(collection.Schema, []string{})
+		for _, generated := range collection.Generated {
+			if !generated.onWrite() {
+				preserved = append(preserved, []string{generated.Field})
+			}
+		}
+		for _, path := range preserved {
+			if value, exists := fieldValue(current, path); exists {
+				setFieldValue(document, path, value)
+			}
+		}
+		applySchemaDefaults(collection.Schema, document)
+		err = applyGeneratedFields(q, collection, document, context, false)
+		if err != nil {
+			return err
+		}
+		return validateDocument(q, collectionName, id, current, document)
+	}
+}
+
+// updateValidator refreshes generated fields of an updated document and
+// validates it. Read-only properties are carried over from the stored
+// document, since a $set of an object replaces the read-only properties it
+// holds along with the rest of the object.
+func updateValidator(collectionName string, context writeContext) documentValidator {
+	return func(q sqlx.Queryer, id int, current map[string]any, document map[string]any) error {
+		collection := getCollectionByName(collectionName)
+		for _, path := range readOnlyPaths(collection.Schema, []string{}) {
+			if value, exists := fieldValue(current, path); exists {
+				setFieldValue(document, path, value)
+			}
+		}
+		err := applyGeneratedFields(q, collection, document, context, false)
+		if err != nil {
+			return err
+		}
+		return validateDocument(q, collectionName, id, current, document)
+	}
+}
+
+// removeReadOnlyOperations rejects or strips update operations that target
+// read-only properties, including $set of an object holding one.
+func removeReadOnlyOperations(collectionName string, operations []updateOperation) ([]updateOperation, error) {
+	collection := getCollectionByName(collectionName)
+	paths := readOnlyPaths(collection.Schema, []string{})
+	allowed := []updateOperation{}
+	for _, operation := range operations {
+		violation := []string(nil)
+		for _, path := range paths {
+			if isPathPrefix(path, operation.Path) {
+				violation = path
+				break
+			}
+			if isPathPrefix(operation.Path, path) && operation.Operator == OperatorSet {
+				value, isObject := operation.Value.(map[string]any)
+				if _, exists := fieldValue(value, path[len(operation.Path):]); isObject && exists {
+					if collection.ReadOnlyPolicy != ReadOnlyPolicyStrip {
+						return nil, fmt.Errorf("%w: %s", errReadOnlyField, strings.Join(path, "."))
+					}
+					deleteFieldValue(value, path[len(operation.Path):])
+				}
+			}
+		}
+		if violation == nil {
+			allowed = append(allowed, operation)
+		} else if collection.ReadOnlyPolicy != ReadOnlyPolicyStrip {
+			return nil, fmt.Errorf("%w: %s", errReadOnlyField, strings.Join(violation, "."))
+		}
+	}
+	return allowed, nil
+}
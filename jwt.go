@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultJWTNameClaim  = "sub"
+	jwksRefreshInterval  = time.Hour
+	jwksMinRefreshPeriod = time.Minute
+	jwtCacheLimit        = 10000
+)
+
+// JWTConfig lets clients authenticate with JWTs of an identity provider in
+// addition to the static access tokens. HS256 tokens are verified with the
+// shared secret, RS256 and ES256 tokens with the keys of a JWKS.
+type JWTConfig struct {
+	Secret    string    `json:"secret"`
+	JWKSFile  string    `json:"jwks_file"`
+	JWKSURL   string    `json:"jwks_url"`
+	Issuer    string    `json:"issuer"`
+	Audience  string    `json:"audience"`
+	Leeway    int       `json:"leeway"`
+	NameClaim string    `json:"name_claim"`
+	Roles     []JWTRole `json:"roles"`
+}
+
+// JWTRole is granted to a JWT whose claim holds the value, or an array
+// containing it. Without a value the claim only has to be present, and
+// without a claim every valid JWT has the role. Role names are used in
+// collection auth and admin_tokens like access token names.
+type JWTRole struct {
+	Name  string `json:"name"`
+	Claim string `json:"claim"`
+	Value any    `json:"value"`
+}
+
+// jwtIdentity is what a verified JWT grants.
+type jwtIdentity struct {
+	name    string
+	roles   []string
+	expires time.Time
+}
+
+// jwtVerifier verifies JWTs and remembers the identities of verified
+// tokens until they expire.
+type jwtVerifier struct {
+	config  JWTConfig
+	parser  *jwt.Parser
+	keys    *jwksKeySet
+	mutex   sync.Mutex
+	tokens  map[string]jwtIdentity
+	methods []string
+}
+
+// newJWTVerifier checks the JWT configuration and loads the JWKS file. A
+// JWKS URL is fetched by runJWKSRefresher once the config is activated.
+func newJWTVerifier(config *JWTConfig) (*jwtVerifier, error) {
+	if config == nil {
+		return nil, nil
+	}
+	verifier := &jwtVerifier{config: *config, tokens: make(map[string]jwtIdentity)}
+	if config.Secret != "" {
+		verifier.methods = append(verifier.methods, jwt.SigningMethodHS256.Alg())
+	}
+	if config.JWKSFile != "" && config.JWKSURL != "" {
+		return nil, errors.New("use either jwks_file or jwks_url")
+	}
+	if config.JWKSFile != "" || config.JWKSURL != "" {
+		verifier.methods = append(verifier.methods, jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg())
+		verifier.keys = &jwksKeySet{url: config.JWKSURL}
+	}
+	if len(verifier.methods) == 0 {
+		return nil, errors.New("a secret, jwks_file or jwks_url is required")
+	}
+	if config.JWKSFile != "" {
+		file := config.JWKSFile
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(configPath), file)
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		verifier.keys.keys, err = parseJWKS(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", config.JWKSFile, err)
+		}
+	}
+	for _, role := range config.Roles {
+		if role.Name == "" {
+			return nil, errors.New("roles need a name")
+		}
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(verifier.methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Duration(config.Leeway) * time.Second),
+	}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		options = append(options, jwt.WithAudience(config.Audience))
+	}
+	verifier.parser = jwt.NewParser(options...)
+	return verifier, nil
+}
+
+// roleNames returns the names of the configured JWT roles.
+func (config *JWTConfig) roleNames() []string {
+	names := []string{}
+	if config == nil {
+		return names
+	}
+	for _, role := range config.Roles {
+		names = append(names, role.Name)
+	}
+	return names
+}
+
+// looksLikeJWT tells JWTs apart from static tokens without parsing them.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// identity verifies a JWT and returns what it grants. Invalid tokens
+// return false.
+func (verifier *jwtVerifier) identity(token string) (jwtIdentity, bool) {
+	if verifier == nil || !looksLikeJWT(token) {
+		return jwtIdentity{}, false
+	}
+	verifier.mutex.Lock()
+	identity, cached := verifier.tokens[token]
+	verifier.mutex.Unlock()
+	if cached && time.Now().Before(identity.expires) {
+		return identity, true
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := verifier.parser.ParseWithClaims(token, claims, verifier.key)
+	if err != nil {
+		return jwtIdentity{}, false
+	}
+	expires, err := claims.GetExpirationTime()
+	if err != nil || expires == nil {
+		return jwtIdentity{}, false
+	}
+	identity = verifier.grant(claims)
+	identity.expires = expires.Add(time.Duration(verifier.config.Leeway) * time.Second)
+
+	verifier.mutex.Lock()
+	if len(verifier.tokens) >= jwtCacheLimit {
+		clear(verifier.tokens)
+	}
+	verifier.tokens[token] = identity
+	verifier.mutex.Unlock()
+	return identity, true
+}
+
+// grant maps the claims of a verified JWT to a name and roles.
+func (verifier *jwtVerifier) grant(claims jwt.MapClaims) jwtIdentity {
+	nameClaim := verifier.config.NameClaim
+	if nameClaim == "" {
+		nameClaim = defaultJWTNameClaim
+	}
+	identity := jwtIdentity{roles: []string{}}
+	if name, ok := claimValue(claims, nameClaim); ok {
+		identity.name = fmt.Sprint(name)
+	}
+	for _, role := range verifier.config.Roles {
+		if role.grantedBy(claims) {
+			identity.roles = append(identity.roles, role.Name)
+		}
+	}
+	return identity
+}
+
+func (role JWTRole) grantedBy(claims jwt.MapClaims) bool {
+	if role.Claim == "" {
+		return true
+	}
+	value, ok := claimValue(claims, role.Claim)
+	if !ok || role.Value == nil {
+		return ok && value != nil
+	}
+	expected := normalizeJSON(role.Value)
+	if values, isList := value.([]any); isList {
+		return slices.ContainsFunc(values, func(value any) bool { return reflect.DeepEqual(value, expected) })
+	}
+	return reflect.DeepEqual(value, expected)
+}
+
+// claimValue looks up a claim, using dot notation for nested claims like
+// realm_access.roles.
+func claimValue(claims jwt.MapClaims, claim string) (any, bool) {
+	if value, ok := claims[claim]; ok {
+		return value, true
+	}
+	return fieldValue(map[string]any(claims), strings.Split(claim, "."))
+}
+
+// key returns the key a token is verified with.
+func (verifier *jwtVerifier) key(token *jwt.Token) (any, error) {
+	if _, isHMAC := token.Method.(*jwt.SigningMethodHMAC); isHMAC {
+		return []byte(verifier.config.Secret), nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	return verifier.keys.lookup(kid, token.Method.Alg())
+}
+
+// jwksKeySet holds the public keys of a JWKS by key id. Keys of a URL are
+// fetched by runJWKSRefresher, never on the request path: when the config is
+// activated, again after an hour, and when a token names an unknown key.
+type jwksKeySet struct {
+	url     string
+	mutex   sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+	missing bool
+}
+
+var jwksWake = make(chan struct{}, 1)
+
+func wakeJWKSRefresher() {
+	select {
+	case jwksWake <- struct{}{}:
+	default:
+	}
+}
+
+// runJWKSRefresher keeps the keys of the active jwks_url up to date.
+func runJWKSRefresher() {
+	runQueueWorker(jwksWake, jwksMinRefreshPeriod, func() {
+		verifier := active().jwtAuth
+		if verifier != nil && verifier.keys != nil {
+			verifier.keys.refresh(time.Now())
+		}
+	})
+}
+
+func (keySet *jwksKeySet) lookup(kid string, alg string) (any, error) {
+	keySet.mutex.Lock()
+	key := keySet.find(kid)
+	if keySet.url != "" && key == nil {
+		keySet.missing = true
+		wakeJWKSRefresher()
+	}
+	keySet.mutex.Unlock()
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if alg == jwt.SigningMethodRS256.Alg() {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == jwt.SigningMethodES256.Alg() {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s key %q", alg, kid)
+}
+
+// refresh fetches the keys of the URL when they were never fetched, are
+// older than jwksRefreshInterval, or a token named an unknown key. Unknown
+// keys cause at most one fetch every jwksMinRefreshPeriod. The mutex is not
+// held during the fetch, so lookups keep using the previous keys.
+func (keySet *jwksKeySet) refresh(now time.Time) {
+	keySet.mutex.Lock()
+	age := now.Sub(keySet.fetched)
+	due := keySet.fetched.IsZero() || age > jwksRefreshInterval || (keySet.missing && age > jwksMinRefreshPeriod)
+	keySet.mutex.Unlock()
+	if keySet.url == "" || !due {
+		return
+	}
+
+	keys, err := fetchJWKS(keySet.url)
+	keySet.mutex.Lock()
+	defer keySet.mutex.Unlock()
+	keySet.fetched = now
+	keySet.missing = false
+	if err != nil {
+		log.Printf("Error fetching JWKS: %v", err)
+		return
+	}
+	keySet.keys = keys
+}
+
+// find returns the key with the id, or the only key for tokens without one.
+func (keySet *jwksKeySet) find(kid string) any {
+	if kid == "" && len(keySet.keys) == 1 {
+		for _, key := range keySet.keys {
+			return key
+		}
+	}
+	return keySet.keys[kid]
+}
+
+func fetchJWKS(url string) (map[string]any, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(content)
+}
+
+// parseJWKS reads the RSA and P-256 keys of a JWKS. Other keys are skipped.
+func parseJWKS(content []byte) (map[string]any, error) {
+	var keySet struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err := json.Unmarshal(content, &keySet)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]any)
+	for _, key := range keySet.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		switch {
+		case key.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(key.N)
+			e, errE := base64.RawURLEncoding.DecodeString(key.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				return nil, fmt.Errorf("invalid RSA key %q", key.Kid)
+			}
+			keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case key.Kty == "EC" && key.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(key.X)
+			y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+			if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+				return nil, fmt.Errorf("invalid EC key %q", key.Kid)
+			}
+			publicKey, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), slices.Concat([]byte{4}, x, y))
+			if err != nil {
+				return nil, fmt.Errorf("invalid EC key %q: %w", key.Kid, err)
+			}
+			keys[key.Kid] = publicKey
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA or P-256 signing keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+)
+
+const (
+	Draft04      = "draft-04"
+	Draft06      = "draft-06"
+	Draft07      = "draft-07"
+	Draft2019    = "2019-09"
+	Draft2020    = "2020-12"
+	DefaultDraft = Draft07
+)
+
+var errUniqueField = errors.New("value is already used")
+var errImmutableField = errors.New("field cannot be changed")
+var errWriteOnceField = errors.New("field cannot be changed once set")
+
+var schemaDrafts = map[string]*jsonschema.Draft{
+	Draft04:   jsonschema.Draft4,
+	Draft06:   jsonschema.Draft6,
+	Draft07:   jsonschema.Draft7,
+	Draft2019: jsonschema.Draft2019,
+	Draft2020: jsonschema.Draft2020,
+}
+
+// draftSchemaURLs maps the $schema of each draft, without scheme and
+// trailing #, to its name.
+var draftSchemaURLs = map[string]string{
+	"json-schema.org/draft-04/schema":      Draft04,
+	"json-schema.org/draft-06/schema":      Draft06,
+	"json-schema.org/draft-07/schema":      Draft07,
+	"json-schema.org/draft/2019-09/schema": Draft2019,
+	"json-schema.org/draft/2020-12/schema": Draft2020,
+}
+
+var draft04Keywords = []string{
+	"$schema", "id", "$ref", "title", "description", "default", "format", "multipleOf",
+	"maximum", "exclusiveMaximum", "minimum", "exclusiveMinimum", "maxLength", "minLength",
+	"pattern", "additionalItems", "items", "maxItems", "minItems", "uniqueItems",
+	"maxProperties", "minProperties", "required", "additionalProperties", "definitions",
+	"properties", "patternProperties", "dependencies", "enum", "type", "allOf", "anyOf",
+	"oneOf", "not",
+}
+
+var draft06Keywords = slices.Concat(draft04Keywords, []string{
+	"$id", "const", "contains", "propertyNames", "examples",
+})
+
+var draft07Keywords = slices.Concat(draft06Keywords, []string{
+	"$comment", "if", "then", "else", "readOnly", "writeOnly", "contentMediaType", "contentEncoding",
+})
+
+var draft2019Keywords = slices.Concat(draft07Keywords, []string{
+	"$anchor", "$defs", "$recursiveRef", "$recursiveAnchor", "$vocabulary", "dependentRequired",
+	"dependentSchemas", "unevaluatedProperties", "unevaluatedItems", "maxContains", "minContains",
+	"deprecated", "contentSchema",
+})
+
+var draft2020Keywords = slices.Concat(slices.DeleteFunc(slices.Clone(draft2019Keywords), func(keyword string) bool {
+	return keyword == "$recursiveRef" || keyword == "$recursiveAnchor" || keyword == "additionalItems"
+}), []string{
+	"prefixItems", "$dynamicRef", "$dynamicAnchor",
+})
+
+var draftKeywords = map[string][]string{
+	Draft04:   draft04Keywords,
+	Draft06:   draft06Keywords,
+	Draft07:   draft07Keywords,
+	Draft2019: draft2019Keywords,
+	Draft2020: draft2020Keywords,
+}
+
+// Subschemas are found in the values of schemaMapKeywords and in the values
+// or items of schemaKeywords.
+var schemaMapKeywords = []string{"properties", "patternProperties", "definitions", "$defs", "dependentSchemas", "dependencies"}
+var schemaKeywords = []string{
+	"items", "additionalItems", "prefixItems", "contains", "additionalProperties", "propertyNames",
+	"unevaluatedProperties", "unevaluatedItems", "contentSchema", "not", "if", "then", "else",
+	"allOf", "anyOf", "oneOf",
+}
+
+// schemaKeyword is a keyword quickstore understands in addition to those of
+// the draft. check validates its value when the config is loaded. enforce
+// runs when a document is written; property keywords are only supported on
+// the properties of the document and of its nested objects.
+type schemaKeyword struct {
+	check    func(value any) error
+	enforce  func(q sqlx.Queryer, collectionName string, field keywordField, id int, current map[string]any, document map[string]any) error
+	property bool
+}
+
+var customKeywords = map[string]schemaKeyword{
+	// readOnly is honoured in every draft, see removeReadOnlyFields.
+	"readOnly": {check: checkBooleanKeyword},
+	// x-ref is checked by collectReferences and checkReferences.
+	"x-ref":        {property: true},
+	"x-unique":     {check: checkBooleanKeyword, enforce: enforceUnique, property: true},
+	"x-immutable":  {check: checkBooleanKeyword, enforce: enforceImmutable, property: true},
+	"x-write-once": {check: checkBooleanKeyword, enforce: enforceWriteOnce, property: true},
+}
+
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+var ulidPattern = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+
+// customFormats are the format values quickstore adds to the formats of
+// the drafts. Formats are asserted in every draft.
+var customFormats = []*jsonschema.Format{
+	{Name: "phone", Validate: validatePhoneFormat},
+	{Name: "country", Validate: validateCountryFormat},
+	{Name: "ulid", Validate: validateULIDFormat},
+	{Name: "currency", Validate: validateCurrencyFormat},
+}
+
+// validatePhoneFormat accepts E.164 numbers like +4930123456.
+func validatePhoneFormat(value any) error {
+	text, ok := value.(string)
+	if !ok || phonePattern.MatchString(text) {
+		return nil
+	}
+	return errors.New("not an E.164 phone number")
+}
+
+// validateCountryFormat accepts ISO 3166-1 alpha-2 country codes like DE.
+func validateCountryFormat(value any) error {
+	text, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	region, err := language.ParseRegion(text)
+	if err != nil || len(text) != 2 || region.String() != text || !region.IsCountry() {
+		return errors.New("not an ISO 3166-1 alpha-2 country code")
+	}
+	return nil
+}
+
+// validateULIDFormat accepts ULIDs in upper case Crockford base32.
+func validateULIDFormat(value any) error {
+	text, ok := value.(string)
+	if !ok || ulidPattern.MatchString(text) {
+		return nil
+	}
+	return errors.New("not a ULID")
+}
+
+// validateCurrencyFormat accepts ISO 4217 currency codes like EUR.
+func validateCurrencyFormat(value any) error {
+	text, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	unit, err := currency.ParseISO(text)
+	if err != nil || unit.String() != text {
+		return errors.New("not an ISO 4217 currency code")
+	}
+	return nil
+}
+
+func checkBooleanKeyword(value any) error {
+	if _, ok := value.(bool); !ok {
+		return errors.New("must be true or false")
+	}
+	return nil
+}
+
+// schemaDraft returns the draft the schema of a collection is written in:
+// the draft of the config, else the draft named by $schema, else draft-07.
+func (collection Collection) schemaDraft() string {
+	if collection.Draft != "" {
+		return collection.Draft
+	}
+	if draft := draftOfSchemaURL(collection.Schema); draft != "" {
+		return draft
+	}
+	return DefaultDraft
+}
+
+func draftOfSchemaURL(schema map[string]any) string {
+	url, _ := schema["$schema"].(string)
+	url = strings.TrimSuffix(url, "#")
+	url = strings.TrimPrefix(strings.TrimPrefix(url, "http://"), "https://")
+	return draftSchemaURLs[url]
+}
+
+// checkCollectionSchema reports an unknown draft, keywords the draft does
+// not know and registered keywords that are used wrongly.
+func checkCollectionSchema(collection Collection) []string {
+	draft := collection.schemaDraft()
+	if _, known := schemaDrafts[draft]; !known {
+		return []string{fmt.Sprintf("collection %s: unknown draft %s", collection.Name, draft)}
+	}
+	if _, declared := collection.Schema["$schema"]; declared && collection.Draft != "" && draftOfSchemaURL(collection.Schema) != collection.Draft {
+		return []string{fmt.Sprintf("collection %s: $schema does not match draft %s", collection.Name, collection.Draft)}
+	}
+	problems := []string{}
+	checkSchemaKeywords(collection.Schema, draftKeywords[draft], "", []string{}, func(location string, problem string) {
+		problems = append(problems, fmt.Sprintf("collection %s: schema %s: %s", collection.Name, location, problem))
+	})
+	return problems
+}
+
+// checkSchemaKeywords walks a schema and its subschemas. field is the path
+// of the document field the schema describes, or nil once the walk leaves
+// the properties of objects.
+func checkSchemaKeywords(value any, keywords []string, location string, field []string, report func(location string, problem string)) {
+	schema, ok := value.(map[string]any)
+	if !ok {
+		return
+	}
+	for _, name := range sortedKeys(schema) {
+		child := schema[name]
+		childLocation := location + "/" + name
+		if keyword, registered := customKeywords[name]; registered {
+			if keyword.check != nil {
+				if err := keyword.check(child); err != nil {
+					report(childLocation, err.Error())
+				}
+			}
+			if keyword.property && len(field) == 0 {
+				report(childLocation, name+" is only supported on object properties")
+			}
+			continue
+		}
+		if !slices.Contains(keywords, name) {
+			report(childLocation, "unsupported keyword "+name)
+			continue
+		}
+		switch {
+		case name == "properties":
+			properties, _ := child.(map[string]any)
+			for _, property := range sortedKeys(properties) {
+				var propertyField []string
+				if field != nil {
+					propertyField = append(slices.Clone(field), property)
+				}
+				checkSchemaKeywords(properties[property], keywords, childLocation+"/"+property, propertyField, report)
+			}
+		case slices.Contains(schemaMapKeywords, name):
+			schemas, _ := child.(map[string]any)
+			for _, key := range sortedKeys(schemas) {
+				checkSchemaKeywords(schemas[key], keywords, childLocation+"/"+key, nil, report)
+			}
+		case slices.Contains(schemaKeywords, name):
+			if items, isList := child.([]any); isList {
+				// allOf schemas describe the same value, which is how a $ref
+				// with keys next to it resolves.
+				var itemField []string
+				if name == "allOf" {
+					itemField = field
+				}
+				for i, item := range items {
+					checkSchemaKeywords(item, keywords, fmt.Sprintf("%s/%d", childLocation, i), itemField, report)
+				}
+				continue
+			}
+			checkSchemaKeywords(child, keywords, childLocation, nil, report)
+		}
+	}
+}
+
+// keywordField is a document field whose schema carries an enforced custom
+// keyword.
+type keywordField struct {
+	Keyword string
+	Field   []string
+}
+
+func (field keywordField) FieldName() string {
+	return strings.Join(field.Field, ".")
+}
+
+func (field keywordField) JSONPath() string {
+	return `$."` + strings.Join(field.Field, `"."`) + `"`
+}
+
+func buildKeywordCache(collections []Collection) map[string][]keywordField {
+	var keywordCache = make(map[string][]keywordField)
+	for _, collection := range collections {
+		fields := []keywordField{}
+		collectKeywordFields(collection.Schema, []string{}, &fields)
+		keywordCache[collection.Name] = fields
+	}
+	return keywordCache
+}
+
+// collectKeywordFields records the properties of an object schema that are
+// enabled by an enforced keyword, like "x-unique": true.
+func collectKeywordFields(schema map[string]any, path []string, fields *[]keywordField) {
+	properties := schemaProperties(schema)
+	for _, name := range sortedKeys(properties) {
+		propertySchema, ok := properties[name].(map[string]any)
+		if !ok {
+			continue
+		}
+		field := append(slices.Clone(path), name)
+		for _, keyword := range sortedKeys(propertySchema) {
+			if customKeywords[keyword].enforce != nil && propertySchema[keyword] == true {
+				*fields = append(*fields, keywordField{Keyword: keyword, Field: field})
+			}
+		}
+		collectKeywordFields(propertySchema, field, fields)
+	}
+}
+
+// enforceSchemaKeywords runs the enforced keywords of a collection against
+// a document about to be written. id and current are those of the stored
+// document, or 0 and nil for a new one.
+func enforceSchemaKeywords(q sqlx.Queryer, collectionName string, id int, current map[string]any, document map[string]any) error {
+	for _, field := range active().keywordCache[collectionName] {
+		err := customKeywords[field.Keyword].enforce(q, collectionName, field, id, current, document)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enforceUnique rejects a value that another live document of the
+// collection holds in the same field. Missing and null values are not
+// compared.
+func enforceUnique(q sqlx.Queryer, collectionName string, field keywordField, id int, current map[string]any, document map[string]any) error {
+	value, exists := fieldValue(document, field.Field)
+	if !exists || value == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var count int
+	query := `SELECT COUNT(*) FROM ` + collectionName + ` WHERE json_extract(data, $1) = json_extract(json($2), '$') AND id != $3 AND ` + liveCondition(collectionName)
+	err = sqlx.Get(q, &count, query, field.JSONPath(), string(encoded), id)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", errUniqueField, field.FieldName())
+	}
+	return nil
+}
+
+// enforceImmutable rejects setting, changing or removing a field of a
+// stored document.
+func enforceImmutable(q sqlx.Queryer, collectionName string, field keywordField, id int, current map[string]any, document map[string]any) error {
+	if current == nil {
+		return nil
+	}
+	previous, existed := fieldValue(current, field.Field)
+	value, exists := fieldValue(document, field.Field)
+	if existed != exists || !reflect.DeepEqual(normalizeJSON(previous), normalizeJSON(value)) {
+		return fmt.Errorf("%w: %s", errImmutableField, field.FieldName())
+	}
+	return nil
+}
+
+// enforceWriteOnce lets a field be set while the stored document does not
+// have it or holds null, and rejects changing or removing it afterwards.
+func enforceWriteOnce(q sqlx.Queryer, collectionName string, field keywordField, id int, current map[string]any, document map[string]any) error {
+	if current == nil {
+		return nil
+	}
+	previous, existed := fieldValue(current, field.Field)
+	if !existed || previous == nil {
+		return nil
+	}
+	value, exists := fieldValue(document, field.Field)
+	if !exists || !reflect.DeepEqual(normalizeJSON(previous), normalizeJSON(value)) {
+		return fmt.Errorf("%w: %s", errWriteOnceField, field.FieldName())
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultLiveSubscriptionLimit = 20
+const liveWriteTimeout = 10 * time.Second
+const livePongTimeout = 60 * time.Second
+const livePingInterval = 30 * time.Second
+const liveMaxMessageSize = 64 << 10
+
+// Initial results are read in pages of liveInitialPageSize documents, and
+// subscriptions matching more than maxLiveInitialDocuments are refused.
+const liveInitialPageSize = 500
+const maxLiveInitialDocuments = 1000
+
+var errTooManyLiveDocuments = errors.New("too many matching documents")
+
+const (
+	LiveAuth         = "auth"
+	LiveSubscribe    = "subscribe"
+	LiveUnsubscribe  = "unsubscribe"
+	LiveAuthorized   = "authorized"
+	LiveInitial      = "initial"
+	LiveAdded        = "added"
+	LiveChanged      = "changed"
+	LiveRemoved      = "removed"
+	LiveUnsubscribed = "unsubscribed"
+	LiveError        = "error"
+)
+
+var liveUpgrader = websocket.Upgrader{
+	// Clients authenticate with bearer tokens, not cookies, so connections
+	// from any origin are accepted like the CORS headers of the REST API.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// liveClientMessage is a message from a live query client. ID is chosen by
+// the client and names a subscription.
+type liveClientMessage struct {
+	Type       string         `json:"type"`
+	ID         string         `json:"id"`
+	Token      string         `json:"token"`
+	Collection string         `json:"collection"`
+	Filter     map[string]any `json:"filter"`
+}
+
+type liveServerMessage struct {
+	Type       string           `json:"type"`
+	ID         string           `json:"id,omitempty"`
+	Documents  []map[string]any `json:"documents,omitzero"`
+	Document   map[string]any   `json:"document,omitempty"`
+	DocumentID int              `json:"document_id,omitempty"`
+	Message    string           `json:"message,omitempty"`
+}
+
+// liveSubscription tracks the result set of one live query so that writes
+// can be turned into added, changed and removed deltas.
+type liveSubscription struct {
+	collection string
+	filter     documentFilter
+	results    map[int]bool
+}
+
+// apply returns the delta a write causes in the result set, if any.
+func (subscription *liveSubscription) apply(event writeEvent) (string, bool) {
+	if event.Collection != subscription.collection {
+		return "", false
+	}
+	inResults := subscription.results[event.ID]
+	matches := event.Event != EventDelete && subscription.filter.Matches(event.Document)
+	switch {
+	case matches && !inResults:
+		subscription.results[event.ID] = true
+		return LiveAdded, true
+	case matches && inResults:
+		return LiveChanged, true
+	case !matches && inResults:
+		delete(subscription.results, event.ID)
+		return LiveRemoved, true
+	}
+	return "", false
+}
+
+// liveConnection is the state of one WebSocket client. Only the goroutine
+// running serve writes to the connection.
+type liveConnection struct {
+	conn          *websocket.Conn
+	token         string
+	subscriptions map[string]*liveSubscription
+	limit         int
+}
+
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	limit := active().config.LiveSubscriptionLimit
+	if limit <= 0 {
+		limit = defaultLiveSubscriptionLimit
+	}
+	connection := &liveConnection{
+		conn:          conn,
+		token:         getAuthTokenFromRequest(r),
+		subscriptions: make(map[string]*liveSubscription),
+		limit:         limit,
+	}
+	connection.serve()
+}
+
+func (connection *liveConnection) serve() {
+	// Subscribe to the bus before initial results are read, so that no write
+	// between the read and the subscription is missed.
+	busID, events := eventBus.Subscribe()
+	defer eventBus.Unsubscribe(busID)
+
+	// quit stops the reader when serve returns while it waits to hand over a
+	// message.
+	messages := make(chan liveClientMessage)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go connection.readMessages(messages, done, quit)
+
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case message := <-messages:
+			err = connection.send(connection.handleMessage(message))
+		case event, ok := <-events:
+			if !ok {
+				connection.send(liveErrorMessage("", "Connection fell behind, please resubscribe"))
+				return
+			}
+			err = connection.sendAll(connection.handleEvent(event))
+		case <-ping.C:
+			err = connection.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (connection *liveConnection) readMessages(messages chan<- liveClientMessage, done chan<- struct{}, quit <-chan struct{}) {
+	defer close(done)
+	conn := connection.conn
+	conn.SetReadLimit(liveMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+	})
+	for {
+		var message liveClientMessage
+		err := conn.ReadJSON(&message)
+		if err != nil {
+			var syntaxError *json.SyntaxError
+			var typeError *json.UnmarshalTypeError
+			if !errors.As(err, &syntaxError) && !errors.As(err, &typeError) {
+				return
+			}
+			message = liveClientMessage{Type: "invalid"}
+		}
+		conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+		select {
+		case messages <- message:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (connection *liveConnection) send(message liveServerMessage) error {
+	connection.conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+	return connection.conn.WriteJSON(message)
+}
+
+func (connection *liveConnection) sendAll(messages []liveServerMessage) error {
+	for _, message := range messages {
+		err := connection.send(message)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func liveErrorMessage(id string, message string) liveServerMessage {
+	return liveServerMessage{Type: LiveError, ID: id, Message: message}
+}
+
+func (connection *liveConnection) canQuery(collectionName string) bool {
+	return isAuthTokenValid(connection.token, collectionName, ActionList) &&
+		isAuthTokenValid(connection.token, collectionName, ActionRead)
+}
+
+// handleMessage runs a client message and returns the reply.
+func (connection *liveConnection) handleMessage(message liveClientMessage) liveServerMessage {
+	switch message.Type {
+	case LiveAuth:
+		connection.token = message.Token
+		return liveServerMessage{Type: LiveAuthorized}
+	case LiveSubscribe:
+		return connection.subscribe(message)
+	case LiveUnsubscribe:
+		if _, ok := connection.subscriptions[message.ID]; !ok {
+			return liveErrorMessage(message.ID, "Subscription not found")
+		}
+		delete(connection.subscriptions, message.ID)
+		return liveServerMessage{Type: LiveUnsubscribed, ID: message.ID}
+	}
+	return liveErrorMessage(message.ID, "Invalid message")
+}
+
+func (connection *liveConnection) subscribe(message liveClientMessage) liveServerMessage {
+	if message.ID == "" {
+		return liveErrorMessage("", "Subscription id is missing")
+	}
+	if _, exists := connection.subscriptions[message.ID]; exists {
+		return liveErrorMessage(message.ID, "Subscription id is already in use")
+	}
+	if len(connection.subscriptions) >= connection.limit {
+		return liveErrorMessage(message.ID, "Too many subscriptions")
+	}
+	collection := getCollectionByName(message.Collection)
+	if collection == nil || collection.Parent != "" {
+		return liveErrorMessage(message.ID, "Collection not found")
+	}
+	if !connection.canQuery(collection.Name) {
+		return liveErrorMessage(message.ID, "Unauthorized access")
+	}
+	filter, err := filterFromQuery(message.Filter)
+	if err != nil {
+		return liveErrorMessage(message.ID, err.Error())
+	}
+
+	results, err := liveInitialDocuments(db, collection.Name, filter)
+	if errors.Is(err, errTooManyLiveDocuments) {
+		return liveErrorMessage(message.ID, "Too many matching documents, narrow the filter")
+	}
+	if err != nil {
+		log.Printf("Error retrieving documents: %v", err)
+		return liveErrorMessage(message.ID, "Failed to retrieve documents")
+	}
+	subscription := &liveSubscription{collection: collection.Name, filter: filter, results: make(map[int]bool)}
+	for _, document := range results {
+		subscription.results[document["_id"].(int)] = true
+	}
+	connection.subscriptions[message.ID] = subscription
+	return liveServerMessage{Type: LiveInitial, ID: message.ID, Documents: results}
+}
+
+// liveInitialDocuments reads the documents of a collection that match a
+// filter, a page at a time. Like the documents of deltas, which come from
+// write events, they carry _id but not _created_at, so that filters match
+// the same fields in both.
+func liveInitialDocuments(db *sqlx.DB, collectionName string, filter documentFilter) ([]map[string]any, error) {
+	query := `SELECT id, created_at, json(data) AS data, schema_version FROM ` + collectionName + ` WHERE id > $1 AND ` + liveCondition(collectionName) + ` ORDER BY id LIMIT $2`
+	results := []map[string]any{}
+	lastID := 0
+	for {
+		records := []DataTable{}
+		err := db.Select(&records, query, lastID, liveInitialPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			lastID = record.ID
+			document, err := documentFromRecord(collectionName, record)
+			if err != nil {
+				continue
+			}
+			delete(document, "_created_at")
+			if !filter.Matches(document) {
+				continue
+			}
+			if len(results) == maxLiveInitialDocuments {
+				return nil, errTooManyLiveDocuments
+			}
+			results = append(results, document)
+		}
+		if len(records) < liveInitialPageSize {
+			return results, nil
+		}
+	}
+}
+
+// handleEvent returns the deltas a write causes.
+func (connection *liveConnection) handleEvent(event writeEvent) []liveServerMessage {
+	messages := []liveServerMessage{}
+	for id, subscription := range connection.subscriptions {
+		delta, ok := subscription.apply(event)
+		if !ok {
+			continue
+		}
+		// Permissions may change while the connection is open.
+		if !connection.canQuery(subscription.collection) {
+			delete(connection.subscriptions, id)
+			messages = append(messages, liveErrorMessage(id, "Unauthorized access"))
+			continue
+		}
+		message := liveServerMessage{Type: delta, ID: id, DocumentID: event.ID}
+		if delta != LiveRemoved {
+			message.Document = maps.Clone(event.Document)
+			message.Document["_id"] = event.ID
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 )
 
 const defaultConfigFile = "./config.json"
@@ -14,28 +15,41 @@ var rootMux *http.ServeMux
 
 func initApp(configFile string, databaseFile string) error {
 	var err error
+	db, err = connectToDatabase(databaseFile)
+	if err != nil {
+		return fmt.Errorf("error connecting to database: %w", err)
+	}
 
-	config, err = readConfig(configFile)
+	// Runtime changes made through the admin API are merged over the file.
+	_, err = db.Exec(createSQLDDLForRuntimeConfig())
+	if err != nil {
+		return fmt.Errorf("error migrating database: %w", err)
+	}
+	configPath = configFile
+	loaded, err := loadConfig(configFile)
 	if err != nil {
-		return fmt.Errorf("could not read config file: %w", err)
+		return err
 	}
+	loaded.activate()
 
-	schemaCache = buildSchemaCache(config.Collections)
-	authCache = buildAuthCache(config)
+	err = migrateDatabase(db, loaded.config.Collections)
+	if err != nil {
+		return fmt.Errorf("error migrating database: %w", err)
+	}
 
-	openapiSpec, err = buildOpenapiSpec(config)
+	err = syncConfigWebhooks(db, loaded.config.Collections)
 	if err != nil {
-		return fmt.Errorf("error creating OpenAPI spec: %w", err)
+		return fmt.Errorf("invalid webhooks: %w", err)
 	}
 
-	db, err = connectToDatabase(databaseFile)
+	attachmentStore, err = newAttachmentStore(loaded.config.AttachmentStorage)
 	if err != nil {
-		return fmt.Errorf("error connecting to database: %w", err)
+		return fmt.Errorf("error opening attachment storage: %w", err)
 	}
 
-	err = migrateDatabase(db, config.Collections)
+	err = initFormTokenSecret(loaded.config.SpamSecret)
 	if err != nil {
-		return fmt.Errorf("error migrating database: %w", err)
+		return fmt.Errorf("error creating form token secret: %w", err)
 	}
 
 	return nil
@@ -46,24 +60,63 @@ func registerRoutes() {
 	mux.HandleFunc("GET /health", healthHandler)
 	mux.HandleFunc("OPTIONS /{collection}", mockOptionsHandler)
 	mux.HandleFunc("OPTIONS /{collection}/{id}", mockOptionsHandler)
+	mux.HandleFunc("OPTIONS /{collection}/{id}/_update", mockOptionsHandler)
 	mux.HandleFunc("GET /{collection}", getAllDocumentsHandler)
 	mux.HandleFunc("POST /{collection}", insertDocumentHandler)
 	mux.HandleFunc("POST /{collection}/", insertDocumentHandler)
 	mux.HandleFunc("GET /{collection}/{id}", getDocumentHandler)
 	mux.HandleFunc("PUT /{collection}/{id}", replaceDocumentHandler)
+	mux.HandleFunc("PATCH /{collection}/{id}", patchDocumentHandler)
+	mux.HandleFunc("POST /{collection}/{id}/_update", updateDocumentHandler)
 	mux.HandleFunc("DELETE /{collection}/{id}", deleteDocumentHandler)
+	mux.HandleFunc("OPTIONS /{collection}/{id}/_files", mockOptionsHandler)
+	mux.HandleFunc("OPTIONS /{collection}/{id}/_files/{name}", mockOptionsHandler)
+	mux.HandleFunc("GET /{collection}/{id}/_files", getAllAttachmentsHandler)
+	mux.HandleFunc("GET /{collection}/{id}/_files/{name}", getAttachmentHandler)
+	mux.HandleFunc("PUT /{collection}/{id}/_files/{name}", uploadAttachmentHandler)
+	mux.HandleFunc("POST /{collection}/{id}/_files/{name}", uploadAttachmentHandler)
+	mux.HandleFunc("DELETE /{collection}/{id}/_files/{name}", deleteAttachmentHandler)
+	mux.HandleFunc("OPTIONS /{collection}/_form_token", mockOptionsHandler)
+	mux.HandleFunc("GET /{collection}/_form_token", formTokenHandler)
+	mux.HandleFunc("GET /{collection}/_changes", changesHandler)
+	mux.HandleFunc("OPTIONS /{collection}/_changes_ticket", mockOptionsHandler)
+	mux.HandleFunc("POST /{collection}/_changes_ticket", changesTicketHandler)
+	mux.HandleFunc("GET /_live", liveHandler)
+	mux.HandleFunc("OPTIONS /{collection}/_sync", mockOptionsHandler)
+	mux.HandleFunc("GET /{collection}/_sync", pullHandler)
+	mux.HandleFunc("POST /{collection}/_sync", pushHandler)
+	mux.HandleFunc("OPTIONS /{parent}/{parentId}/{collection}", mockOptionsHandler)
+	mux.HandleFunc("OPTIONS /{parent}/{parentId}/{collection}/{id}", mockOptionsHandler)
+	mux.HandleFunc("OPTIONS /{parent}/{parentId}/{collection}/{id}/_update", mockOptionsHandler)
+	mux.HandleFunc("GET /{parent}/{parentId}/{collection}", getAllDocumentsHandler)
+	mux.HandleFunc("POST /{parent}/{parentId}/{collection}", insertDocumentHandler)
+	mux.HandleFunc("GET /{parent}/{parentId}/{collection}/{id}", getDocumentHandler)
+	mux.HandleFunc("PUT /{parent}/{parentId}/{collection}/{id}", replaceDocumentHandler)
+	mux.HandleFunc("PATCH /{parent}/{parentId}/{collection}/{id}", patchDocumentHandler)
+	mux.HandleFunc("POST /{parent}/{parentId}/{collection}/{id}/_update", updateDocumentHandler)
+	mux.HandleFunc("DELETE /{parent}/{parentId}/{collection}/{id}", deleteDocumentHandler)
 	apiMux := SetGlobalHeaders(mux)
+	adminMux := http.NewServeMux()
+	registerAdminRoutes(adminMux)
 	rootMux = http.NewServeMux()
+	rootMux.Handle("/api/_admin/", http.StripPrefix("/api/_admin", SetGlobalHeaders(requireAdmin(adminMux))))
 	rootMux.Handle("/api/", http.StripPrefix("/api", apiMux))
 	rootMux.Handle("/docs/", http.StripPrefix("/docs", SwaggerHandler()))
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		os.Exit(runToken(os.Args[2:]))
+	}
+
 	var configFile string
 	var databaseFile string
 
 	flag.StringVar(&configFile, "config", defaultConfigFile, "Path to config file")
-	flag.StringVar(&databaseFile, "db", defaultDatabaseFile, "Path to database file")
+	flag.StringVar(&databaseFile, "db", databaseFileFromEnvironment(), "Path to database file")
 	flag.Parse()
 
 	err := initApp(configFile, databaseFile)
@@ -75,6 +128,27 @@ func main() {
 
 	registerRoutes()
 
+	config := active().config
+	reaperInterval := config.ReaperInterval
+	if reaperInterval <= 0 {
+		reaperInterval = defaultReaperInterval
+	}
+	changesRetention := config.ChangesRetention
+	if changesRetention <= 0 {
+		changesRetention = defaultChangesRetention
+	}
+	go runReaper(db, reaperInterval, changesRetention)
+
+	go runWebhookDispatcher(db)
+
+	go runTokenUsageWriter(db)
+
+	go runJWKSRefresher()
+
+	go watchConfig(configFile)
+
+	go runMailer(db)
+
 	log.Printf("QuickStore Server starting on http://%s:%d", config.Host, config.Port)
 
 	err = http.ListenAndServe(fmt.Sprintf("%s:%d", config.Host, config.Port), rootMux)
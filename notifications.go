@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"maps"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultSMTPPort = 587
+const maxEmailAttempts = 6
+const mailerPollInterval = 30 * time.Second
+const mailerBatchSize = 50
+
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
+
+var mailerWake = make(chan struct{}, 1)
+
+// SMTPConfig is the mail server notifications are sent through.
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	StartTLS bool   `json:"starttls"`
+}
+
+// CollectionNotification sends an email when documents of a collection are
+// written. Filter, subject and body are Go templates executed with the
+// document fields plus _event and _collection. A notification is only sent
+// when the filter is empty or renders "true".
+type CollectionNotification struct {
+	Events  []string `json:"events"`
+	Filter  string   `json:"filter"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+	HTML    bool     `json:"html"`
+}
+
+type executableTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+type notificationRule struct {
+	events  []string
+	to      []string
+	html    bool
+	filter  *template.Template
+	subject *template.Template
+	body    executableTemplate
+}
+
+func buildNotificationCache(config Config) (map[string][]notificationRule, error) {
+	cache := make(map[string][]notificationRule)
+	for _, collection := range config.Collections {
+		if len(collection.Notifications) > 0 && config.SMTP == nil {
+			return nil, fmt.Errorf("collection %s: notifications need smtp to be configured", collection.Name)
+		}
+		for i, notification := range collection.Notifications {
+			rule, err := compileNotification(notification)
+			if err != nil {
+				return nil, fmt.Errorf("collection %s: notification %d: %w", collection.Name, i, err)
+			}
+			cache[collection.Name] = append(cache[collection.Name], rule)
+		}
+	}
+	return cache, nil
+}
+
+func compileNotification(notification CollectionNotification) (notificationRule, error) {
+	rule := notificationRule{events: notification.Events, to: notification.To, html: notification.HTML}
+	for _, event := range notification.Events {
+		if event != EventCreate && event != EventUpdate && event != EventDelete {
+			return rule, fmt.Errorf("unknown event %q", event)
+		}
+	}
+	if len(notification.To) == 0 {
+		return rule, fmt.Errorf("no recipients")
+	}
+	var err error
+	if notification.Filter != "" {
+		rule.filter, err = template.New("filter").Parse(notification.Filter)
+		if err != nil {
+			return rule, err
+		}
+	}
+	rule.subject, err = template.New("subject").Parse(notification.Subject)
+	if err != nil {
+		return rule, err
+	}
+	if notification.HTML {
+		rule.body, err = htmltemplate.New("body").Parse(notification.Body)
+	} else {
+		rule.body, err = template.New("body").Parse(notification.Body)
+	}
+	return rule, err
+}
+
+func createSQLDDLForEmailQueue() string {
+	return `
+	CREATE TABLE IF NOT EXISTS _email_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		recipients TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		html INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS _email_queue_pending ON _email_queue (status, next_attempt_at);`
+}
+
+// enqueueNotifications renders the notifications of a write and queues them.
+// Templates that fail to render are logged and skipped so that they never
+// fail the write itself.
+func enqueueNotifications(tx sqlx.Execer, event string, collectionName string, id int, document map[string]any) error {
+	rules := active().notificationCache[collectionName]
+	if len(rules) == 0 {
+		return nil
+	}
+	data := maps.Clone(document)
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["_id"] = id
+	data["_event"] = event
+	data["_collection"] = collectionName
+
+	for _, rule := range rules {
+		if !slices.Contains(rule.events, event) {
+			continue
+		}
+		subject, body, ok, err := renderNotification(rule, data)
+		if err != nil {
+			log.Printf("Error rendering notification for %s: %v", collectionName, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		recipients, err := json.Marshal(rule.to)
+		if err != nil {
+			return err
+		}
+		query := `INSERT INTO _email_queue (recipients, subject, body, html) VALUES ($1, $2, $3, $4)`
+		_, err = tx.Exec(query, string(recipients), subject, body, rule.html)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderNotification(rule notificationRule, data map[string]any) (string, string, bool, error) {
+	var buffer bytes.Buffer
+	if rule.filter != nil {
+		err := rule.filter.Execute(&buffer, data)
+		if err != nil {
+			return "", "", false, err
+		}
+		if strings.TrimSpace(buffer.String()) != "true" {
+			return "", "", false, nil
+		}
+		buffer.Reset()
+	}
+	err := rule.subject.Execute(&buffer, data)
+	if err != nil {
+		return "", "", false, err
+	}
+	subject := strings.TrimSpace(buffer.String())
+	buffer.Reset()
+	err = rule.body.Execute(&buffer, data)
+	if err != nil {
+		return "", "", false, err
+	}
+	return subject, buffer.String(), true, nil
+}
+
+// MailTransport delivers a complete message.
+type MailTransport interface {
+	Send(from string, to []string, message []byte) error
+}
+
+type smtpTransport struct {
+	config SMTPConfig
+}
+
+func (transport smtpTransport) Send(from string, to []string, message []byte) error {
+	port := transport.config.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	host := transport.config.Host
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), 30*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if transport.config.StartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smtp server %s does not support STARTTLS", host)
+		}
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if transport.config.Username != "" {
+		// PlainAuth refuses to send credentials over unencrypted connections
+		// to anything but localhost.
+		err = client.Auth(smtp.PlainAuth("", transport.config.Username, transport.config.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		err = client.Rcpt(recipient)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(message)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func buildEmailMessage(from string, to []string, subject string, body string, html bool, date time.Time) []byte {
+	contentType := "text/plain; charset=utf-8"
+	if html {
+		contentType = "text/html; charset=utf-8"
+	}
+	var message bytes.Buffer
+	message.WriteString("From: " + from + "\r\n")
+	message.WriteString("To: " + strings.Join(to, ", ") + "\r\n")
+	message.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	message.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: " + contentType + "\r\n")
+	message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	writer := quotedprintable.NewWriter(&message)
+	writer.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")))
+	writer.Close()
+	return message.Bytes()
+}
+
+func wakeMailer() {
+	select {
+	case mailerWake <- struct{}{}:
+	default:
+	}
+}
+
+// runMailer sends queued emails whenever notifications are queued and at
+// least every mailerPollInterval for retries. It runs even without smtp, so
+// that a reload which configures smtp and notifications needs no restart.
+func runMailer(db *sqlx.DB) {
+	runQueueWorker(mailerWake, mailerPollInterval, func() {
+		_, err := sendActiveQueuedEmails(db, time.Now())
+		if err != nil {
+			log.Printf("Error sending queued emails: %v", err)
+		}
+	})
+}
+
+// sendActiveQueuedEmails sends the emails that are due through the mail
+// server of the active config. Without one, emails stay queued.
+func sendActiveQueuedEmails(db *sqlx.DB, now time.Time) (int, error) {
+	smtpConfig := active().config.SMTP
+	if smtpConfig == nil {
+		return 0, nil
+	}
+	return sendQueuedEmails(db, smtpTransport{config: *smtpConfig}, smtpConfig.From, now)
+}
+
+type queuedEmail struct {
+	ID         int    `db:"id"`
+	Recipients string `db:"recipients"`
+	Subject    string `db:"subject"`
+	Body       string `db:"body"`
+	HTML       bool   `db:"html"`
+	Attempts   int    `db:"attempts"`
+}
+
+// sendQueuedEmails sends the emails that are due and returns how many were
+// sent. Failed emails are retried with exponential backoff and marked failed
+// after maxEmailAttempts.
+func sendQueuedEmails(db *sqlx.DB, transport MailTransport, from string, now time.Time) (int, error) {
+	emails := []queuedEmail{}
+	query := `SELECT id, recipients, subject, body, html, attempts FROM _email_queue WHERE status = $1 AND next_attempt_at <= datetime('now') ORDER BY id LIMIT $2`
+	err := db.Select(&emails, query, EmailPending, mailerBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, email := range emails {
+		var to []string
+		err = json.Unmarshal([]byte(email.Recipients), &to)
+		if err == nil {
+			err = transport.Send(from, to, buildEmailMessage(from, to, email.Subject, email.Body, email.HTML, now))
+		}
+		attempts := email.Attempts + 1
+		if err == nil {
+			sent++
+			_, err = db.Exec(`UPDATE _email_queue SET status = $1, attempts = $2, last_error = '' WHERE id = $3`, EmailSent, attempts, email.ID)
+			if err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		status := EmailPending
+		if attempts >= maxEmailAttempts {
+			status = EmailFailed
+		}
+		log.Printf("Error sending email %d (attempt %d): %v", email.ID, attempts, err)
+		delay := fmt.Sprintf("+%d seconds", 30<<(attempts-1))
+		query := `UPDATE _email_queue SET status = $1, attempts = $2, last_error = $3, next_attempt_at = datetime('now', $4) WHERE id = $5`
+		_, err = db.Exec(query, status, attempts, err.Error(), delay, email.ID)
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
@@ -12,8 +12,6 @@ import (
 //go:embed swagger-ui
 var swagfs embed.FS
 
-var openapiSpec []byte
-
 func buildOpenapiSpec(config Config) ([]byte, error) {
 	spec := map[string]any{
 		"openapi": "3.0.3",
@@ -33,6 +31,7 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 					"type":         "http",
 					"scheme":       "bearer",
 					"bearerFormat": "JWT",
+					"description":  "A static access token from the config, or a JWT when jwt is configured.",
 				},
 			},
 		},
@@ -69,6 +68,44 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 		},
 	}
 
+	schemas["Attachment"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"name": map[string]any{
+				"type": "string",
+			},
+			"content_type": map[string]any{
+				"type": "string",
+			},
+			"size": map[string]any{
+				"type": "integer",
+			},
+			"created_at": map[string]any{
+				"type": "string",
+			},
+		},
+	}
+
+	fieldUpdates := map[string]any{
+		"type":                 "object",
+		"additionalProperties": true,
+	}
+	schemas["UpdateOperators"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			OperatorInc:      fieldUpdates,
+			OperatorMul:      fieldUpdates,
+			OperatorMin:      fieldUpdates,
+			OperatorMax:      fieldUpdates,
+			OperatorSet:      fieldUpdates,
+			OperatorUnset:    fieldUpdates,
+			OperatorPush:     fieldUpdates,
+			OperatorAddToSet: fieldUpdates,
+			OperatorPull:     fieldUpdates,
+		},
+		"additionalProperties": false,
+	}
+
 	specPaths["/health"] = map[string]any{
 		"get": map[string]any{
 			"summary": "Health check endpoint",
@@ -81,15 +118,35 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 		},
 	}
 
+	// Shared definitions become components that collection schemas refer to.
+	resolver := newSchemaResolver(config)
+	for _, name := range sortedKeys(config.Definitions) {
+		schema, err := resolver.componentSchema(config.Definitions[name], schemaDocument{root: config.Definitions[name], dir: resolver.dir, config: true})
+		if err != nil {
+			return nil, err
+		}
+		schemas[name] = schema
+	}
+
 	for _, collection := range config.Collections {
 		schemaName := collection.Schema["title"].(string)
-		schemas[schemaName] = collection.Schema
+		declared := collection.declared().Schema
+		schema, err := resolver.componentSchema(declared, schemaDocument{root: declared, dir: resolver.dir, config: true})
+		if err != nil {
+			return nil, err
+		}
+		schemas[schemaName] = schema
 		tags = append(tags, map[string]any{
 			"name":        collection.Name,
 			"description": fmt.Sprintf("Operations related to the %s collection", collection.Name),
 		})
 
-		specPaths["/"+collection.Name] = map[string]any{
+		basePath := "/" + collection.Name
+		if collection.Parent != "" {
+			basePath = fmt.Sprintf("/%s/{parentId}/%s", collection.Parent, collection.Name)
+		}
+
+		specPaths[basePath] = map[string]any{
 			"get": map[string]any{
 				"summary":     "Get all documents from a collection",
 				"description": "Retrieve all documents from the specified collection",
@@ -113,6 +170,15 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 							"type": "integer",
 						},
 					},
+					{
+						"name":        "expand",
+						"in":          "query",
+						"description": "Comma separated reference fields to replace with the referenced documents",
+						"required":    false,
+						"schema": map[string]any{
+							"type": "string",
+						},
+					},
 				},
 				"responses": map[string]any{
 					"200": map[string]any{
@@ -138,7 +204,7 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 			},
 			"post": map[string]any{
 				"summary":     "Insert a new document",
-				"description": "Insert a new document into the specified collection",
+				"description": "Insert a new document into the specified collection. HTML form posts are coerced to the schema types and may be answered with a 303 redirect.",
 				"tags":        []string{collection.Name},
 				"requestBody": map[string]any{
 					"content": map[string]any{
@@ -147,6 +213,16 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 								"$ref": fmt.Sprintf("#/components/schemas/%s", schemaName),
 							},
 						},
+						"application/x-www-form-urlencoded": map[string]any{
+							"schema": map[string]any{
+								"$ref": fmt.Sprintf("#/components/schemas/%s", schemaName),
+							},
+						},
+						"multipart/form-data": map[string]any{
+							"schema": map[string]any{
+								"$ref": fmt.Sprintf("#/components/schemas/%s", schemaName),
+							},
+						},
 					},
 				},
 				"responses": map[string]any{
@@ -160,6 +236,9 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 							},
 						},
 					},
+					"303": map[string]any{
+						"description": "Form post redirected to the configured success or error page",
+					},
 					"400": map[string]any{
 						"description": "Invalid JSON or validation failed",
 						"content": map[string]any{
@@ -180,6 +259,16 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 							},
 						},
 					},
+					"409": map[string]any{
+						"description": "A unique value is already used",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
 					"404": map[string]any{
 						"description": "Collection not found",
 						"content": map[string]any{
@@ -194,7 +283,7 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 			},
 		}
 
-		specPaths[fmt.Sprintf("/%s/{id}", collection.Name)] = map[string]any{
+		specPaths[basePath+"/{id}"] = map[string]any{
 			"get": map[string]any{
 				"summary":     "Get a document by ID",
 				"description": "Retrieve a specific document from the collection by ID",
@@ -209,6 +298,15 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 							"type": "integer",
 						},
 					},
+					{
+						"name":        "expand",
+						"in":          "query",
+						"description": "Comma separated reference fields to replace with the referenced documents",
+						"required":    false,
+						"schema": map[string]any{
+							"type": "string",
+						},
+					},
 				},
 				"responses": map[string]any{
 					"200": map[string]any{
@@ -298,6 +396,93 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 							},
 						},
 					},
+					"409": map[string]any{
+						"description": "An immutable or write-once field was changed, or a unique value is already used",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
+					"404": map[string]any{
+						"description": "Document or collection not found",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
+				},
+			},
+			"patch": map[string]any{
+				"summary":     "Patch a document",
+				"description": "Replace the given top level fields of a document. The patched document must still match the collection schema.",
+				"tags":        []string{collection.Name},
+				"parameters": []map[string]any{
+					{
+						"name":        "id",
+						"in":          "path",
+						"description": "Document ID",
+						"required":    true,
+						"schema": map[string]any{
+							"type": "integer",
+						},
+					},
+				},
+				"requestBody": map[string]any{
+					"content": map[string]any{
+						"application/json": map[string]any{
+							"schema": map[string]any{
+								"type": "object",
+							},
+						},
+					},
+				},
+				"responses": map[string]any{
+					"200": map[string]any{
+						"description": "Document patched successfully",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": fmt.Sprintf("#/components/schemas/%s", schemaName),
+								},
+							},
+						},
+					},
+					"400": map[string]any{
+						"description": "Invalid JSON or validation failed",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
+					"401": map[string]any{
+						"description": "Unauthorized access",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
+					"409": map[string]any{
+						"description": "An immutable or write-once field was changed, or a unique value is already used",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
 					"404": map[string]any{
 						"description": "Document or collection not found",
 						"content": map[string]any{
@@ -336,6 +521,85 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 							},
 						},
 					},
+					"409": map[string]any{
+						"description": "Document is still referenced by other documents",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
+					"401": map[string]any{
+						"description": "Unauthorized access",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
+					"404": map[string]any{
+						"description": "Document or collection not found",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		specPaths[basePath+"/{id}/_update"] = map[string]any{
+			"post": map[string]any{
+				"summary":     "Atomically update a document",
+				"description": "Apply update operators ($inc, $mul, $min, $max, $set, $unset, $push, $addToSet, $pull) to a document in a single transaction. Field names use dot notation for nested paths.",
+				"tags":        []string{collection.Name},
+				"parameters": []map[string]any{
+					{
+						"name":        "id",
+						"in":          "path",
+						"description": "Document ID",
+						"required":    true,
+						"schema": map[string]any{
+							"type": "integer",
+						},
+					},
+				},
+				"requestBody": map[string]any{
+					"content": map[string]any{
+						"application/json": map[string]any{
+							"schema": map[string]any{
+								"$ref": "#/components/schemas/UpdateOperators",
+							},
+						},
+					},
+				},
+				"responses": map[string]any{
+					"200": map[string]any{
+						"description": "Document updated successfully",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": fmt.Sprintf("#/components/schemas/%s", schemaName),
+								},
+							},
+						},
+					},
+					"400": map[string]any{
+						"description": "Invalid update or validation failed",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
 					"401": map[string]any{
 						"description": "Unauthorized access",
 						"content": map[string]any{
@@ -346,6 +610,16 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 							},
 						},
 					},
+					"409": map[string]any{
+						"description": "An immutable or write-once field was changed, or a unique value is already used",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"$ref": "#/components/schemas/ErrorResponse",
+								},
+							},
+						},
+					},
 					"404": map[string]any{
 						"description": "Document or collection not found",
 						"content": map[string]any{
@@ -359,6 +633,408 @@ func buildOpenapiSpec(config Config) ([]byte, error) {
 				},
 			},
 		}
+
+		if collection.Attachments != nil && collection.Parent == "" {
+			idParameter := map[string]any{
+				"name":        "id",
+				"in":          "path",
+				"description": "Document ID",
+				"required":    true,
+				"schema": map[string]any{
+					"type": "integer",
+				},
+			}
+			nameParameter := map[string]any{
+				"name":        "name",
+				"in":          "path",
+				"description": "Attachment name",
+				"required":    true,
+				"schema": map[string]any{
+					"type": "string",
+				},
+			}
+			errorResponse := map[string]any{
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": map[string]any{
+							"$ref": "#/components/schemas/ErrorResponse",
+						},
+					},
+				},
+			}
+			specPaths[basePath+"/{id}/_files"] = map[string]any{
+				"get": map[string]any{
+					"summary":     "List attachments",
+					"description": "List the attachments of a document",
+					"tags":        []string{collection.Name},
+					"parameters":  []map[string]any{idParameter},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "Attachments retrieved successfully",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{
+										"type": "array",
+										"items": map[string]any{
+											"$ref": "#/components/schemas/Attachment",
+										},
+									},
+								},
+							},
+						},
+						"401": map[string]any{"description": "Unauthorized access", "content": errorResponse["content"]},
+						"404": map[string]any{"description": "Document or collection not found", "content": errorResponse["content"]},
+					},
+				},
+			}
+			specPaths[basePath+"/{id}/_files/{name}"] = map[string]any{
+				"get": map[string]any{
+					"summary":     "Download an attachment",
+					"description": "Download an attachment. Range requests are supported.",
+					"tags":        []string{collection.Name},
+					"parameters":  []map[string]any{idParameter, nameParameter},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "Attachment content",
+						},
+						"206": map[string]any{
+							"description": "Partial attachment content",
+						},
+						"401": map[string]any{"description": "Unauthorized access", "content": errorResponse["content"]},
+						"404": map[string]any{"description": "Attachment, document or collection not found", "content": errorResponse["content"]},
+					},
+				},
+				"put": map[string]any{
+					"summary":     "Upload an attachment",
+					"description": "Upload an attachment as the raw request body or as a file part of multipart/form-data. An existing attachment with the same name is replaced.",
+					"tags":        []string{collection.Name},
+					"parameters":  []map[string]any{idParameter, nameParameter},
+					"requestBody": map[string]any{
+						"content": map[string]any{
+							"application/octet-stream": map[string]any{
+								"schema": map[string]any{
+									"type":   "string",
+									"format": "binary",
+								},
+							},
+							"multipart/form-data": map[string]any{
+								"schema": map[string]any{
+									"type": "object",
+									"properties": map[string]any{
+										"file": map[string]any{
+											"type":   "string",
+											"format": "binary",
+										},
+									},
+								},
+							},
+						},
+					},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "Attachment saved successfully",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{
+										"$ref": "#/components/schemas/SuccessResponse",
+									},
+								},
+							},
+						},
+						"401": map[string]any{"description": "Unauthorized access", "content": errorResponse["content"]},
+						"404": map[string]any{"description": "Document or collection not found", "content": errorResponse["content"]},
+						"413": map[string]any{"description": "Attachment too large", "content": errorResponse["content"]},
+						"415": map[string]any{"description": "Content type not allowed", "content": errorResponse["content"]},
+					},
+				},
+				"delete": map[string]any{
+					"summary":     "Delete an attachment",
+					"description": "Delete an attachment of a document",
+					"tags":        []string{collection.Name},
+					"parameters":  []map[string]any{idParameter, nameParameter},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "Attachment deleted successfully",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{
+										"$ref": "#/components/schemas/SuccessResponse",
+									},
+								},
+							},
+						},
+						"401": map[string]any{"description": "Unauthorized access", "content": errorResponse["content"]},
+						"404": map[string]any{"description": "Attachment, document or collection not found", "content": errorResponse["content"]},
+					},
+				},
+			}
+		}
+
+		if collection.Parent == "" {
+			specPaths[basePath+"/_changes"] = map[string]any{
+				"get": map[string]any{
+					"summary":     "Stream changes",
+					"description": "Stream writes to the collection as Server-Sent Events. Event ids are change log sequence numbers; reconnecting clients resume after Last-Event-ID.",
+					"tags":        []string{collection.Name},
+					"parameters": []map[string]any{
+						{
+							"name":        "Last-Event-ID",
+							"in":          "header",
+							"description": "Resume after this sequence number",
+							"schema": map[string]any{
+								"type": "integer",
+							},
+						},
+						{
+							"name":        "since",
+							"in":          "query",
+							"description": "Resume after this sequence number",
+							"schema": map[string]any{
+								"type": "integer",
+							},
+						},
+						{
+							"name":        "filter",
+							"in":          "query",
+							"description": "JSON query object the documents must match",
+							"schema": map[string]any{
+								"type": "string",
+							},
+						},
+						{
+							"name":        "ticket",
+							"in":          "query",
+							"description": "Ticket from _changes_ticket for clients that cannot set the Authorization header",
+							"schema": map[string]any{
+								"type": "string",
+							},
+						},
+					},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "Event stream",
+							"content": map[string]any{
+								"text/event-stream": map[string]any{
+									"schema": map[string]any{
+										"type": "string",
+									},
+								},
+							},
+						},
+						"400": map[string]any{
+							"description": "Invalid filter or event ID",
+						},
+						"401": map[string]any{
+							"description": "Unauthorized access",
+						},
+					},
+				},
+			}
+			specPaths[basePath+"/_changes_ticket"] = map[string]any{
+				"post": map[string]any{
+					"summary":     "Get a change feed ticket",
+					"description": "Get a ticket that opens one change feed for the token of the request. Tickets expire after 60 seconds.",
+					"tags":        []string{collection.Name},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "Ticket issued",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{
+										"type": "object",
+										"properties": map[string]any{
+											"ticket": map[string]any{
+												"type": "string",
+											},
+										},
+									},
+								},
+							},
+						},
+						"401": map[string]any{
+							"description": "Unauthorized access",
+						},
+					},
+				},
+			}
+		}
+
+		if collection.Sync != nil {
+			errorResponse := map[string]any{
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": map[string]any{
+							"$ref": "#/components/schemas/ErrorResponse",
+						},
+					},
+				},
+			}
+			specPaths[basePath+"/_sync"] = map[string]any{
+				"get": map[string]any{
+					"summary":     "Pull changes",
+					"description": "Get the documents changed after a checkpoint in revision order. Deleted documents are returned as tombstones with _deleted set.",
+					"tags":        []string{collection.Name},
+					"parameters": []map[string]any{
+						{
+							"name":        "checkpoint",
+							"in":          "query",
+							"description": "Checkpoint returned by the previous pull. Omit it to start from the beginning.",
+							"schema": map[string]any{
+								"type": "string",
+							},
+						},
+						{
+							"name":        "limit",
+							"in":          "query",
+							"description": "Maximum number of documents to return",
+							"schema": map[string]any{
+								"type":    "integer",
+								"default": 100,
+							},
+						},
+					},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "Changed documents",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{
+										"type": "object",
+										"properties": map[string]any{
+											"documents": map[string]any{
+												"type":  "array",
+												"items": map[string]any{"type": "object"},
+											},
+											"checkpoint": map[string]any{"type": "string"},
+											"has_more":   map[string]any{"type": "boolean"},
+										},
+									},
+								},
+							},
+						},
+						"400": map[string]any{"description": "Invalid checkpoint", "content": errorResponse["content"]},
+						"401": map[string]any{"description": "Unauthorized access", "content": errorResponse["content"]},
+					},
+				},
+				"post": map[string]any{
+					"summary":     "Push changes",
+					"description": "Apply a batch of client changes. Changes made against an outdated revision are resolved with the " + collection.Sync.conflictPolicy() + " policy.",
+					"tags":        []string{collection.Name},
+					"requestBody": map[string]any{
+						"required": true,
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": map[string]any{
+									"type": "object",
+									"properties": map[string]any{
+										"changes": map[string]any{
+											"type":     "array",
+											"maxItems": maxSyncBatchSize,
+											"items": map[string]any{
+												"type": "object",
+												"properties": map[string]any{
+													"id":          map[string]any{"type": "integer"},
+													"rev":         map[string]any{"type": "integer"},
+													"deleted":     map[string]any{"type": "boolean"},
+													"document":    map[string]any{"type": "object"},
+													"modified_at": map[string]any{"type": "string", "format": "date-time"},
+												},
+											},
+										},
+									},
+									"required": []string{"changes"},
+								},
+							},
+						},
+					},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "One result per change, in order",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{
+										"type": "object",
+										"properties": map[string]any{
+											"results": map[string]any{
+												"type": "array",
+												"items": map[string]any{
+													"type": "object",
+													"properties": map[string]any{
+														"id":       map[string]any{"type": "integer"},
+														"status":   map[string]any{"type": "string", "enum": []string{SyncApplied, SyncRejected, SyncConflict, SyncError}},
+														"rev":      map[string]any{"type": "integer"},
+														"document": map[string]any{"type": "object"},
+														"error":    map[string]any{"type": "string"},
+													},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+						"400": map[string]any{"description": "Invalid JSON", "content": errorResponse["content"]},
+						"401": map[string]any{"description": "Unauthorized access", "content": errorResponse["content"]},
+						"413": map[string]any{"description": "Too many changes", "content": errorResponse["content"]},
+					},
+				},
+			}
+		}
+
+		if collection.Spam != nil && collection.Parent == "" {
+			errorResponse := map[string]any{
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": map[string]any{
+							"$ref": "#/components/schemas/ErrorResponse",
+						},
+					},
+				},
+			}
+			specPaths[basePath+"/_form_token"] = map[string]any{
+				"get": map[string]any{
+					"summary":     "Get a form token",
+					"description": "Get a signed token to submit with a new document. Submissions must not arrive sooner than min_submit_seconds after the token was issued.",
+					"tags":        []string{collection.Name},
+					"responses": map[string]any{
+						"200": map[string]any{
+							"description": "Form token issued",
+							"content": map[string]any{
+								"application/json": map[string]any{
+									"schema": map[string]any{
+										"type": "object",
+										"properties": map[string]any{
+											"token": map[string]any{
+												"type": "string",
+											},
+										},
+									},
+								},
+							},
+						},
+						"401": map[string]any{"description": "Unauthorized access", "content": errorResponse["content"]},
+						"404": map[string]any{"description": "Collection not found", "content": errorResponse["content"]},
+					},
+				},
+			}
+		}
+
+		if collection.Parent != "" {
+			parentParameters := []map[string]any{
+				{
+					"name":        "parentId",
+					"in":          "path",
+					"description": fmt.Sprintf("ID of the parent document in %s", collection.Parent),
+					"required":    true,
+					"schema": map[string]any{
+						"type": "integer",
+					},
+				},
+			}
+			for _, path := range []string{basePath, basePath + "/{id}", basePath + "/{id}/_update"} {
+				specPaths[path].(map[string]any)["parameters"] = parentParameters
+			}
+		}
 	}
 
 	spec["components"].(map[string]any)["schemas"] = schemas
@@ -374,7 +1050,7 @@ func SwaggerHandler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /apispec.json", func(w http.ResponseWriter, _ *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(openapiSpec)
+		w.Write(active().openapiSpec)
 	})
 	mux.Handle("/", http.FileServer(http.FS(static)))
 	return mux
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+const (
+	FilterEq     = "$eq"
+	FilterNe     = "$ne"
+	FilterGt     = "$gt"
+	FilterGte    = "$gte"
+	FilterLt     = "$lt"
+	FilterLte    = "$lte"
+	FilterIn     = "$in"
+	FilterNin    = "$nin"
+	FilterExists = "$exists"
+)
+
+var filterOperators = []string{FilterEq, FilterNe, FilterGt, FilterGte, FilterLt, FilterLte, FilterIn, FilterNin, FilterExists}
+
+var errInvalidFilter = errors.New("invalid filter")
+
+// documentFilter selects documents with a MongoDB style query object such as
+// {"status": "open", "votes": {"$gte": 3}}. All conditions must match.
+type documentFilter []filterCondition
+
+type filterCondition struct {
+	Path     []string
+	Operator string
+	Value    any
+}
+
+// parseFilter parses a JSON query object. An empty string is a filter that
+// matches every document.
+func parseFilter(raw string) (documentFilter, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var query map[string]any
+	err := json.Unmarshal([]byte(raw), &query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidFilter, err)
+	}
+	return filterFromQuery(query)
+}
+
+func filterFromQuery(query map[string]any) (documentFilter, error) {
+	filter := documentFilter{}
+	for field, value := range query {
+		path, err := splitFieldPath(field)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid field %q", errInvalidFilter, field)
+		}
+		operators, isObject := value.(map[string]any)
+		if !isObject || !isOperatorObject(operators) {
+			filter = append(filter, filterCondition{Path: path, Operator: FilterEq, Value: value})
+			continue
+		}
+		for operator, operand := range operators {
+			if !slices.Contains(filterOperators, operator) {
+				return nil, fmt.Errorf("%w: unknown operator %s", errInvalidFilter, operator)
+			}
+			if operator == FilterIn || operator == FilterNin {
+				if _, isArray := operand.([]any); !isArray {
+					return nil, fmt.Errorf("%w: %s needs an array", errInvalidFilter, operator)
+				}
+			}
+			if _, isBool := operand.(bool); operator == FilterExists && !isBool {
+				return nil, fmt.Errorf("%w: %s needs a boolean", errInvalidFilter, operator)
+			}
+			filter = append(filter, filterCondition{Path: path, Operator: operator, Value: operand})
+		}
+	}
+	return filter, nil
+}
+
+func isOperatorObject(object map[string]any) bool {
+	if len(object) == 0 {
+		return false
+	}
+	for key := range object {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches reports whether a document satisfies every condition.
+func (filter documentFilter) Matches(document map[string]any) bool {
+	for _, condition := range filter {
+		if !condition.matches(document) {
+			return false
+		}
+	}
+	return true
+}
+
+func (condition filterCondition) matches(document map[string]any) bool {
+	value, exists := fieldValue(document, condition.Path)
+	switch condition.Operator {
+	case FilterExists:
+		return exists == condition.Value.(bool)
+	case FilterEq:
+		return exists && equalsFilterValue(value, condition.Value)
+	case FilterNe:
+		return !exists || !equalsFilterValue(value, condition.Value)
+	case FilterIn:
+		return exists && containsFilterValue(condition.Value.([]any), value)
+	case FilterNin:
+		return !exists || !containsFilterValue(condition.Value.([]any), value)
+	}
+	if !exists {
+		return false
+	}
+	order, comparable := compareFilterValues(value, condition.Value)
+	if !comparable {
+		return false
+	}
+	switch condition.Operator {
+	case FilterGt:
+		return order > 0
+	case FilterGte:
+		return order >= 0
+	case FilterLt:
+		return order < 0
+	case FilterLte:
+		return order <= 0
+	}
+	return false
+}
+
+// equalsFilterValue compares JSON values. A scalar also matches an array
+// field that contains it.
+func equalsFilterValue(value any, expected any) bool {
+	normalized := normalizeJSON(value)
+	if reflect.DeepEqual(normalized, normalizeJSON(expected)) {
+		return true
+	}
+	if items, isArray := normalized.([]any); isArray {
+		return containsJSONValue(items, expected)
+	}
+	return false
+}
+
+func containsFilterValue(candidates []any, value any) bool {
+	for _, candidate := range candidates {
+		if equalsFilterValue(value, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareFilterValues orders two numbers or two strings.
+func compareFilterValues(value any, operand any) (int, bool) {
+	switch left := normalizeJSON(value).(type) {
+	case float64:
+		right, ok := normalizeJSON(operand).(float64)
+		if !ok {
+			return 0, false
+		}
+		if left < right {
+			return -1, true
+		} else if left > right {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		right, ok := normalizeJSON(operand).(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(left, right), true
+	}
+	return 0, false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	OnDeleteRestrict = "restrict"
+	OnDeleteCascade  = "cascade"
+	OnDeleteSetNull  = "set-null"
+)
+
+var errReferenceNotFound = errors.New("referenced document not found")
+var errReferenceRestricted = errors.New("document is still referenced")
+
+// Reference is a schema property declared with the x-ref keyword. It holds
+// the id of a document in the target collection.
+type Reference struct {
+	Collection string
+	Field      []string
+	Target     string
+	OnDelete   string
+}
+
+func buildReferenceCache(collections []Collection) (map[string][]Reference, error) {
+	var referenceCache = make(map[string][]Reference)
+	for _, collection := range collections {
+		references := []Reference{}
+		err := collectReferences(collection.Name, collection.Schema, []string{}, &references)
+		if err != nil {
+			return nil, err
+		}
+		for _, reference := range references {
+			if !slices.ContainsFunc(collections, func(c Collection) bool { return c.Name == reference.Target }) {
+				return nil, fmt.Errorf("collection %s: field %s references unknown collection %s", collection.Name, reference.FieldName(), reference.Target)
+			}
+		}
+		referenceCache[collection.Name] = references
+	}
+	return referenceCache, nil
+}
+
+// collectReferences walks the properties of an object schema and records
+// every property carrying an x-ref keyword. x-ref is either the target
+// collection name or an object {"collection": ..., "on_delete": ...}.
+func collectReferences(collectionName string, schema map[string]any, path []string, references *[]Reference) error {
+	properties := schemaProperties(schema)
+	for name, property := range properties {
+		propertySchema, ok := property.(map[string]any)
+		if !ok {
+			continue
+		}
+		field := append(slices.Clone(path), name)
+		ref, hasRef := propertySchema["x-ref"]
+		if !hasRef {
+			err := collectReferences(collectionName, propertySchema, field, references)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		reference := Reference{Collection: collectionName, Field: field, OnDelete: OnDeleteRestrict}
+		switch value := ref.(type) {
+		case string:
+			reference.Target = value
+		case map[string]any:
+			reference.Target, _ = value["collection"].(string)
+			if onDelete, ok := value["on_delete"].(string); ok {
+				reference.OnDelete = onDelete
+			}
+		}
+		if reference.Target == "" {
+			return fmt.Errorf("collection %s: field %s has an invalid x-ref", collectionName, reference.FieldName())
+		}
+		if !slices.Contains([]string{OnDeleteRestrict, OnDeleteCascade, OnDeleteSetNull}, reference.OnDelete) {
+			return fmt.Errorf("collection %s: field %s has unknown on_delete %q", collectionName, reference.FieldName(), reference.OnDelete)
+		}
+		*references = append(*references, reference)
+	}
+	return nil
+}
+
+func (reference Reference) FieldName() string {
+	return strings.Join(reference.Field, ".")
+}
+
+func (reference Reference) JSONPath() string {
+	return `$."` + strings.Join(reference.Field, `"."`) + `"`
+}
+
+func getReferenceByField(collectionName string, field string) *Reference {
+	for _, reference := range active().referenceCache[collectionName] {
+		if reference.FieldName() == field {
+			return &reference
+		}
+	}
+	return nil
+}
+
+// incomingReferences returns the references of all collections that point
+// at the given collection.
+func incomingReferences(collectionName string) []Reference {
+	references := []Reference{}
+	for _, outgoing := range active().referenceCache {
+		for _, reference := range outgoing {
+			if reference.Target == collectionName {
+				references = append(references, reference)
+			}
+		}
+	}
+	return references
+}
+
+func fieldValue(document map[string]any, path []string) (any, bool) {
+	var current any = document
+	for _, segment := range path {
+		object, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[segment]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func setFieldValue(document map[string]any, path []string, value any) {
+	object := document
+	for _, segment := range path[:len(path)-1] {
+		child, ok := object[segment].(map[string]any)
+		if !ok {
+			return
+		}
+		object = child
+	}
+	object[path[len(path)-1]] = value
+}
+
+func deleteFieldValue(document map[string]any, path []string) {
+	object := document
+	for _, segment := range path[:len(path)-1] {
+		child, ok := object[segment].(map[string]any)
+		if !ok {
+			return
+		}
+		object = child
+	}
+	delete(object, path[len(path)-1])
+}
+
+func referenceID(value any) (int, bool) {
+	number, ok := sqlNumber(value)
+	id, isInt := number.(int64)
+	return int(id), ok && isInt
+}
+
+// checkReferences verifies that every reference held by the document points
+// at an existing document.
+func checkReferences(q sqlx.Queryer, collectionName string, document map[string]any) error {
+	for _, reference := range active().referenceCache[collectionName] {
+		value, exists := fieldValue(document, reference.Field)
+		if !exists || value == nil {
+			continue
+		}
+		id, ok := referenceID(value)
+		if !ok {
+			return fmt.Errorf("%w: %s must be a document id", errReferenceNotFound, reference.FieldName())
+		}
+		var count int
+		err := sqlx.Get(q, &count, `SELECT COUNT(*) FROM `+reference.Target+` WHERE id = $1 AND `+liveCondition(reference.Target), id)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("%w: %s %d in %s", errReferenceNotFound, reference.FieldName(), id, reference.Target)
+		}
+	}
+	return nil
+}
+
+// expandReferences replaces the ids held by the given reference fields with
+// the referenced documents. Missing documents expand to null.
+func expandReferences(q sqlx.Queryer, collectionName string, documents []map[string]any, fields []string) error {
+	for _, field := range fields {
+		reference := getReferenceByField(collectionName, field)
+		if reference == nil {
+			return fmt.Errorf("%s is not a reference field", field)
+		}
+		ids := []int{}
+		for _, document := range documents {
+			value, _ := fieldValue(document, reference.Field)
+			if id, ok := referenceID(value); ok {
+				ids = append(ids, id)
+			}
+		}
+		targets, err := getDocumentsByIDs(q, reference.Target, ids)
+		if err != nil {
+			return err
+		}
+		for _, document := range documents {
+			value, exists := fieldValue(document, reference.Field)
+			if !exists || value == nil {
+				continue
+			}
+			id, _ := referenceID(value)
+			if target, found := targets[id]; found {
+				setFieldValue(document, reference.Field, target)
+			} else {
+				setFieldValue(document, reference.Field, nil)
+			}
+		}
+	}
+	return nil
+}
+
+// expandFieldsFromQuery reads ?expand=a,b and repeated expand parameters.
+func expandFieldsFromQuery(values []string) []string {
+	fields := []string{}
+	for _, value := range values {
+		for field := range strings.SplitSeq(value, ",") {
+			field = strings.TrimSpace(field)
+			if field != "" && !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
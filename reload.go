@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+const configWatchInterval = 2 * time.Second
+
+// reloadLock serializes reloads.
+var reloadLock sync.Mutex
+
+// loadedConfig is a validated configuration with its caches, ready to be
+// swapped in. It is never changed once it is active, so it can be read
+// without locks; a reload activates a new one instead.
+type loadedConfig struct {
+	config Config
+	// schemaCache holds the compiled schema of every collection. A schema
+	// that does not compile is stored as nil, and no document passes it.
+	schemaCache       map[string]*jsonschema.Schema
+	keywordCache      map[string][]keywordField // {"collection" : fields with enforced keywords}
+	authCache         map[string][]string       // {"collection-action" : "access token or JWT role names"}
+	publicCache       map[string]bool           // {"collection-action" : runs without a token}
+	tokenIndex        *accessTokenIndex
+	jwtAuth           *jwtVerifier
+	referenceCache    map[string][]Reference        // {"collection" : outgoing references}
+	notificationCache map[string][]notificationRule // {"collection": rules}
+	openapiSpec       []byte
+}
+
+// activeConfig holds the active configuration. A reload swaps it at once
+// and never waits for running requests. Tables of new collections are
+// created before the swap and tables are never dropped, so a request that
+// runs across a reload still finds the tables it works on.
+var activeConfig atomic.Pointer[loadedConfig]
+
+var emptyConfig = &loadedConfig{}
+
+// active returns the active configuration. Code that reads several values
+// of it keeps the result in a variable, so that all of them come from the
+// same configuration.
+func active() *loadedConfig {
+	if loaded := activeConfig.Load(); loaded != nil {
+		return loaded
+	}
+	return emptyConfig
+}
+
+// loadConfig reads a config file, merges the runtime overrides stored in
+// the database over it and builds the caches, without touching the active
+// configuration.
+func loadConfig(configFile string) (*loadedConfig, error) {
+	config, err := readConfig(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	overrides, err := loadRuntimeOverrides(db)
+	if err != nil {
+		return nil, fmt.Errorf("could not read runtime configuration: %w", err)
+	}
+	return buildLoadedConfig(mergeRuntimeOverrides(config, overrides))
+}
+
+// buildLoadedConfig validates a configuration and builds its caches.
+func buildLoadedConfig(config Config) (*loadedConfig, error) {
+	config, err := resolveCollectionSchemas(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema reference: %w", err)
+	}
+
+	problems := checkConfig(config)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+
+	err = checkCollectionParents(config.Collections)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collection hierarchy: %w", err)
+	}
+
+	err = checkGeneratedFields(config.Collections)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generated fields: %w", err)
+	}
+
+	err = checkCollectionTTLs(config.Collections)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ttl: %w", err)
+	}
+
+	err = checkCollectionSync(config.Collections)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sync: %w", err)
+	}
+
+	err = checkCollectionVersioning(config.Collections)
+	if err != nil {
+		return nil, fmt.Errorf("invalid versioning: %w", err)
+	}
+
+	err = checkConfigWebhooks(config.Collections)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhooks: %w", err)
+	}
+
+	loaded := &loadedConfig{
+		config:       config,
+		schemaCache:  buildSchemaCache(config.Collections),
+		keywordCache: buildKeywordCache(config.Collections),
+		authCache:    buildAuthCache(config),
+		publicCache:  buildPublicCache(config),
+	}
+
+	loaded.tokenIndex, err = buildTokenIndex(config.AccessTokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access tokens: %w", err)
+	}
+
+	loaded.jwtAuth, err = newJWTVerifier(config.JWT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt: %w", err)
+	}
+
+	loaded.referenceCache, err = buildReferenceCache(config.Collections)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collection references: %w", err)
+	}
+
+	loaded.notificationCache, err = buildNotificationCache(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notifications: %w", err)
+	}
+
+	loaded.openapiSpec, err = buildOpenapiSpec(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OpenAPI spec: %w", err)
+	}
+	return loaded, nil
+}
+
+// activate makes the loaded configuration the active one and wakes the JWKS
+// refresher, so that the keys of a new jwks_url are fetched right away.
+func (loaded *loadedConfig) activate() {
+	activeConfig.Store(loaded)
+	wakeJWKSRefresher()
+}
+
+// reloadConfig replaces the active configuration with the contents of the
+// config file. Tables of new collections are created and webhooks stored
+// before the swap, so no request sees a collection without its table. On any
+// error the active configuration stays in place.
+func reloadConfig(configFile string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	loaded, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	err = migrateDatabase(db, loaded.config.Collections)
+	if err != nil {
+		return fmt.Errorf("error migrating database: %w", err)
+	}
+
+	previous := active().config
+	restartSettings := changedRestartSettings(previous, loaded.config)
+
+	// Webhooks of the config file may clash with webhooks created through
+	// the admin API, so they are stored before the config goes live.
+	err = syncConfigWebhooks(db, loaded.config.Collections)
+	if err != nil {
+		return fmt.Errorf("invalid webhooks: %w", err)
+	}
+	loaded.activate()
+	// Checking every document against a changed schema can take long, so it
+	// neither holds the reload lock nor delays the new config.
+	go logSchemaPlans(db, previous.Collections, loaded.config.Collections)
+
+	for _, setting := range restartSettings {
+		log.Printf("Config setting %s changed and takes effect after a restart", setting)
+	}
+	return nil
+}
+
+// changedRestartSettings lists settings that are only read at startup and
+// differ between two configurations.
+func changedRestartSettings(previous Config, next Config) []string {
+	settings := []string{}
+	if previous.Host != next.Host || previous.Port != next.Port {
+		settings = append(settings, "host/port")
+	}
+	if previous.ReaperInterval != next.ReaperInterval {
+		settings = append(settings, "reaper_interval")
+	}
+	if previous.ChangesRetention != next.ChangesRetention {
+		settings = append(settings, "changes_retention")
+	}
+	if !reflect.DeepEqual(previous.AttachmentStorage, next.AttachmentStorage) {
+		settings = append(settings, "attachment_storage")
+	}
+	if previous.SpamSecret != next.SpamSecret {
+		settings = append(settings, "spam_secret")
+	}
+	return settings
+}
+
+// watchConfig reloads the config file on SIGHUP and whenever the
+// modification time or size of it or one of its includes changes.
+func watchConfig(configFile string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	lastState := configFileState(configFile, nil)
+	for {
+		select {
+		case <-hangup:
+		case <-ticker.C:
+			state := configFileState(configFile, nil)
+			if state == "" || state == lastState {
+				continue
+			}
+		}
+		lastState = configFileState(configFile, nil)
+
+		err := reloadConfig(configFile)
+		if err != nil {
+			log.Printf("Config reload rejected, keeping the active config: %v", err)
+			continue
+		}
+		log.Printf("Config reloaded from %s", configFile)
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"time"
 )
 
 func getAuthTokenFromRequest(r *http.Request) string {
@@ -22,8 +25,9 @@ func getAuthTokenFromRequest(r *http.Request) string {
 }
 
 func sendError(w http.ResponseWriter, message string, code int) {
+	quoted, _ := json.Marshal(message)
 	w.Header().Set("Content-Type", "application/json")
-	http.Error(w, fmt.Sprintf(`{"error": {"message": "%s"}}`, message), code)
+	http.Error(w, fmt.Sprintf(`{"error": {"message": %s}}`, quoted), code)
 }
 
 func sendSuccess(w http.ResponseWriter, message string) {
@@ -52,55 +56,198 @@ func mockOptionsHandler(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func insertDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	collectionName := r.PathValue("collection")
-	if !isCollectionExists(collectionName) {
+// requestCollection resolves the collection addressed by a flat route
+// (/{collection}) or a nested route (/{parent}/{parentId}/{collection}) and
+// checks that the caller may perform action on it. Child collections are only
+// reachable through their parent, and the parent document must exist. It
+// sends the error response and returns ok == false when the request cannot
+// proceed. parentID is 0 for flat routes.
+func requestCollection(w http.ResponseWriter, r *http.Request, action string) (collectionName string, parentID int, ok bool) {
+	collectionName = r.PathValue("collection")
+	collection := getCollectionByName(collectionName)
+	if collection == nil || collection.Parent != r.PathValue("parent") {
 		sendError(w, "Collection not found", http.StatusNotFound)
-		return
+		return "", 0, false
 	}
 
 	authToken := getAuthTokenFromRequest(r)
-	if !isAuthTokenValid(authToken, collectionName, ActionCreate) {
+	if !isAuthTokenValid(authToken, collectionName, action) {
+		sendError(w, "Unauthorized access", http.StatusUnauthorized)
+		return "", 0, false
+	}
+	if collection.Parent == "" {
+		return collectionName, 0, true
+	}
+	if collection.ParentAuth == ParentAuthCombine && !isAuthTokenValid(authToken, collection.Parent, ActionRead) {
 		sendError(w, "Unauthorized access", http.StatusUnauthorized)
+		return "", 0, false
+	}
+
+	parentID, err := StoiStrict(r.PathValue("parentId"))
+	if err != nil {
+		sendError(w, "Invalid parent ID", http.StatusBadRequest)
+		return "", 0, false
+	}
+	_, err = getDocument(db, collection.Parent, parentID)
+	if err != nil {
+		if isDocumentNotFound(err) {
+			sendError(w, "Parent document not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error retrieving parent document: %v", err)
+			sendError(w, "Failed to retrieve parent document", http.StatusInternalServerError)
+		}
+		return "", 0, false
+	}
+
+	if id, err := StoiStrict(r.PathValue("id")); err == nil {
+		inParent, err := isChildDocument(db, collectionName, parentID, id)
+		if err != nil {
+			log.Printf("Error retrieving document: %v", err)
+			sendError(w, "Failed to retrieve document", http.StatusInternalServerError)
+			return "", 0, false
+		}
+		if !inParent {
+			sendError(w, "Document not found", http.StatusNotFound)
+			return "", 0, false
+		}
+	}
+	return collectionName, parentID, true
+}
+
+func insertDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	collectionName, parentID, ok := requestCollection(w, r, ActionCreate)
+	if !ok {
 		return
 	}
+	collection := getCollectionByName(collectionName)
+
+	// HTML form posts are answered with redirects when the collection has them
+	isForm := isFormRequest(r)
+	fail := func(message string, code int) {
+		if isForm && collection.Form != nil && collection.Form.ErrorRedirect != "" {
+			redirectForm(w, r, collection.Form.ErrorRedirect, message)
+			return
+		}
+		sendError(w, message, code)
+	}
 
 	var document map[string]any
-	// Decode JSON from request body
-	err := json.NewDecoder(r.Body).Decode(&document)
+	var uploads []formUpload
+	var err error
+	if isForm {
+		document, uploads, err = decodeFormDocument(w, r, collection)
+		if errors.Is(err, errAttachmentTooLarge) || errors.Is(err, errFormTooLarge) {
+			fail(err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			fail(err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		// Decode JSON from request body
+		err = json.NewDecoder(r.Body).Decode(&document)
+		if err != nil {
+			fail("Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	defer r.Body.Close()
+
+	// Run the spam checks; rejected submissions are kept for review unless
+	// they were throttled
+	submitted := maps.Clone(document)
+	reject := func(rejection *spamRejection) {
+		if !rejection.Throttled {
+			err := quarantineSubmission(db, collectionName, rejection.Reason, clientIP(r), submitted)
+			if err != nil {
+				log.Printf("Error quarantining submission: %v", err)
+			}
+		}
+		if !rejection.Silent {
+			fail(rejection.Reason, rejection.Status)
+			return
+		}
+		if isForm && collection.Form != nil && collection.Form.SuccessRedirect != "" {
+			redirectForm(w, r, collection.Form.SuccessRedirect, "")
+			return
+		}
+		sendSuccess(w, "Document inserted")
+	}
+	rejection, err := checkSubmission(db, collection, document, clientIP(r), time.Now())
 	if err != nil {
-		sendError(w, "Invalid JSON", http.StatusBadRequest)
+		log.Printf("Error checking submission: %v", err)
+		fail("Failed to check submission", http.StatusInternalServerError)
+		return
+	}
+	if rejection != nil {
+		reject(rejection)
 		return
 	}
-	defer r.Body.Close()
 
-	// Validate against schema
-	if !validateJSONByCollectionName(document, collectionName) {
-		sendError(w, "Validation failed", http.StatusBadRequest)
+	// Validate and insert in one transaction, so that unique fields and
+	// references are checked against every committed write
+	tx, err := beginWrite(db)
+	if err != nil {
+		log.Printf("Error inserting document: %v", err)
+		fail("Failed to insert document", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	// Insert into database
-	err = insertDocument(db, collectionName, document)
+	// Duplicates are only remembered once the document is inserted
+	rejection, err = checkDuplicateSubmission(tx, collection, document)
+	if err != nil {
+		log.Printf("Error checking submission: %v", err)
+		fail("Failed to check submission", http.StatusInternalServerError)
+		return
+	}
+	if rejection != nil {
+		// The quarantine is written outside of the insert transaction.
+		tx.Rollback()
+		reject(rejection)
+		return
+	}
+
+	// Fill in defaults and generated fields, then validate
+	err = prepareInsert(tx, collectionName, newWriteContext(r), document)
+	if err != nil {
+		fail(validationErrorMessage(err))
+		return
+	}
+
+	// Insert into database, together with the uploaded files
+	id, err := insertDocumentTx(tx, collectionName, parentID, document)
+	if err != nil {
+		log.Printf("Error inserting document: %v", err)
+		fail("Failed to insert document", http.StatusInternalServerError)
+		return
+	}
+	for _, upload := range uploads {
+		err = saveAttachmentTx(tx, attachmentStore, collectionName, id, upload.Name, upload.ContentType, upload.Content)
+		if err != nil {
+			log.Printf("Error saving attachment: %v", err)
+			fail("Failed to save attachment", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = commitWrite(tx)
 	if err != nil {
 		log.Printf("Error inserting document: %v", err)
-		sendError(w, "Failed to insert document", http.StatusInternalServerError)
+		fail("Failed to insert document", http.StatusInternalServerError)
 		return
 	}
 
+	if isForm && collection.Form != nil && collection.Form.SuccessRedirect != "" {
+		redirectForm(w, r, collection.Form.SuccessRedirect, "")
+		return
+	}
 	sendSuccess(w, "Document inserted")
 }
 
 func getDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	collectionName := r.PathValue("collection")
-	if !isCollectionExists(collectionName) {
-		sendError(w, "Collection not found", http.StatusNotFound)
-		return
-	}
-
-	authToken := getAuthTokenFromRequest(r)
-	if !isAuthTokenValid(authToken, collectionName, ActionRead) {
-		sendError(w, "Unauthorized access", http.StatusUnauthorized)
+	collectionName, _, ok := requestCollection(w, r, ActionRead)
+	if !ok {
 		return
 	}
 
@@ -111,6 +258,11 @@ func getDocumentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	expand := expandFieldsFromQuery(r.URL.Query()["expand"])
+	if !canExpand(w, getAuthTokenFromRequest(r), collectionName, expand) {
+		return
+	}
+
 	document, err := getDocument(db, collectionName, id)
 	if err != nil {
 		log.Printf("Error retrieving document: %v", err)
@@ -122,47 +274,58 @@ func getDocumentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = expandReferences(db, collectionName, []map[string]any{document}, expand)
+	if err != nil {
+		log.Printf("Error expanding references: %v", err)
+		sendError(w, "Failed to expand references", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(document)
 }
 
 func getAllDocumentsHandler(w http.ResponseWriter, r *http.Request) {
-	collectionName := r.PathValue("collection")
-	if !isCollectionExists(collectionName) {
-		sendError(w, "Collection not found", http.StatusNotFound)
-		return
-	}
-
-	authToken := getAuthTokenFromRequest(r)
-	if !isAuthTokenValid(authToken, collectionName, ActionList) {
-		sendError(w, "Unauthorized access", http.StatusUnauthorized)
+	collectionName, parentID, ok := requestCollection(w, r, ActionList)
+	if !ok {
 		return
 	}
 
 	skip := Stoi(r.URL.Query().Get("skip"), 0)
 	limit := rangeBound(Stoi(r.URL.Query().Get("limit"), 100), 1, 1000)
 
-	documents, err := getAllDocuments(db, collectionName, skip, limit)
+	expand := expandFieldsFromQuery(r.URL.Query()["expand"])
+	if !canExpand(w, getAuthTokenFromRequest(r), collectionName, expand) {
+		return
+	}
+
+	var documents []map[string]any
+	var err error
+	if parentID != 0 {
+		documents, err = getAllChildDocuments(db, collectionName, parentID, skip, limit)
+	} else {
+		documents, err = getAllDocuments(db, collectionName, skip, limit)
+	}
 	if err != nil {
 		log.Printf("Error retrieving documents: %v", err)
 		sendError(w, "Failed to retrieve documents", http.StatusInternalServerError)
 		return
 	}
 
+	err = expandReferences(db, collectionName, documents, expand)
+	if err != nil {
+		log.Printf("Error expanding references: %v", err)
+		sendError(w, "Failed to expand references", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(documents)
 }
 
 func replaceDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	collectionName := r.PathValue("collection")
-	if !isCollectionExists(collectionName) {
-		sendError(w, "Collection not found", http.StatusNotFound)
-		return
-	}
-
-	authToken := getAuthTokenFromRequest(r)
-	if !isAuthTokenValid(authToken, collectionName, ActionReplace) {
-		sendError(w, "Unauthorized access", http.StatusUnauthorized)
+	collectionName, _, ok := requestCollection(w, r, ActionReplace)
+	if !ok {
 		return
 	}
 
@@ -181,10 +344,9 @@ func replaceDocumentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	err = updateDocument(db, collectionName, id, document)
+	err = replaceDocument(db, collectionName, id, document, replaceValidator(collectionName, newWriteContext(r)))
 	if err != nil {
-		log.Printf("Error updating document: %v", err)
-		sendError(w, "Failed to update document", http.StatusInternalServerError)
+		sendUpdateError(w, err)
 		return
 	}
 
@@ -192,15 +354,8 @@ func replaceDocumentHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func deleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	collectionName := r.PathValue("collection")
-	if !isCollectionExists(collectionName) {
-		sendError(w, "Collection not found", http.StatusNotFound)
-		return
-	}
-
-	authToken := getAuthTokenFromRequest(r)
-	if !isAuthTokenValid(authToken, collectionName, ActionDelete) {
-		sendError(w, "Unauthorized access", http.StatusUnauthorized)
+	collectionName, _, ok := requestCollection(w, r, ActionDelete)
+	if !ok {
 		return
 	}
 
@@ -212,6 +367,10 @@ func deleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = deleteDocument(db, collectionName, id)
+	if errors.Is(err, errReferenceRestricted) {
+		sendError(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Printf("Error deleting document: %v", err)
 		sendError(w, "Failed to delete document", http.StatusInternalServerError)
@@ -220,3 +379,135 @@ func deleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
 
 	sendSuccess(w, "Document deleted")
 }
+
+func patchDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	collectionName, _, ok := requestCollection(w, r, ActionPatch)
+	if !ok {
+		return
+	}
+
+	idStr := r.PathValue("id")
+	id, err := StoiStrict(idStr)
+	if err != nil {
+		sendError(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var updates map[string]any
+	err = json.NewDecoder(r.Body).Decode(&updates)
+	if err != nil {
+		sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	err = removeReadOnlyFields(getCollectionByName(collectionName), updates)
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	document, err := patchDocument(db, collectionName, id, updates, updateValidator(collectionName, newWriteContext(r)))
+	if err != nil {
+		sendUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(document)
+}
+
+func updateDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	collectionName, _, ok := requestCollection(w, r, ActionPatch)
+	if !ok {
+		return
+	}
+
+	idStr := r.PathValue("id")
+	id, err := StoiStrict(idStr)
+	if err != nil {
+		sendError(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var update map[string]any
+	decoder := json.NewDecoder(r.Body)
+	// Keep integers exact so $inc and friends do not turn them into floats.
+	decoder.UseNumber()
+	err = decoder.Decode(&update)
+	if err != nil {
+		sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	operations, err := parseUpdateOperators(update)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	operations, err = removeReadOnlyOperations(collectionName, operations)
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	document, err := applyUpdateOperations(db, collectionName, id, operations, updateValidator(collectionName, newWriteContext(r)))
+	if err != nil {
+		sendUpdateError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(document)
+}
+
+func sendUpdateError(w http.ResponseWriter, err error) {
+	switch {
+	case isDocumentNotFound(err):
+		sendError(w, "Document not found", http.StatusNotFound)
+	case errors.Is(err, errInvalidUpdate):
+		sendError(w, err.Error(), http.StatusBadRequest)
+	default:
+		sendValidationError(w, err)
+	}
+}
+
+func sendValidationError(w http.ResponseWriter, err error) {
+	message, code := validationErrorMessage(err)
+	sendError(w, message, code)
+}
+
+// validationErrorMessage maps errors of the write preparation steps to a
+// client message and status code.
+func validationErrorMessage(err error) (string, int) {
+	switch {
+	case errors.Is(err, errValidationFailed):
+		return "Validation failed", http.StatusBadRequest
+	case errors.Is(err, errReferenceNotFound), errors.Is(err, errReadOnlyField):
+		return err.Error(), http.StatusBadRequest
+	case errors.Is(err, errUniqueField), errors.Is(err, errImmutableField), errors.Is(err, errWriteOnceField):
+		return err.Error(), http.StatusConflict
+	default:
+		log.Printf("Error validating document: %v", err)
+		return "Failed to write document", http.StatusInternalServerError
+	}
+}
+
+// canExpand checks that every expanded field is a reference the caller may
+// read. It sends the error response and returns false otherwise.
+func canExpand(w http.ResponseWriter, authToken string, collectionName string, fields []string) bool {
+	for _, field := range fields {
+		reference := getReferenceByField(collectionName, field)
+		if reference == nil {
+			sendError(w, fmt.Sprintf("Cannot expand %s: not a reference field", field), http.StatusBadRequest)
+			return false
+		}
+		if !isAuthTokenValid(authToken, reference.Target, ActionRead) {
+			sendError(w, fmt.Sprintf("Unauthorized access to %s", reference.Target), http.StatusUnauthorized)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	SourceConfig  = "config"
+	SourceRuntime = "api"
+)
+
+var collectionNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+var errInvalidRuntimeChange = errors.New("invalid change")
+
+// configPath is the config file that runtime changes are merged with.
+var configPath string
+
+// runtimeOverrides are the collections and access tokens managed through the
+// admin API. They are merged over the config file, and a nil entry removes
+// the collection or token of the same name from it.
+type runtimeOverrides struct {
+	Collections map[string]*Collection
+	Tokens      map[string]*runtimeToken
+}
+
+// runtimeToken is stored with the hash of the token. Token is only set by
+// callers of putRuntimeTokenChange, which replaces it with its hash.
+type runtimeToken struct {
+	Token string
+	Hash  string
+	Admin bool
+}
+
+func createSQLDDLForRuntimeConfig() string {
+	return `
+	CREATE TABLE IF NOT EXISTS _runtime_collections (
+		name TEXT PRIMARY KEY,
+		definition BLOB,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS _runtime_tokens (
+		name TEXT PRIMARY KEY,
+		token TEXT,
+		admin INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS _admin_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		data BLOB,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+}
+
+func loadRuntimeOverrides(q sqlx.Queryer) (runtimeOverrides, error) {
+	overrides := runtimeOverrides{Collections: map[string]*Collection{}, Tokens: map[string]*runtimeToken{}}
+
+	collectionRecords := []struct {
+		Name       string         `db:"name"`
+		Definition sql.NullString `db:"definition"`
+	}{}
+	err := sqlx.Select(q, &collectionRecords, `SELECT name, json(definition) AS definition FROM _runtime_collections`)
+	if err != nil {
+		return overrides, err
+	}
+	for _, record := range collectionRecords {
+		if !record.Definition.Valid {
+			overrides.Collections[record.Name] = nil
+			continue
+		}
+		var collection Collection
+		err = json.Unmarshal([]byte(record.Definition.String), &collection)
+		if err != nil {
+			return overrides, fmt.Errorf("collection %s: %w", record.Name, err)
+		}
+		overrides.Collections[record.Name] = &collection
+	}
+
+	tokenRecords := []struct {
+		Name  string         `db:"name"`
+		Token sql.NullString `db:"token"`
+		Admin bool           `db:"admin"`
+	}{}
+	err = sqlx.Select(q, &tokenRecords, `SELECT name, token, admin FROM _runtime_tokens`)
+	if err != nil {
+		return overrides, err
+	}
+	for _, record := range tokenRecords {
+		if !record.Token.Valid {
+			overrides.Tokens[record.Name] = nil
+			continue
+		}
+		overrides.Tokens[record.Name] = &runtimeToken{Hash: record.Token.String, Admin: record.Admin}
+	}
+	return overrides, nil
+}
+
+// mergeRuntimeOverrides returns the config file with the runtime collections
+// and tokens applied.
+func mergeRuntimeOverrides(config Config, overrides runtimeOverrides) Config {
+	collections := []Collection{}
+	for _, collection := range config.Collections {
+		override, overridden := overrides.Collections[collection.Name]
+		if !overridden {
+			collections = append(collections, collection)
+		} else if override != nil {
+			collections = append(collections, *override)
+		}
+	}
+	for _, name := range sortedKeys(overrides.Collections) {
+		override := overrides.Collections[name]
+		if override != nil && !slices.ContainsFunc(config.Collections, func(collection Collection) bool { return collection.Name == name }) {
+			collections = append(collections, *override)
+		}
+	}
+	config.Collections = collections
+
+	accessTokens := []AccessToken{}
+	for _, accessToken := range config.AccessTokens {
+		if _, overridden := overrides.Tokens[accessToken.Name]; !overridden {
+			accessTokens = append(accessTokens, accessToken)
+		}
+	}
+	adminTokens := slices.DeleteFunc(slices.Clone(config.AdminTokens), func(name string) bool {
+		override, overridden := overrides.Tokens[name]
+		return overridden && (override == nil || !override.Admin)
+	})
+	for _, name := range sortedKeys(overrides.Tokens) {
+		override := overrides.Tokens[name]
+		if override == nil {
+			continue
+		}
+		accessTokens = append(accessTokens, AccessToken{Name: name, Hash: override.Hash})
+		if override.Admin && !slices.Contains(adminTokens, name) {
+			adminTokens = append(adminTokens, name)
+		}
+	}
+	config.AccessTokens = accessTokens
+	config.AdminTokens = adminTokens
+	return config
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// runtimeChange is a change of the runtime overrides. edit applies it to the
+// overrides in memory so that the merged configuration can be checked, and
+// save persists it.
+type runtimeChange struct {
+	Actor  string
+	Action string
+	Target string
+	Data   any
+	edit   func(overrides *runtimeOverrides)
+	save   func(tx *sqlx.Tx) error
+}
+
+// applyRuntimeChange validates the configuration that results from a change,
+// then persists the change with its audit entry and activates the new
+// configuration. An invalid change is not persisted.
+func applyRuntimeChange(change runtimeChange) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	fileConfig, err := readConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	overrides, err := loadRuntimeOverrides(db)
+	if err != nil {
+		return err
+	}
+	change.edit(&overrides)
+	loaded, err := buildLoadedConfig(mergeRuntimeOverrides(fileConfig, overrides))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRuntimeChange, err)
+	}
+
+	err = migrateDatabase(db, loaded.config.Collections)
+	if err != nil {
+		return fmt.Errorf("error migrating database: %w", err)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = change.save(tx)
+	if err != nil {
+		return err
+	}
+	err = recordAudit(tx, change.Actor, change.Action, change.Target, change.Data)
+	if err != nil {
+		return err
+	}
+	// Webhooks of the config file may clash with webhooks created through
+	// the admin API, which makes the change invalid.
+	err = syncConfigWebhooksTx(tx, loaded.config.Collections)
+	if errors.Is(err, errWebhookExists) {
+		return fmt.Errorf("%w: invalid webhooks: %v", errInvalidRuntimeChange, err)
+	}
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	loaded.activate()
+	return nil
+}
+
+// AuditEntry records a change made through the admin API.
+type AuditEntry struct {
+	ID        int            `json:"id"`
+	Actor     string         `json:"actor"`
+	Action    string         `json:"action"`
+	Target    string         `json:"target"`
+	Data      map[string]any `json:"data,omitempty"`
+	CreatedAt string         `json:"created_at"`
+}
+
+func recordAudit(tx sqlx.Execer, actor string, action string, target string, data any) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO _admin_audit (actor, action, target, data) VALUES ($1, $2, $3, jsonb($4))`
+	_, err = tx.Exec(query, actor, action, target, jsonData)
+	return err
+}
+
+func getAuditEntries(db *sqlx.DB, limit int) ([]AuditEntry, error) {
+	records := []struct {
+		ID        int            `db:"id"`
+		Actor     string         `db:"actor"`
+		Action    string         `db:"action"`
+		Target    string         `db:"target"`
+		Data      sql.NullString `db:"data"`
+		CreatedAt string         `db:"created_at"`
+	}{}
+	query := `SELECT id, actor, action, target, json(data) AS data, created_at FROM _admin_audit ORDER BY id DESC LIMIT $1`
+	err := db.Select(&records, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	for _, record := range records {
+		entry := AuditEntry{ID: record.ID, Actor: record.Actor, Action: record.Action, Target: record.Target, CreatedAt: record.CreatedAt}
+		if record.Data.Valid {
+			json.Unmarshal([]byte(record.Data.String), &entry.Data)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func putRuntimeCollectionChange(actor string, collection Collection) (runtimeChange, error) {
+	definition, err := json.Marshal(collection)
+	if err != nil {
+		return runtimeChange{}, err
+	}
+	var data map[string]any
+	json.Unmarshal(definition, &data)
+	return runtimeChange{
+		Actor:  actor,
+		Action: "collection.put",
+		Target: collection.Name,
+		Data:   data,
+		edit: func(overrides *runtimeOverrides) {
+			overrides.Collections[collection.Name] = &collection
+		},
+		save: func(tx *sqlx.Tx) error {
+			query := `INSERT INTO _runtime_collections (name, definition) VALUES ($1, jsonb($2))
+			ON CONFLICT (name) DO UPDATE SET definition = excluded.definition, updated_at = CURRENT_TIMESTAMP`
+			_, err := tx.Exec(query, collection.Name, definition)
+			return err
+		},
+	}, nil
+}
+
+// deleteRuntimeCollectionChange removes a collection from the configuration.
+// Its table and documents are kept, so that the collection can be restored.
+func deleteRuntimeCollectionChange(actor string, name string) runtimeChange {
+	return runtimeChange{
+		Actor:  actor,
+		Action: "collection.delete",
+		Target: name,
+		edit: func(overrides *runtimeOverrides) {
+			overrides.Collections[name] = nil
+		},
+		save: func(tx *sqlx.Tx) error {
+			query := `INSERT INTO _runtime_collections (name, definition) VALUES ($1, NULL)
+			ON CONFLICT (name) DO UPDATE SET definition = NULL, updated_at = CURRENT_TIMESTAMP`
+			_, err := tx.Exec(query, name)
+			return err
+		},
+	}
+}
+
+func putRuntimeTokenChange(actor string, name string, token runtimeToken) runtimeChange {
+	// Only the hash of a token is stored.
+	if token.Hash == "" {
+		token.Hash, _ = hashToken(token.Token, TokenHashSHA256)
+		token.Token = ""
+	}
+	return runtimeChange{
+		Actor:  actor,
+		Action: "token.put",
+		Target: name,
+		// The token itself is kept out of the audit log.
+		Data: map[string]any{"admin": token.Admin},
+		edit: func(overrides *runtimeOverrides) {
+			overrides.Tokens[name] = &token
+		},
+		save: func(tx *sqlx.Tx) error {
+			query := `INSERT INTO _runtime_tokens (name, token, admin) VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET token = excluded.token, admin = excluded.admin, updated_at = CURRENT_TIMESTAMP`
+			_, err := tx.Exec(query, name, token.Hash, token.Admin)
+			return err
+		},
+	}
+}
+
+func deleteRuntimeTokenChange(actor string, name string) runtimeChange {
+	return runtimeChange{
+		Actor:  actor,
+		Action: "token.delete",
+		Target: name,
+		edit: func(overrides *runtimeOverrides) {
+			overrides.Tokens[name] = nil
+		},
+		save: func(tx *sqlx.Tx) error {
+			query := `INSERT INTO _runtime_tokens (name, token, admin) VALUES ($1, NULL, 0)
+			ON CONFLICT (name) DO UPDATE SET token = NULL, admin = 0, updated_at = CURRENT_TIMESTAMP`
+			_, err := tx.Exec(query, name)
+			return err
+		},
+	}
+}
+
+func newAccessToken() string {
+	token := make([]byte, 24)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// source tells whether the active definition of a collection or token comes
+// from the config file or the admin API.
+func source(overridden bool) string {
+	if overridden {
+		return SourceRuntime
+	}
+	return SourceConfig
+}
+
+// sendRuntimeChangeError answers a failed runtime change.
+func sendRuntimeChangeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInvalidRuntimeChange) {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Error changing configuration: %v", err)
+	sendError(w, "Failed to change configuration", http.StatusInternalServerError)
+}
+
+// collectionInfo is a collection as listed by the admin API.
+type collectionInfo struct {
+	Collection
+	Source string `json:"source"`
+}
+
+func getCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	overrides, err := loadRuntimeOverrides(db)
+	if err != nil {
+		log.Printf("Error retrieving runtime configuration: %v", err)
+		sendError(w, "Failed to retrieve collections", http.StatusInternalServerError)
+		return
+	}
+	collections := []collectionInfo{}
+	for _, collection := range active().config.Collections {
+		collections = append(collections, collectionInfo{collection.declared(), source(overrides.Collections[collection.Name] != nil)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collections)
+}
+
+func getCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	collection := getCollectionByName(r.PathValue("name"))
+	if collection == nil {
+		sendError(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+	overrides, err := loadRuntimeOverrides(db)
+	if err != nil {
+		log.Printf("Error retrieving runtime configuration: %v", err)
+		sendError(w, "Failed to retrieve collection", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collectionInfo{collection.declared(), source(overrides.Collections[collection.Name] != nil)})
+}
+
+func putCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	collection, ok := decodeCollectionDefinition(w, r)
+	if !ok {
+		return
+	}
+	name := collection.Name
+
+	created := getCollectionByName(name) == nil
+	change, err := putRuntimeCollectionChange(tokenName(getAuthTokenFromRequest(r)), collection)
+	if err != nil {
+		sendRuntimeChangeError(w, err)
+		return
+	}
+	err = applyRuntimeChange(change)
+	if err != nil {
+		sendRuntimeChangeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(collectionInfo{collection, SourceRuntime})
+}
+
+// decodeCollectionDefinition reads a collection definition from the request
+// body and checks it against the config schema. The name comes from the
+// path. It sends an error response when the definition is invalid.
+func decodeCollectionDefinition(w http.ResponseWriter, r *http.Request) (Collection, bool) {
+	name := r.PathValue("name")
+	if !collectionNamePattern.MatchString(name) {
+		sendError(w, "Invalid collection name", http.StatusBadRequest)
+		return Collection{}, false
+	}
+
+	var definition map[string]any
+	err := json.NewDecoder(r.Body).Decode(&definition)
+	if err != nil {
+		sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return Collection{}, false
+	}
+	defer r.Body.Close()
+	definition["name"] = name
+	delete(definition, "source")
+
+	// Check the definition against the config schema
+	content, _ := json.Marshal(map[string]any{"host": "", "port": 0, "access_tokens": []any{}, "collections": []any{definition}})
+	problems, err := validateConfigJSON(content)
+	if err != nil {
+		sendRuntimeChangeError(w, err)
+		return Collection{}, false
+	}
+	if len(problems) > 0 {
+		sendError(w, "Invalid collection: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return Collection{}, false
+	}
+	var collection Collection
+	content, _ = json.Marshal(definition)
+	err = json.Unmarshal(content, &collection)
+	if err != nil {
+		sendError(w, "Invalid collection: "+err.Error(), http.StatusBadRequest)
+		return Collection{}, false
+	}
+	return collection, true
+}
+
+func deleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if getCollectionByName(name) == nil {
+		sendError(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	actor := tokenName(getAuthTokenFromRequest(r))
+	err := applyRuntimeChange(deleteRuntimeCollectionChange(actor, name))
+	if err != nil {
+		sendRuntimeChangeError(w, err)
+		return
+	}
+
+	sendSuccess(w, "Collection deleted")
+}
+
+// tokenInfo is an access token as listed by the admin API. The token is only
+// included when it is created. A client may send the hash of a token it
+// generated instead of the token.
+type tokenInfo struct {
+	Name   string `json:"name"`
+	Token  string `json:"token,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	Admin  bool   `json:"admin"`
+	Source string `json:"source"`
+}
+
+func getTokensHandler(w http.ResponseWriter, r *http.Request) {
+	overrides, err := loadRuntimeOverrides(db)
+	if err != nil {
+		log.Printf("Error retrieving runtime configuration: %v", err)
+		sendError(w, "Failed to retrieve tokens", http.StatusInternalServerError)
+		return
+	}
+	config := active().config
+	tokens := []tokenInfo{}
+	for _, accessToken := range config.AccessTokens {
+		tokens = append(tokens, tokenInfo{
+			Name:   accessToken.Name,
+			Admin:  slices.Contains(config.AdminTokens, accessToken.Name),
+			Source: source(overrides.Tokens[accessToken.Name] != nil),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func putTokenHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var token tokenInfo
+	err := json.NewDecoder(r.Body).Decode(&token)
+	if err != nil {
+		sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if token.Token == "" && token.Hash == "" {
+		token.Token = newAccessToken()
+	}
+	err = checkAccessToken(AccessToken{Name: name, Token: token.Token, Hash: token.Hash})
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if token.Hash == "" {
+		token.Hash, _ = hashToken(token.Token, TokenHashSHA256)
+	}
+	token.Name = name
+	token.Source = SourceRuntime
+
+	created := !slices.ContainsFunc(active().config.AccessTokens, func(accessToken AccessToken) bool { return accessToken.Name == name })
+	actor := tokenName(getAuthTokenFromRequest(r))
+	err = applyRuntimeChange(putRuntimeTokenChange(actor, name, runtimeToken{Hash: token.Hash, Admin: token.Admin}))
+	if err != nil {
+		sendRuntimeChangeError(w, err)
+		return
+	}
+
+	// The token is only returned in this response.
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(token)
+}
+
+func deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !slices.ContainsFunc(active().config.AccessTokens, func(accessToken AccessToken) bool { return accessToken.Name == name }) {
+		sendError(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	actor := tokenName(getAuthTokenFromRequest(r))
+	err := applyRuntimeChange(deleteRuntimeTokenChange(actor, name))
+	if err != nil {
+		sendRuntimeChangeError(w, err)
+		return
+	}
+
+	sendSuccess(w, "Token deleted")
+}
+
+func getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := rangeBound(Stoi(r.URL.Query().Get("limit"), 100), 1, 1000)
+	entries, err := getAuditEntries(db, limit)
+	if err != nil {
+		log.Printf("Error retrieving audit log: %v", err)
+		sendError(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
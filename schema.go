@@ -1,44 +1,170 @@
 package main
 
 import (
-	"github.com/xeipuuv/gojsonschema"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/santhosh-tekuri/jsonschema/v6"
 )
 
-var schemaCache map[string]gojsonschema.JSONLoader
+// schemaResource is the location collection schemas are compiled at. Their
+// refs are resolved before, so it is never looked up.
+const schemaResource = "quickstore:///schema.json"
 
-func buildSchemaCache(collections []Collection) map[string]gojsonschema.JSONLoader {
-	var schemaCache = make(map[string]gojsonschema.JSONLoader)
+// buildSchemaCache compiles the collection schemas once, so that documents
+// are validated without parsing the schema again.
+func buildSchemaCache(collections []Collection) map[string]*jsonschema.Schema {
+	var schemaCache = make(map[string]*jsonschema.Schema)
 	for _, collection := range collections {
-		schemaCache[collection.Name] = gojsonschema.NewGoLoader(collection.Schema)
+		schema, err := compileSchema(collection.Schema, collection.schemaDraft())
+		if err != nil {
+			log.Printf("Error compiling schema of %s: %v", collection.Name, err)
+		}
+		schemaCache[collection.Name] = schema
 	}
 	return schemaCache
 }
 
-func validateJSON(json map[string]any, schemaLoader gojsonschema.JSONLoader) bool {
-
-	// Create document loader from the json data
-	documentLoader := gojsonschema.NewGoLoader(json)
-
-	// Validate the json against the schema
-	result, err := gojsonschema.Validate(schemaLoader, documentLoader)
+// compileSchema compiles a schema written in the given draft, unless its
+// $schema names another one. Formats, including the custom formats, are
+// asserted in every draft.
+func compileSchema(schema map[string]any, draft string) (*jsonschema.Schema, error) {
+	schemaDraft, known := schemaDrafts[draft]
+	if !known {
+		return nil, fmt.Errorf("unknown draft %s", draft)
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.DefaultDraft(schemaDraft)
+	compiler.AssertFormat()
+	for _, format := range customFormats {
+		compiler.RegisterFormat(format)
+	}
+	err := compiler.AddResource(schemaResource, normalizeJSON(schema))
 	if err != nil {
+		return nil, err
+	}
+	return compiler.Compile(schemaResource)
+}
+
+func validateJSON(json map[string]any, schema *jsonschema.Schema) bool {
+	if schema == nil {
 		return false
 	}
 
-	return result.Valid()
+	// Validate the json against the compiled schema
+	return schema.Validate(json) == nil
+}
+
+// schemaErrors returns the reasons a document does not match a schema.
+func schemaErrors(json map[string]any, schema *jsonschema.Schema) []string {
+	if schema == nil {
+		return []string{"schema does not compile"}
+	}
+	err := schema.Validate(json)
+	if err == nil {
+		return []string{}
+	}
+	validationError, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	problems := []string{}
+	for _, unit := range validationError.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		location := unit.InstanceLocation
+		if location == "" {
+			location = "(root)"
+		}
+		problems = append(problems, location+": "+unit.Error.String())
+	}
+	return problems
 }
 
 func validateJSONByCollectionName(json map[string]any, collectionName string) bool {
-	schemaLoader, exists := schemaCache[collectionName]
+	schema, exists := active().schemaCache[collectionName]
 
 	if !exists {
 		return false
 	}
 
-	return validateJSON(json, schemaLoader)
+	return validateJSON(json, schema)
+}
+
+// validateDocument checks a document against the collection schema, the
+// custom keywords of the schema and its references. id and current are
+// those of the stored document, or 0 and nil for a new one.
+func validateDocument(q sqlx.Queryer, collectionName string, id int, current map[string]any, document map[string]any) error {
+	if !validateJSONByCollectionName(document, collectionName) {
+		return errValidationFailed
+	}
+	err := enforceSchemaKeywords(q, collectionName, id, current, document)
+	if err != nil {
+		return err
+	}
+	return checkReferences(q, collectionName, document)
+}
+
+// applySchemaDefaults fills in the default of every missing property. It
+// descends into nested objects that are present in the document, including
+// objects that were just created from a default.
+func applySchemaDefaults(schema map[string]any, document map[string]any) {
+	properties := schemaProperties(schema)
+	for name, property := range properties {
+		propertySchema, ok := property.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, exists := document[name]; !exists {
+			if defaultValue, hasDefault := propertySchema["default"]; hasDefault {
+				document[name] = normalizeJSON(defaultValue)
+			}
+		}
+		if object, isObject := document[name].(map[string]any); isObject {
+			applySchemaDefaults(propertySchema, object)
+		}
+	}
+}
+
+// readOnlyPaths returns the paths of all properties marked readOnly.
+func readOnlyPaths(schema map[string]any, prefix []string) [][]string {
+	paths := [][]string{}
+	properties := schemaProperties(schema)
+	for name, property := range properties {
+		propertySchema, ok := property.(map[string]any)
+		if !ok {
+			continue
+		}
+		path := append(slices.Clone(prefix), name)
+		if readOnly, _ := propertySchema["readOnly"].(bool); readOnly {
+			paths = append(paths, path)
+			continue
+		}
+		paths = append(paths, readOnlyPaths(propertySchema, path)...)
+	}
+	return paths
+}
+
+// removeReadOnlyFields rejects or, with the strip policy, removes readOnly
+// properties sent by a client.
+func removeReadOnlyFields(collection *Collection, document map[string]any) error {
+	for _, path := range readOnlyPaths(collection.Schema, []string{}) {
+		if _, exists := fieldValue(document, path); !exists {
+			continue
+		}
+		if collection.ReadOnlyPolicy != ReadOnlyPolicyStrip {
+			return fmt.Errorf("%w: %s", errReadOnlyField, strings.Join(path, "."))
+		}
+		deleteFieldValue(document, path)
+	}
+	return nil
 }
 
 func isCollectionExists(collectionName string) bool {
-	_, exists := schemaCache[collectionName]
+	_, exists := active().schemaCache[collectionName]
 	return exists
 }
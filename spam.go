@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultFormTokenField = "_form_token"
+const defaultCaptchaResponseField = "captcha_response"
+const formTokenMaxAge = 24 * time.Hour
+const quarantineRetention = 30 * 24 * time.Hour
+
+var formTokenSecret []byte
+
+var submissionLimiter = newRateLimiter()
+
+// CollectionSpam configures anti-abuse checks for submissions to a
+// collection. Every check is optional.
+type CollectionSpam struct {
+	HoneypotFields   []string       `json:"honeypot_fields"`
+	MinSubmitSeconds int            `json:"min_submit_seconds"`
+	TokenField       string         `json:"token_field"`
+	RateLimit        *SpamRateLimit `json:"rate_limit"`
+	DuplicateWindow  int            `json:"duplicate_window"`
+	Captcha          *SpamCaptcha   `json:"captcha"`
+}
+
+// SpamRateLimit allows Requests submissions per client IP every Window seconds.
+type SpamRateLimit struct {
+	Requests int `json:"requests"`
+	Window   int `json:"window"`
+}
+
+// SpamCaptcha verifies CAPTCHA responses with an hCaptcha or Turnstile style
+// siteverify endpoint.
+type SpamCaptcha struct {
+	VerifyURL     string `json:"verify_url"`
+	Secret        string `json:"secret"`
+	ResponseField string `json:"response_field"`
+}
+
+// spamRejection describes why a submission was rejected. Silent rejections
+// are answered as if the document had been inserted. Throttled rejections
+// are not quarantined, so a flood of submissions cannot fill the quarantine.
+type spamRejection struct {
+	Reason    string
+	Status    int
+	Silent    bool
+	Throttled bool
+}
+
+// CaptchaVerifier checks the CAPTCHA response a client submitted.
+type CaptchaVerifier interface {
+	Verify(response string, remoteIP string) (bool, error)
+}
+
+// httpCaptchaVerifier posts the response to a siteverify endpoint, which is
+// how both hCaptcha and Cloudflare Turnstile verify tokens.
+type httpCaptchaVerifier struct {
+	verifyURL string
+	secret    string
+	client    *http.Client
+}
+
+func newCaptchaVerifier(captcha *SpamCaptcha) CaptchaVerifier {
+	return httpCaptchaVerifier{
+		verifyURL: captcha.VerifyURL,
+		secret:    captcha.Secret,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (verifier httpCaptchaVerifier) Verify(response string, remoteIP string) (bool, error) {
+	form := url.Values{}
+	form.Set("secret", verifier.secret)
+	form.Set("response", response)
+	form.Set("remoteip", remoteIP)
+	resp, err := verifier.client.PostForm(verifier.verifyURL, form)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha verification returned %s", resp.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// rateLimiter counts requests per key in fixed windows.
+type rateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{windows: make(map[string]rateWindow)}
+}
+
+func (limiter *rateLimiter) Allow(key string, limit int, window time.Duration, now time.Time) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	current := limiter.windows[key]
+	if now.Sub(current.start) >= window {
+		// Drop expired windows now and then so the map does not grow forever.
+		if len(limiter.windows) > 10000 {
+			for k, w := range limiter.windows {
+				if now.Sub(w.start) >= window {
+					delete(limiter.windows, k)
+				}
+			}
+		}
+		current = rateWindow{start: now}
+	}
+	current.count++
+	limiter.windows[key] = current
+	return current.count <= limit
+}
+
+func initFormTokenSecret(secret string) error {
+	if secret != "" {
+		formTokenSecret = []byte(secret)
+		return nil
+	}
+	// Without a configured secret, tokens only survive until the next restart.
+	formTokenSecret = make([]byte, 32)
+	_, err := rand.Read(formTokenSecret)
+	return err
+}
+
+// newFormToken returns a signed token holding the time the form was served.
+func newFormToken(collectionName string, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return timestamp + "." + signFormToken(collectionName, timestamp)
+}
+
+func signFormToken(collectionName string, timestamp string) string {
+	mac := hmac.New(sha256.New, formTokenSecret)
+	mac.Write([]byte(collectionName + "." + timestamp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// formTokenAge verifies a form token and returns how long ago it was issued.
+func formTokenAge(collectionName string, token string, now time.Time) (time.Duration, bool) {
+	timestamp, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signFormToken(collectionName, timestamp))) {
+		return 0, false
+	}
+	issued, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(time.Unix(issued, 0)), true
+}
+
+// checkSubmission runs the spam checks of a collection on a new document and
+// removes the honeypot, token and CAPTCHA fields from it. It returns nil when
+// the submission is accepted. Duplicates are checked separately by
+// checkDuplicateSubmission in the insert transaction.
+func checkSubmission(q sqlx.Queryer, collection *Collection, document map[string]any, clientIP string, now time.Time) (*spamRejection, error) {
+	spam := collection.Spam
+	if spam == nil {
+		return nil, nil
+	}
+
+	if spam.RateLimit != nil {
+		window := time.Duration(spam.RateLimit.Window) * time.Second
+		if !submissionLimiter.Allow(collection.Name+"|"+clientIP, spam.RateLimit.Requests, window, now) {
+			return &spamRejection{Reason: "Too many submissions", Status: http.StatusTooManyRequests, Throttled: true}, nil
+		}
+	}
+
+	var rejection *spamRejection
+	for _, field := range spam.HoneypotFields {
+		if value, exists := document[field]; exists && value != "" && value != nil && rejection == nil {
+			rejection = &spamRejection{Reason: "Honeypot field " + field + " was filled", Status: http.StatusOK, Silent: true}
+		}
+		delete(document, field)
+	}
+
+	if spam.MinSubmitSeconds > 0 {
+		tokenField := spam.TokenField
+		if tokenField == "" {
+			tokenField = defaultFormTokenField
+		}
+		token, _ := document[tokenField].(string)
+		delete(document, tokenField)
+		age, valid := formTokenAge(collection.Name, token, now)
+		if rejection == nil && (!valid || age > formTokenMaxAge) {
+			rejection = &spamRejection{Reason: "Invalid or expired form token", Status: http.StatusBadRequest}
+		} else if rejection == nil && age < time.Duration(spam.MinSubmitSeconds)*time.Second {
+			rejection = &spamRejection{Reason: "Form submitted too quickly", Status: http.StatusBadRequest}
+		}
+	}
+
+	if spam.Captcha != nil {
+		responseField := spam.Captcha.ResponseField
+		if responseField == "" {
+			responseField = defaultCaptchaResponseField
+		}
+		response, _ := document[responseField].(string)
+		delete(document, responseField)
+		if rejection == nil {
+			ok, err := newCaptchaVerifier(spam.Captcha).Verify(response, clientIP)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				rejection = &spamRejection{Reason: "CAPTCHA verification failed", Status: http.StatusBadRequest}
+			}
+		}
+	}
+
+	return rejection, nil
+}
+
+// checkDuplicateSubmission rejects a document that was already submitted
+// within the duplicate window. It records the content hash of accepted
+// documents, so it runs in the transaction that inserts the document: a
+// submission that fails later on is not remembered.
+func checkDuplicateSubmission(q sqlx.Queryer, collection *Collection, document map[string]any) (*spamRejection, error) {
+	if collection.Spam == nil || collection.Spam.DuplicateWindow <= 0 {
+		return nil, nil
+	}
+	duplicate, err := isDuplicateSubmission(q, collection.Name, document, collection.Spam.DuplicateWindow)
+	if err != nil || !duplicate {
+		return nil, err
+	}
+	return &spamRejection{Reason: "Duplicate submission", Status: http.StatusConflict}, nil
+}
+
+func createSQLDDLForSpam() string {
+	return `
+	CREATE TABLE IF NOT EXISTS _submission_hashes (
+		collection TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (collection, hash)
+	);
+	CREATE TABLE IF NOT EXISTS _quarantine (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		collection TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		client_ip TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		data BLOB NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS _quarantine_collection ON _quarantine (collection);`
+}
+
+// isDuplicateSubmission reports whether a document with the same content was
+// submitted within the window, and records the content hash otherwise.
+func isDuplicateSubmission(q sqlx.Queryer, collectionName string, document map[string]any, window int) (bool, error) {
+	content, err := json.Marshal(document)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	var recorded []string
+	// Expired hashes are replaced, recent ones are kept and reported.
+	query := `INSERT INTO _submission_hashes (collection, hash) VALUES ($1, $2)
+		ON CONFLICT (collection, hash) DO UPDATE SET created_at = CURRENT_TIMESTAMP
+		WHERE created_at <= datetime('now', $3)
+		RETURNING hash`
+	err = sqlx.Select(q, &recorded, query, collectionName, hash, fmt.Sprintf("-%d seconds", window))
+	if err != nil {
+		return false, err
+	}
+	return len(recorded) == 0, nil
+}
+
+func quarantineSubmission(db *sqlx.DB, collectionName string, reason string, clientIP string, document map[string]any) error {
+	jsonData, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO _quarantine (collection, reason, client_ip, data) VALUES ($1, $2, $3, jsonb($4))`
+	_, err = db.Exec(query, collectionName, reason, clientIP, jsonData)
+	return err
+}
+
+// pruneSpamRecords removes the submission hashes that are past the duplicate
+// window of their collection and quarantined submissions older than
+// quarantineRetention.
+func pruneSpamRecords(db *sqlx.DB, collections []Collection) (int64, error) {
+	windowed := []string{}
+	var pruned int64
+	for _, collection := range collections {
+		if collection.Spam == nil || collection.Spam.DuplicateWindow <= 0 {
+			continue
+		}
+		windowed = append(windowed, collection.Name)
+		query := `DELETE FROM _submission_hashes WHERE collection = $1 AND created_at <= datetime('now', $2)`
+		result, err := db.Exec(query, collection.Name, fmt.Sprintf("-%d seconds", collection.Spam.DuplicateWindow))
+		if err != nil {
+			return pruned, err
+		}
+		affected, _ := result.RowsAffected()
+		pruned += affected
+	}
+	// Collections without a duplicate window no longer need their hashes.
+	names, err := json.Marshal(windowed)
+	if err != nil {
+		return pruned, err
+	}
+	result, err := db.Exec(`DELETE FROM _submission_hashes WHERE collection NOT IN (SELECT value FROM json_each($1))`, string(names))
+	if err != nil {
+		return pruned, err
+	}
+	affected, _ := result.RowsAffected()
+	pruned += affected
+
+	result, err = db.Exec(`DELETE FROM _quarantine WHERE created_at <= datetime('now', $1)`, fmt.Sprintf("-%d seconds", int(quarantineRetention.Seconds())))
+	if err != nil {
+		return pruned, err
+	}
+	affected, _ = result.RowsAffected()
+	return pruned + affected, nil
+}
+
+type QuarantinedSubmission struct {
+	ID        int            `db:"id" json:"id"`
+	Reason    string         `db:"reason" json:"reason"`
+	ClientIP  string         `db:"client_ip" json:"client_ip"`
+	CreatedAt string         `db:"created_at" json:"created_at"`
+	Data      string         `db:"data" json:"-"`
+	Document  map[string]any `db:"-" json:"data"`
+}
+
+func getQuarantinedSubmissions(db *sqlx.DB, collectionName string, skip int, limit int) ([]QuarantinedSubmission, error) {
+	submissions := []QuarantinedSubmission{}
+	query := `SELECT id, reason, client_ip, created_at, json(data) AS data FROM _quarantine WHERE collection = $1 ORDER BY id DESC LIMIT $2 OFFSET $3`
+	err := db.Select(&submissions, query, collectionName, limit, skip)
+	if err != nil {
+		return nil, err
+	}
+	for i := range submissions {
+		err = json.Unmarshal([]byte(submissions[i].Data), &submissions[i].Document)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return submissions, nil
+}
+
+func formTokenHandler(w http.ResponseWriter, r *http.Request) {
+	collectionName, _, ok := requestCollection(w, r, ActionCreate)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"token": newFormToken(collectionName, time.Now())})
+}
+
+func getQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	collectionName := r.PathValue("name")
+	if getCollectionByName(collectionName) == nil {
+		sendError(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	skip := max(Stoi(r.URL.Query().Get("skip"), 0), 0)
+	limit := rangeBound(Stoi(r.URL.Query().Get("limit"), 100), 1, 1000)
+
+	submissions, err := getQuarantinedSubmissions(db, collectionName, skip, limit)
+	if err != nil {
+		log.Printf("Error retrieving quarantined submissions: %v", err)
+		sendError(w, "Failed to retrieve quarantined submissions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(submissions)
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	SyncServerWins    = "server-wins"
+	SyncClientWins    = "client-wins"
+	SyncLastWriteWins = "last-write-wins"
+	SyncManual        = "manual"
+)
+
+const (
+	SyncApplied  = "applied"
+	SyncRejected = "rejected"
+	SyncConflict = "conflict"
+	SyncError    = "error"
+)
+
+var syncConflictPolicies = []string{SyncServerWins, SyncClientWins, SyncLastWriteWins, SyncManual}
+
+const maxSyncBatchSize = 500
+
+// CollectionSync enables the offline sync endpoints of a collection.
+// Conflicts decides what happens to a pushed change that was made against an
+// outdated revision of the document.
+type CollectionSync struct {
+	Conflicts string `json:"conflicts"`
+}
+
+func (sync *CollectionSync) conflictPolicy() string {
+	if sync.Conflicts == "" {
+		return SyncServerWins
+	}
+	return sync.Conflicts
+}
+
+func checkCollectionSync(collections []Collection) error {
+	for _, collection := range collections {
+		if collection.Sync == nil {
+			continue
+		}
+		if collection.Parent != "" {
+			return fmt.Errorf("collection %s: child collections cannot be synced", collection.Name)
+		}
+		if !slices.Contains(syncConflictPolicies, collection.Sync.conflictPolicy()) {
+			return fmt.Errorf("collection %s: unknown conflict policy %s", collection.Name, collection.Sync.Conflicts)
+		}
+	}
+	return nil
+}
+
+// The revision of a document is the change log sequence number of its last
+// write. Rows of deleted documents stay behind as tombstones, so that clients
+// learn about deletions however long they were offline.
+func createSQLDDLForSync() string {
+	return `
+	CREATE TABLE IF NOT EXISTS _sync_revisions (
+		collection TEXT NOT NULL,
+		document_id INTEGER NOT NULL,
+		rev INTEGER NOT NULL,
+		deleted INTEGER NOT NULL DEFAULT 0,
+		modified_at TEXT NOT NULL,
+		PRIMARY KEY (collection, document_id)
+	);
+	CREATE INDEX IF NOT EXISTS _sync_revisions_rev ON _sync_revisions (collection, rev, document_id);`
+}
+
+func syncTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func recordRevision(tx sqlx.Execer, collectionName string, id int, seq int, deleted bool) error {
+	query := `INSERT INTO _sync_revisions (collection, document_id, rev, deleted, modified_at) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (collection, document_id) DO UPDATE SET rev = excluded.rev, deleted = excluded.deleted, modified_at = excluded.modified_at`
+	_, err := tx.Exec(query, collectionName, id, seq, deleted, syncTimestamp(time.Now()))
+	return err
+}
+
+// backfillRevisions gives documents written before revisions were tracked
+// revision 0, so that they are part of the first pull.
+func backfillRevisions(db *sqlx.DB, collectionName string) error {
+	query := `INSERT OR IGNORE INTO _sync_revisions (collection, document_id, rev, modified_at) SELECT $1, id, 0, $2 FROM ` + collectionName
+	_, err := db.Exec(query, collectionName, syncTimestamp(time.Now()))
+	return err
+}
+
+// syncCheckpoint is a position in the revision order of a collection. It is
+// built from persisted revisions only, so it stays valid across restarts.
+type syncCheckpoint struct {
+	Rev int
+	ID  int
+}
+
+// The empty checkpoint starts before revision 0.
+var initialSyncCheckpoint = syncCheckpoint{Rev: -1}
+
+func parseSyncCheckpoint(token string) (syncCheckpoint, error) {
+	if token == "" {
+		return initialSyncCheckpoint, nil
+	}
+	rev, id, found := strings.Cut(token, "-")
+	if !found {
+		return syncCheckpoint{}, errors.New("invalid checkpoint")
+	}
+	checkpoint := syncCheckpoint{}
+	var err error
+	checkpoint.Rev, err = StoiStrict(rev)
+	if err != nil {
+		return syncCheckpoint{}, errors.New("invalid checkpoint")
+	}
+	checkpoint.ID, err = StoiStrict(id)
+	if err != nil {
+		return syncCheckpoint{}, errors.New("invalid checkpoint")
+	}
+	return checkpoint, nil
+}
+
+func (checkpoint syncCheckpoint) String() string {
+	if checkpoint == initialSyncCheckpoint {
+		return ""
+	}
+	return strconv.Itoa(checkpoint.Rev) + "-" + strconv.Itoa(checkpoint.ID)
+}
+
+type syncRecord struct {
+	DocumentID int            `db:"document_id"`
+	Rev        int            `db:"rev"`
+	Deleted    bool           `db:"deleted"`
+	ModifiedAt string         `db:"modified_at"`
+	CreatedAt  sql.NullString `db:"created_at"`
+	Data       sql.NullString `db:"data"`
+	Version    sql.NullInt64  `db:"schema_version"`
+}
+
+// syncDocument returns the document with its revision, or a tombstone.
+// Documents that expired but were not purged yet count as deleted.
+func (record syncRecord) syncDocument(collectionName string) (map[string]any, error) {
+	if record.Deleted || !record.Data.Valid {
+		return map[string]any{"_id": record.DocumentID, "_rev": record.Rev, "_deleted": true, "_modified_at": record.ModifiedAt}, nil
+	}
+	document, err := documentFromRecord(collectionName, DataTable{ID: record.DocumentID, CreatedAt: record.CreatedAt.String, Data: record.Data.String, SchemaVersion: int(record.Version.Int64)})
+	if err != nil {
+		return nil, err
+	}
+	document["_rev"] = record.Rev
+	document["_modified_at"] = record.ModifiedAt
+	return document, nil
+}
+
+func syncRecordQuery(collectionName string) string {
+	return `SELECT r.document_id, r.rev, r.deleted, r.modified_at, c.created_at, json(c.data) AS data, c.schema_version FROM _sync_revisions r
+	LEFT JOIN ` + collectionName + ` c ON c.id = r.document_id AND ` + liveCondition(collectionName) + `
+	WHERE r.collection = $1`
+}
+
+// SyncPull is a page of the documents changed after a checkpoint.
+type SyncPull struct {
+	Documents  []map[string]any `json:"documents"`
+	Checkpoint string           `json:"checkpoint"`
+	HasMore    bool             `json:"has_more"`
+}
+
+func pullChanges(db *sqlx.DB, collectionName string, since syncCheckpoint, limit int) (SyncPull, error) {
+	records := []syncRecord{}
+	query := syncRecordQuery(collectionName) + ` AND (r.rev, r.document_id) > ($2, $3) ORDER BY r.rev, r.document_id LIMIT $4`
+	err := db.Select(&records, query, collectionName, since.Rev, since.ID, limit+1)
+	if err != nil {
+		return SyncPull{}, err
+	}
+	pull := SyncPull{Documents: []map[string]any{}, Checkpoint: since.String()}
+	if len(records) > limit {
+		pull.HasMore = true
+		records = records[:limit]
+	}
+	for _, record := range records {
+		document, err := record.syncDocument(collectionName)
+		if err != nil {
+			return SyncPull{}, err
+		}
+		pull.Documents = append(pull.Documents, document)
+		pull.Checkpoint = syncCheckpoint{Rev: record.Rev, ID: record.DocumentID}.String()
+	}
+	return pull, nil
+}
+
+// SyncChange is a change made by an offline client. Rev is the revision the
+// client based the change on; changes without an ID create documents.
+type SyncChange struct {
+	ID         int            `json:"id"`
+	Rev        int            `json:"rev"`
+	Deleted    bool           `json:"deleted"`
+	Document   map[string]any `json:"document"`
+	ModifiedAt string         `json:"modified_at"`
+}
+
+// SyncResult reports the outcome of a pushed change. Rejected and conflicting
+// changes carry the server's version of the document.
+type SyncResult struct {
+	ID       int            `json:"id"`
+	Status   string         `json:"status"`
+	Rev      int            `json:"rev,omitempty"`
+	Document map[string]any `json:"document,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// pushChange applies one client change in its own transaction, so that a
+// failing change does not hold back the rest of a batch.
+func pushChange(db *sqlx.DB, collection *Collection, context writeContext, change SyncChange) (SyncResult, error) {
+	tx, err := beginWrite(db)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	defer tx.Rollback()
+
+	// Clients push back what they pulled, including the fields the server
+	// adds, which are not part of the document.
+	if change.Document != nil {
+		stripReservedFields(change.Document)
+	}
+	result := SyncResult{ID: change.ID}
+	if change.ID == 0 {
+		if change.Deleted || change.Document == nil {
+			return SyncResult{Status: SyncError, Error: "New documents need a document"}, nil
+		}
+		err = prepareInsert(tx, collection.Name, context, change.Document)
+		if err != nil {
+			return syncErrorResult(result, err)
+		}
+		result.ID, err = insertDocumentTx(tx, collection.Name, 0, change.Document)
+		if err != nil {
+			return SyncResult{}, err
+		}
+		return finishPush(tx, collection.Name, change, result)
+	}
+
+	current := syncRecord{}
+	err = tx.Get(&current, syncRecordQuery(collection.Name)+` AND r.document_id = $2`, collection.Name, change.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		result.Status = SyncError
+		result.Error = "Document not found"
+		return result, nil
+	}
+	if err != nil {
+		return SyncResult{}, err
+	}
+	serverDeleted := current.Deleted || !current.Data.Valid
+
+	if current.Rev != change.Rev && !winsConflict(collection.Sync.conflictPolicy(), current, change) {
+		result.Status = SyncRejected
+		if collection.Sync.conflictPolicy() == SyncManual {
+			result.Status = SyncConflict
+		}
+		result.Rev = current.Rev
+		result.Document, err = current.syncDocument(collection.Name)
+		return result, err
+	}
+
+	switch {
+	case change.Deleted && serverDeleted:
+		// Nothing left to delete
+		result.Status = SyncApplied
+		result.Rev = current.Rev
+		return result, nil
+	case change.Deleted:
+		err = deleteDocumentTx(tx, collection.Name, change.ID)
+		if errors.Is(err, errReferenceRestricted) {
+			result.Status = SyncError
+			result.Error = err.Error()
+			return result, nil
+		}
+	case change.Document == nil:
+		result.Status = SyncError
+		result.Error = "Updates need a document"
+		return result, nil
+	case serverDeleted:
+		// The client edited a document that was deleted on the server and
+		// won the conflict, so the document comes back under its old id.
+		err = prepareInsert(tx, collection.Name, context, change.Document)
+		if err != nil {
+			return syncErrorResult(result, err)
+		}
+		err = restoreDocument(tx, collection.Name, change.ID, change.Document)
+	default:
+		// The stored document is what x-immutable and x-write-once compare
+		// against, so a document that cannot be read fails the push.
+		var document map[string]any
+		document, err = current.syncDocument(collection.Name)
+		if err != nil {
+			return SyncResult{}, err
+		}
+		stripReservedFields(document)
+		err = replaceValidator(collection.Name, context)(tx, change.ID, document, change.Document)
+		if err != nil {
+			return syncErrorResult(result, err)
+		}
+		err = updateDocument(tx, collection.Name, change.ID, change.Document)
+		if err == nil {
+			err = recordWrite(tx, EventUpdate, collection.Name, change.ID, change.Document)
+		}
+	}
+	if err != nil {
+		return SyncResult{}, err
+	}
+	return finishPush(tx, collection.Name, change, result)
+}
+
+// stripReservedFields removes the fields starting with an underscore, such as
+// _id and _rev, which are kept by the server rather than in the document.
+func stripReservedFields(document map[string]any) {
+	maps.DeleteFunc(document, func(field string, _ any) bool {
+		return strings.HasPrefix(field, "_")
+	})
+}
+
+// winsConflict reports whether a change made against an outdated revision is
+// applied anyway. Under last-write-wins, a timestamp that cannot be parsed on
+// either side leaves the conflict to the server.
+func winsConflict(policy string, current syncRecord, change SyncChange) bool {
+	switch policy {
+	case SyncClientWins:
+		return true
+	case SyncLastWriteWins:
+		clientTime, err := time.Parse(time.RFC3339Nano, change.ModifiedAt)
+		if err != nil {
+			return false
+		}
+		serverTime, err := time.Parse(time.RFC3339Nano, current.ModifiedAt)
+		return err == nil && clientTime.After(serverTime)
+	}
+	return false
+}
+
+func restoreDocument(tx *writeTx, collectionName string, id int, document map[string]any) error {
+	jsonData, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO `+collectionName+` (id, data, schema_version) VALUES ($1, jsonb($2), $3)`, id, jsonData, schemaVersion(collectionName))
+	if err != nil {
+		return err
+	}
+	return recordWrite(tx, EventCreate, collectionName, id, document)
+}
+
+// finishPush keeps the client's modification time for last-write-wins and
+// commits the change.
+func finishPush(tx *writeTx, collectionName string, change SyncChange, result SyncResult) (SyncResult, error) {
+	if modifiedAt, err := time.Parse(time.RFC3339Nano, change.ModifiedAt); err == nil {
+		query := `UPDATE _sync_revisions SET modified_at = $1 WHERE collection = $2 AND document_id = $3`
+		_, err = tx.Exec(query, syncTimestamp(modifiedAt), collectionName, result.ID)
+		if err != nil {
+			return SyncResult{}, err
+		}
+	}
+	err := tx.Get(&result.Rev, `SELECT rev FROM _sync_revisions WHERE collection = $1 AND document_id = $2`, collectionName, result.ID)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	err = commitWrite(tx)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	result.Status = SyncApplied
+	return result, nil
+}
+
+func syncErrorResult(result SyncResult, err error) (SyncResult, error) {
+	message, code := validationErrorMessage(err)
+	if code == http.StatusInternalServerError {
+		return SyncResult{}, err
+	}
+	result.Status = SyncError
+	result.Error = message
+	return result, nil
+}
+
+func pullHandler(w http.ResponseWriter, r *http.Request) {
+	collectionName, _, ok := requestSyncCollection(w, r, ActionList, ActionRead)
+	if !ok {
+		return
+	}
+
+	checkpoint, err := parseSyncCheckpoint(r.URL.Query().Get("checkpoint"))
+	if err != nil {
+		sendError(w, "Invalid checkpoint", http.StatusBadRequest)
+		return
+	}
+	limit := rangeBound(Stoi(r.URL.Query().Get("limit"), 100), 1, 1000)
+
+	pull, err := pullChanges(db, collectionName, checkpoint, limit)
+	if err != nil {
+		log.Printf("Error retrieving changes: %v", err)
+		sendError(w, "Failed to retrieve changes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pull)
+}
+
+func pushHandler(w http.ResponseWriter, r *http.Request) {
+	collectionName, _, ok := requestSyncCollection(w, r, ActionRead)
+	if !ok {
+		return
+	}
+	collection := getCollectionByName(collectionName)
+	authToken := getAuthTokenFromRequest(r)
+
+	var push struct {
+		Changes []SyncChange `json:"changes"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&push)
+	if err != nil {
+		sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if len(push.Changes) > maxSyncBatchSize {
+		sendError(w, fmt.Sprintf("At most %d changes can be pushed at once", maxSyncBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	context := newWriteContext(r)
+	results := []SyncResult{}
+	for _, change := range push.Changes {
+		action := ActionReplace
+		if change.ID == 0 {
+			action = ActionCreate
+		} else if change.Deleted {
+			action = ActionDelete
+		}
+		if !isAuthTokenValid(authToken, collectionName, action) {
+			results = append(results, SyncResult{ID: change.ID, Status: SyncError, Error: "Unauthorized access"})
+			continue
+		}
+		result, err := pushChange(db, collection, context, change)
+		if err != nil {
+			log.Printf("Error applying sync change: %v", err)
+			result = SyncResult{ID: change.ID, Status: SyncError, Error: "Failed to apply change"}
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
+
+// requestSyncCollection checks that the collection has sync enabled and that
+// the caller may perform every given action on it.
+func requestSyncCollection(w http.ResponseWriter, r *http.Request, actions ...string) (string, int, bool) {
+	collectionName, parentID, ok := requestCollection(w, r, actions[0])
+	if !ok {
+		return "", 0, false
+	}
+	if getCollectionByName(collectionName).Sync == nil {
+		sendError(w, "Sync is not enabled for this collection", http.StatusNotFound)
+		return "", 0, false
+	}
+	for _, action := range actions[1:] {
+		if !isAuthTokenValid(getAuthTokenFromRequest(r), collectionName, action) {
+			sendError(w, "Unauthorized access", http.StatusUnauthorized)
+			return "", 0, false
+		}
+	}
+	return collectionName, parentID, true
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	TokenHashSHA256   = "sha256"
+	TokenHashArgon2id = "argon2id"
+)
+
+// Parameters of generated argon2id hashes, as recommended by RFC 9106 for
+// memory constrained systems.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// verifiedTokenLimit bounds the remembered results of argon2id checks.
+const verifiedTokenLimit = 10000
+
+// argon2Slots bounds the argon2id checks running at the same time. Every
+// unknown token is checked against every argon2id hash, so without a bound
+// a flood of made-up tokens would take all CPU time and memory.
+var argon2Slots = make(chan struct{}, 2)
+
+// tokenHash is a parsed access token hash, either sha256:{hex} or an
+// argon2id hash in PHC format.
+type tokenHash struct {
+	algorithm string
+	digest    []byte
+	salt      []byte
+	time      uint32
+	memory    uint32
+	threads   uint8
+}
+
+func parseTokenHash(hash string) (tokenHash, error) {
+	if digest, ok := strings.CutPrefix(hash, TokenHashSHA256+":"); ok {
+		decoded, err := hex.DecodeString(digest)
+		if err != nil || len(decoded) != sha256.Size {
+			return tokenHash{}, errors.New("invalid sha256 hash")
+		}
+		return tokenHash{algorithm: TokenHashSHA256, digest: decoded}, nil
+	}
+	// $argon2id$v=19$m=65536,t=3,p=4${salt}${digest}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != TokenHashArgon2id || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return tokenHash{}, errors.New("hash must be sha256:{hex} or an argon2id hash")
+	}
+	parsed := tokenHash{algorithm: TokenHashArgon2id}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.time, &parsed.threads)
+	if err != nil || parsed.time == 0 || parsed.threads == 0 {
+		return tokenHash{}, errors.New("invalid argon2id parameters")
+	}
+	parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return tokenHash{}, errors.New("invalid argon2id salt")
+	}
+	parsed.digest, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(parsed.digest) == 0 {
+		return tokenHash{}, errors.New("invalid argon2id hash")
+	}
+	return parsed, nil
+}
+
+// matches compares a token with the hash in constant time.
+func (hash tokenHash) matches(token string) bool {
+	var digest []byte
+	if hash.algorithm == TokenHashArgon2id {
+		digest = argon2.IDKey([]byte(token), hash.salt, hash.time, hash.memory, hash.threads, uint32(len(hash.digest)))
+	} else {
+		sum := sha256.Sum256([]byte(token))
+		digest = sum[:]
+	}
+	return subtle.ConstantTimeCompare(digest, hash.digest) == 1
+}
+
+// hashToken returns the hash of a token for the hash field of an access
+// token.
+func hashToken(token string, algorithm string) (string, error) {
+	switch algorithm {
+	case TokenHashSHA256:
+		sum := sha256.Sum256([]byte(token))
+		return TokenHashSHA256 + ":" + hex.EncodeToString(sum[:]), nil
+	case TokenHashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		rand.Read(salt)
+		digest := argon2.IDKey([]byte(token), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(digest)), nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm %s", algorithm)
+}
+
+// checkAccessToken reports an access token without a usable secret.
+func checkAccessToken(accessToken AccessToken) error {
+	switch {
+	case accessToken.Token != "" && accessToken.Hash != "":
+		return errors.New("use either token or hash")
+	case accessToken.Hash != "":
+		_, err := parseTokenHash(accessToken.Hash)
+		return err
+	case accessToken.Token == "":
+		return errors.New("token or hash is required; list actions under public to allow requests without a token")
+	}
+	return nil
+}
+
+// accessTokenIndex finds the access token a request presents. Plain tokens
+// are compared by their sha256 hash, so every comparison takes the same
+// time. argon2id checks are slow by design, so their results are
+// remembered by the sha256 hash of the presented token.
+type accessTokenIndex struct {
+	names    []string
+	hashes   []tokenHash
+	mutex    sync.Mutex
+	verified map[[sha256.Size]byte]string
+}
+
+func buildTokenIndex(accessTokens []AccessToken) (*accessTokenIndex, error) {
+	index := &accessTokenIndex{verified: make(map[[sha256.Size]byte]string)}
+	for _, accessToken := range accessTokens {
+		err := checkAccessToken(accessToken)
+		if err != nil {
+			return nil, fmt.Errorf("access token %s: %w", accessToken.Name, err)
+		}
+		hash := accessToken.Hash
+		if hash == "" {
+			hash, _ = hashToken(accessToken.Token, TokenHashSHA256)
+		}
+		parsed, _ := parseTokenHash(hash)
+		index.names = append(index.names, accessToken.Name)
+		index.hashes = append(index.hashes, parsed)
+	}
+	return index, nil
+}
+
+// name returns the name of the access token matching token.
+func (index *accessTokenIndex) name(token string) (string, bool) {
+	if index == nil || token == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(token))
+	name, found := "", false
+	slow := false
+	for i, hash := range index.hashes {
+		if hash.algorithm != TokenHashSHA256 {
+			slow = true
+			continue
+		}
+		// Every hash is compared, whether an earlier one matched or not.
+		if subtle.ConstantTimeCompare(sum[:], hash.digest) == 1 {
+			name, found = index.names[i], true
+		}
+	}
+	// Stored tokens and JWTs have paths of their own, so they never wait
+	// for argon2id checks.
+	if found || !slow || strings.HasPrefix(token, storedTokenPrefix) || looksLikeJWT(token) {
+		return name, found
+	}
+
+	if name, checked := index.lookupVerified(sum); checked {
+		return name, name != ""
+	}
+	argon2Slots <- struct{}{}
+	defer func() { <-argon2Slots }()
+	// The token may have been checked while this request waited.
+	if name, checked := index.lookupVerified(sum); checked {
+		return name, name != ""
+	}
+	for i, hash := range index.hashes {
+		if hash.algorithm == TokenHashArgon2id && hash.matches(token) {
+			name = index.names[i]
+		}
+	}
+	index.mutex.Lock()
+	if len(index.verified) >= verifiedTokenLimit {
+		clear(index.verified)
+	}
+	index.verified[sum] = name
+	index.mutex.Unlock()
+	return name, name != ""
+}
+
+func (index *accessTokenIndex) lookupVerified(sum [sha256.Size]byte) (string, bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	name, checked := index.verified[sum]
+	return name, checked
+}
+
+// runToken implements the token command. token generate prints a new random
+// token and the access token entry holding its hash, the other subcommands
+// manage the token store. It returns the exit code.
+func runToken(args []string) int {
+	if len(args) > 0 && slices.Contains([]string{"create", "list", "revoke", "rotate"}, args[0]) {
+		return runTokenStore(args[0], args[1:])
+	}
+	if len(args) == 0 || args[0] != "generate" {
+		fmt.Fprintln(os.Stderr, "usage: quickstore token generate [-name name] [-hash sha256|argon2id]")
+		fmt.Fprintln(os.Stderr, "       quickstore token create -role role [-description text] [-expires 720h] [-scope collection:action,action]")
+		fmt.Fprintln(os.Stderr, "       quickstore token list")
+		fmt.Fprintln(os.Stderr, "       quickstore token revoke id")
+		fmt.Fprintln(os.Stderr, "       quickstore token rotate [-grace 24h] [-expires 720h] id")
+		return 2
+	}
+	flags := flag.NewFlagSet("token generate", flag.ExitOnError)
+	name := flags.String("name", "client", "Name of the access token")
+	algorithm := flags.String("hash", TokenHashSHA256, "Hash algorithm: sha256 or argon2id")
+	flags.Parse(args[1:])
+
+	token := newAccessToken()
+	hash, err := hashToken(token, *algorithm)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	entry, _ := json.Marshal(map[string]string{"name": *name, "hash": hash})
+	fmt.Printf("Token: %s\n", token)
+	fmt.Printf("Hash:  %s\n\n", hash)
+	fmt.Println("Add this entry to access_tokens and hand out the token. It is not shown again:")
+	fmt.Println(string(entry))
+	return 0
+}
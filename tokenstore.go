@@ -0,0 +1,700 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// storedTokenPrefix marks the tokens of the token store, so that other
+// tokens are never looked up in the database.
+const storedTokenPrefix = "qs_"
+
+const (
+	defaultTokenRotationGrace = 24 * time.Hour
+	tokenLastUsedInterval     = time.Minute
+	tokenUsageFlushInterval   = 10 * time.Second
+	sqliteTimeLayout          = "2006-01-02 15:04:05"
+)
+
+// storedTokenUsage collects the ids of stored tokens used since the last
+// flush, so that their last_used_at is written in one batch.
+var storedTokenUsage = struct {
+	sync.Mutex
+	ids map[int]bool
+}{ids: make(map[int]bool)}
+
+var (
+	errInvalidStoredToken  = errors.New("invalid token")
+	errInactiveStoredToken = errors.New("token is revoked or expired")
+)
+
+// StoredToken is an access token of the token store. It acts as its role,
+// a name used in collection auth and admin_tokens, and when it has scopes
+// it is limited to the listed collections and actions. The token itself is
+// only returned when it is created.
+type StoredToken struct {
+	ID          int          `json:"id"`
+	Token       string       `json:"token,omitempty"`
+	Prefix      string       `json:"prefix"`
+	Role        string       `json:"role"`
+	Description string       `json:"description"`
+	Scopes      []TokenScope `json:"scopes"`
+	RotatedFrom *int         `json:"rotated_from"`
+	ExpiresAt   *string      `json:"expires_at"`
+	LastUsedAt  *string      `json:"last_used_at"`
+	RevokedAt   *string      `json:"revoked_at"`
+	CreatedAt   string       `json:"created_at"`
+}
+
+type TokenScope struct {
+	Collection string   `json:"collection"`
+	Actions    []string `json:"actions"`
+}
+
+type storedTokenRecord struct {
+	ID          int     `db:"id"`
+	Prefix      string  `db:"prefix"`
+	Role        string  `db:"role"`
+	Description string  `db:"description"`
+	Scopes      string  `db:"scopes"`
+	RotatedFrom *int    `db:"rotated_from"`
+	ExpiresAt   *string `db:"expires_at"`
+	LastUsedAt  *string `db:"last_used_at"`
+	RevokedAt   *string `db:"revoked_at"`
+	CreatedAt   string  `db:"created_at"`
+}
+
+func createSQLDDLForStoredTokens() string {
+	return `
+	CREATE TABLE IF NOT EXISTS _stored_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hash TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		role TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		scopes TEXT NOT NULL DEFAULT '[]',
+		rotated_from INTEGER,
+		expires_at DATETIME,
+		last_used_at DATETIME,
+		revoked_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+}
+
+// storedTokenRoles returns the names stored tokens can act as: access
+// tokens, JWT roles and token_roles.
+func storedTokenRoles(config Config) []string {
+	roles := slices.Clone(config.TokenRoles)
+	for _, accessToken := range config.AccessTokens {
+		roles = append(roles, accessToken.Name)
+	}
+	return append(roles, config.JWT.roleNames()...)
+}
+
+// checkStoredToken checks a new token against the configuration and
+// normalizes its expiry to the database time format.
+func checkStoredToken(token *StoredToken, config Config) error {
+	if !slices.Contains(storedTokenRoles(config), token.Role) {
+		return fmt.Errorf("%w: unknown role %q", errInvalidStoredToken, token.Role)
+	}
+	for _, scope := range token.Scopes {
+		if !slices.ContainsFunc(config.Collections, func(collection Collection) bool { return collection.Name == scope.Collection }) {
+			return fmt.Errorf("%w: scope of unknown collection %q", errInvalidStoredToken, scope.Collection)
+		}
+		if len(scope.Actions) == 0 {
+			return fmt.Errorf("%w: scope of %s needs actions", errInvalidStoredToken, scope.Collection)
+		}
+		for _, action := range scope.Actions {
+			if !slices.Contains(collectionActions, action) {
+				return fmt.Errorf("%w: scope of %s: unknown action %q", errInvalidStoredToken, scope.Collection, action)
+			}
+		}
+	}
+	var err error
+	token.ExpiresAt, err = normalizeTokenExpiry(token.ExpiresAt)
+	return err
+}
+
+// normalizeTokenExpiry checks that an expiry is in the future and converts
+// it to the database time format.
+func normalizeTokenExpiry(value *string) (*string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	expiresAt, err := parseTimestamp(*value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: expires_at must be an RFC 3339 timestamp", errInvalidStoredToken)
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: expires_at is in the past", errInvalidStoredToken)
+	}
+	formatted := expiresAt.UTC().Format(sqliteTimeLayout)
+	return &formatted, nil
+}
+
+// parseTimestamp reads RFC 3339 timestamps and the timestamps of the
+// database, which are in UTC.
+func parseTimestamp(value string) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Parse(sqliteTimeLayout, value)
+	}
+	return parsed, nil
+}
+
+func storedTokenFromRecord(record storedTokenRecord) StoredToken {
+	token := StoredToken{
+		ID:          record.ID,
+		Prefix:      record.Prefix,
+		Role:        record.Role,
+		Description: record.Description,
+		Scopes:      []TokenScope{},
+		RotatedFrom: record.RotatedFrom,
+		ExpiresAt:   record.ExpiresAt,
+		LastUsedAt:  record.LastUsedAt,
+		RevokedAt:   record.RevokedAt,
+		CreatedAt:   record.CreatedAt,
+	}
+	json.Unmarshal([]byte(record.Scopes), &token.Scopes)
+	return token
+}
+
+const storedTokenColumns = `id, prefix, role, description, scopes, rotated_from, expires_at, last_used_at, revoked_at, created_at`
+
+func getStoredTokens(q sqlx.Queryer) ([]StoredToken, error) {
+	records := []storedTokenRecord{}
+	err := sqlx.Select(q, &records, `SELECT `+storedTokenColumns+` FROM _stored_tokens ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []StoredToken{}
+	for _, record := range records {
+		tokens = append(tokens, storedTokenFromRecord(record))
+	}
+	return tokens, nil
+}
+
+func getStoredToken(q sqlx.Queryer, id int) (StoredToken, error) {
+	record := storedTokenRecord{}
+	err := sqlx.Get(q, &record, `SELECT `+storedTokenColumns+` FROM _stored_tokens WHERE id = $1`, id)
+	if err != nil {
+		return StoredToken{}, err
+	}
+	return storedTokenFromRecord(record), nil
+}
+
+// insertStoredToken generates the token and stores its hash. The returned
+// token is the only copy of it.
+func insertStoredToken(tx sqlx.Ext, token StoredToken) (StoredToken, error) {
+	secret := storedTokenPrefix + newAccessToken()
+	hash, _ := hashToken(secret, TokenHashSHA256)
+	if token.Scopes == nil {
+		token.Scopes = []TokenScope{}
+	}
+	scopes, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return StoredToken{}, err
+	}
+	query := `INSERT INTO _stored_tokens (hash, prefix, role, description, scopes, rotated_from, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	result, err := tx.Exec(query, hash, secret[:len(storedTokenPrefix)+8], token.Role, token.Description, string(scopes), token.RotatedFrom, token.ExpiresAt)
+	if err != nil {
+		return StoredToken{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return StoredToken{}, err
+	}
+	created, err := getStoredToken(tx, int(id))
+	if err != nil {
+		return StoredToken{}, err
+	}
+	created.Token = secret
+	return created, nil
+}
+
+func createStoredToken(db *sqlx.DB, actor string, token StoredToken) (StoredToken, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return StoredToken{}, err
+	}
+	defer tx.Rollback()
+	token.RotatedFrom = nil
+	created, err := insertStoredToken(tx, token)
+	if err != nil {
+		return StoredToken{}, err
+	}
+	err = recordAudit(tx, actor, "stored_token.create", fmt.Sprint(created.ID), map[string]any{"role": created.Role, "scopes": created.Scopes})
+	if err != nil {
+		return StoredToken{}, err
+	}
+	return created, tx.Commit()
+}
+
+// revokeStoredToken rejects a token from now on. It returns false when the
+// token does not exist or is already revoked.
+func revokeStoredToken(db *sqlx.DB, actor string, id int) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`UPDATE _stored_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	revoked, _ := result.RowsAffected()
+	if revoked == 0 {
+		return false, nil
+	}
+	err = recordAudit(tx, actor, "stored_token.revoke", fmt.Sprint(id), nil)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// rotateStoredToken replaces an active token with a new one of the same
+// role, description and scopes. The old token keeps working for the grace
+// period, unless it expires earlier. Without an expiry of its own, the new
+// token gets the lifetime of the old one.
+func rotateStoredToken(db *sqlx.DB, actor string, id int, grace time.Duration, expiresAt *string) (StoredToken, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return StoredToken{}, err
+	}
+	defer tx.Rollback()
+	old, err := getStoredToken(tx, id)
+	if err != nil {
+		return StoredToken{}, err
+	}
+	if old.RevokedAt != nil || old.expired(time.Now()) {
+		return StoredToken{}, errInactiveStoredToken
+	}
+
+	replacement := old
+	replacement.RotatedFrom = &old.ID
+	replacement.ExpiresAt = expiresAt
+	if expiresAt == nil && old.ExpiresAt != nil {
+		created, errCreated := parseTimestamp(old.CreatedAt)
+		expires, errExpires := parseTimestamp(*old.ExpiresAt)
+		if errCreated == nil && errExpires == nil {
+			renewed := time.Now().UTC().Add(expires.Sub(created)).Format(sqliteTimeLayout)
+			replacement.ExpiresAt = &renewed
+		}
+	}
+	rotated, err := insertStoredToken(tx, replacement)
+	if err != nil {
+		return StoredToken{}, err
+	}
+
+	graceEnd := time.Now().UTC().Add(grace).Format(sqliteTimeLayout)
+	query := `UPDATE _stored_tokens SET expires_at = $1 WHERE id = $2 AND (expires_at IS NULL OR expires_at > $1)`
+	_, err = tx.Exec(query, graceEnd, id)
+	if err != nil {
+		return StoredToken{}, err
+	}
+	err = recordAudit(tx, actor, "stored_token.rotate", fmt.Sprint(id), map[string]any{"replacement": rotated.ID, "grace": int(grace.Seconds())})
+	if err != nil {
+		return StoredToken{}, err
+	}
+	return rotated, tx.Commit()
+}
+
+func (token StoredToken) expired(now time.Time) bool {
+	if token.ExpiresAt == nil {
+		return false
+	}
+	expiresAt, err := parseTimestamp(*token.ExpiresAt)
+	return err == nil && !expiresAt.After(now)
+}
+
+// storedTokenGrant is what an active stored token grants. prefix names the
+// token in audit logs and token_name fields.
+type storedTokenGrant struct {
+	prefix string
+	role   string
+	scopes []TokenScope
+}
+
+// allows reports whether the scopes of a token cover an action. Tokens
+// without scopes are only limited by the auth rules of their role.
+func (grant storedTokenGrant) allows(collectionName string, action string) bool {
+	if len(grant.scopes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(grant.scopes, func(scope TokenScope) bool {
+		return scope.Collection == collectionName && (slices.Contains(scope.Actions, ActionAll) || slices.Contains(scope.Actions, action))
+	})
+}
+
+// lookupStoredToken finds an active token of the token store by its hash.
+// The time it was last used is written at most once a minute by
+// runTokenUsageWriter, so that requests do not wait for the write lock.
+func lookupStoredToken(token string) (storedTokenGrant, bool) {
+	if db == nil || !strings.HasPrefix(token, storedTokenPrefix) {
+		return storedTokenGrant{}, false
+	}
+	hash, _ := hashToken(token, TokenHashSHA256)
+	record := storedTokenRecord{}
+	query := `SELECT ` + storedTokenColumns + ` FROM _stored_tokens
+	WHERE hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > datetime('now'))`
+	err := db.Get(&record, query, hash)
+	if err != nil {
+		if !isDocumentNotFound(err) {
+			log.Printf("Error looking up stored token: %v", err)
+		}
+		return storedTokenGrant{}, false
+	}
+	stored := storedTokenFromRecord(record)
+	lastUsed := time.Time{}
+	if stored.LastUsedAt != nil {
+		lastUsed, _ = parseTimestamp(*stored.LastUsedAt)
+	}
+	if time.Since(lastUsed) > tokenLastUsedInterval {
+		storedTokenUsage.Lock()
+		storedTokenUsage.ids[stored.ID] = true
+		storedTokenUsage.Unlock()
+	}
+	return storedTokenGrant{prefix: stored.Prefix, role: stored.Role, scopes: stored.Scopes}, true
+}
+
+// runTokenUsageWriter writes the last use of stored tokens every
+// tokenUsageFlushInterval.
+func runTokenUsageWriter(db *sqlx.DB) {
+	runQueueWorker(nil, tokenUsageFlushInterval, func() {
+		err := flushTokenUsage(db)
+		if err != nil {
+			log.Printf("Error recording token usage: %v", err)
+		}
+	})
+}
+
+// flushTokenUsage sets last_used_at of the tokens used since the last flush.
+func flushTokenUsage(db *sqlx.DB) error {
+	storedTokenUsage.Lock()
+	ids := slices.Sorted(maps.Keys(storedTokenUsage.ids))
+	clear(storedTokenUsage.ids)
+	storedTokenUsage.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In(`UPDATE _stored_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id IN (?)`, ids)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(query, args...)
+	return err
+}
+
+// sendStoredTokenError answers a failed token store operation.
+func sendStoredTokenError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case isDocumentNotFound(err):
+		sendError(w, "Token not found", http.StatusNotFound)
+	case errors.Is(err, errInvalidStoredToken):
+		sendError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errInactiveStoredToken):
+		sendError(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Error in token store: %v", err)
+		sendError(w, message, http.StatusInternalServerError)
+	}
+}
+
+func getStoredTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := getStoredTokens(db)
+	if err != nil {
+		sendStoredTokenError(w, err, "Failed to retrieve tokens")
+		return
+	}
+	if role := r.URL.Query().Get("role"); role != "" {
+		tokens = slices.DeleteFunc(tokens, func(token StoredToken) bool { return token.Role != role })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func getStoredTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := StoiStrict(r.PathValue("id"))
+	if err != nil {
+		sendError(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	token, err := getStoredToken(db, id)
+	if err != nil {
+		sendStoredTokenError(w, err, "Failed to retrieve token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+}
+
+func createStoredTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var token StoredToken
+	err := json.NewDecoder(r.Body).Decode(&token)
+	if err != nil {
+		sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	err = checkStoredToken(&token, active().config)
+	if err != nil {
+		sendStoredTokenError(w, err, "Failed to create token")
+		return
+	}
+	created, err := createStoredToken(db, tokenName(getAuthTokenFromRequest(r)), token)
+	if err != nil {
+		sendStoredTokenError(w, err, "Failed to create token")
+		return
+	}
+
+	// The token is only returned in this response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func revokeStoredTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := StoiStrict(r.PathValue("id"))
+	if err != nil {
+		sendError(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := revokeStoredToken(db, tokenName(getAuthTokenFromRequest(r)), id)
+	if err != nil {
+		sendStoredTokenError(w, err, "Failed to revoke token")
+		return
+	}
+	if !revoked {
+		sendError(w, "No active token with this ID", http.StatusNotFound)
+		return
+	}
+
+	sendSuccess(w, "Token revoked")
+}
+
+func rotateStoredTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := StoiStrict(r.PathValue("id"))
+	if err != nil {
+		sendError(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	options := struct {
+		Grace     *int    `json:"grace"`
+		ExpiresAt *string `json:"expires_at"`
+	}{}
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(&options)
+		if err != nil {
+			sendError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+	}
+	grace := defaultTokenRotationGrace
+	if options.Grace != nil {
+		if *options.Grace < 0 {
+			sendError(w, "grace must not be negative", http.StatusBadRequest)
+			return
+		}
+		grace = time.Duration(*options.Grace) * time.Second
+	}
+	expiresAt, err := normalizeTokenExpiry(options.ExpiresAt)
+	if err != nil {
+		sendStoredTokenError(w, err, "Failed to rotate token")
+		return
+	}
+
+	rotated, err := rotateStoredToken(db, tokenName(getAuthTokenFromRequest(r)), id, grace, expiresAt)
+	if err != nil {
+		sendStoredTokenError(w, err, "Failed to rotate token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rotated)
+}
+
+// scopeFlags collects the -scope collection:action,action flags of the
+// token commands.
+type scopeFlags []TokenScope
+
+func (scopes *scopeFlags) String() string {
+	return ""
+}
+
+func (scopes *scopeFlags) Set(value string) error {
+	collection, actions, found := strings.Cut(value, ":")
+	if !found || collection == "" || actions == "" {
+		return errors.New("scopes are written collection:action,action")
+	}
+	*scopes = append(*scopes, TokenScope{Collection: collection, Actions: strings.Split(actions, ",")})
+	return nil
+}
+
+// openTokenStore opens the database of the token commands.
+func openTokenStore(databaseFile string) (*sqlx.DB, error) {
+	store, err := connectToDatabase(databaseFile)
+	if err != nil {
+		return nil, err
+	}
+	_, err = store.Exec(createSQLDDLForRuntimeConfig() + createSQLDDLForStoredTokens())
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// expiryFlag converts the duration of an -expires flag to an expiry.
+func expiryFlag(expires time.Duration) *string {
+	if expires <= 0 {
+		return nil
+	}
+	expiresAt := time.Now().UTC().Add(expires).Format(sqliteTimeLayout)
+	return &expiresAt
+}
+
+// runTokenStore implements the token commands that manage the token store
+// of a database. Changes are picked up by a running server right away. It
+// returns the exit code.
+func runTokenStore(command string, args []string) int {
+	flags := flag.NewFlagSet("token "+command, flag.ExitOnError)
+	configFile := flags.String("config", defaultConfigFile, "Path to config file")
+	databaseFile := flags.String("db", databaseFileFromEnvironment(), "Path to database file")
+	role := flags.String("role", "", "Access token, JWT role or token role the token acts as")
+	description := flags.String("description", "", "Description of the token")
+	expires := flags.Duration("expires", 0, "Lifetime of the token, such as 720h")
+	grace := flags.Duration("grace", defaultTokenRotationGrace, "Time the old token keeps working after a rotation")
+	var scopes scopeFlags
+	flags.Var(&scopes, "scope", "Limit the token to actions of a collection: collection:action,action (repeatable)")
+	flags.Parse(args)
+
+	store, err := openTokenStore(*databaseFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	switch command {
+	case "create":
+		fileConfig, err := readConfig(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config: %v\n", err)
+			return 1
+		}
+		overrides, err := loadRuntimeOverrides(store)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "database: %v\n", err)
+			return 1
+		}
+		token := StoredToken{Role: *role, Description: *description, Scopes: scopes, ExpiresAt: expiryFlag(*expires)}
+		err = checkStoredToken(&token, mergeRuntimeOverrides(fileConfig, overrides))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		created, err := createStoredToken(store, "cli", token)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printStoredToken(created)
+		return 0
+
+	case "list":
+		tokens, err := getStoredTokens(store)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tPREFIX\tROLE\tSTATUS\tEXPIRES\tLAST USED\tDESCRIPTION")
+		for _, token := range tokens {
+			fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Prefix, token.Role, token.status(time.Now()),
+				valueOrDash(token.ExpiresAt), valueOrDash(token.LastUsedAt), token.Description)
+		}
+		writer.Flush()
+		return 0
+
+	case "revoke", "rotate":
+		id, err := StoiStrict(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "usage: quickstore token %s [flags] id\n", command)
+			return 2
+		}
+		if command == "revoke" {
+			revoked, err := revokeStoredToken(store, "cli", id)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			if !revoked {
+				fmt.Fprintf(os.Stderr, "no active token with ID %d\n", id)
+				return 1
+			}
+			fmt.Printf("Token %d revoked\n", id)
+			return 0
+		}
+		rotated, err := rotateStoredToken(store, "cli", id, *grace, expiryFlag(*expires))
+		if isDocumentNotFound(err) {
+			fmt.Fprintf(os.Stderr, "no token with ID %d\n", id)
+			return 1
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printStoredToken(rotated)
+		fmt.Printf("Token %d keeps working for %s.\n", id, *grace)
+		return 0
+	}
+	return 2
+}
+
+func printStoredToken(token StoredToken) {
+	fmt.Printf("ID:      %d\n", token.ID)
+	fmt.Printf("Role:    %s\n", token.Role)
+	fmt.Printf("Expires: %s\n", valueOrDash(token.ExpiresAt))
+	fmt.Printf("Token:   %s\n\n", token.Token)
+	fmt.Println("Hand out the token. It is not shown again.")
+}
+
+// status tells whether a token is active, expired or revoked.
+func (token StoredToken) status(now time.Time) string {
+	switch {
+	case token.RevokedAt != nil:
+		return "revoked"
+	case token.expired(now):
+		return "expired"
+	}
+	return "active"
+}
+
+func valueOrDash(value *string) string {
+	if value == nil {
+		return "-"
+	}
+	return *value
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultReaperInterval = 60
+const reaperBatchSize = 500
+
+// CollectionTTL makes documents of a collection expire, either a fixed number
+// of seconds after created_at or at the time stored in a document field. The
+// field holds an RFC 3339 timestamp or unix seconds.
+type CollectionTTL struct {
+	Seconds int    `json:"seconds"`
+	Field   string `json:"field"`
+}
+
+func checkCollectionTTLs(collections []Collection) error {
+	for _, collection := range collections {
+		if collection.TTL == nil {
+			continue
+		}
+		if (collection.TTL.Seconds > 0) == (collection.TTL.Field != "") {
+			return fmt.Errorf("collection %s: ttl needs either seconds or field", collection.Name)
+		}
+		if strings.ContainsAny(collection.TTL.Field, `'"`) {
+			return fmt.Errorf("collection %s: invalid ttl field %q", collection.Name, collection.TTL.Field)
+		}
+	}
+	return nil
+}
+
+// expiredCondition returns an SQL condition that is true for expired
+// documents of the collection, or "" when its documents never expire.
+func expiredCondition(collectionName string) string {
+	collection := getCollectionByName(collectionName)
+	if collection == nil || collection.TTL == nil {
+		return ""
+	}
+	if collection.TTL.Seconds > 0 {
+		return fmt.Sprintf(`created_at <= datetime('now', '-%d seconds')`, collection.TTL.Seconds)
+	}
+	path := `'$."` + collection.TTL.Field + `"'`
+	return `CASE WHEN json_type(data, ` + path + `) IN ('integer', 'real') THEN json_extract(data, ` + path + `)` +
+		` ELSE unixepoch(json_extract(data, ` + path + `)) END <= unixepoch('now')`
+}
+
+// liveCondition returns an SQL condition that hides expired documents.
+func liveCondition(collectionName string) string {
+	condition := expiredCondition(collectionName)
+	if condition == "" {
+		return "1"
+	}
+	return "NOT coalesce(" + condition + ", 0)"
+}
+
+// runReaper purges expired documents, old change log entries and old spam
+// records and upgrades documents of eager versioned collections every interval seconds.
+func runReaper(db *sqlx.DB, interval int, changesRetention int) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		_, err := pruneChanges(db, changesRetention)
+		if err != nil {
+			log.Printf("Error pruning change log: %v", err)
+		}
+		collections := active().config.Collections
+		_, err = pruneSpamRecords(db, collections)
+		if err != nil {
+			log.Printf("Error pruning spam records: %v", err)
+		}
+		for _, collection := range collections {
+			if collection.TTL == nil {
+				continue
+			}
+			purged, err := purgeExpiredDocuments(db, collection.Name, reaperBatchSize)
+			if err != nil {
+				log.Printf("Error purging expired documents from %s: %v", collection.Name, err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("Purged %d expired documents from %s", purged, collection.Name)
+			}
+		}
+		for _, collection := range collections {
+			if collection.Versioning.mode() != MigrationEager {
+				continue
+			}
+			upgraded, err := upgradeOutdatedDocuments(db, collection.Name, reaperBatchSize)
+			if err != nil {
+				log.Printf("Error upgrading documents of %s: %v", collection.Name, err)
+				continue
+			}
+			if upgraded > 0 {
+				log.Printf("Upgraded %d documents of %s to schema version %d", upgraded, collection.Name, collection.Versioning.current())
+			}
+		}
+	}
+}
+
+// purgeExpiredDocuments deletes expired documents in batches. Every batch is
+// its own short transaction so the write lock is released between batches.
+// Documents that are still referenced with on_delete restrict are skipped.
+func purgeExpiredDocuments(db *sqlx.DB, collectionName string, batchSize int) (int, error) {
+	condition := expiredCondition(collectionName)
+	if condition == "" {
+		return 0, nil
+	}
+	purged := 0
+	lastID := 0
+	for {
+		ids := []int{}
+		query := `SELECT id FROM ` + collectionName + ` WHERE id > $1 AND ` + condition + ` ORDER BY id LIMIT $2`
+		err := db.Select(&ids, query, lastID, batchSize)
+		if err != nil {
+			return purged, err
+		}
+		if len(ids) == 0 {
+			return purged, nil
+		}
+
+		deleted, err := purgeBatch(db, collectionName, ids)
+		purged += deleted
+		if err != nil {
+			return purged, err
+		}
+		if len(ids) < batchSize {
+			return purged, nil
+		}
+		lastID = ids[len(ids)-1]
+	}
+}
+
+func purgeBatch(db *sqlx.DB, collectionName string, ids []int) (int, error) {
+	tx, err := beginWrite(db)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	deleted := 0
+	for _, id := range ids {
+		_, err = tx.Exec(`SAVEPOINT purge`)
+		if err != nil {
+			return 0, err
+		}
+		recorded, removals := len(tx.events), len(tx.afterCommit)
+		err = deleteDocumentTx(tx, collectionName, id)
+		if errors.Is(err, errReferenceRestricted) {
+			tx.events = tx.events[:recorded]
+			tx.afterCommit = tx.afterCommit[:removals]
+			_, err = tx.Exec(`ROLLBACK TO purge`)
+		} else if err == nil {
+			deleted++
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`RELEASE purge`)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return deleted, commitWrite(tx)
+}
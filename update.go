@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	OperatorInc      = "$inc"
+	OperatorMul      = "$mul"
+	OperatorMin      = "$min"
+	OperatorMax      = "$max"
+	OperatorSet      = "$set"
+	OperatorUnset    = "$unset"
+	OperatorPush     = "$push"
+	OperatorAddToSet = "$addToSet"
+	OperatorPull     = "$pull"
+)
+
+var updateOperators = []string{
+	OperatorSet,
+	OperatorUnset,
+	OperatorInc,
+	OperatorMul,
+	OperatorMin,
+	OperatorMax,
+	OperatorPush,
+	OperatorAddToSet,
+	OperatorPull,
+}
+
+var errInvalidUpdate = errors.New("invalid update")
+
+type updateOperation struct {
+	Operator string
+	Path     []string
+	Value    any
+}
+
+func invalidUpdate(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errInvalidUpdate, fmt.Sprintf(format, args...))
+}
+
+// parseUpdateOperators converts an update document such as
+// {"$inc": {"stats.views": 1}} into a list of operations. Field paths use dot
+// notation; numeric segments address array elements.
+func parseUpdateOperators(update map[string]any) ([]updateOperation, error) {
+	operations := []updateOperation{}
+	for _, operator := range updateOperators {
+		fields, exists := update[operator]
+		if !exists {
+			continue
+		}
+		fieldMap, ok := fields.(map[string]any)
+		if !ok {
+			return nil, invalidUpdate("%s expects an object", operator)
+		}
+		paths := make([]string, 0, len(fieldMap))
+		for path := range fieldMap {
+			paths = append(paths, path)
+		}
+		slices.Sort(paths)
+		for _, path := range paths {
+			segments, err := splitFieldPath(path)
+			if err != nil {
+				return nil, err
+			}
+			operations = append(operations, updateOperation{Operator: operator, Path: segments, Value: fieldMap[path]})
+		}
+	}
+	for key := range update {
+		if !slices.Contains(updateOperators, key) {
+			return nil, invalidUpdate("unknown operator %s", key)
+		}
+	}
+	if len(operations) == 0 {
+		return nil, invalidUpdate("no update operators given")
+	}
+	for i := range operations {
+		for j := i + 1; j < len(operations); j++ {
+			if isPathPrefix(operations[i].Path, operations[j].Path) || isPathPrefix(operations[j].Path, operations[i].Path) {
+				return nil, invalidUpdate("conflicting updates on %s and %s", strings.Join(operations[i].Path, "."), strings.Join(operations[j].Path, "."))
+			}
+		}
+	}
+	return operations, nil
+}
+
+// setOperations turns a partial document into $set operations on its top
+// level keys, which is how PATCH merges documents.
+func setOperations(updates map[string]any) []updateOperation {
+	operations := []updateOperation{}
+	for key, value := range updates {
+		operations = append(operations, updateOperation{Operator: OperatorSet, Path: []string{key}, Value: value})
+	}
+	return operations
+}
+
+func splitFieldPath(path string) ([]string, error) {
+	segments := strings.Split(path, ".")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, invalidUpdate("invalid field path %q", path)
+		}
+	}
+	return segments, nil
+}
+
+func isPathPrefix(prefix []string, path []string) bool {
+	return len(prefix) <= len(path) && slices.Equal(prefix, path[:len(prefix)])
+}
+
+// buildUpdateExpression builds an SQL expression that evaluates to the updated
+// jsonb value of the data column. The current document is needed to resolve
+// array indexes and to type check operands; callers must read it in the same
+// transaction that runs the update.
+func buildUpdateExpression(document map[string]any, operations []updateOperation) (string, []any, error) {
+	expr := "data"
+	args := []any{}
+	for _, operation := range operations {
+		current, exists, jsonPath, parents, err := resolveFieldPath(document, operation.Path)
+		if err != nil {
+			return "", nil, err
+		}
+		field := strings.Join(operation.Path, ".")
+		if operation.Operator != OperatorUnset && operation.Operator != OperatorPull {
+			// jsonb_insert only adds missing keys, so this creates any absent
+			// parent objects without touching existing ones.
+			for _, parent := range parents {
+				expr = "jsonb_insert(" + expr + ", ?, jsonb('{}'))"
+				args = append(args, parent)
+			}
+		}
+
+		switch operation.Operator {
+		case OperatorSet:
+			value, err := json.Marshal(operation.Value)
+			if err != nil {
+				return "", nil, err
+			}
+			expr = "jsonb_set(" + expr + ", ?, jsonb(?))"
+			args = append(args, jsonPath, string(value))
+
+		case OperatorUnset:
+			if exists {
+				expr = "jsonb_remove(" + expr + ", ?)"
+				args = append(args, jsonPath)
+			}
+
+		case OperatorInc, OperatorMul:
+			number, ok := sqlNumber(operation.Value)
+			if !ok {
+				return "", nil, invalidUpdate("%s on %s expects a number", operation.Operator, field)
+			}
+			if exists && !isJSONNumber(current) {
+				return "", nil, invalidUpdate("cannot apply %s to non-numeric field %s", operation.Operator, field)
+			}
+			sqlOperator := "+"
+			if operation.Operator == OperatorMul {
+				sqlOperator = "*"
+			}
+			expr = "jsonb_set(" + expr + ", ?, coalesce(json_extract(data, ?), 0) " + sqlOperator + " ?)"
+			args = append(args, jsonPath, jsonPath, number)
+
+		case OperatorMin, OperatorMax:
+			value, ok := sqlNumber(operation.Value)
+			if !ok {
+				text, isString := operation.Value.(string)
+				if !isString {
+					return "", nil, invalidUpdate("%s on %s expects a number or a string", operation.Operator, field)
+				}
+				value = text
+			}
+			if exists && reflect.TypeOf(normalizeJSON(current)) != reflect.TypeOf(normalizeJSON(operation.Value)) {
+				return "", nil, invalidUpdate("cannot compare %s with a value of a different type", field)
+			}
+			sqlFunction := "min"
+			if operation.Operator == OperatorMax {
+				sqlFunction = "max"
+			}
+			expr = "jsonb_set(" + expr + ", ?, " + sqlFunction + "(coalesce(json_extract(data, ?), ?), ?))"
+			args = append(args, jsonPath, jsonPath, value, value)
+
+		case OperatorPush, OperatorAddToSet:
+			array, err := arrayField(current, exists, operation.Operator, field)
+			if err != nil {
+				return "", nil, err
+			}
+			values, slice, err := pushModifiers(operation)
+			if err != nil {
+				return "", nil, err
+			}
+			if operation.Operator == OperatorAddToSet {
+				values = uniqueMissingValues(array, values)
+			}
+			expr = "jsonb_insert(" + expr + ", ?, jsonb('[]'))"
+			args = append(args, jsonPath)
+			for _, value := range values {
+				encoded, err := json.Marshal(value)
+				if err != nil {
+					return "", nil, err
+				}
+				expr = "jsonb_insert(" + expr + ", ?, jsonb(?))"
+				args = append(args, jsonPath+"[#]", string(encoded))
+			}
+			if slice != nil {
+				length := len(array) + len(values)
+				removals, index := sliceRemovals(length, *slice)
+				if removals > 0 {
+					expr = "jsonb_remove(" + expr + strings.Repeat(", ?", removals) + ")"
+					for range removals {
+						args = append(args, jsonPath+index)
+					}
+				}
+			}
+
+		case OperatorPull:
+			array, err := arrayField(current, exists, operation.Operator, field)
+			if err != nil {
+				return "", nil, err
+			}
+			matches := []any{operation.Value}
+			if condition, ok := operation.Value.(map[string]any); ok {
+				if in, hasIn := condition["$in"]; hasIn {
+					inValues, isArray := in.([]any)
+					if !isArray || len(condition) != 1 {
+						return "", nil, invalidUpdate("$pull on %s expects $in with an array", field)
+					}
+					matches = inValues
+				}
+			}
+			// Remove matching elements from the end so earlier indexes stay valid.
+			for i := len(array) - 1; i >= 0; i-- {
+				if containsJSONValue(matches, array[i]) {
+					expr = "jsonb_remove(" + expr + ", ?)"
+					args = append(args, fmt.Sprintf("%s[%d]", jsonPath, i))
+				}
+			}
+		}
+	}
+	return expr, args, nil
+}
+
+// resolveFieldPath walks the document along path and returns the current
+// value, whether it exists, the SQLite JSON path of the field and the JSON
+// paths of parent objects that have to be created first.
+func resolveFieldPath(document map[string]any, path []string) (any, bool, string, []string, error) {
+	var current any = document
+	exists := true
+	jsonPath := "$"
+	parents := []string{}
+	for i, segment := range path {
+		if strings.Contains(segment, `"`) {
+			return nil, false, "", nil, invalidUpdate("invalid field name %q", segment)
+		}
+		if i > 0 && !exists {
+			parents = append(parents, jsonPath)
+		}
+		switch container := current.(type) {
+		case map[string]any:
+			jsonPath += `."` + segment + `"`
+			current, exists = container[segment]
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 {
+				return nil, false, "", nil, invalidUpdate("invalid array index %q in %s", segment, strings.Join(path, "."))
+			}
+			jsonPath += fmt.Sprintf("[%d]", index)
+			exists = index < len(container)
+			current = nil
+			if exists {
+				current = container[index]
+			}
+		default:
+			if exists {
+				return nil, false, "", nil, invalidUpdate("cannot traverse non-object field in %s", strings.Join(path, "."))
+			}
+			jsonPath += `."` + segment + `"`
+		}
+	}
+	return current, exists, jsonPath, parents, nil
+}
+
+func arrayField(current any, exists bool, operator string, field string) ([]any, error) {
+	if !exists {
+		return []any{}, nil
+	}
+	array, ok := current.([]any)
+	if !ok {
+		return nil, invalidUpdate("cannot apply %s to non-array field %s", operator, field)
+	}
+	return array, nil
+}
+
+// pushModifiers returns the values to append and the optional $slice
+// modifier for $push and $addToSet.
+func pushModifiers(operation updateOperation) ([]any, *int, error) {
+	modifiers, ok := operation.Value.(map[string]any)
+	if !ok {
+		return []any{operation.Value}, nil, nil
+	}
+	each, hasEach := modifiers["$each"]
+	if !hasEach {
+		return []any{operation.Value}, nil, nil
+	}
+	field := strings.Join(operation.Path, ".")
+	values, ok := each.([]any)
+	if !ok {
+		return nil, nil, invalidUpdate("$each on %s expects an array", field)
+	}
+	var slice *int
+	for key, modifier := range modifiers {
+		switch key {
+		case "$each":
+		case "$slice":
+			if operation.Operator != OperatorPush {
+				return nil, nil, invalidUpdate("$slice is only supported with $push")
+			}
+			number, ok := sqlNumber(modifier)
+			n, isInt := number.(int64)
+			if !ok || !isInt {
+				return nil, nil, invalidUpdate("$slice on %s expects an integer", field)
+			}
+			size := int(n)
+			slice = &size
+		default:
+			return nil, nil, invalidUpdate("unknown modifier %s on %s", key, field)
+		}
+	}
+	return values, slice, nil
+}
+
+// sliceRemovals returns how many elements must be removed from an array of
+// the given length to honour $slice, and the index suffix to remove them at.
+func sliceRemovals(length int, slice int) (int, string) {
+	if slice >= 0 {
+		return max(length-slice, 0), "[#-1]"
+	}
+	return max(length+slice, 0), "[0]"
+}
+
+func uniqueMissingValues(array []any, values []any) []any {
+	missing := []any{}
+	for _, value := range values {
+		if !containsJSONValue(array, value) && !containsJSONValue(missing, value) {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
+
+func containsJSONValue(values []any, value any) bool {
+	normalized := normalizeJSON(value)
+	for _, candidate := range values {
+		if reflect.DeepEqual(normalizeJSON(candidate), normalized) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeJSON round-trips a value through encoding/json so that values
+// decoded with and without UseNumber compare equal.
+func normalizeJSON(value any) any {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized any
+	if json.Unmarshal(encoded, &normalized) != nil {
+		return value
+	}
+	return normalized
+}
+
+func isJSONNumber(value any) bool {
+	_, ok := sqlNumber(value)
+	return ok
+}
+
+// sqlNumber converts a decoded JSON number to int64 when it is integral so
+// that SQLite keeps integer fields as integers.
+func sqlNumber(value any) (any, bool) {
+	switch number := value.(type) {
+	case json.Number:
+		if n, err := number.Int64(); err == nil {
+			return n, true
+		}
+		f, err := number.Float64()
+		return f, err == nil
+	case float64:
+		if number == float64(int64(number)) {
+			return int64(number), true
+		}
+		return number, true
+	case int:
+		return int64(number), true
+	case int64:
+		return number, true
+	}
+	return nil, false
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	MigrationLazy  = "lazy"
+	MigrationEager = "eager"
+)
+
+const (
+	MigrationRename     = "rename"
+	MigrationSetDefault = "set_default"
+	MigrationDelete     = "delete"
+	MigrationCoerce     = "coerce"
+)
+
+const maxPlanFailures = 20
+
+var migrationCoerceTypes = []string{"string", "number", "integer", "boolean"}
+
+// CollectionVersioning numbers the revisions of a collection's schema. Every
+// document stores the schema version it was written with. Documents of older
+// versions are upgraded by the migrations, either when they are read (lazy)
+// or in batches by the reaper (eager).
+type CollectionVersioning struct {
+	Version    int               `json:"version"`
+	Mode       string            `json:"mode"`
+	Migrations []SchemaMigration `json:"migrations"`
+}
+
+// SchemaMigration upgrades documents from Version-1 to Version.
+type SchemaMigration struct {
+	Version int             `json:"version"`
+	Steps   []MigrationStep `json:"steps"`
+}
+
+type MigrationStep struct {
+	Op    string `json:"op"`
+	Field string `json:"field"`
+	To    string `json:"to"`
+	Value any    `json:"value"`
+	Type  string `json:"type"`
+}
+
+// current returns the schema version documents are written with.
+func (versioning *CollectionVersioning) current() int {
+	if versioning == nil || versioning.Version < 1 {
+		return 1
+	}
+	return versioning.Version
+}
+
+func (versioning *CollectionVersioning) mode() string {
+	if versioning == nil || versioning.Mode == "" {
+		return MigrationLazy
+	}
+	return versioning.Mode
+}
+
+func checkCollectionVersioning(collections []Collection) error {
+	for _, collection := range collections {
+		versioning := collection.Versioning
+		if versioning == nil {
+			continue
+		}
+		if versioning.Version < 1 {
+			return fmt.Errorf("collection %s: version must be at least 1", collection.Name)
+		}
+		if versioning.Mode != "" && versioning.Mode != MigrationLazy && versioning.Mode != MigrationEager {
+			return fmt.Errorf("collection %s: invalid migration mode %q", collection.Name, versioning.Mode)
+		}
+		queried := [][]string{}
+		if versioning.mode() == MigrationLazy {
+			queried = queriedFields(collection)
+		}
+		seen := make(map[int]bool)
+		for _, migration := range versioning.Migrations {
+			if migration.Version < 2 || migration.Version > versioning.Version {
+				return fmt.Errorf("collection %s: migration version %d is outside 2..%d", collection.Name, migration.Version, versioning.Version)
+			}
+			if seen[migration.Version] {
+				return fmt.Errorf("collection %s: duplicate migration for version %d", collection.Name, migration.Version)
+			}
+			seen[migration.Version] = true
+			for _, step := range migration.Steps {
+				err := step.check()
+				if err != nil {
+					return fmt.Errorf("collection %s: migration %d: %w", collection.Name, migration.Version, err)
+				}
+				if field := step.queriedField(queried); field != "" {
+					return fmt.Errorf("collection %s: migration %d changes %s, which is matched in SQL against stored documents; use eager mode", collection.Name, migration.Version, field)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// queriedFields returns the fields of a collection that SQL queries match
+// against stored documents: x-ref and x-unique fields and the ttl field.
+// Lazy migrations only upgrade documents in memory, so they must not change
+// these fields.
+func queriedFields(collection Collection) [][]string {
+	fields := [][]string{}
+	references := []Reference{}
+	// Invalid references are reported by buildReferenceCache.
+	collectReferences(collection.Name, collection.Schema, []string{}, &references)
+	for _, reference := range references {
+		fields = append(fields, reference.Field)
+	}
+	keywordFields := []keywordField{}
+	collectKeywordFields(collection.Schema, []string{}, &keywordFields)
+	for _, field := range keywordFields {
+		if field.Keyword == "x-unique" {
+			fields = append(fields, field.Field)
+		}
+	}
+	if collection.TTL != nil && collection.TTL.Field != "" {
+		fields = append(fields, []string{collection.TTL.Field})
+	}
+	return fields
+}
+
+// queriedField returns the first of the given fields the step changes, or
+// "" if it changes none of them.
+func (step MigrationStep) queriedField(fields [][]string) string {
+	changed := []string{step.Field}
+	if step.Op == MigrationRename {
+		changed = append(changed, step.To)
+	}
+	for _, path := range changed {
+		segments, _ := splitFieldPath(path)
+		for _, field := range fields {
+			if isPathPrefix(segments, field) || isPathPrefix(field, segments) {
+				return strings.Join(field, ".")
+			}
+		}
+	}
+	return ""
+}
+
+func (step MigrationStep) check() error {
+	_, err := splitFieldPath(step.Field)
+	if err != nil {
+		return err
+	}
+	switch step.Op {
+	case MigrationRename:
+		_, err = splitFieldPath(step.To)
+		return err
+	case MigrationCoerce:
+		if !slices.Contains(migrationCoerceTypes, step.Type) {
+			return fmt.Errorf("cannot coerce %s to %q", step.Field, step.Type)
+		}
+	case MigrationSetDefault, MigrationDelete:
+	default:
+		return fmt.Errorf("unknown migration op %q", step.Op)
+	}
+	return nil
+}
+
+// schemaVersion returns the current schema version of a collection.
+func schemaVersion(collectionName string) int {
+	collection := getCollectionByName(collectionName)
+	if collection == nil {
+		return 1
+	}
+	return collection.Versioning.current()
+}
+
+// upgradeDocument migrates a document that was stored with an older schema
+// version of its collection in memory.
+func upgradeDocument(collectionName string, document map[string]any, version int) {
+	if version < 1 {
+		return
+	}
+	collection := getCollectionByName(collectionName)
+	if collection != nil {
+		collection.Versioning.migrate(document, version)
+	}
+}
+
+// migrate runs the migrations from the given version up to the current one.
+func (versioning *CollectionVersioning) migrate(document map[string]any, from int) {
+	if versioning == nil {
+		return
+	}
+	for version := from + 1; version <= versioning.current(); version++ {
+		for _, migration := range versioning.Migrations {
+			if migration.Version != version {
+				continue
+			}
+			for _, step := range migration.Steps {
+				step.apply(document)
+			}
+		}
+	}
+}
+
+// apply runs one migration step. Steps that do not apply to a document, like
+// renaming a missing field or coercing a value that cannot be converted,
+// leave it unchanged.
+func (step MigrationStep) apply(document map[string]any) {
+	path, err := splitFieldPath(step.Field)
+	if err != nil {
+		return
+	}
+	value, exists := fieldValue(document, path)
+	switch step.Op {
+	case MigrationRename:
+		to, err := splitFieldPath(step.To)
+		if err != nil || !exists {
+			return
+		}
+		deleteFieldValue(document, path)
+		setFieldValue(document, to, value)
+	case MigrationSetDefault:
+		if !exists {
+			// Every document gets its own copy of the value.
+			var copied any
+			content, _ := json.Marshal(step.Value)
+			json.Unmarshal(content, &copied)
+			setFieldValue(document, path, copied)
+		}
+	case MigrationDelete:
+		if exists {
+			deleteFieldValue(document, path)
+		}
+	case MigrationCoerce:
+		if !exists {
+			return
+		}
+		coerced, ok := coerceValue(value, step.Type)
+		if ok {
+			setFieldValue(document, path, coerced)
+		}
+	}
+}
+
+func coerceValue(value any, typeName string) (any, bool) {
+	switch typeName {
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	case "number", "integer":
+		var number float64
+		switch v := value.(type) {
+		case float64:
+			number = v
+		case string:
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, false
+			}
+			number = parsed
+		case bool:
+			if v {
+				number = 1
+			}
+		default:
+			return nil, false
+		}
+		if typeName == "integer" && number != math.Trunc(number) {
+			return nil, false
+		}
+		return number, true
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, true
+		case string:
+			parsed, err := strconv.ParseBool(strings.TrimSpace(v))
+			return parsed, err == nil
+		case float64:
+			return v != 0, true
+		}
+	}
+	return nil, false
+}
+
+// upgradeStoredDocument writes back a document that was migrated on read,
+// so that SQL updates run against the migrated fields.
+func upgradeStoredDocument(tx sqlx.Execer, collectionName string, id int, document map[string]any) error {
+	jsonData, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE ` + collectionName + ` SET data = jsonb($1), schema_version = $2 WHERE id = $3 AND schema_version < $2`
+	_, err = tx.Exec(query, jsonData, schemaVersion(collectionName), id)
+	return err
+}
+
+// upgradeOutdatedDocuments migrates the stored documents of an eager
+// collection in batches. Every batch is its own short transaction. Upgrades
+// are not document writes: they do not show up in the change log and do not
+// trigger notifications or webhooks.
+func upgradeOutdatedDocuments(db *sqlx.DB, collectionName string, batchSize int) (int, error) {
+	upgraded := 0
+	for {
+		count, err := upgradeBatch(db, collectionName, batchSize)
+		upgraded += count
+		if err != nil || count < batchSize {
+			return upgraded, err
+		}
+	}
+}
+
+func upgradeBatch(db *sqlx.DB, collectionName string, batchSize int) (int, error) {
+	collection := getCollectionByName(collectionName)
+	if collection == nil || collection.Versioning.mode() != MigrationEager {
+		return 0, nil
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	records := []DataTable{}
+	query := `SELECT id, created_at, json(data) AS data, schema_version FROM ` + collectionName + ` WHERE schema_version < $1 ORDER BY id LIMIT $2`
+	err = tx.Select(&records, query, collection.Versioning.current(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range records {
+		var document map[string]any
+		err = json.Unmarshal([]byte(record.Data), &document)
+		if err != nil {
+			return 0, err
+		}
+		collection.Versioning.migrate(document, record.SchemaVersion)
+		err = updateDocument(tx, collectionName, record.ID, document)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(records), tx.Commit()
+}
+
+// scanRecords calls fn for every stored row of a collection in id order,
+// including expired rows that were not purged yet, until fn returns false.
+func scanRecords(db *sqlx.DB, collectionName string, fn func(record DataTable) bool) error {
+	lastID := 0
+	for {
+		records := []DataTable{}
+		query := `SELECT id, created_at, json(data) AS data, schema_version FROM ` + collectionName + ` WHERE id > $1 ORDER BY id LIMIT $2`
+		err := db.Select(&records, query, lastID, reaperBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if !fn(record) {
+				return nil
+			}
+		}
+		if len(records) < reaperBatchSize {
+			return nil
+		}
+		lastID = records[len(records)-1].ID
+	}
+}
+
+// DocumentProblem describes a stored document that does not match its
+// collection schema.
+type DocumentProblem struct {
+	ID            int            `json:"_id"`
+	SchemaVersion int            `json:"schema_version"`
+	Errors        []string       `json:"errors"`
+	Document      map[string]any `json:"document,omitempty"`
+}
+
+// SchemaPlan reports how the stored documents of a collection fare against
+// a new definition of it, after its migrations ran.
+type SchemaPlan struct {
+	Collection string            `json:"collection"`
+	Version    int               `json:"version"`
+	Documents  int               `json:"documents"`
+	Outdated   int               `json:"outdated"`
+	Failing    int               `json:"failing"`
+	Failures   []DocumentProblem `json:"failures"`
+}
+
+// planSchemaChange checks every stored document of an existing collection
+// against a new definition of the collection without changing anything.
+func planSchemaChange(db *sqlx.DB, collection Collection) (SchemaPlan, error) {
+	plan := SchemaPlan{Collection: collection.Name, Version: collection.Versioning.current(), Failures: []DocumentProblem{}}
+	schema, err := compileSchema(collection.Schema, collection.schemaDraft())
+	if err != nil {
+		return plan, err
+	}
+	err = scanRecords(db, collection.Name, func(record DataTable) bool {
+		var document map[string]any
+		if json.Unmarshal([]byte(record.Data), &document) != nil {
+			return true
+		}
+		plan.Documents++
+		if record.SchemaVersion < plan.Version {
+			plan.Outdated++
+		}
+		collection.Versioning.migrate(document, record.SchemaVersion)
+		problems := schemaErrors(document, schema)
+		if len(problems) > 0 {
+			plan.Failing++
+			if len(plan.Failures) < maxPlanFailures {
+				plan.Failures = append(plan.Failures, DocumentProblem{ID: record.ID, SchemaVersion: record.SchemaVersion, Errors: problems})
+			}
+		}
+		return true
+	})
+	return plan, err
+}
+
+// nonconformantDocuments lists stored documents that do not match the
+// current schema of their collection, even after migrating them. A negative
+// limit lists all of them.
+func nonconformantDocuments(db *sqlx.DB, collectionName string, skip int, limit int) ([]DocumentProblem, error) {
+	schema := active().schemaCache[collectionName]
+	documents := []DocumentProblem{}
+	err := scanRecords(db, collectionName, func(record DataTable) bool {
+		var document map[string]any
+		if json.Unmarshal([]byte(record.Data), &document) != nil {
+			return true
+		}
+		upgradeDocument(collectionName, document, record.SchemaVersion)
+		problems := schemaErrors(document, schema)
+		if len(problems) == 0 {
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
+		}
+		document["_id"] = record.ID
+		document["_created_at"] = record.CreatedAt
+		documents = append(documents, DocumentProblem{ID: record.ID, SchemaVersion: record.SchemaVersion, Errors: problems, Document: document})
+		return limit < 0 || len(documents) < limit
+	})
+	return documents, err
+}
+
+// logSchemaPlans reports collections whose documents would not match their
+// changed schema. It runs in the background on reload, once the new
+// configuration is active.
+func logSchemaPlans(db *sqlx.DB, previous []Collection, next []Collection) {
+	for _, collection := range next {
+		index := slices.IndexFunc(previous, func(c Collection) bool { return c.Name == collection.Name })
+		if index < 0 || schemasEqual(previous[index], collection) {
+			continue
+		}
+		plan, err := planSchemaChange(db, collection)
+		if err != nil {
+			log.Printf("Error checking documents of %s against the new schema: %v", collection.Name, err)
+			continue
+		}
+		if plan.Failing > 0 {
+			log.Printf("Collection %s: %d of %d documents do not match schema version %d", collection.Name, plan.Failing, plan.Documents, plan.Version)
+		}
+	}
+}
+
+func schemasEqual(a Collection, b Collection) bool {
+	schemaA, _ := json.Marshal(a.Schema)
+	schemaB, _ := json.Marshal(b.Schema)
+	versioningA, _ := json.Marshal(a.Versioning)
+	versioningB, _ := json.Marshal(b.Versioning)
+	return string(schemaA) == string(schemaB) && string(versioningA) == string(versioningB)
+}
+
+func planCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	collection, ok := decodeCollectionDefinition(w, r)
+	if !ok {
+		return
+	}
+	err := checkCollectionVersioning([]Collection{collection})
+	if err != nil {
+		sendError(w, "Invalid collection: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Refs are resolved against the active configuration.
+	proposed := active().config
+	proposed.Collections = slices.DeleteFunc(slices.Clone(proposed.Collections), func(c Collection) bool { return c.Name == collection.Name })
+	proposed.Collections = append(proposed.Collections, collection)
+	proposed, err = resolveCollectionSchemas(proposed)
+	if err != nil {
+		sendError(w, "Invalid collection: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	collection = *getCollectionFrom(proposed.Collections, collection.Name)
+
+	exists := getCollectionByName(collection.Name) != nil
+	plan := SchemaPlan{Collection: collection.Name, Version: collection.Versioning.current(), Failures: []DocumentProblem{}}
+	if exists {
+		plan, err = planSchemaChange(db, collection)
+		if err != nil {
+			log.Printf("Error planning schema change: %v", err)
+			sendError(w, "Failed to check documents", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+func getNonconformantDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	collectionName := r.PathValue("name")
+	if getCollectionByName(collectionName) == nil {
+		sendError(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+	skip := max(Stoi(r.URL.Query().Get("skip"), 0), 0)
+	limit := rangeBound(Stoi(r.URL.Query().Get("limit"), 100), 1, 1000)
+	documents, err := nonconformantDocuments(db, collectionName, skip, limit)
+	if err != nil {
+		log.Printf("Error checking documents: %v", err)
+		sendError(w, "Failed to check documents", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(documents)
+}
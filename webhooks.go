@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const maxWebhookAttempts = 8
+const webhookTimeout = 10 * time.Second
+const webhookPollInterval = 10 * time.Second
+const webhookBatchSize = 50
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+const (
+	WebhookSourceConfig = "config"
+	WebhookSourceAPI    = "api"
+)
+
+var errWebhookExists = errors.New("webhook already exists")
+var errInvalidWebhook = errors.New("invalid webhook")
+
+var webhookWake = make(chan struct{}, 1)
+
+var webhookNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Webhook posts signed write events of a collection to an URL. Webhooks come
+// from the collection configuration or from the admin API and are all kept
+// in the _webhooks table.
+type Webhook struct {
+	Name       string   `json:"name"`
+	Collection string   `json:"collection,omitempty"`
+	Events     []string `json:"events"`
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret,omitempty"`
+	Source     string   `json:"source,omitempty"`
+}
+
+type webhookRecord struct {
+	Name       string `db:"name"`
+	Collection string `db:"collection"`
+	Events     string `db:"events"`
+	URL        string `db:"url"`
+	Secret     string `db:"secret"`
+	Source     string `db:"source"`
+}
+
+// webhookPayload is the JSON body of a webhook request.
+type webhookPayload struct {
+	Event      string         `json:"event"`
+	Collection string         `json:"collection"`
+	ID         int            `json:"id"`
+	Document   map[string]any `json:"document"`
+	Timestamp  string         `json:"timestamp"`
+}
+
+// WebhookDelivery is one event queued for one webhook.
+type WebhookDelivery struct {
+	ID          int              `db:"id" json:"id"`
+	Webhook     string           `db:"webhook" json:"webhook"`
+	Event       string           `db:"event" json:"event"`
+	Status      string           `db:"status" json:"status"`
+	Attempts    int              `db:"attempts" json:"attempts"`
+	LastError   string           `db:"last_error" json:"last_error"`
+	NextAttempt string           `db:"next_attempt_at" json:"next_attempt_at"`
+	CreatedAt   string           `db:"created_at" json:"created_at"`
+	DeliveredAt sql.NullString   `db:"delivered_at" json:"-"`
+	Payload     string           `db:"payload" json:"-"`
+	Log         []WebhookAttempt `db:"-" json:"log,omitempty"`
+}
+
+// WebhookAttempt is a single HTTP request of a delivery.
+type WebhookAttempt struct {
+	StatusCode  int    `db:"status_code" json:"status_code"`
+	Error       string `db:"error" json:"error"`
+	DurationMS  int    `db:"duration_ms" json:"duration_ms"`
+	AttemptedAt string `db:"attempted_at" json:"attempted_at"`
+}
+
+func createSQLDDLForWebhooks() string {
+	return `
+	CREATE TABLE IF NOT EXISTS _webhooks (
+		name TEXT PRIMARY KEY,
+		collection TEXT NOT NULL,
+		events TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		source TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS _webhooks_collection ON _webhooks (collection);
+	CREATE TABLE IF NOT EXISTS _webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		delivered_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS _webhook_deliveries_pending ON _webhook_deliveries (status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS _webhook_deliveries_webhook ON _webhook_deliveries (webhook);
+	CREATE TABLE IF NOT EXISTS _webhook_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		delivery_id INTEGER NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		attempted_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS _webhook_attempts_delivery ON _webhook_attempts (delivery_id);`
+}
+
+func checkWebhook(webhook Webhook) error {
+	if !webhookNamePattern.MatchString(webhook.Name) {
+		return fmt.Errorf("%w: name %q must only contain letters, digits, '.', '_' and '-'", errInvalidWebhook, webhook.Name)
+	}
+	if len(webhook.Events) == 0 {
+		return fmt.Errorf("%w: %s has no events", errInvalidWebhook, webhook.Name)
+	}
+	for _, event := range webhook.Events {
+		if event != EventCreate && event != EventUpdate && event != EventDelete {
+			return fmt.Errorf("%w: %s has unknown event %q", errInvalidWebhook, webhook.Name, event)
+		}
+	}
+	target, err := url.Parse(webhook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("%w: %s needs an http or https url", errInvalidWebhook, webhook.Name)
+	}
+	return nil
+}
+
+// checkConfigWebhooks checks the webhooks of the configuration. Their names
+// must be unique, since they share the _webhooks table.
+func checkConfigWebhooks(collections []Collection) error {
+	names := map[string]bool{}
+	for _, collection := range collections {
+		for _, webhook := range collection.Webhooks {
+			webhook.Collection = collection.Name
+			err := checkWebhook(webhook)
+			if err != nil {
+				return err
+			}
+			if names[webhook.Name] {
+				return fmt.Errorf("%w: %s is defined more than once", errInvalidWebhook, webhook.Name)
+			}
+			names[webhook.Name] = true
+		}
+	}
+	return nil
+}
+
+// syncConfigWebhooks replaces the webhooks from the configuration in the
+// _webhooks table. Webhooks created through the admin API are kept. The
+// webhooks were checked by checkConfigWebhooks when the config was loaded.
+func syncConfigWebhooks(db *sqlx.DB, collections []Collection) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = syncConfigWebhooksTx(tx, collections)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// syncConfigWebhooksTx is syncConfigWebhooks in an open transaction.
+func syncConfigWebhooksTx(tx sqlx.Ext, collections []Collection) error {
+	_, err := tx.Exec(`DELETE FROM _webhooks WHERE source = $1`, WebhookSourceConfig)
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		for _, webhook := range collection.Webhooks {
+			webhook.Collection = collection.Name
+			webhook.Source = WebhookSourceConfig
+			err = saveWebhook(tx, webhook)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func saveWebhook(tx sqlx.Ext, webhook Webhook) error {
+	var count int
+	err := sqlx.Get(tx, &count, `SELECT COUNT(*) FROM _webhooks WHERE name = $1`, webhook.Name)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", errWebhookExists, webhook.Name)
+	}
+	events, err := json.Marshal(webhook.Events)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO _webhooks (name, collection, events, url, secret, source) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = tx.Exec(query, webhook.Name, webhook.Collection, string(events), webhook.URL, webhook.Secret, webhook.Source)
+	return err
+}
+
+// createWebhook stores a webhook created through the admin API together with
+// its audit log entry.
+func createWebhook(db *sqlx.DB, actor string, webhook Webhook) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = saveWebhook(tx, webhook)
+	if err != nil {
+		return err
+	}
+	err = recordAudit(tx, actor, "webhook.create", webhook.Name, map[string]any{"collection": webhook.Collection, "url": webhook.URL})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleteWebhook(db *sqlx.DB, actor string, name string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM _webhooks WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	err = recordAudit(tx, actor, "webhook.delete", name, nil)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func webhookFromRecord(record webhookRecord) Webhook {
+	webhook := Webhook{Name: record.Name, Collection: record.Collection, URL: record.URL, Source: record.Source}
+	json.Unmarshal([]byte(record.Events), &webhook.Events)
+	return webhook
+}
+
+func getWebhooks(db *sqlx.DB) ([]Webhook, error) {
+	records := []webhookRecord{}
+	err := db.Select(&records, `SELECT name, collection, events, url, secret, source FROM _webhooks ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	webhooks := []Webhook{}
+	for _, record := range records {
+		webhooks = append(webhooks, webhookFromRecord(record))
+	}
+	return webhooks, nil
+}
+
+func getWebhook(db *sqlx.DB, name string) (Webhook, error) {
+	record := webhookRecord{}
+	err := db.Get(&record, `SELECT name, collection, events, url, secret, source FROM _webhooks WHERE name = $1`, name)
+	if err != nil {
+		return Webhook{}, err
+	}
+	return webhookFromRecord(record), nil
+}
+
+// enqueueWebhooks adds a delivery to the outbox for every webhook of the
+// collection subscribed to the event. It runs in the write transaction, so
+// a delivery exists exactly when the write is committed.
+func enqueueWebhooks(tx sqlx.Ext, event string, collectionName string, id int, document map[string]any) error {
+	names := []string{}
+	query := `SELECT name FROM _webhooks WHERE collection = $1 AND EXISTS (SELECT 1 FROM json_each(events) WHERE value = $2)`
+	err := sqlx.Select(tx, &names, query, collectionName, event)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	payload, err := json.Marshal(webhookPayload{
+		Event:      event,
+		Collection: collectionName,
+		ID:         id,
+		Document:   document,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		query := `INSERT INTO _webhook_deliveries (webhook, event, payload) VALUES ($1, $2, $3)`
+		_, err = tx.Exec(query, name, event, string(payload))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runWebhookDispatcher delivers webhooks whenever writes queue them and at
+// least every webhookPollInterval for retries.
+func runWebhookDispatcher(db *sqlx.DB) {
+	client := &http.Client{Timeout: webhookTimeout}
+	runQueueWorker(webhookWake, webhookPollInterval, func() {
+		_, err := deliverWebhooks(db, client)
+		if err != nil {
+			log.Printf("Error delivering webhooks: %v", err)
+		}
+	})
+}
+
+func wakeWebhookDispatcher() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// signWebhookPayload returns the X-QuickStore-Signature header value.
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type dueDelivery struct {
+	ID       int            `db:"id"`
+	Webhook  string         `db:"webhook"`
+	Event    string         `db:"event"`
+	Payload  string         `db:"payload"`
+	Attempts int            `db:"attempts"`
+	URL      sql.NullString `db:"url"`
+	Secret   sql.NullString `db:"secret"`
+}
+
+// deliverWebhooks sends the deliveries that are due and returns how many
+// succeeded. Failed deliveries are retried with exponential backoff and
+// moved to the dead state after maxWebhookAttempts.
+func deliverWebhooks(db *sqlx.DB, client *http.Client) (int, error) {
+	deliveries := []dueDelivery{}
+	query := `SELECT d.id, d.webhook, d.event, d.payload, d.attempts, w.url, w.secret
+		FROM _webhook_deliveries d LEFT JOIN _webhooks w ON w.name = d.webhook
+		WHERE d.status = $1 AND d.next_attempt_at <= datetime('now') ORDER BY d.id LIMIT $2`
+	err := db.Select(&deliveries, query, DeliveryPending, webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, delivery := range deliveries {
+		attempts := delivery.Attempts + 1
+		if !delivery.URL.Valid {
+			_, err = db.Exec(`UPDATE _webhook_deliveries SET status = $1, last_error = $2 WHERE id = $3`, DeliveryDead, "webhook was removed", delivery.ID)
+			if err != nil {
+				return delivered, err
+			}
+			continue
+		}
+
+		start := time.Now()
+		statusCode, sendErr := postWebhook(client, delivery)
+		_, err = db.Exec(`INSERT INTO _webhook_attempts (delivery_id, status_code, error, duration_ms) VALUES ($1, $2, $3, $4)`,
+			delivery.ID, statusCode, errorText(sendErr), time.Since(start).Milliseconds())
+		if err != nil {
+			return delivered, err
+		}
+
+		if sendErr == nil {
+			delivered++
+			query := `UPDATE _webhook_deliveries SET status = $1, attempts = $2, last_error = '', delivered_at = CURRENT_TIMESTAMP WHERE id = $3`
+			_, err = db.Exec(query, DeliveryDelivered, attempts, delivery.ID)
+			if err != nil {
+				return delivered, err
+			}
+			continue
+		}
+
+		status := DeliveryPending
+		if attempts >= maxWebhookAttempts {
+			status = DeliveryDead
+		}
+		log.Printf("Error delivering webhook %s (delivery %d, attempt %d): %v", delivery.Webhook, delivery.ID, attempts, sendErr)
+		delay := fmt.Sprintf("+%d seconds", 10<<(attempts-1))
+		query := `UPDATE _webhook_deliveries SET status = $1, attempts = $2, last_error = $3, next_attempt_at = datetime('now', $4) WHERE id = $5`
+		_, err = db.Exec(query, status, attempts, sendErr.Error(), delay, delivery.ID)
+		if err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+func postWebhook(client *http.Client, delivery dueDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.URL.String, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "QuickStore-Webhook")
+	req.Header.Set("X-QuickStore-Event", delivery.Event)
+	req.Header.Set("X-QuickStore-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-QuickStore-Signature", signWebhookPayload(delivery.Secret.String, payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func getWebhookDeliveries(db *sqlx.DB, webhookName string, status string, skip int, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	query := `SELECT id, webhook, event, status, attempts, last_error, next_attempt_at, created_at, delivered_at, payload
+		FROM _webhook_deliveries WHERE webhook = $1 AND ($2 = '' OR status = $2) ORDER BY id DESC LIMIT $3 OFFSET $4`
+	err := db.Select(&deliveries, query, webhookName, status, limit, skip)
+	return deliveries, err
+}
+
+func getWebhookDelivery(db *sqlx.DB, id int) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+	query := `SELECT id, webhook, event, status, attempts, last_error, next_attempt_at, created_at, delivered_at, payload FROM _webhook_deliveries WHERE id = $1`
+	err := db.Get(&delivery, query, id)
+	if err != nil {
+		return delivery, err
+	}
+	delivery.Log = []WebhookAttempt{}
+	query = `SELECT status_code, error, duration_ms, attempted_at FROM _webhook_attempts WHERE delivery_id = $1 ORDER BY id`
+	err = db.Select(&delivery.Log, query, id)
+	return delivery, err
+}
+
+// retryWebhookDelivery queues a dead delivery again.
+func retryWebhookDelivery(db *sqlx.DB, id int) (bool, error) {
+	query := `UPDATE _webhook_deliveries SET status = $1, attempts = 0, next_attempt_at = CURRENT_TIMESTAMP WHERE id = $2 AND status = $3`
+	result, err := db.Exec(query, DeliveryPending, id, DeliveryDead)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if count > 0 {
+		wakeWebhookDispatcher()
+	}
+	return count > 0, err
+}
+
+func newWebhookSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+func getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := getWebhooks(db)
+	if err != nil {
+		log.Printf("Error retrieving webhooks: %v", err)
+		sendError(w, "Failed to retrieve webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, err := getWebhook(db, r.PathValue("name"))
+	if err != nil {
+		if isDocumentNotFound(err) {
+			sendError(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error retrieving webhook: %v", err)
+			sendError(w, "Failed to retrieve webhook", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var webhook Webhook
+	err := json.NewDecoder(r.Body).Decode(&webhook)
+	if err != nil {
+		sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if getCollectionByName(webhook.Collection) == nil {
+		sendError(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+	err = checkWebhook(webhook)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = newWebhookSecret()
+	}
+	webhook.Source = WebhookSourceAPI
+
+	err = createWebhook(db, tokenName(getAuthTokenFromRequest(r)), webhook)
+	if errors.Is(err, errWebhookExists) {
+		sendError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving webhook: %v", err)
+		sendError(w, "Failed to save webhook", http.StatusInternalServerError)
+		return
+	}
+
+	// The secret is only returned once, when the webhook is created.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, err := getWebhook(db, r.PathValue("name"))
+	if isDocumentNotFound(err) {
+		sendError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving webhook: %v", err)
+		sendError(w, "Failed to retrieve webhook", http.StatusInternalServerError)
+		return
+	}
+	if webhook.Source == WebhookSourceConfig {
+		sendError(w, "Webhook is defined in the configuration", http.StatusConflict)
+		return
+	}
+
+	err = deleteWebhook(db, tokenName(getAuthTokenFromRequest(r)), webhook.Name)
+	if err != nil {
+		log.Printf("Error deleting webhook: %v", err)
+		sendError(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	sendSuccess(w, "Webhook deleted")
+}
+
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !slices.Contains([]string{DeliveryPending, DeliveryDelivered, DeliveryDead}, status) {
+		sendError(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	skip := Stoi(r.URL.Query().Get("skip"), 0)
+	limit := rangeBound(Stoi(r.URL.Query().Get("limit"), 100), 1, 1000)
+
+	deliveries, err := getWebhookDeliveries(db, r.PathValue("name"), status, skip, limit)
+	if err != nil {
+		log.Printf("Error retrieving webhook deliveries: %v", err)
+		sendError(w, "Failed to retrieve webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func getWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := StoiStrict(r.PathValue("id"))
+	if err != nil {
+		sendError(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := getWebhookDelivery(db, id)
+	if err != nil {
+		if isDocumentNotFound(err) {
+			sendError(w, "Delivery not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error retrieving webhook delivery: %v", err)
+			sendError(w, "Failed to retrieve webhook delivery", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+func retryWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := StoiStrict(r.PathValue("id"))
+	if err != nil {
+		sendError(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	retried, err := retryWebhookDelivery(db, id)
+	if err != nil {
+		log.Printf("Error retrying webhook delivery: %v", err)
+		sendError(w, "Failed to retry webhook delivery", http.StatusInternalServerError)
+		return
+	}
+	if !retried {
+		sendError(w, "No dead delivery with this ID", http.StatusNotFound)
+		return
+	}
+
+	sendSuccess(w, "Delivery queued")
+}